@@ -0,0 +1,37 @@
+package glob
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "user:1/a", true},
+		{"user:*", "user:100", true},
+		{"user:*", "usr:100", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"**a", "ba", true},
+		{"[abc", "b", true},
+	}
+	for _, c := range cases {
+		ensure.True(t, Match([]byte(c.pattern), []byte(c.str)) == c.match, c.pattern, c.str)
+	}
+}
@@ -0,0 +1,631 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// 读取的数据都要计算crc，不能从bufio直接读
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type Decoder struct {
+	r       byteReader
+	crc     uint64
+	Version int
+	// AUX字段，比如redis-ver、repl-id
+	Aux map[string]string
+	// GoRedis不能表示的key，比如stream和module类型，跳过不调用fn
+	Skipped int
+}
+
+// r实现了io.ByteReader时直接读取，不会多读RDB后面的数据，
+// 否则使用bufio.Reader
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, Aux: make(map[string]string)}
+}
+
+// 读取整个RDB，每个key调用一次fn，fn返回错误时停止
+// Entry在fn返回之后不再使用，可以保存
+func (d *Decoder) Decode(fn func(e *Entry) error) error {
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	db := 0
+	var expireAt int64
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbOpcodeEOF:
+			return d.readChecksum()
+		case rdbOpcodeSelectDB:
+			n, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+		case rdbOpcodeResizeDB:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+		case rdbOpcodeAux:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.Aux[string(key)] = string(value)
+		case rdbOpcodeExpireTimeMs:
+			b, err := d.readFull(8)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(b))
+		case rdbOpcodeExpireTime:
+			b, err := d.readFull(4)
+			if err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+		case rdbOpcodeIdle:
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+		case rdbOpcodeFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case rdbOpcodeFunction2:
+			// 函数库的代码，不需要
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+		case rdbOpcodeModuleAux:
+			// module id、when的opcode和when，之后是module的数据
+			when, err := d.readLengths(3)
+			if err != nil {
+				return err
+			}
+			if when[1] != rdbModuleOpcodeUInt {
+				return ErrCorrupt
+			}
+			if err := d.skipModuleValue(); err != nil {
+				return err
+			}
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			e := &Entry{DB: db, Key: key, ExpireAt: expireAt}
+			expireAt = 0
+			if skipped, err := d.skipValue(op); err != nil {
+				return err
+			} else if skipped {
+				d.Skipped++
+				continue
+			}
+			if err := d.readValue(op, e); err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *Decoder) readHeader() error {
+	b, err := d.readFull(len(rdbMagic) + 4)
+	if err != nil {
+		return err
+	}
+	if string(b[:len(rdbMagic)]) != rdbMagic {
+		return ErrBadMagic
+	}
+	d.Version, err = strconv.Atoi(string(b[len(rdbMagic):]))
+	if err != nil {
+		return ErrBadMagic
+	}
+	if d.Version < 1 || d.Version > rdbVersion {
+		return fmt.Errorf("rdb: unsupported version %d", d.Version)
+	}
+	return nil
+}
+
+// crc为0表示生成文件时关闭了校验
+func (d *Decoder) readChecksum() error {
+	if d.Version < rdbChecksumMinVersion {
+		return nil
+	}
+	crc := d.crc
+	b, err := d.readFull(8)
+	if err != nil {
+		return err
+	}
+	if sum := binary.LittleEndian.Uint64(b); sum != 0 && sum != crc {
+		return ErrBadChecksum
+	}
+	return nil
+}
+
+func (d *Decoder) readValue(t byte, e *Entry) error {
+	var err error
+	switch t {
+	case rdbTypeString:
+		e.Type = TypeString
+		e.Value, err = d.readString()
+	case rdbTypeList, rdbTypeSet:
+		e.Type = TypeList
+		if t == rdbTypeSet {
+			e.Type = TypeSet
+		}
+		e.Values, err = d.readStrings(1)
+	case rdbTypeHash:
+		e.Type = TypeHash
+		e.Values, err = d.readStrings(2)
+	case rdbTypeZSet, rdbTypeZSet2:
+		e.Type = TypeZSet
+		e.Members, err = d.readZSet(t == rdbTypeZSet2)
+	case rdbTypeHashZipmap:
+		e.Type = TypeHash
+		err = d.readPacked(e, parseZipmap)
+	case rdbTypeListZiplist:
+		e.Type = TypeList
+		err = d.readPacked(e, parseZiplist)
+	case rdbTypeSetIntset:
+		e.Type = TypeSet
+		err = d.readPacked(e, parseIntset)
+	case rdbTypeSetListpack:
+		e.Type = TypeSet
+		err = d.readPacked(e, parseListpack)
+	case rdbTypeHashZiplist:
+		e.Type = TypeHash
+		err = d.readPacked(e, parseZiplist)
+	case rdbTypeHashListpack:
+		e.Type = TypeHash
+		err = d.readPacked(e, parseListpack)
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		e.Type = TypeZSet
+		parse := parseZiplist
+		if t == rdbTypeZSetListpack {
+			parse = parseListpack
+		}
+		if err = d.readPacked(e, parse); err == nil {
+			e.Members, err = pairsToMembers(e.Values)
+			e.Values = nil
+		}
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		e.Type = TypeList
+		e.Values, err = d.readQuicklist(t == rdbTypeListQuicklist2)
+	default:
+		return fmt.Errorf("rdb: unsupported value type %d for key %q", t, e.Key)
+	}
+	if err == nil && e.Type == TypeHash && len(e.Values)%2 != 0 {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// 跳过GoRedis不能表示的值，t不是这些类型时返回false
+func (d *Decoder) skipValue(t byte) (bool, error) {
+	switch t {
+	case rdbTypeStream, rdbTypeStream2, rdbTypeStream3:
+		return true, d.skipStream(t)
+	case rdbTypeModule2:
+		if _, err := d.readLength(); err != nil {
+			return true, err
+		}
+		return true, d.skipModuleValue()
+	case rdbTypeModulePreGA:
+		return true, fmt.Errorf("rdb: module value of pre-GA format can't be skipped")
+	}
+	return false, nil
+}
+
+// 和redis的rdbLoadObject读取stream的顺序一致
+func (d *Decoder) skipStream(t byte) error {
+	// listpack节点，每个节点是主ID和listpack两个字符串
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n*2; i++ {
+		if _, err := d.readString(); err != nil {
+			return err
+		}
+	}
+	// 元素个数和last_id，之后的版本还有first_id、max_deleted_entry_id和entries_added
+	fields := 3
+	if t >= rdbTypeStream2 {
+		fields += 5
+	}
+	if _, err := d.readLengths(fields); err != nil {
+		return err
+	}
+	groups, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < groups; i++ {
+		if _, err := d.readString(); err != nil {
+			return err
+		}
+		// last_id，之后的版本还有entries_read
+		fields := 2
+		if t >= rdbTypeStream2 {
+			fields++
+		}
+		if _, err := d.readLengths(fields); err != nil {
+			return err
+		}
+		// 消费组的PEL：ID、毫秒的delivery_time和delivery_count
+		pel, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		for j := uint64(0); j < pel; j++ {
+			if _, err := d.readFull(streamIDLen + 8); err != nil {
+				return err
+			}
+			if _, err := d.readLength(); err != nil {
+				return err
+			}
+		}
+		// 消费者：名称、毫秒的seen_time，7.2之后还有active_time，和只有ID的PEL
+		consumers, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		times := 8
+		if t >= rdbTypeStream3 {
+			times += 8
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			if _, err := d.readFull(times); err != nil {
+				return err
+			}
+			pel, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			for k := uint64(0); k < pel; k++ {
+				if _, err := d.readFull(streamIDLen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// module的数据是一串opcode和值，直到EOF
+func (d *Decoder) skipModuleValue() error {
+	for {
+		op, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSInt, rdbModuleOpcodeUInt:
+			_, err = d.readLength()
+		case rdbModuleOpcodeFloat:
+			_, err = d.readFull(4)
+		case rdbModuleOpcodeDouble:
+			_, err = d.readFull(8)
+		case rdbModuleOpcodeString:
+			_, err = d.readString()
+		default:
+			return ErrCorrupt
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// n个连续的长度
+func (d *Decoder) readLengths(n int) ([]uint64, error) {
+	vals := make([]uint64, n)
+	for i := range vals {
+		var err error
+		if vals[i], err = d.readLength(); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// 元素个数乘以per个字符串
+func (d *Decoder) readStrings(per uint64) ([][]byte, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([][]byte, 0, preallocLen(n*per))
+	for i := uint64(0); i < n*per; i++ {
+		v, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func (d *Decoder) readZSet(binaryScore bool) ([]ScoreMember, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ScoreMember, 0, preallocLen(n))
+	for i := uint64(0); i < n; i++ {
+		member, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScore {
+			b, err := d.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else if score, err = d.readStringScore(); err != nil {
+			return nil, err
+		}
+		members = append(members, ScoreMember{Member: member, Score: score})
+	}
+	return members, nil
+}
+
+// RDB_TYPE_ZSET的分数：一个字节的长度加上字符串
+func (d *Decoder) readStringScore() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case rdbZSetScoreNaN:
+		return math.NaN(), nil
+	case rdbZSetScorePosInf:
+		return math.Inf(1), nil
+	case rdbZSetScoreNegInf:
+		return math.Inf(-1), nil
+	}
+	b, err := d.readFull(int(n))
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, ErrCorrupt
+	}
+	return f, nil
+}
+
+// ziplist、listpack等编码保存在一个字符串里
+func (d *Decoder) readPacked(e *Entry, parse func([]byte) ([][]byte, error)) error {
+	b, err := d.readString()
+	if err != nil {
+		return err
+	}
+	e.Values, err = parse(b)
+	return err
+}
+
+// quicklist的每个节点是一个ziplist，quicklist2的节点是listpack或者单个元素
+func (d *Decoder) readQuicklist(v2 bool) ([][]byte, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([][]byte, 0)
+	for i := uint64(0); i < n; i++ {
+		container := uint64(quicklistNodePacked)
+		if v2 {
+			if container, err = d.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case container == quicklistNodePlain:
+			vals = append(vals, b)
+			continue
+		case container != quicklistNodePacked:
+			return nil, ErrCorrupt
+		}
+		parse := parseZiplist
+		if v2 {
+			parse = parseListpack
+		}
+		node, err := parse(b)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, node...)
+	}
+	return vals, nil
+}
+
+func pairsToMembers(vals [][]byte) ([]ScoreMember, error) {
+	if len(vals)%2 != 0 {
+		return nil, ErrCorrupt
+	}
+	members := make([]ScoreMember, 0, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		score, err := strconv.ParseFloat(string(vals[i+1]), 64)
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+		members = append(members, ScoreMember{Member: vals[i], Score: score})
+	}
+	return members, nil
+}
+
+// 长度编码，isEncoded表示后面是特殊编码的字符串，返回值是编码类型
+func (d *Decoder) readLengthOrEncoding() (n uint64, isEncoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbLen6Bit:
+		return uint64(b & 0x3f), false, nil
+	case rdbLen14Bit:
+		next, err := d.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case rdbLenEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdbLen32Bit:
+		buf, err := d.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case rdbLen64Bit:
+		buf, err := d.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, ErrCorrupt
+}
+
+func (d *Decoder) readLength() (uint64, error) {
+	n, isEncoded, err := d.readLengthOrEncoding()
+	if err == nil && isEncoded {
+		err = ErrCorrupt
+	}
+	return n, err
+}
+
+// 字符串可能是整数或者LZF压缩的
+func (d *Decoder) readString() ([]byte, error) {
+	n, isEncoded, err := d.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !isEncoded {
+		return d.readFull(int(n))
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := d.readFull(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case rdbEncInt16:
+		b, err := d.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case rdbEncInt32:
+		b, err := d.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case rdbEncLZF:
+		clen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.readFull(int(clen))
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(b, int(ulen))
+	}
+	return nil, ErrCorrupt
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	d.crc = crc64Update(d.crc, []byte{b})
+	return b, nil
+}
+
+// 长度来自文件，大的数据随着读取增长，不一次分配
+func (d *Decoder) readFull(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrCorrupt
+	}
+	var b []byte
+	if n <= maxPrealloc*64 {
+		b = make([]byte, n)
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	} else {
+		buf := make([]byte, 0, maxPrealloc*64)
+		for len(buf) < n {
+			chunk := n - len(buf)
+			if chunk > maxPrealloc*64 {
+				chunk = maxPrealloc * 64
+			}
+			start := len(buf)
+			buf = append(buf, make([]byte, chunk)...)
+			if _, err := io.ReadFull(d.r, buf[start:]); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		}
+		b = buf
+	}
+	d.crc = crc64Update(d.crc, b)
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func preallocLen(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
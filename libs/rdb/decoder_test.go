@@ -0,0 +1,207 @@
+package rdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/facebookgo/ensure"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func decodeFile(t *testing.T, name string) (*Decoder, map[string]*Entry) {
+	data, err := ioutil.ReadFile(name)
+	ensure.Nil(t, err)
+	d := NewDecoder(bytes.NewReader(data))
+	entries := make(map[string]*Entry)
+	ensure.Nil(t, d.Decode(func(e *Entry) error {
+		entries[string(e.Key)] = e
+		return nil
+	}))
+	return d, entries
+}
+
+func strs(vals [][]byte) []string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = string(v)
+	}
+	return s
+}
+
+func TestDecodeSample(t *testing.T) {
+	d, entries := decodeFile(t, "testdata/sample.rdb")
+	ensure.DeepEqual(t, d.Version, 11)
+	ensure.DeepEqual(t, d.Aux["redis-ver"], "7.2.4")
+	ensure.DeepEqual(t, d.Aux["redis-bits"], "64")
+	ensure.DeepEqual(t, len(entries), 24)
+
+	strings := map[string]string{
+		"str":       "hello",
+		"int8":      "123",
+		"int16":     "-1234",
+		"int32":     "100000",
+		"lzf":       "aaaaaaaaaa",
+		"expiring":  "soon",
+		"expiring2": "later",
+	}
+	for k, v := range strings {
+		ensure.DeepEqual(t, entries[k].Type, TypeString, k)
+		ensure.DeepEqual(t, string(entries[k].Value), v, k)
+	}
+	ensure.DeepEqual(t, entries["str"].ExpireAt, int64(0))
+	ensure.DeepEqual(t, entries["expiring"].ExpireAt, int64(4102444800000))
+	ensure.DeepEqual(t, entries["expiring2"].ExpireAt, int64(4102444800000))
+
+	values := []struct {
+		key  string
+		typ  Type
+		vals []string
+	}{
+		{"list:lp", TypeList, []string{"a", "5", "1000"}},
+		{"list:zl", TypeList, []string{"hello", "world", "2", "12345"}},
+		{"list:plain", TypeList, []string{"big", "tail"}},
+		{"list:old", TypeList, []string{"x", "y"}},
+		{"list:ziplist", TypeList, []string{"p", "-100"}},
+		{"set:intset", TypeSet, []string{"1", "2", "-1"}},
+		{"set:lp", TypeSet, []string{"m1", "m2"}},
+		{"set:plain", TypeSet, []string{"u", "v"}},
+		{"hash:lp", TypeHash, []string{"f1", "v1", "f2", "-32768"}},
+		{"hash:zl", TypeHash, []string{"name", "goredis", "n", "300"}},
+		{"hash:plain", TypeHash, []string{"k", "v"}},
+		{"hash:zipmap", TypeHash, []string{"foo", "bar", "x", "yz"}},
+	}
+	for _, c := range values {
+		e := entries[c.key]
+		ensure.DeepEqual(t, e.Type, c.typ, c.key)
+		ensure.DeepEqual(t, strs(e.Values), c.vals, c.key)
+	}
+
+	zsets := []struct {
+		key     string
+		members []ScoreMember
+	}{
+		{"zset:lp", []ScoreMember{{[]byte("a"), 1}, {[]byte("b"), 2.5}}},
+		{"zset:zl", []ScoreMember{{[]byte("c"), 3}, {[]byte("d"), -1.5}}},
+		{"zset:2", []ScoreMember{{[]byte("e"), 3.25}, {[]byte("f"), math.Inf(-1)}}},
+		{"zset:old", []ScoreMember{{[]byte("g"), 7}, {[]byte("h"), math.Inf(1)}}},
+	}
+	for _, c := range zsets {
+		ensure.DeepEqual(t, entries[c.key].Type, TypeZSet, c.key)
+		ensure.DeepEqual(t, entries[c.key].Members, c.members, c.key)
+	}
+
+	ensure.DeepEqual(t, entries["db1"].DB, 1)
+	ensure.DeepEqual(t, entries["str"].DB, 0)
+}
+
+// 同样的数据用各个版本的编码写成：v6是ziplist、zipmap和秒级的过期时间，
+// v7开始是quicklist和AUX，v8开始是ZSET_2，v10开始是listpack和quicklist2，v11的set是listpack
+func TestDecodeVersions(t *testing.T) {
+	redisVer := map[int]string{6: "", 7: "3.2.13", 8: "4.0.14", 9: "5.0.14", 10: "7.0.15", 11: "7.2.4"}
+	for v := 6; v <= 11; v++ {
+		name := fmt.Sprintf("testdata/v%d.rdb", v)
+		d, entries := decodeFile(t, name)
+		ensure.DeepEqual(t, d.Version, v)
+		ensure.DeepEqual(t, d.Aux["redis-ver"], redisVer[v])
+		ensure.DeepEqual(t, string(entries["str"].Value), "hello", name)
+		ensure.DeepEqual(t, string(entries["int"].Value), "12345", name)
+		ensure.DeepEqual(t, string(entries["lzf"].Value), "abcabcabcabc", name)
+		ensure.DeepEqual(t, entries["exp"].ExpireAt, int64(4102444800000), name)
+		ensure.DeepEqual(t, strs(entries["list"].Values), []string{"a", "5", "1000"}, name)
+		ensure.DeepEqual(t, strs(entries["set:int"].Values), []string{"1", "2", "3"}, name)
+		ensure.DeepEqual(t, strs(entries["set"].Values), []string{"m1", "m2"}, name)
+		ensure.DeepEqual(t, strs(entries["hash"].Values), []string{"f1", "v1", "f2", "300"}, name)
+		ensure.DeepEqual(t, entries["zset"].Members, []ScoreMember{{[]byte("a"), 1}, {[]byte("b"), 2.5}}, name)
+		ensure.DeepEqual(t, entries["db1"].DB, 1, name)
+	}
+}
+
+// 按redis-server 7.2保存的格式构造：完整的AUX字段，7.2的stream带消费组和PEL，
+// module类型的值和module aux。这些key跳过并计数，前后的key正常读取
+func TestDecodeSkipUnsupported(t *testing.T) {
+	d, entries := decodeFile(t, "testdata/unsupported.rdb")
+	ensure.DeepEqual(t, d.Version, 11)
+	ensure.DeepEqual(t, d.Aux["redis-ver"], "7.2.4")
+	ensure.DeepEqual(t, d.Aux["ctime"], "1700000000")
+	ensure.DeepEqual(t, d.Aux["used-mem"], "1034216")
+	ensure.DeepEqual(t, d.Aux["aof-base"], "0")
+	ensure.DeepEqual(t, d.Skipped, 2)
+	ensure.DeepEqual(t, len(entries), 2)
+	ensure.DeepEqual(t, string(entries["before"].Value), "1")
+	ensure.DeepEqual(t, string(entries["after"].Value), "2")
+	// stream的过期时间不会留给下一个key
+	ensure.DeepEqual(t, entries["after"].ExpireAt, int64(0))
+
+	// 任何位置截断都返回错误
+	data, err := ioutil.ReadFile("testdata/unsupported.rdb")
+	ensure.Nil(t, err)
+	for i := 0; i < len(data); i++ {
+		ensure.NotNil(t, NewDecoder(bytes.NewReader(data[:i])).Decode(func(e *Entry) error { return nil }), i)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.rdb")
+	ensure.Nil(t, err)
+	nop := func(e *Entry) error { return nil }
+
+	err = NewDecoder(bytes.NewReader([]byte("RODIS0011"))).Decode(nop)
+	ensure.DeepEqual(t, err, ErrBadMagic)
+
+	bad := append([]byte{}, data...)
+	bad[len(bad)-1] ^= 0xff
+	ensure.DeepEqual(t, NewDecoder(bytes.NewReader(bad)).Decode(nop), ErrBadChecksum)
+
+	// 校验和为0时不检查
+	bad = append([]byte{}, data...)
+	copy(bad[len(bad)-8:], make([]byte, 8))
+	ensure.Nil(t, NewDecoder(bytes.NewReader(bad)).Decode(nop))
+
+	// 任何位置截断都返回错误
+	for i := 0; i < len(data); i++ {
+		ensure.NotNil(t, NewDecoder(bytes.NewReader(data[:i])).Decode(nop), i)
+	}
+}
+
+func TestDecodeNotOverread(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.rdb")
+	ensure.Nil(t, err)
+	r := bytes.NewReader(append(data, "+PING\r\n"...))
+	ensure.Nil(t, NewDecoder(r).Decode(func(e *Entry) error { return nil }))
+	rest, _ := ioutil.ReadAll(r)
+	ensure.DeepEqual(t, string(rest), "+PING\r\n")
+}
+
+func TestLZF(t *testing.T) {
+	out, err := lzfDecompress([]byte{0x02, 'a', 'b', 'c', 0x20, 0x02}, 6)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(out), "abcabc")
+
+	// 回溯超出已经输出的数据
+	_, err = lzfDecompress([]byte{0x00, 'a', 0x20, 0x05}, 4)
+	ensure.DeepEqual(t, err, ErrCorrupt)
+	_, err = lzfDecompress([]byte{0x02, 'a', 'b', 'c'}, 2)
+	ensure.DeepEqual(t, err, ErrCorrupt)
+}
+
+func TestListpackInts(t *testing.T) {
+	cases := []struct {
+		entry []byte
+		want  string
+	}{
+		{[]byte{0x7f}, "127"},
+		{[]byte{0xdf, 0xff}, "-1"},
+		{[]byte{0xd0, 0x00}, "-4096"},
+		{[]byte{0xf2, 0xff, 0xff, 0x7f}, "8388607"},
+		{[]byte{0xf2, 0x00, 0x00, 0x80}, "-8388608"},
+		{[]byte{0xf3, 0x00, 0x00, 0x00, 0x80}, "-2147483648"},
+		{[]byte{0xf4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, "9223372036854775807"},
+	}
+	for _, c := range cases {
+		p := &packedReader{b: c.entry[1:]}
+		v, err := readListpackEntry(p, c.entry[0])
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, string(v), c.want)
+	}
+}
@@ -0,0 +1,169 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// 生成RDB文件，给官方redis从库全量同步或者导出数据
+// 只使用最基本的编码：字符串不压缩，集合都是逐个元素写入，
+// 版本是9，redis 5.0之后的版本都能载入
+//
+// e := rdb.NewEncoder(w)
+// e.WriteHeader()
+// e.Encode(&rdb.Entry{Key: []byte("name"), Value: []byte("latermoon")})
+// e.Close()
+//
+// 很大的集合可以先写入类型和个数，再逐个写入元素，不需要全部读入内存：
+// e.WriteKey(0, rdb.TypeList, key, 0, n)
+// e.WriteString(value) ...
+
+const rdbEncodeVersion = 9
+
+type Encoder struct {
+	w   *bufio.Writer
+	crc uint64
+	db  int
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), db: -1}
+}
+
+// 文件头和辅助字段
+func (e *Encoder) WriteHeader() error {
+	e.write([]byte(fmt.Sprintf("%s%04d", rdbMagic, rdbEncodeVersion)))
+	e.WriteAux("redis-bits", "64")
+	return e.err
+}
+
+// 辅助字段，比如redis-ver，载入时会被忽略
+func (e *Encoder) WriteAux(key, value string) error {
+	e.writeByte(rdbOpcodeAux)
+	e.WriteString([]byte(key))
+	e.WriteString([]byte(value))
+	return e.err
+}
+
+// 写入一个完整的key
+func (e *Encoder) Encode(entry *Entry) error {
+	switch entry.Type {
+	case TypeString:
+		e.WriteKey(entry.DB, entry.Type, entry.Key, entry.ExpireAt, 0)
+		e.WriteString(entry.Value)
+	case TypeList, TypeSet:
+		e.WriteKey(entry.DB, entry.Type, entry.Key, entry.ExpireAt, len(entry.Values))
+		for _, v := range entry.Values {
+			e.WriteString(v)
+		}
+	case TypeHash:
+		e.WriteKey(entry.DB, entry.Type, entry.Key, entry.ExpireAt, len(entry.Values)/2)
+		for _, v := range entry.Values[:len(entry.Values)/2*2] {
+			e.WriteString(v)
+		}
+	case TypeZSet:
+		e.WriteKey(entry.DB, entry.Type, entry.Key, entry.ExpireAt, len(entry.Members))
+		for _, m := range entry.Members {
+			e.WriteString(m.Member)
+			e.WriteScore(m.Score)
+		}
+	}
+	return e.err
+}
+
+// 写入key和值的类型，n是集合的元素个数，之后需要写入同样个数的元素：
+// list和set每个元素一个WriteString，hash是field和value两个，zset是WriteString和WriteScore
+func (e *Encoder) WriteKey(db int, t Type, key []byte, expireAt int64, n int) error {
+	if db != e.db {
+		e.writeByte(rdbOpcodeSelectDB)
+		e.writeLength(uint64(db))
+		e.db = db
+	}
+	if expireAt > 0 {
+		e.writeByte(rdbOpcodeExpireTimeMs)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(expireAt))
+		e.write(b[:])
+	}
+	switch t {
+	case TypeString:
+		e.writeByte(rdbTypeString)
+	case TypeList:
+		e.writeByte(rdbTypeList)
+	case TypeSet:
+		e.writeByte(rdbTypeSet)
+	case TypeZSet:
+		e.writeByte(rdbTypeZSet2)
+	case TypeHash:
+		e.writeByte(rdbTypeHash)
+	}
+	e.WriteString(key)
+	if t != TypeString {
+		e.writeLength(uint64(n))
+	}
+	return e.err
+}
+
+func (e *Encoder) WriteString(s []byte) error {
+	e.writeLength(uint64(len(s)))
+	e.write(s)
+	return e.err
+}
+
+// zset的分数，RDB_TYPE_ZSET_2使用8字节的double
+func (e *Encoder) WriteScore(f float64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	e.write(b[:])
+	return e.err
+}
+
+// 写入结束标记和校验和
+func (e *Encoder) Close() error {
+	e.writeByte(rdbOpcodeEOF)
+	if e.err != nil {
+		return e.err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], e.crc)
+	if _, err := e.w.Write(b[:]); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *Encoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.writeByte(byte(n))
+	case n < 1<<14:
+		e.write([]byte{byte(n>>8) | rdbLen14Bit<<6, byte(n)})
+	case n <= math.MaxUint32:
+		b := e.buf[:5]
+		b[0] = rdbLen32Bit
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		e.write(b)
+	default:
+		b := e.buf[:9]
+		b[0] = rdbLen64Bit
+		binary.BigEndian.PutUint64(b[1:], n)
+		e.write(b)
+	}
+}
+
+func (e *Encoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *Encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = crc64Update(e.crc, p)
+	_, e.err = e.w.Write(p)
+}
@@ -0,0 +1,65 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/facebookgo/ensure"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	big := strings.Repeat("x", 20000)
+	entries := []*Entry{
+		{Key: []byte("str"), Type: TypeString, Value: []byte("hello")},
+		{Key: []byte("empty"), Type: TypeString, Value: []byte{}},
+		{Key: []byte("big"), Type: TypeString, Value: []byte(big), ExpireAt: 4102444800000},
+		{Key: []byte("list"), Type: TypeList, Values: [][]byte{[]byte("a"), []byte(strings.Repeat("b", 100))}},
+		{Key: []byte("set"), Type: TypeSet, Values: [][]byte{[]byte("1"), []byte("-1")}},
+		{Key: []byte("hash"), Type: TypeHash, Values: [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("")}},
+		{Key: []byte("zset"), Type: TypeZSet, Members: []ScoreMember{{[]byte("a"), 1.5}, {[]byte("b"), math.Inf(-1)}}},
+		{DB: 2, Key: []byte("db2"), Type: TypeString, Value: []byte("other")},
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	ensure.Nil(t, e.WriteHeader())
+	ensure.Nil(t, e.WriteAux("redis-ver", "5.0.0"))
+	for _, entry := range entries {
+		ensure.Nil(t, e.Encode(entry))
+	}
+	ensure.Nil(t, e.Close())
+
+	d := NewDecoder(&buf)
+	var decoded []*Entry
+	ensure.Nil(t, d.Decode(func(e *Entry) error {
+		decoded = append(decoded, e)
+		return nil
+	}))
+	ensure.DeepEqual(t, d.Version, rdbEncodeVersion)
+	ensure.DeepEqual(t, d.Aux["redis-ver"], "5.0.0")
+	ensure.DeepEqual(t, len(decoded), len(entries))
+	for i, entry := range entries {
+		ensure.DeepEqual(t, decoded[i], entry)
+	}
+}
+
+// 先写入个数再逐个写入元素
+func TestEncodeStreaming(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.WriteHeader()
+	n := 20000
+	ensure.Nil(t, e.WriteKey(0, TypeList, []byte("list"), 0, n))
+	for i := 0; i < n; i++ {
+		e.WriteString([]byte(itoa(int64(i))))
+	}
+	ensure.Nil(t, e.Close())
+
+	var entry *Entry
+	ensure.Nil(t, NewDecoder(&buf).Decode(func(e *Entry) error {
+		entry = e
+		return nil
+	}))
+	ensure.DeepEqual(t, len(entry.Values), n)
+	ensure.DeepEqual(t, string(entry.Values[n-1]), "19999")
+}
@@ -0,0 +1,54 @@
+package rdb
+
+// LZF解压，和redis的lzf_d.c一致
+// 控制字节小于32时后面是ctrl+1个原样的字节，
+// 否则高3位是长度（7表示还要再读一个字节），低5位和下一个字节是回溯的距离
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	if outLen < 0 || outLen > len(in)*maxLZFRatio {
+		return nil, ErrCorrupt
+	}
+	out := make([]byte, 0, outLen)
+	i := 0
+	for i < len(in) {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, ErrCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, ErrCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > outLen {
+			return nil, ErrCorrupt
+		}
+		// 回溯的区间可能和正在写入的重叠，逐个字节复制
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
+
+// 压缩比不会超过这个值，防止伪造的长度导致大量分配
+// 一个回溯最多3个字节输出264个字节
+const maxLZFRatio = 88
@@ -0,0 +1,159 @@
+package rdb
+
+import (
+	"errors"
+	"hash/crc64"
+)
+
+// 解析redis的RDB文件，用于从官方redis全量同步
+// https://github.com/sripathikrishnan/redis-rdb-tools/wiki/Redis-RDB-Dump-File-Format
+//
+// d := rdb.NewDecoder(r)
+// err := d.Decode(func(e *rdb.Entry) error {
+//     fmt.Println(e.DB, string(e.Key), e.Type)
+//     return nil
+// })
+
+// key的类型，各种编码都转成这五种
+type Type byte
+
+const (
+	TypeString Type = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeZSet:
+		return "zset"
+	case TypeHash:
+		return "hash"
+	}
+	return "unknown"
+}
+
+// 一个key和它的值
+type Entry struct {
+	DB       int
+	Key      []byte
+	Type     Type
+	ExpireAt int64 // 毫秒时间戳，0表示不过期
+
+	Value   []byte        // string
+	Values  [][]byte      // list和set的元素，hash是field, value交替
+	Members []ScoreMember // zset
+}
+
+type ScoreMember struct {
+	Member []byte
+	Score  float64
+}
+
+// RDB中的值类型，和redis的rdb.h一致
+const (
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5 // 分数是二进制的double
+	rdbTypeModulePreGA    = 6 // 没有opcode，不能跳过
+	rdbTypeModule2        = 7
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeStream         = 15
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeStream2        = 19 // 7.0，增加first_id、max_deleted_entry_id、entries_added和消费组的offset
+	rdbTypeSetListpack    = 20
+	rdbTypeStream3        = 21 // 7.2，消费者增加active_time
+)
+
+// module的值和module aux是一串带opcode的字段，以EOF结束
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSInt   = 1
+	rdbModuleOpcodeUInt   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
+
+// 特殊的操作码
+const (
+	rdbOpcodeFunction2    = 245
+	rdbOpcodeModuleAux    = 247
+	rdbOpcodeIdle         = 248
+	rdbOpcodeFreq         = 249
+	rdbOpcodeAux          = 250
+	rdbOpcodeResizeDB     = 251
+	rdbOpcodeExpireTimeMs = 252
+	rdbOpcodeExpireTime   = 253
+	rdbOpcodeSelectDB     = 254
+	rdbOpcodeEOF          = 255
+)
+
+// 长度编码，最高两位是11时表示特殊编码的字符串
+const (
+	rdbLen6Bit   = 0
+	rdbLen14Bit  = 1
+	rdbLen32Bit  = 0x80
+	rdbLen64Bit  = 0x81
+	rdbLenEncVal = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// RDB_TYPE_ZSET的分数用字符串保存，这三个长度表示特殊值
+const (
+	rdbZSetScoreNaN    = 253
+	rdbZSetScorePosInf = 254
+	rdbZSetScoreNegInf = 255
+)
+
+// quicklist2的节点类型
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// stream的ID在消费组的PEL中是16字节的原始数据
+const streamIDLen = 16
+
+const (
+	rdbMagic              = "REDIS"
+	rdbVersion            = 12 // 能解析的最高版本
+	rdbChecksumMinVersion = 5  // 从这个版本开始文件末尾有crc64
+	// 元素个数来自文件，预分配不超过这个数
+	maxPrealloc = 1024
+)
+
+var (
+	ErrBadMagic    = errors.New("rdb: bad magic string")
+	ErrBadChecksum = errors.New("rdb: checksum mismatch")
+	ErrCorrupt     = errors.New("rdb: corrupt data")
+)
+
+// redis使用的crc64，Jones多项式，没有初值和结果取反
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
@@ -0,0 +1,316 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// redis小对象的紧凑编码：ziplist、listpack、intset、zipmap
+// 都整体保存在一个字符串中，解析成元素列表，整数转成十进制字符串
+
+// 带边界检查的读取，越界时返回ErrCorrupt
+type packedReader struct {
+	b   []byte
+	pos int
+}
+
+func (p *packedReader) next(n int) ([]byte, error) {
+	if n < 0 || p.pos+n > len(p.b) || p.pos+n < p.pos {
+		return nil, ErrCorrupt
+	}
+	b := p.b[p.pos : p.pos+n]
+	p.pos += n
+	return b, nil
+}
+
+func (p *packedReader) byte() (byte, error) {
+	b, err := p.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func itoa(n int64) []byte {
+	return strconv.AppendInt(nil, n, 10)
+}
+
+// <zlbytes><zltail><zllen><entry>...<0xff>
+// entry: <prevlen><encoding><data>
+func parseZiplist(b []byte) ([][]byte, error) {
+	p := &packedReader{b: b}
+	header, err := p.next(10)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(header[8:]))
+	vals := make([][]byte, 0, n)
+	for {
+		prev, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		if prev == 0xff {
+			return vals, nil
+		}
+		if prev == 0xfe {
+			if _, err := p.next(4); err != nil {
+				return nil, err
+			}
+		}
+		v, err := readZiplistEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+}
+
+func readZiplistEntry(p *packedReader) ([]byte, error) {
+	enc, err := p.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch enc >> 6 {
+	case 0:
+		return p.next(int(enc & 0x3f))
+	case 1:
+		next, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		return p.next(int(enc&0x3f)<<8 | int(next))
+	case 2:
+		b, err := p.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return p.next(int(binary.BigEndian.Uint32(b)))
+	}
+	switch enc {
+	case 0xc0:
+		b, err := p.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int16(binary.LittleEndian.Uint16(b)))), nil
+	case 0xd0:
+		b, err := p.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int32(binary.LittleEndian.Uint32(b)))), nil
+	case 0xe0:
+		b, err := p.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(binary.LittleEndian.Uint64(b))), nil
+	case 0xf0:
+		b, err := p.next(3)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)), nil
+	case 0xfe:
+		b, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int8(b))), nil
+	}
+	// 1111xxxx，xxxx减1是0到12的整数
+	if enc >= 0xf1 && enc <= 0xfd {
+		return itoa(int64(enc&0x0f) - 1), nil
+	}
+	return nil, ErrCorrupt
+}
+
+// <total-bytes><num-elements><element>...<0xff>
+// element: <encoding-type><element-data><element-tot-len>
+func parseListpack(b []byte) ([][]byte, error) {
+	p := &packedReader{b: b}
+	header, err := p.next(6)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(header[4:]))
+	vals := make([][]byte, 0, n)
+	for {
+		start := p.pos
+		enc, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		if enc == 0xff {
+			return vals, nil
+		}
+		v, err := readListpackEntry(p, enc)
+		if err != nil {
+			return nil, err
+		}
+		// 跳过反向遍历用的长度
+		if _, err := p.next(backlenSize(p.pos - start)); err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+}
+
+func readListpackEntry(p *packedReader, enc byte) ([]byte, error) {
+	switch {
+	case enc&0x80 == 0:
+		return itoa(int64(enc)), nil
+	case enc&0xc0 == 0x80:
+		return p.next(int(enc & 0x3f))
+	case enc&0xe0 == 0xc0:
+		next, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		v := int64(enc&0x1f)<<8 | int64(next)
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		return itoa(v), nil
+	case enc&0xf0 == 0xe0:
+		next, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		return p.next(int(enc&0x0f)<<8 | int(next))
+	}
+	switch enc {
+	case 0xf0:
+		b, err := p.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return p.next(int(binary.LittleEndian.Uint32(b)))
+	case 0xf1:
+		b, err := p.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int16(binary.LittleEndian.Uint16(b)))), nil
+	case 0xf2:
+		b, err := p.next(3)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)), nil
+	case 0xf3:
+		b, err := p.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(int32(binary.LittleEndian.Uint32(b)))), nil
+	case 0xf4:
+		b, err := p.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return itoa(int64(binary.LittleEndian.Uint64(b))), nil
+	}
+	return nil, ErrCorrupt
+}
+
+// element-tot-len每个字节保存7位
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// <encoding><length><contents>，encoding是每个整数的字节数
+func parseIntset(b []byte) ([][]byte, error) {
+	p := &packedReader{b: b}
+	header, err := p.next(8)
+	if err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	n := int(binary.LittleEndian.Uint32(header[4:]))
+	if size != 2 && size != 4 && size != 8 {
+		return nil, ErrCorrupt
+	}
+	if n < 0 || n*size != len(b)-8 {
+		return nil, ErrCorrupt
+	}
+	vals := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		v, _ := p.next(size)
+		switch size {
+		case 2:
+			vals = append(vals, itoa(int64(int16(binary.LittleEndian.Uint16(v)))))
+		case 4:
+			vals = append(vals, itoa(int64(int32(binary.LittleEndian.Uint32(v)))))
+		default:
+			vals = append(vals, itoa(int64(binary.LittleEndian.Uint64(v))))
+		}
+	}
+	return vals, nil
+}
+
+// <zmlen><len>"key"<len><free>"value"...<0xff>，redis 2.6之前的hash编码
+func parseZipmap(b []byte) ([][]byte, error) {
+	p := &packedReader{b: b}
+	if _, err := p.byte(); err != nil {
+		return nil, err
+	}
+	vals := make([][]byte, 0)
+	for {
+		n, end, err := zipmapLen(p)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return vals, nil
+		}
+		key, err := p.next(n)
+		if err != nil {
+			return nil, err
+		}
+		if n, end, err = zipmapLen(p); err != nil || end {
+			return nil, ErrCorrupt
+		}
+		free, err := p.byte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.next(n)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.next(int(free)); err != nil {
+			return nil, err
+		}
+		vals = append(vals, key, value)
+	}
+}
+
+func zipmapLen(p *packedReader) (n int, end bool, err error) {
+	b, err := p.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b {
+	case 0xff:
+		return 0, true, nil
+	case 0xfe:
+		buf, err := p.next(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return int(binary.LittleEndian.Uint32(buf)), false, nil
+	}
+	return int(b), false, nil
+}
@@ -8,11 +8,14 @@ import (
 	"github.com/tecbot/gorocksdb"
 	"log"
 	"net"
+	"time"
 )
 
 //接收端口
 func init() {
 	flag.StringVar(&address, "bind address", ":6380", "Bind address")
+	flag.DurationVar(&walTTL, "wal-ttl", 24*time.Hour, "How long to keep WAL files for incremental replication")
+	flag.Uint64Var(&walSizeLimit, "wal-size-limit", 0, "Max size of archived WAL files in MB, 0 means no limit")
 }
 
 func main() {
@@ -43,6 +46,9 @@ func newRocksDB(dir string) *rocks.DB {
 	//基本选项
 	opts := gorocksdb.NewDefaultOptions()
 	opts.SetCreateIfMissing(true)
+	//保留WAL，从库断开之后可以增量同步
+	opts.SetWALTtlSeconds(uint64(walTTL.Seconds()))
+	opts.SetWalSizeLimitMb(walSizeLimit)
 	//打开一个db
 	rdb, err := gorocksdb.OpenDb(opts, dir)
 	if err != nil {
@@ -53,5 +59,7 @@ func newRocksDB(dir string) *rocks.DB {
 }
 
 var (
-	address string
+	address      string
+	walTTL       time.Duration
+	walSizeLimit uint64
 )
@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// 不以'*'开头时按inline命令处理，方便telnet和健康检查直接发送 "PING\r\n"
+// 参数之间用空格分隔，支持和redis-cli一样的引号和转义
+
+// inline命令一行的最大长度，和redis的PROTO_INLINE_MAX_SIZE一致
+const inlineMaxSize = 64 * 1024
+
+// 协议错误，回复 "-ERR Protocol error: ..." 之后关闭连接
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// 读取一行inline命令，空行返回长度为0的命令
+func (s *Session) readInline() (Command, error) {
+	var line []byte
+	for {
+		frag, err := s.rd.ReadSlice(LF)
+		if len(line)+len(frag) > inlineMaxSize {
+			return nil, ProtocolError("too big inline request")
+		}
+		line = append(line, frag...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	// 兼容只发送\n的客户端
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{CR})
+	args, ok := splitArgs(line)
+	if !ok {
+		return nil, ProtocolError("unbalanced quotes in request")
+	}
+	return Command(args), nil
+}
+
+// 按redis的sdssplitargs拆分参数
+// 双引号内支持 \n \r \t \b \a \xHH 等转义，单引号内只支持 \'
+// 引号不配对或者右引号后面不是空格时返回false
+func splitArgs(line []byte) ([][]byte, bool) {
+	args := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, true
+		}
+		var arg []byte
+		inq, insq := false, false
+		done := false
+		for !done {
+			if inq {
+				switch {
+				case i >= len(line):
+					return nil, false
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescape(line[i]))
+				case line[i] == '"':
+					// 右引号后面必须是空格或者结束
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if insq {
+				switch {
+				case i >= len(line):
+					return nil, false
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				switch {
+				case i >= len(line) || isSpace(line[i]):
+					done = true
+				case line[i] == '"':
+					inq = true
+				case line[i] == '\'':
+					insq = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"sync/atomic"
+)
+
+// 读取命令时的限制，防止客户端发来的长度耗尽内存
+// 同一个Limits可以被多个Session共享，修改之后对已有的连接立即生效
+type Limits struct {
+	maxBulkLen       int64 // 单个参数的最大长度，proto-max-bulk-len
+	maxMultiBulkLen  int64 // 参数的最大个数
+	queryBufferLimit int64 // 一个命令全部参数的总长度，client-query-buffer-limit
+}
+
+// 和redis的默认值一致
+const (
+	DefaultMaxBulkLen       = 512 * 1024 * 1024
+	DefaultMaxMultiBulkLen  = 1024 * 1024
+	DefaultQueryBufferLimit = 1024 * 1024 * 1024
+)
+
+// 参数不超过这个长度时一次分配，和redis的PROTO_MBULK_BIG_ARG一致
+const bulkPrealloc = 32 * 1024
+
+// 没有调用SetLimits的Session使用
+var DefaultLimits = NewLimits()
+
+func NewLimits() *Limits {
+	return &Limits{
+		maxBulkLen:       DefaultMaxBulkLen,
+		maxMultiBulkLen:  DefaultMaxMultiBulkLen,
+		queryBufferLimit: DefaultQueryBufferLimit,
+	}
+}
+
+func (l *Limits) MaxBulkLen() int64 { return atomic.LoadInt64(&l.maxBulkLen) }
+
+func (l *Limits) SetMaxBulkLen(n int64) { atomic.StoreInt64(&l.maxBulkLen, n) }
+
+func (l *Limits) MaxMultiBulkLen() int64 { return atomic.LoadInt64(&l.maxMultiBulkLen) }
+
+func (l *Limits) SetMaxMultiBulkLen(n int64) { atomic.StoreInt64(&l.maxMultiBulkLen, n) }
+
+func (l *Limits) QueryBufferLimit() int64 { return atomic.LoadInt64(&l.queryBufferLimit) }
+
+func (l *Limits) SetQueryBufferLimit(n int64) { atomic.StoreInt64(&l.queryBufferLimit, n) }
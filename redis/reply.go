@@ -1,8 +1,12 @@
 package redis
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"io"
+	"math"
+	"strconv"
 )
 
 //返回类型，实现了Bytes接口
@@ -26,101 +30,316 @@ type IntegerReply int
 type BulkReply []byte
 type MultiBulkReply []interface{} // interface{} can be int/string/[]byte
 
-//状态回复
-func (r StatusReply) Bytes() []byte {
+// RESP3的回复类型，RESP2的连接会收到对应的RESP2格式
+// https://github.com/antirez/RESP3/blob/master/spec.md
+type MapReply []interface{}  // key1, value1, key2, value2 ...，RESP2是平铺的数组
+type SetReply []interface{}  // RESP2是数组
+type DoubleReply float64     // RESP2是bulk字符串
+type BooleanReply bool       // RESP2是整数1/0
+type NullReply struct{}      // RESP2是nil bulk
+type BigNumberReply string   // RESP2是bulk字符串
+type PushReply []interface{} // 发布订阅的消息，RESP2是数组
+
+// 带格式的字符串，Format是三个字符，比如"txt"、"mkd"，RESP2是bulk字符串
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+// 附加在回复前面的属性，RESP2只输出Reply
+type AttributeReply struct {
+	Attrs MapReply
+	Reply Reply
+}
+
+// 协议版本
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// 回复直接写入的缓冲区，bufio.Writer和bytes.Buffer都满足
+// 写入错误由bufio.Writer保存，Flush时返回
+type replyBuffer interface {
+	io.Writer
+	io.ByteWriter
+	WriteString(s string) (int, error)
+}
+
+// 可以直接写入缓冲区的回复，Session写出时不再经过Bytes()
+type replyEncoder interface {
+	writeTo(w replyBuffer, proto int) int
+}
+
+// 按RESP2写入w，w不是bufio.Writer时使用临时的缓冲区
+func writeReply(w io.Writer, r replyEncoder) (int64, error) {
+	if bw, ok := w.(replyBuffer); ok {
+		return int64(r.writeTo(bw, RESP2)), nil
+	}
+	bw := bufio.NewWriter(w)
+	n := r.writeTo(bw, RESP2)
+	return int64(n), bw.Flush()
+}
+
+func encodeReply(r replyEncoder, proto int) []byte {
 	buf := bytes.Buffer{}
-	buf.WriteString("+")
-	buf.WriteString(string(r))
-	buf.WriteString(CRLF)
+	r.writeTo(&buf, proto)
 	return buf.Bytes()
 }
 
+//写入 <prefix><n>\r\n
+func writeHeader(w replyBuffer, prefix byte, n int) int {
+	w.WriteByte(prefix)
+	s := itoa(n)
+	w.WriteString(s)
+	w.WriteString(CRLF)
+	return len(s) + 3
+}
+
+func writeLine(w replyBuffer, prefix byte, s string) int {
+	w.WriteByte(prefix)
+	w.WriteString(s)
+	w.WriteString(CRLF)
+	return len(s) + 3
+}
+
+func writeBulk(w replyBuffer, b []byte) int {
+	n := writeHeader(w, '$', len(b))
+	w.Write(b)
+	w.WriteString(CRLF)
+	return n + len(b) + 2
+}
+
+func writeBulkString(w replyBuffer, s string) int {
+	n := writeHeader(w, '$', len(s))
+	w.WriteString(s)
+	w.WriteString(CRLF)
+	return n + len(s) + 2
+}
+
+// RESP3只有一种null，RESP2分为nil bulk和nil数组
+func writeNull(w replyBuffer, proto int, resp2 string) int {
+	if proto >= RESP3 {
+		return writeLine(w, '_', "")
+	}
+	return writeLine(w, resp2[0], resp2[1:])
+}
+
+// 写入数组的元素
+func writeElem(w replyBuffer, proto int, elem interface{}) int {
+	switch v := elem.(type) {
+	case string:
+		return writeBulkString(w, v)
+	case []byte:
+		if v == nil {
+			return writeNull(w, proto, "$-1")
+		}
+		return writeBulk(w, v)
+	case int:
+		return writeHeader(w, ':', v)
+	case nil:
+		// nil element
+		return writeNull(w, proto, "$-1")
+	case replyEncoder:
+		// 嵌套的回复，比如SCAN的 [cursor, [keys...]]，自带CRLF
+		return v.writeTo(w, proto)
+	case Reply:
+		b := v.Bytes()
+		w.Write(b)
+		return len(b)
+	default:
+		// as json json压缩
+		b, err := json.Marshal(elem)
+		if err != nil {
+			b = []byte(err.Error())
+		}
+		return writeBulk(w, b)
+	}
+}
+
+// 写入聚合类型，RESP2统一使用'*'
+func writeAggregate(w replyBuffer, proto int, prefix byte, n int, elems []interface{}) int {
+	if proto < RESP3 {
+		prefix = '*'
+	}
+	size := writeHeader(w, prefix, n)
+	for _, elem := range elems {
+		size += writeElem(w, proto, elem)
+	}
+	return size
+}
+
+//状态回复
+func (r StatusReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r StatusReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r StatusReply) writeTo(w replyBuffer, proto int) int {
+	return writeLine(w, '+', string(r))
+}
+
 //error回复
-func (r ErrorReply) Bytes() []byte {
-	buf := bytes.Buffer{}
-	buf.WriteString("-")
-	buf.WriteString(string(r))
-	buf.WriteString(CRLF)
-	return buf.Bytes()
+func (r ErrorReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r ErrorReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r ErrorReply) writeTo(w replyBuffer, proto int) int {
+	return writeLine(w, '-', string(r))
 }
+
 //整数
-func (r IntegerReply) Bytes() []byte {
-	buf := bytes.Buffer{}
-	buf.WriteString(":")
-	buf.WriteString(itoa(int(r)))
-	buf.WriteString(CRLF)
-	return buf.Bytes()
+func (r IntegerReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r IntegerReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r IntegerReply) writeTo(w replyBuffer, proto int) int {
+	return writeHeader(w, ':', int(r))
 }
 
 //多个字符
-func (r BulkReply) Bytes() []byte {
+func (r BulkReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r BulkReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r BulkReply) writeTo(w replyBuffer, proto int) int {
 	if r == nil {
-		return []byte("$-1\r\n") // NULL Bulk Reply
+		return writeNull(w, proto, "$-1") // NULL Bulk Reply
 	}
-	buf := bytes.Buffer{}
-	buf.WriteString("$")
-	buf.WriteString(itoa(len(r)))
-	buf.WriteString(CRLF)
-	buf.Write(r)
-	buf.WriteString(CRLF)
-	return buf.Bytes()
+	return writeBulk(w, r)
 }
 
 //多个命令回复
-func (r MultiBulkReply) Bytes() []byte {
+func (r MultiBulkReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r MultiBulkReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r MultiBulkReply) writeTo(w replyBuffer, proto int) int {
 	//空
 	if r == nil {
-		return []byte("*-1\r\n") // Null Multi Bulk Reply
+		return writeNull(w, proto, "*-1") // Null Multi Bulk Reply
 	}
-	if len(r) == 0 {
-		return []byte("*0\r\n") // Empty Multi Bulk Reply
+	return writeAggregate(w, proto, '*', len(r), r)
+}
+
+//map，RESP3的元素个数是键值对的个数
+func (r MapReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r MapReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r MapReply) writeTo(w replyBuffer, proto int) int {
+	if proto < RESP3 {
+		return writeAggregate(w, proto, '*', len(r), r)
 	}
-	//写入多条命令
-	buf := bytes.Buffer{}
-	buf.WriteString("*")
-	buf.WriteString(itoa(len(r)))
-	buf.WriteString(CRLF)
-	for _, bulk := range r {
-		switch bulk.(type) {
-		case string:
-			buf.WriteString("$")
-			b := []byte(bulk.(string))
-			buf.WriteString(itoa(len(b)))
-			buf.WriteString(CRLF)
-			buf.Write(b)
-		case []byte:
-			b := bulk.([]byte)
-			if b == nil {
-				buf.WriteString("$-1")
-			} else {
-				buf.WriteString("$")
-				buf.WriteString(itoa(len(b)))
-				buf.WriteString(CRLF)
-				buf.Write(b)
-			}
-		case int:
-			buf.WriteString(":")
-			buf.WriteString(itoa(bulk.(int)))
-		case nil:
-			// nil element
-			buf.WriteString("$-1")
-		default:
-			// as json json压缩
-			b, err := json.Marshal(bulk)
-			if err != nil {
-				buf.WriteString("$")
-				b = []byte(err.Error())
-				buf.WriteString(itoa(len(b)))
-				buf.WriteString(CRLF)
-				buf.Write(b)
-			} else {
-				buf.WriteString("$")
-				buf.WriteString(itoa(len(b)))
-				buf.WriteString(CRLF)
-				buf.Write(b)
-			}
+	return writeAggregate(w, proto, '%', len(r)/2, r)
+}
+
+//集合
+func (r SetReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r SetReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r SetReply) writeTo(w replyBuffer, proto int) int {
+	return writeAggregate(w, proto, '~', len(r), r)
+}
+
+//推送消息
+func (r PushReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r PushReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r PushReply) writeTo(w replyBuffer, proto int) int {
+	return writeAggregate(w, proto, '>', len(r), r)
+}
+
+//浮点数
+func (r DoubleReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r DoubleReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r DoubleReply) writeTo(w replyBuffer, proto int) int {
+	f := float64(r)
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if proto < RESP3 {
+		return writeBulkString(w, s)
+	}
+	return writeLine(w, ',', s)
+}
+
+//布尔值
+func (r BooleanReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r BooleanReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r BooleanReply) writeTo(w replyBuffer, proto int) int {
+	if proto < RESP3 {
+		if r {
+			return writeLine(w, ':', "1")
 		}
-		buf.WriteString(CRLF)
+		return writeLine(w, ':', "0")
 	}
-	return buf.Bytes()
+	if r {
+		return writeLine(w, '#', "t")
+	}
+	return writeLine(w, '#', "f")
+}
+
+//null
+func (r NullReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r NullReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r NullReply) writeTo(w replyBuffer, proto int) int {
+	return writeNull(w, proto, "$-1")
+}
+
+//大整数
+func (r BigNumberReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r BigNumberReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r BigNumberReply) writeTo(w replyBuffer, proto int) int {
+	if proto < RESP3 {
+		return writeBulkString(w, string(r))
+	}
+	return writeLine(w, '(', string(r))
+}
+
+//带格式的字符串
+func (r VerbatimReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r VerbatimReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r VerbatimReply) writeTo(w replyBuffer, proto int) int {
+	if proto < RESP3 {
+		return writeBulk(w, r.Text)
+	}
+	n := writeHeader(w, '=', len(r.Format)+1+len(r.Text))
+	w.WriteString(r.Format)
+	w.WriteByte(':')
+	w.Write(r.Text)
+	w.WriteString(CRLF)
+	return n + len(r.Format) + 1 + len(r.Text) + 2
+}
+
+//属性
+func (r AttributeReply) Bytes() []byte { return encodeReply(r, RESP2) }
+
+func (r AttributeReply) WriteTo(w io.Writer) (int64, error) { return writeReply(w, r) }
+
+func (r AttributeReply) writeTo(w replyBuffer, proto int) int {
+	n := 0
+	if proto >= RESP3 {
+		n = writeAggregate(w, proto, '|', len(r.Attrs)/2, r.Attrs)
+	}
+	return n + writeElem(w, proto, r.Reply)
 }
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"github.com/facebookgo/ensure"
+	"math"
+	"testing"
+)
+
+func TestReplyProtocols(t *testing.T) {
+	cases := []struct {
+		reply        replyEncoder
+		resp2, resp3 string
+	}{
+		{BulkReply(nil), "$-1\r\n", "_\r\n"},
+		{MultiBulkReply(nil), "*-1\r\n", "_\r\n"},
+		{NullReply{}, "$-1\r\n", "_\r\n"},
+		{MultiBulkReply{nil, 1}, "*2\r\n$-1\r\n:1\r\n", "*2\r\n_\r\n:1\r\n"},
+		{MapReply{"a", 1, "b", []byte("x")}, "*4\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n$1\r\nx\r\n", "%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n$1\r\nx\r\n"},
+		{SetReply{"a"}, "*1\r\n$1\r\na\r\n", "~1\r\n$1\r\na\r\n"},
+		{PushReply{"message", "ch", "hi"}, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+		{DoubleReply(1.5), "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{DoubleReply(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{BooleanReply(true), ":1\r\n", "#t\r\n"},
+		{BooleanReply(false), ":0\r\n", "#f\r\n"},
+		{BigNumberReply("3492890328409238509324850943850943825024385"), "$43\r\n3492890328409238509324850943850943825024385\r\n", "(3492890328409238509324850943850943825024385\r\n"},
+		{VerbatimReply{"txt", []byte("Some string")}, "$11\r\nSome string\r\n", "=15\r\ntxt:Some string\r\n"},
+		{AttributeReply{MapReply{"ttl", 3600}, IntegerReply(7)}, ":7\r\n", "|1\r\n$3\r\nttl\r\n:3600\r\n:7\r\n"},
+		{MultiBulkReply{MapReply{"k", "v"}}, "*1\r\n*2\r\n$1\r\nk\r\n$1\r\nv\r\n", "*1\r\n%1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+	}
+	for _, tc := range cases {
+		ensure.DeepEqual(t, string(encodeReply(tc.reply, RESP2)), tc.resp2)
+		ensure.DeepEqual(t, string(encodeReply(tc.reply, RESP3)), tc.resp3)
+		ensure.DeepEqual(t, tc.reply.writeTo(&discard{}, RESP3), len(tc.resp3))
+	}
+}
+
+// 只统计长度
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error)       { return len(p), nil }
+func (discard) WriteByte(c byte) error            { return nil }
+func (discard) WriteString(s string) (int, error) { return len(s), nil }
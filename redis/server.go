@@ -54,8 +54,6 @@ func (s *Server) Serve(lis net.Listener) error {
 		//处理每个请求
 		go s.ServeSession(NewSession(conn))
 	}
-
-	return nil
 }
 
 //针对session的处理
@@ -64,6 +62,7 @@ func (s *Server) ServeSession(session *Session) {
 	//
 	defer func() {
 		//关闭服务
+		session.Flush()
 		session.Close()
 		if v := recover(); v != nil {
 			//定义一个error
@@ -85,9 +84,19 @@ func (s *Server) ServeSession(session *Session) {
 		//读取命令
 		cmd, err := session.ReadCommand()
 		if err != nil {
+			//协议错误回复给客户端之后再关闭
+			if pe, ok := err.(ProtocolError); ok {
+				session.WriteReply(ErrorReply("ERR " + pe.Error()))
+			}
 			break
 		}
 		//接收命令
 		s.handler.RecvCommand(session, cmd)
+		//pipeline中的命令处理完之后再写出
+		if session.Buffered() == 0 {
+			if err := session.Flush(); err != nil {
+				break
+			}
+		}
 	}
 }
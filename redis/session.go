@@ -2,33 +2,69 @@ package redis
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 //定义session
 // cmd, err := session.ReadCommand()
 // session.WriteReply(reply)
-// session.Write(reply.Bytes())
+// session.Flush()
 type Session struct {
 	net.Conn
 	rd *bufio.Reader
+	// 回复先写入wr，读缓冲中的命令都处理完之后才flush，
+	// pipeline的一批命令只需要一次系统调用
+	wr *bufio.Writer
+	// 发布消息的goroutine也会写入，回复不能交错
+	wmu sync.Mutex
+	// HELLO协商的协议版本，RESP2或RESP3
+	proto int
+	// 读取命令时的限制
+	limits *Limits
+	// 由ServerHandler保存的会话状态，比如MULTI的命令队列
+	ctx interface{}
 }
 
 //新建一个session
 func NewSession(conn net.Conn) *Session {
 	return &Session{
-		Conn: conn,
-		rd:   bufio.NewReader(conn),
+		Conn:   conn,
+		rd:     bufio.NewReader(conn),
+		wr:     bufio.NewWriter(conn),
+		proto:  RESP2,
+		limits: DefaultLimits,
 	}
 }
 
 //"*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n"
 //*3$3SET$3eat$13I want to eat\r\n 标准协议
 func (s *Session) ReadCommand() (Command, error) {
+	//不以*开头的是inline命令，忽略空行和空的multibulk
+	for {
+		b, err := s.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		var c Command
+		if b[0] == '*' {
+			c, err = s.readMultiBulk()
+		} else {
+			c, err = s.readInline()
+		}
+		if err != nil || len(c) > 0 {
+			return c, err
+		}
+	}
+}
+
+//读取一个multibulk命令，*0和*-1返回空的命令
+func (s *Session) readMultiBulk() (Command, error) {
 	//读取*
 	// Read ( *<number of arguments> CR LF )
 	if err := s.skipByte('*'); err != nil { // io.EOF
@@ -37,26 +73,33 @@ func (s *Session) ReadCommand() (Command, error) {
 	//参数的个数
 	// number of arguments
 	argCount, err := s.readInt()
-	if err != nil {
-		return nil, err
+	if err != nil || argCount > s.limits.MaxMultiBulkLen() {
+		return nil, ProtocolError("invalid multibulk length")
+	}
+	//和redis一样忽略 *0 和 *-1
+	if argCount <= 0 {
+		return nil, nil
 	}
-	//定义参数的存储数据
-	args := make([][]byte, argCount)
-	for i := 0; i < argCount; i++ {
+	//定义参数的存储数据，个数来自客户端，不能一次分配
+	args := make([][]byte, 0, minInt64(argCount, 1024))
+	var total int64
+	for i := int64(0); i < argCount; i++ {
 		// Read ( $<number of bytes of argument 1> CR LF )
 		if err := s.skipByte('$'); err != nil {
 			return nil, err
 		}
 		//读取数据的长度
-		var argSize int
-		argSize, err = s.readInt()
-		if err != nil {
-			return nil, err
+		argSize, err := s.readInt()
+		if err != nil || argSize < 0 || argSize > s.limits.MaxBulkLen() {
+			return nil, ProtocolError("invalid bulk length")
+		}
+		total += argSize
+		if total > s.limits.QueryBufferLimit() {
+			return nil, ProtocolError("query buffer limit exceeded")
 		}
 		//读取命令
 		// Read ( <argument data> CR LF )
-		args[i] = make([]byte, argSize)
-		_, err = io.ReadFull(s, args[i])
+		arg, err := s.readBulk(argSize)
 		if err != nil {
 			return nil, err
 		}
@@ -65,18 +108,117 @@ func (s *Session) ReadCommand() (Command, error) {
 		if err != nil {
 			return nil, err
 		}
+		args = append(args, arg)
 	}
 	return Command(args), nil
 }
 
+//较大的参数随着读取增长，客户端只发送长度时不会分配整块内存
+func (s *Session) readBulk(size int64) ([]byte, error) {
+	if size <= bulkPrealloc {
+		arg := make([]byte, size)
+		_, err := io.ReadFull(s, arg)
+		return arg, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(bulkPrealloc)
+	_, err := io.CopyN(&buf, s, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+//使用的限制，多个Session可以共享同一个Limits
+func (s *Session) SetLimits(l *Limits) {
+	s.limits = l
+}
+
+//保存会话状态
+func (s *Session) SetContext(v interface{}) {
+	s.ctx = v
+}
+
+//读取会话状态
+func (s *Session) Context() interface{} {
+	return s.ctx
+}
+
 //读取字节
 func (s *Session) Read(p []byte) (int, error) {
 	return s.rd.Read(p)
 }
 
-//写入字节
+//读取一个字节，作为复制客户端时直接从缓冲中解析主库发来的RDB
+func (s *Session) ReadByte() (byte, error) {
+	return s.rd.ReadByte()
+}
+
+//读取一行，去掉CRLF，作为客户端读取状态回复
+func (s *Session) ReadLine() ([]byte, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, line...), nil
+}
+
+//写入回复，只写到缓冲区，需要调用Flush
 func (s *Session) WriteReply(r Reply) (int, error) {
-	return s.Write(r.Bytes())
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if e, ok := r.(replyEncoder); ok {
+		return e.writeTo(s.wr, s.proto), nil
+	}
+	return s.wr.Write(r.Bytes())
+}
+
+//切换协议版本，之后的回复按新的版本编码
+func (s *Session) SetProtocol(proto int) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.proto = proto
+}
+
+//当前的协议版本
+func (s *Session) Protocol() int {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.proto
+}
+
+//把缓冲的回复写到连接
+func (s *Session) Flush() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.wr.Flush()
+}
+
+//读缓冲中是否还有没处理的命令，只能在读取命令的goroutine中调用
+func (s *Session) Buffered() int {
+	return s.rd.Buffered()
+}
+
+//阻塞命令等待期间监听连接是否断开，断开时closed可读
+//stop会中断监听，继续读取命令之前必须调用
+func (s *Session) CloseNotify() (closed <-chan bool, stop func()) {
+	ch := make(chan bool, 1)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// Peek不消费数据，客户端提前发来的命令仍然保留在rd中
+		if _, err := s.rd.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				ch <- true
+			}
+		}
+	}()
+	stop = func() {
+		s.SetReadDeadline(time.Now())
+		<-done
+		s.SetReadDeadline(time.Time{})
+	}
+	return ch, stop
 }
 
 //读取一个byte，判断是否是需要的协议信息
@@ -87,7 +229,7 @@ func (s *Session) skipByte(c byte) (err error) {
 		return
 	}
 	if tmp != c {
-		err = errors.New(fmt.Sprintf("Illegal Byte [%d] != [%d]", tmp, c))
+		err = ProtocolError(fmt.Sprintf("expected '%c', got '%c'", c, tmp))
 	}
 	return
 }
@@ -105,23 +247,30 @@ func (s *Session) skipBytes(bs []byte) error {
 func (s *Session) readLine() (line []byte, err error) {
 	line, err = s.rd.ReadSlice(LF)
 	if err == bufio.ErrBufferFull {
-		return nil, errors.New("line too long")
+		return nil, ProtocolError("line too long")
 	}
 	if err != nil {
 		return
 	}
 	i := len(line) - 2
 	if i < 0 || line[i] != CR {
-		err = errors.New("bad line terminator:" + string(line))
+		return nil, ProtocolError("bad line terminator")
 	}
 	return line[:i], nil
 }
 
 //读取int
-func (s *Session) readInt() (int, error) {
+func (s *Session) readInt() (int64, error) {
 	if line, err := s.readLine(); err == nil {
-		return strconv.Atoi(string(line))
+		return strconv.ParseInt(string(line), 10, 64)
 	} else {
 		return 0, err
 	}
 }
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/facebookgo/ensure"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 回复GET的参数，unbuffered时按改动之前的方式每个回复直接写到连接
+type echoHandler struct {
+	unbuffered bool
+}
+
+func (h *echoHandler) SessionOpened(*Session)        {}
+func (h *echoHandler) SessoinClosed(*Session, error) {}
+
+func (h *echoHandler) RecvCommand(s *Session, c Command) {
+	reply := BulkReply(c[1])
+	if h.unbuffered {
+		s.Conn.Write(reply.Bytes())
+		return
+	}
+	s.WriteReply(reply)
+}
+
+func benchmarkPipeline(b *testing.B, depth int, unbuffered bool) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer lis.Close()
+	srv := NewServer()
+	srv.Register(&echoHandler{unbuffered: unbuffered})
+	go srv.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	var batch, want []byte
+	for i := 0; i < depth; i++ {
+		batch = append(batch, Command{[]byte("GET"), []byte("key")}.Bytes()...)
+		want = append(want, BulkReply("key").Bytes()...)
+	}
+	got := make([]byte, len(want))
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, got); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if !bytes.Equal(got, want) {
+		b.Fatalf("unexpected replies %q", got)
+	}
+}
+
+func BenchmarkPipeline1(b *testing.B)              { benchmarkPipeline(b, 1, false) }
+func BenchmarkPipeline1Unbuffered(b *testing.B)    { benchmarkPipeline(b, 1, true) }
+func BenchmarkPipeline100(b *testing.B)            { benchmarkPipeline(b, 100, false) }
+func BenchmarkPipeline100Unbuffered(b *testing.B)  { benchmarkPipeline(b, 100, true) }
+func BenchmarkPipeline1000(b *testing.B)           { benchmarkPipeline(b, 1000, false) }
+func BenchmarkPipeline1000Unbuffered(b *testing.B) { benchmarkPipeline(b, 1000, true) }
+
+var benchReply = MultiBulkReply{"message", []byte("channel"), 12345, nil, StatusReply("OK")}
+
+func BenchmarkReplyBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioutil.Discard.Write(benchReply.Bytes())
+	}
+}
+
+func BenchmarkReplyWriteTo(b *testing.B) {
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		benchReply.WriteTo(&buf)
+	}
+}
+
+func TestReplyWriteTo(t *testing.T) {
+	replies := []Reply{
+		StatusReply("OK"),
+		ErrorReply("ERR x"),
+		IntegerReply(-42),
+		BulkReply(nil),
+		BulkReply("abc"),
+		MultiBulkReply(nil),
+		MultiBulkReply{},
+		benchReply,
+		MultiBulkReply{"0", MultiBulkReply{[]byte("a"), []byte(nil)}},
+	}
+	want := []string{
+		"+OK\r\n",
+		"-ERR x\r\n",
+		":-42\r\n",
+		"$-1\r\n",
+		"$3\r\nabc\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*5\r\n$7\r\nmessage\r\n$7\r\nchannel\r\n:12345\r\n$-1\r\n+OK\r\n",
+		"*2\r\n$1\r\n0\r\n*2\r\n$1\r\na\r\n$-1\r\n",
+	}
+	for i, r := range replies {
+		var buf bytes.Buffer
+		n, err := r.(io.WriterTo).WriteTo(&buf)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, buf.String(), want[i])
+		ensure.DeepEqual(t, n, int64(len(want[i])))
+		ensure.DeepEqual(t, string(r.Bytes()), want[i])
+	}
+}
+
+// 从字符串读取命令的连接
+type readConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func readCommands(input string) ([]Command, error) {
+	s := NewSession(&readConn{r: strings.NewReader(input)})
+	cmds := make([]Command, 0)
+	for {
+		c, err := s.ReadCommand()
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, c)
+	}
+}
+
+func TestReadInlineCommand(t *testing.T) {
+	cmds, err := readCommands("PING\r\n\r\nset a  \"b c\"\nget 'it'\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\n" +
+		"echo \"\\x41\\n\\\"\" 'x\\'y' \"\"\r\n")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(cmds), 5)
+	ensure.DeepEqual(t, cmds[0].String(), `["PING"]`)
+	ensure.DeepEqual(t, cmds[1].String(), `["set","a","b c"]`)
+	ensure.DeepEqual(t, cmds[2].String(), `["get","it"]`)
+	ensure.DeepEqual(t, cmds[3].String(), `["GET","a"]`)
+	ensure.DeepEqual(t, cmds[4], Command{[]byte("echo"), []byte("A\n\""), []byte("x'y"), []byte{}})
+}
+
+func TestReadInlineErrors(t *testing.T) {
+	for _, input := range []string{
+		"get \"a\r\n",
+		"get 'a\r\n",
+		"get \"a\"b\r\n",
+	} {
+		_, err := readCommands(input)
+		ensure.DeepEqual(t, err, ProtocolError("unbalanced quotes in request"))
+	}
+	// 'it''s'的右引号后面不是空格
+	_, err := readCommands("get 'it''s'\r\n")
+	ensure.NotNil(t, err)
+
+	_, err = readCommands(strings.Repeat("a", inlineMaxSize+1) + "\r\n")
+	ensure.DeepEqual(t, err, ProtocolError("too big inline request"))
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	cases := map[string]error{
+		"*2147483647\r\n":                 ProtocolError("invalid multibulk length"),
+		"*x\r\n":                          ProtocolError("invalid multibulk length"),
+		"*1\r\n$-5\r\n":                   ProtocolError("invalid bulk length"),
+		"*1\r\n$9999999999\r\n":           ProtocolError("invalid bulk length"),
+		"*1\r\n+OK\r\n":                   ProtocolError("expected '$', got '+'"),
+		"*1\r\n$2\r\nabc\r\n":             ProtocolError("expected '\r', got 'c'"),
+		"*1\r\n$3\r\nab":                  io.ErrUnexpectedEOF,
+		"*0\r\n*-1\r\n":                   nil,
+		"*2\r\n$3\r\nGET\r\n$40000\r\nab": io.ErrUnexpectedEOF,
+	}
+	for input, want := range cases {
+		_, err := readCommands(input)
+		ensure.DeepEqual(t, err, want)
+	}
+
+	l := NewLimits()
+	l.SetMaxMultiBulkLen(2)
+	l.SetQueryBufferLimit(5)
+	for input, want := range map[string]error{
+		"*3\r\n":                                ProtocolError("invalid multibulk length"),
+		"*2\r\n$3\r\nGET\r\n$3\r\nabc\r\n":      ProtocolError("query buffer limit exceeded"),
+		"*2\r\n$3\r\nGET\r\n$2\r\nab\r\n*0\r\n": nil,
+	} {
+		s := NewSession(&readConn{r: strings.NewReader(input)})
+		s.SetLimits(l)
+		var err error
+		for err == nil {
+			_, err = s.ReadCommand()
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		ensure.DeepEqual(t, err, want)
+	}
+}
+
+func TestProtocolErrorReply(t *testing.T) {
+	client, conn := net.Pipe()
+	srv := NewServer()
+	srv.Register(&echoHandler{})
+	go srv.ServeSession(NewSession(conn))
+	go client.Write([]byte("*1\r\n$-1\r\n"))
+	b, _ := ioutil.ReadAll(client)
+	ensure.DeepEqual(t, string(b), "-ERR Protocol error: invalid bulk length\r\n")
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	f.Add([]byte("PING\r\n"))
+	f.Add([]byte("set a \"b\\x41\" 'c'\r\n"))
+	f.Add([]byte("*2147483647\r\n"))
+	f.Add([]byte("*1\r\n$-1\r\n"))
+	l := NewLimits()
+	l.SetMaxBulkLen(1024)
+	l.SetMaxMultiBulkLen(64)
+	l.SetQueryBufferLimit(4096)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewSession(&readConn{r: bytes.NewReader(data)})
+		s.SetLimits(l)
+		for {
+			c, err := s.ReadCommand()
+			if err != nil {
+				return
+			}
+			if len(c) == 0 {
+				t.Fatalf("unexpected empty command")
+			}
+			// 重新编码之后应该读到同样的命令
+			rs := NewSession(&readConn{r: bytes.NewReader(c.Bytes())})
+			again, err := rs.ReadCommand()
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, again, c)
+		}
+	})
+}
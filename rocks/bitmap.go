@@ -0,0 +1,667 @@
+package rocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/tecbot/gorocksdb"
+	"math/bits"
+	"strconv"
+)
+
+// bitmap
+// 	+key,b = "8193"
+// 	b[key]<chunk> = 4096 bytes
+// SETBIT/BITFIELD写过的string按4096字节分块保存，<chunk>是4字节大端的块序号，
+// 全0的块可以不存在，+key,b 记录字节长度。对客户端来说它依然是string，
+// GET时拼接全部块，APPEND/SETRANGE等修改后转回普通string
+
+const bitmapChunkSize = 4096
+
+// 和redis一样，bitmap最大512MB
+const MaxBitOffset = MaxStringSize*8 - 1
+
+var (
+	ErrBitOffset     = errors.New("bit offset is not an integer or out of range")
+	ErrBitOpNotArity = errors.New("BITOP NOT must be called with a single source key")
+)
+
+type BitOperation int
+
+const (
+	BitAnd BitOperation = iota
+	BitOr
+	BitXor
+	BitNot
+)
+
+// BITCOUNT/BITPOS的范围，Bit为true时按bit而不是字节计算
+type BitRange struct {
+	Start, End int64
+	Bit        bool
+}
+
+type BitFieldKind int
+
+const (
+	BitFieldGet BitFieldKind = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+type BitOverflow int
+
+const (
+	BitOverflowWrap BitOverflow = iota
+	BitOverflowSat
+	BitOverflowFail
+)
+
+// BITFIELD的一个操作，Offset以bit为单位
+type BitFieldOp struct {
+	Kind     BitFieldKind
+	Signed   bool
+	Bits     uint
+	Offset   int64
+	Value    int64
+	Overflow BitOverflow
+}
+
+// 一个key的bitmap视图，读取的块缓存在chunks里，修改过的块由flush写回
+type bitmap struct {
+	d      *DB
+	key    []byte
+	src    *DB         // 读取用的DB，可以是快照视图
+	t      ElementType // NONE, STRING, BITMAP
+	size   int64
+	raw    []byte // 普通string的内容
+	chunks map[int64][]byte
+	dirty  map[int64]bool
+}
+
+// 打开key，它必须是string或者不存在
+func (d *DB) openBitmap(key []byte, src *DB) (*bitmap, error) {
+	b := &bitmap{d: d, key: key, src: src, t: NONE, chunks: make(map[int64][]byte), dirty: make(map[int64]bool)}
+	val, err := src.RawGet(rawKey(key, BITMAP))
+	if err != nil {
+		return nil, err
+	}
+	if val != nil {
+		b.t = BITMAP
+		b.size, _ = strconv.ParseInt(string(val), 10, 64)
+		return b, nil
+	}
+	raw, err := src.RawGet(rawKey(key, STRING))
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		b.t = STRING
+		b.raw = raw
+		b.size = int64(len(raw))
+		return b, nil
+	}
+	if d.typeOf(key) != NONE {
+		return nil, ErrWrongType
+	}
+	return b, nil
+}
+
+// 读取第idx块，不存在的块返回nil，不缓存
+func (b *bitmap) chunk(idx int64) ([]byte, error) {
+	if c, ok := b.chunks[idx]; ok {
+		return c, nil
+	}
+	start := idx * bitmapChunkSize
+	if start >= b.size {
+		return nil, nil
+	}
+	switch b.t {
+	case STRING:
+		c := make([]byte, bitmapChunkSize)
+		copy(c, b.raw[start:])
+		return c, nil
+	case BITMAP:
+		c, err := b.src.RawGet(bitmapChunkKey(b.key, idx))
+		if c != nil && len(c) < bitmapChunkSize {
+			c = append(c, make([]byte, bitmapChunkSize-len(c))...)
+		}
+		return c, err
+	}
+	return nil, nil
+}
+
+// 读取并缓存第idx块
+func (b *bitmap) load(idx int64) ([]byte, error) {
+	c, err := b.chunk(idx)
+	if err == nil {
+		b.chunks[idx] = c
+	}
+	return c, err
+}
+
+func (b *bitmap) getBit(offset int64) (int, error) {
+	c, err := b.load(offset / 8 / bitmapChunkSize)
+	if err != nil || c == nil {
+		return 0, err
+	}
+	byt := c[offset/8%bitmapChunkSize]
+	return int(byt>>uint(7-offset%8)) & 1, nil
+}
+
+// 修改一个bit，返回原来的值
+func (b *bitmap) setBit(offset int64, bit int) (int, error) {
+	idx := offset / 8 / bitmapChunkSize
+	c, err := b.load(idx)
+	if err != nil {
+		return 0, err
+	}
+	if c == nil {
+		c = make([]byte, bitmapChunkSize)
+		b.chunks[idx] = c
+	}
+	pos, mask := offset/8%bitmapChunkSize, byte(1)<<uint(7-offset%8)
+	old := 0
+	if c[pos]&mask != 0 {
+		old = 1
+	}
+	if bit == 1 {
+		c[pos] |= mask
+	} else {
+		c[pos] &^= mask
+	}
+	b.dirty[idx] = true
+	if offset/8+1 > b.size {
+		b.size = offset/8 + 1
+	}
+	return old, nil
+}
+
+// 从offset开始读取n个bit，高位在前
+func (b *bitmap) getBits(offset int64, n uint) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := b.getBit(offset + int64(i))
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint64(bit)
+	}
+	return v, nil
+}
+
+func (b *bitmap) setBits(offset int64, n uint, v uint64) error {
+	for i := uint(0); i < n; i++ {
+		if _, err := b.setBit(offset+int64(i), int(v>>(n-1-i))&1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写回修改过的块和长度，普通string在第一次写回时转为分块保存
+func (b *bitmap) flush() error {
+	if len(b.dirty) == 0 && b.t == BITMAP {
+		return nil
+	}
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	b.flushTo(batch)
+	return b.d.WriteBatch(batch)
+}
+
+// 把修改加入batch，由调用者写入
+func (b *bitmap) flushTo(batch *gorocksdb.WriteBatch) {
+	if b.t == STRING {
+		for idx := int64(0); idx*bitmapChunkSize < int64(len(b.raw)); idx++ {
+			if !b.dirty[idx] {
+				c, _ := b.chunk(idx)
+				batch.Put(bitmapChunkKey(b.key, idx), c)
+			}
+		}
+		batch.Delete(rawKey(b.key, STRING))
+		b.raw = nil
+	}
+	b.t = BITMAP
+	for idx := range b.dirty {
+		batch.Put(bitmapChunkKey(b.key, idx), b.chunks[idx])
+	}
+	batch.Put(rawKey(b.key, BITMAP), []byte(strconv.FormatInt(b.size, 10)))
+	b.dirty = make(map[int64]bool)
+	b.d.touch(b.key)
+}
+
+// 遍历[start, end]字节范围，不存在的块data全为0且zero为true，fn返回false时停止
+func (b *bitmap) eachChunk(start, end int64, fn func(pos int64, data []byte, zero bool) bool) error {
+	for idx := start / bitmapChunkSize; idx <= end/bitmapChunkSize; idx++ {
+		c, err := b.chunk(idx)
+		if err != nil {
+			return err
+		}
+		base := idx * bitmapChunkSize
+		lo, hi := start, end
+		if lo < base {
+			lo = base
+		}
+		if hi > base+bitmapChunkSize-1 {
+			hi = base + bitmapChunkSize - 1
+		}
+		zero := c == nil
+		if zero {
+			c = zeroChunk
+		}
+		if !fn(lo, c[lo-base:hi-base+1], zero) {
+			return nil
+		}
+	}
+	return nil
+}
+
+var zeroChunk = make([]byte, bitmapChunkSize)
+
+// 按redis的规则处理负数下标，返回bit为单位的[start, end]，范围为空时ok为false
+func (r *BitRange) bits(size int64) (start, end int64, ok bool) {
+	total := size
+	if r.Bit {
+		total = size * 8
+	}
+	start, end = r.Start, r.End
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end || total == 0 {
+		return 0, 0, false
+	}
+	if r.Bit {
+		return start, end, true
+	}
+	return start * 8, end*8 + 7, true
+}
+
+// 读取整个bitmap，用于GET
+func (d *DB) bitmapBytes(key []byte) ([]byte, error) {
+	b, err := d.openBitmap(key, d)
+	if err != nil || b.t == NONE {
+		return nil, err
+	}
+	buf := make([]byte, 0, b.size)
+	if b.size == 0 {
+		return buf, nil
+	}
+	err = b.eachChunk(0, b.size-1, func(pos int64, data []byte, zero bool) bool {
+		buf = append(buf, data...)
+		return true
+	})
+	return buf, err
+}
+
+// 把删除bitmap全部数据的操作加入batch
+func (d *DB) dropBitmap(batch *gorocksdb.WriteBatch, key []byte) {
+	d.PrefixEnumerate(bitmapChunkPrefix(key), IterForward, func(i int, key, value []byte, quit *bool) {
+		batch.Delete(copyBytes(key))
+	})
+	batch.Delete(rawKey(key, BITMAP))
+}
+
+// SETBIT，返回原来的值
+func (d *DB) SetBit(key []byte, offset int64, bit int) (int, error) {
+	if offset < 0 || offset > MaxBitOffset {
+		return 0, ErrBitOffset
+	}
+	defer d.lockString(key)()
+	d.expireIfNeeded(key)
+	b, err := d.openBitmap(key, d)
+	if err != nil {
+		return 0, err
+	}
+	old, err := b.setBit(offset, bit)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.flush(); err != nil {
+		return 0, err
+	}
+	d.notify(NotifyString, "setbit", key)
+	return old, nil
+}
+
+// GETBIT
+func (d *DB) GetBit(key []byte, offset int64) (int, error) {
+	if offset < 0 || offset > MaxBitOffset {
+		return 0, ErrBitOffset
+	}
+	d.expireIfNeeded(key)
+	b, err := d.openBitmap(key, d)
+	if err != nil {
+		return 0, err
+	}
+	return b.getBit(offset)
+}
+
+// BITCOUNT，r为nil时统计全部
+func (d *DB) BitCount(key []byte, r *BitRange) (int64, error) {
+	d.expireIfNeeded(key)
+	b, err := d.openBitmap(key, d)
+	if err != nil {
+		return 0, err
+	}
+	if r == nil {
+		r = &BitRange{Start: 0, End: -1}
+	}
+	start, end, ok := r.bits(b.size)
+	if !ok {
+		return 0, nil
+	}
+	var n int64
+	err = b.eachChunk(start/8, end/8, func(pos int64, data []byte, zero bool) bool {
+		if zero {
+			return true
+		}
+		for i, byt := range data {
+			p := (pos + int64(i)) * 8
+			// 首尾不完整的字节
+			if p < start {
+				byt &= 0xFF >> uint(start-p)
+			}
+			if p+7 > end {
+				byt &= 0xFF << uint(p+7-end)
+			}
+			n += int64(bits.OnesCount8(byt))
+		}
+		return true
+	})
+	return n, err
+}
+
+// BITPOS，返回第一个值为bit的位置，找不到时返回-1
+// 查找0并且没有指定end时，和redis一样认为右边补了无限个0
+func (d *DB) BitPos(key []byte, bit int, r *BitRange, endGiven bool) (int64, error) {
+	d.expireIfNeeded(key)
+	b, err := d.openBitmap(key, d)
+	if err != nil {
+		return 0, err
+	}
+	if b.t == NONE {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	if r == nil {
+		r = &BitRange{Start: 0, End: -1}
+	}
+	start, end, ok := r.bits(b.size)
+	if !ok {
+		return -1, nil
+	}
+	found := int64(-1)
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xFF
+	}
+	err = b.eachChunk(start/8, end/8, func(pos int64, data []byte, zero bool) bool {
+		if zero && bit == 1 {
+			return true
+		}
+		for i, byt := range data {
+			if byt == skip {
+				continue
+			}
+			p := (pos + int64(i)) * 8
+			for j := int64(0); j < 8; j++ {
+				if p+j < start || p+j > end {
+					continue
+				}
+				if int(byt>>uint(7-j))&1 == bit {
+					found = p + j
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if found < 0 && bit == 0 && !endGiven {
+		return end + 1, nil
+	}
+	return found, nil
+}
+
+// BITOP，结果保存到dest，返回结果的字节长度
+// 源key从同一个快照读取，所以dest也可以是源key之一
+func (d *DB) BitOp(op BitOperation, dest []byte, keys ...[]byte) (int64, error) {
+	if op == BitNot && len(keys) != 1 {
+		return 0, ErrBitOpNotArity
+	}
+	defer d.lockStrings(append([][]byte{dest}, keys...)...)()
+	for _, key := range keys {
+		d.expireIfNeeded(key)
+	}
+
+	view, release := d.snapshot()
+	defer release()
+
+	srcs := make([]*bitmap, len(keys))
+	size := int64(0)
+	for i, key := range keys {
+		b, err := d.openBitmap(key, view)
+		if err != nil {
+			return 0, err
+		}
+		srcs[i] = b
+		if b.size > size {
+			size = b.size
+		}
+	}
+	// 删除dest和第一批结果在同一个batch中写入
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	deleted, err := d.deleteTo(batch, dest)
+	if err != nil {
+		return 0, err
+	}
+	write := func() error {
+		err := d.WriteBatch(batch)
+		batch.Clear()
+		d.uncache(dest)
+		return err
+	}
+	if size == 0 {
+		if !deleted {
+			return 0, nil
+		}
+		if err := write(); err != nil {
+			return 0, err
+		}
+		d.notify(NotifyGeneric, "del", dest)
+		return 0, nil
+	}
+
+	dst := &bitmap{d: d, key: dest, src: d, t: NONE, size: size, chunks: make(map[int64][]byte), dirty: make(map[int64]bool)}
+	for idx := int64(0); idx*bitmapChunkSize < size; idx++ {
+		out := make([]byte, bitmapChunkSize)
+		for i, src := range srcs {
+			c, err := src.chunk(idx)
+			if err != nil {
+				return 0, err
+			}
+			if c == nil {
+				c = zeroChunk
+			}
+			bitOpChunk(op, out, c, i == 0)
+		}
+		// 超出长度的部分保持为0
+		if tail := size - idx*bitmapChunkSize; tail < bitmapChunkSize {
+			copy(out[tail:], zeroChunk)
+		}
+		if !bytes.Equal(out, zeroChunk) {
+			dst.chunks[idx] = out
+			dst.dirty[idx] = true
+		}
+		// 结果可能很大，分批写入，每批都带上最终的长度
+		if len(dst.dirty) >= 256 {
+			dst.flushTo(batch)
+			if err := write(); err != nil {
+				return 0, err
+			}
+			dst.chunks = make(map[int64][]byte)
+		}
+	}
+	dst.flushTo(batch)
+	if err := write(); err != nil {
+		return 0, err
+	}
+	d.notify(NotifyString, "set", dest)
+	return size, nil
+}
+
+func bitOpChunk(op BitOperation, out, c []byte, first bool) {
+	if first {
+		copy(out, c)
+		if op == BitNot {
+			for j := range out {
+				out[j] = ^out[j]
+			}
+		}
+		return
+	}
+	for j := range out {
+		switch op {
+		case BitAnd:
+			out[j] &= c[j]
+		case BitOr:
+			out[j] |= c[j]
+		case BitXor:
+			out[j] ^= c[j]
+		}
+	}
+}
+
+// BITFIELD，按顺序执行，OVERFLOW FAIL时对应的结果为nil
+func (d *DB) BitField(key []byte, ops []BitFieldOp) ([]*int64, error) {
+	for _, op := range ops {
+		if op.Offset < 0 || op.Offset+int64(op.Bits)-1 > MaxBitOffset {
+			return nil, ErrBitOffset
+		}
+	}
+	defer d.lockString(key)()
+	d.expireIfNeeded(key)
+	b, err := d.openBitmap(key, d)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*int64, len(ops))
+	for i, op := range ops {
+		raw, err := b.getBits(op.Offset, op.Bits)
+		if err != nil {
+			return nil, err
+		}
+		old := int64(raw)
+		if op.Signed {
+			old = signExtend(raw, op.Bits)
+		}
+		if op.Kind == BitFieldGet {
+			results[i] = &old
+			continue
+		}
+		val, overflow := op.apply(old)
+		if overflow && op.Overflow == BitOverflowFail {
+			continue
+		}
+		if err := b.setBits(op.Offset, op.Bits, uint64(val)); err != nil {
+			return nil, err
+		}
+		if op.Kind == BitFieldSet {
+			results[i] = &old
+		} else {
+			results[i] = &val
+		}
+	}
+	if len(b.dirty) > 0 {
+		if err := b.flush(); err != nil {
+			return nil, err
+		}
+		d.notify(NotifyString, "setbit", key)
+	}
+	return results, nil
+}
+
+// 计算SET/INCRBY之后的值，溢出时按WRAP/SAT处理
+func (op BitFieldOp) apply(old int64) (int64, bool) {
+	value, incr := old, op.Value
+	if op.Kind == BitFieldSet {
+		value, incr = op.Value, 0
+	}
+	if op.Signed {
+		max := int64(uint64(1)<<(op.Bits-1) - 1)
+		min := -max - 1
+		high := incr >= 0 && value > max-incr
+		low := incr <= 0 && value < min-incr
+		if !high && !low {
+			return value + incr, false
+		}
+		if op.Overflow == BitOverflowSat {
+			if high {
+				return max, true
+			}
+			return min, true
+		}
+		return signExtend((uint64(value)+uint64(incr))&bitMask(op.Bits), op.Bits), true
+	}
+
+	max := bitMask(op.Bits)
+	v := uint64(value)
+	high := incr >= 0 && (uint64(incr) > max || v > max-uint64(incr))
+	low := incr < 0 && v < uint64(-incr)
+	if !high && !low {
+		return int64(v + uint64(incr)), false
+	}
+	if op.Overflow == BitOverflowSat {
+		if high {
+			return int64(max), true
+		}
+		return 0, true
+	}
+	return int64((v + uint64(incr)) & max), true
+}
+
+func bitMask(n uint) uint64 {
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<n - 1
+}
+
+func signExtend(v uint64, n uint) int64 {
+	if n < 64 && v&(uint64(1)<<(n-1)) != 0 {
+		v |= ^uint64(0) << n
+	}
+	return int64(v)
+}
+
+// b[key]
+func bitmapChunkPrefix(key []byte) []byte {
+	return bytes.Join([][]byte{[]byte{BITMAP}, SOK, key, EOK}, nil)
+}
+
+// b[key]<chunk>
+func bitmapChunkKey(key []byte, idx int64) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(idx))
+	return append(bitmapChunkPrefix(key), buf...)
+}
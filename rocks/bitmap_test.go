@@ -0,0 +1,192 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+func TestBitmapSetGet(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	key := []byte("dau")
+	old, err := db.SetBit(key, 7, 1)
+	ensure.Nil(t, err)
+	ensure.True(t, old == 0)
+	old, err = db.SetBit(key, 7, 1)
+	ensure.Nil(t, err)
+	ensure.True(t, old == 1)
+	ensure.True(t, db.TypeOf(key) == BITMAP)
+	val, err := db.Get(key)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte{1})
+
+	// 远处的offset只写一个块
+	_, err = db.SetBit(key, 1<<32-1, 1)
+	ensure.Nil(t, err)
+	n := 0
+	db.PrefixEnumerate(bitmapChunkPrefix(key), IterForward, func(i int, key, value []byte, quit *bool) {
+		n++
+	})
+	ensure.True(t, n == 2)
+	bit, err := db.GetBit(key, 1<<32-1)
+	ensure.Nil(t, err)
+	ensure.True(t, bit == 1)
+	bit, _ = db.GetBit(key, 1<<31)
+	ensure.True(t, bit == 0)
+	_, err = db.SetBit(key, 1<<32, 1)
+	ensure.True(t, err == ErrBitOffset)
+
+	cnt, err := db.BitCount(key, nil)
+	ensure.Nil(t, err)
+	ensure.True(t, cnt == 2)
+
+	// 普通string转为bitmap，再被APPEND转回string
+	ensure.Nil(t, db.Set([]byte("s"), []byte("a")))
+	_, err = db.SetBit([]byte("s"), 6, 1)
+	ensure.Nil(t, err)
+	val, _ = db.Get([]byte("s"))
+	ensure.DeepEqual(t, string(val), "c")
+	_, err = db.Append([]byte("s"), []byte("d"))
+	ensure.Nil(t, err)
+	ensure.True(t, db.TypeOf([]byte("s")) == STRING)
+	val, _ = db.Get([]byte("s"))
+	ensure.DeepEqual(t, string(val), "cd")
+
+	ensure.Nil(t, db.Delete(key))
+	ensure.True(t, db.TypeOf(key) == NONE)
+	db.PrefixEnumerate(bitmapChunkPrefix(key), IterForward, func(i int, key, value []byte, quit *bool) {
+		t.Fatal("chunk not deleted")
+	})
+
+	h, _ := db.Hash([]byte("h"))
+	h.Set([]byte("f"), []byte("v"))
+	_, err = db.SetBit([]byte("h"), 1, 1)
+	ensure.True(t, err == ErrWrongType)
+}
+
+func TestBitmapCountPos(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	key := []byte("k")
+	ensure.Nil(t, db.Set(key, []byte{0xff, 0xf0, 0x00}))
+	count := func(r *BitRange) int64 {
+		n, err := db.BitCount(key, r)
+		ensure.Nil(t, err)
+		return n
+	}
+	ensure.True(t, count(nil) == 12)
+	ensure.True(t, count(&BitRange{Start: 1, End: 1}) == 4)
+	ensure.True(t, count(&BitRange{Start: -2, End: -1}) == 4)
+	ensure.True(t, count(&BitRange{Start: 5, End: 10, Bit: true}) == 6)
+	ensure.True(t, count(&BitRange{Start: 2, End: 1}) == 0)
+
+	pos := func(bit int, r *BitRange, endGiven bool) int64 {
+		p, err := db.BitPos(key, bit, r, endGiven)
+		ensure.Nil(t, err)
+		return p
+	}
+	ensure.True(t, pos(0, nil, false) == 12)
+	ensure.True(t, pos(1, &BitRange{Start: 2, End: -1}, false) == -1)
+	ensure.True(t, pos(1, &BitRange{Start: 7, End: 20, Bit: true}, true) == 7)
+
+	ensure.Nil(t, db.Set(key, []byte{0xff}))
+	ensure.True(t, pos(0, nil, false) == 8)
+	ensure.True(t, pos(0, &BitRange{Start: 0, End: -1}, true) == -1)
+
+	p, _ := db.BitPos([]byte("none"), 1, nil, false)
+	ensure.True(t, p == -1)
+	p, _ = db.BitPos([]byte("none"), 0, nil, false)
+	ensure.True(t, p == 0)
+}
+
+func TestBitOp(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("a"), []byte{0x0f, 0xff}))
+	db.SetBit([]byte("b"), 0, 1)
+	db.SetBit([]byte("b"), 70000, 1)
+
+	n, err := db.BitOp(BitOr, []byte("dst"), []byte("a"), []byte("b"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 70000/8+1)
+	c, _ := db.BitCount([]byte("dst"), nil)
+	ensure.True(t, c == 14)
+
+	n, err = db.BitOp(BitAnd, []byte("dst"), []byte("a"), []byte("b"))
+	ensure.Nil(t, err)
+	c, _ = db.BitCount([]byte("dst"), nil)
+	ensure.True(t, c == 0)
+
+	// dest也是源key
+	_, err = db.BitOp(BitXor, []byte("a"), []byte("a"), []byte("a"))
+	ensure.Nil(t, err)
+	val, _ := db.Get([]byte("a"))
+	ensure.DeepEqual(t, val, []byte{0, 0})
+
+	ensure.Nil(t, db.Set([]byte("n"), []byte{0x0f, 0x00, 0x01}))
+	n, err = db.BitOp(BitNot, []byte("dst"), []byte("n"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 3)
+	val, _ = db.Get([]byte("dst"))
+	ensure.DeepEqual(t, val, []byte{0xf0, 0xff, 0xfe})
+
+	_, err = db.BitOp(BitNot, []byte("dst"), []byte("a"), []byte("b"))
+	ensure.True(t, err == ErrBitOpNotArity)
+
+	n, err = db.BitOp(BitOr, []byte("dst"), []byte("none"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 0)
+	ensure.True(t, db.TypeOf([]byte("dst")) == NONE)
+
+	// 覆盖其他类型的key，结果超过一批
+	l, _ := db.List([]byte("ldst"))
+	l.RPush([]byte("x"))
+	db.ExpireAt([]byte("ldst"), nowMs()+60000)
+	size := int64(300 * bitmapChunkSize)
+	db.SetBit([]byte("zero"), size*8-1, 0)
+	n, err = db.BitOp(BitNot, []byte("ldst"), []byte("zero"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == size)
+	c, _ = db.BitCount([]byte("ldst"), nil)
+	ensure.True(t, c == size*8)
+	ttl, _ := db.TTL([]byte("ldst"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+	_, err = db.List([]byte("ldst"))
+	ensure.True(t, err == ErrWrongType)
+}
+
+func TestBitField(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	key := []byte("bf")
+	res, err := db.BitField(key, []BitFieldOp{
+		{Kind: BitFieldSet, Signed: false, Bits: 8, Offset: 0, Value: 255},
+		{Kind: BitFieldGet, Signed: true, Bits: 8, Offset: 0},
+		{Kind: BitFieldIncrBy, Signed: false, Bits: 8, Offset: 0, Value: 10},
+		{Kind: BitFieldIncrBy, Signed: false, Bits: 8, Offset: 0, Value: 300, Overflow: BitOverflowSat},
+		{Kind: BitFieldIncrBy, Signed: true, Bits: 4, Offset: 100, Value: 8, Overflow: BitOverflowFail},
+		{Kind: BitFieldIncrBy, Signed: true, Bits: 4, Offset: 100, Value: -9, Overflow: BitOverflowSat},
+		{Kind: BitFieldSet, Signed: true, Bits: 64, Offset: 200, Value: -1},
+		{Kind: BitFieldIncrBy, Signed: true, Bits: 64, Offset: 200, Value: -1 << 63, Overflow: BitOverflowWrap},
+	})
+	ensure.Nil(t, err)
+	want := []interface{}{int64(0), int64(-1), int64(9), int64(255), nil, int64(-8), int64(0), int64(1<<63 - 1)}
+	for i, v := range res {
+		if want[i] == nil {
+			ensure.True(t, v == nil, i)
+		} else {
+			ensure.True(t, v != nil && *v == want[i].(int64), i, *v)
+		}
+	}
+	bit, _ := db.GetBit(key, 0)
+	ensure.True(t, bit == 1)
+
+	// 只有GET时不创建key
+	_, err = db.BitField([]byte("none"), []BitFieldOp{{Kind: BitFieldGet, Bits: 8}})
+	ensure.Nil(t, err)
+	ensure.True(t, db.TypeOf([]byte("none")) == NONE)
+}
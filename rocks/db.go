@@ -2,6 +2,7 @@ package rocks
 
 import (
 	"bytes"
+	"errors"
 	"github.com/golang/groupcache/lru"
 	"github.com/tecbot/gorocksdb"
 	"sync"
@@ -14,8 +15,28 @@ type DB struct {
 	ro     *gorocksdb.ReadOptions
 	mu     sync.Mutex
 	caches *lru.Cache
+	quit   chan bool
+	wg     sync.WaitGroup
+	pushFn func(key []byte)
+	//键空间通知
+	notifyFn NotifyFunc
+	//string的分片锁
+	strLocks stringLocks
+	//事务的排它锁，普通命令持有共享锁
+	txMu sync.RWMutex
+	//快照视图和事务使用的快照
+	snap *gorocksdb.Snapshot
+	//事务内的写入，非nil时这是Begin返回的事务视图
+	tx *txn
+	//WATCH的修改计数
+	watched watchedKeys
+	//数据库的编号，复制时使用
+	id string
 }
 
+// 对已有的key执行了其他类型的操作
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
 //新建一个rockdb配置
 func New(rdb *gorocksdb.DB) *DB {
 	db := &DB{rdb: rdb}
@@ -24,85 +45,343 @@ func New(rdb *gorocksdb.DB) *DB {
 	db.caches = lru.New(1000)
 	//最大256个
 	db.RawSet([]byte{MAXBYTE}, nil) // for Enumerator seek to last
+	db.id = db.loadID()
+	//后台清理过期key
+	db.quit = make(chan bool)
+	db.wg.Add(1)
+	go db.reaper()
 	return db
 }
 
 //获取数据，并且cache
-func (d *DB) objFromCache(key []byte, e ElementType) interface{} {
+//key已经是其他类型时返回ErrWrongType
+//缓存命中同类型的对象时不再检查，因为改变key类型的Set/Delete都会清除缓存
+func (d *DB) objFromCache(key []byte, e ElementType) (interface{}, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	skey := string(key)
 	obj, ok := d.caches.Get(skey)
-	if !ok {
-		switch e {
-		case HASH:
-			obj = NewHashElement(d, key)
-		case LIST:
-			obj = NewListElement(d, key)
-		case SORTEDSET:
-			obj = NewSortedSetElement(d, key)
-		}
-		d.caches.Add(skey, obj)
+	if ok && isElementOf(obj, e) {
+		return obj, nil
+	}
+	if t := d.typeOf(key); t != NONE && t != e {
+		return nil, ErrWrongType
+	}
+	obj = newElement(d, key, e)
+	d.caches.Add(skey, obj)
+	if d.tx != nil {
+		d.tx.keys[skey] = true
+	}
+	return obj, nil
+}
+
+//复杂结构都需要实现dropper，用于Delete
+//dropTo只把删除加入batch，不加锁，locker是删除期间要持有的锁
+type dropper interface {
+	locker() sync.Locker
+	dropTo(batch *gorocksdb.WriteBatch)
+}
+
+func newElement(d *DB, key []byte, e ElementType) interface{} {
+	switch e {
+	case HASH:
+		return NewHashElement(d, key)
+	case LIST:
+		return NewListElement(d, key)
+	case SORTEDSET:
+		return NewSortedSetElement(d, key)
+	case SET:
+		return NewSetElement(d, key)
+	}
+	return nil
+}
+
+//判断缓存中的对象是否为指定类型
+func isElementOf(obj interface{}, e ElementType) bool {
+	switch obj.(type) {
+	case *HashElement:
+		return e == HASH
+	case *ListElement:
+		return e == LIST
+	case *SortedSetElement:
+		return e == SORTEDSET
+	case *SetElement:
+		return e == SET
 	}
-	return obj
+	return false
 }
 
 //获取各类数据
-func (d *DB) Hash(key []byte) *HashElement {
-	return d.objFromCache(key, HASH).(*HashElement)
+func (d *DB) Hash(key []byte) (*HashElement, error) {
+	d.expireIfNeeded(key)
+	obj, err := d.objFromCache(key, HASH)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*HashElement), nil
+}
+
+func (d *DB) List(key []byte) (*ListElement, error) {
+	d.expireIfNeeded(key)
+	obj, err := d.objFromCache(key, LIST)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*ListElement), nil
 }
 
-func (d *DB) List(key []byte) *ListElement {
-	return d.objFromCache(key, LIST).(*ListElement)
+func (d *DB) SortedSet(key []byte) (*SortedSetElement, error) {
+	d.expireIfNeeded(key)
+	obj, err := d.objFromCache(key, SORTEDSET)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*SortedSetElement), nil
 }
 
-func (d *DB) SortedSet(key []byte) *SortedSetElement {
-	return d.objFromCache(key, SORTEDSET).(*SortedSetElement)
+// Set已经用于string，因此用SetOf
+func (d *DB) SetOf(key []byte) (*SetElement, error) {
+	d.expireIfNeeded(key)
+	obj, err := d.objFromCache(key, SET)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*SetElement), nil
 }
 
-//删除
+//删除key，包括hash/list/zset/bitmap的全部子元素和过期时间
 func (d *DB) Delete(key []byte) error {
-	return nil
+	deleted, err := d.delete(key)
+	if deleted {
+		d.notify(NotifyGeneric, "del", key)
+	}
+	return err
+}
+
+//不发出通知的删除，用于覆盖写入和过期，返回key是否存在
+func (d *DB) delete(key []byte) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 缓存中的元素可能正在被写入，持有它的锁，过期记录和数据在同一个batch中删除
+	skey := string(key)
+	if obj, ok := d.caches.Get(skey); ok {
+		if e, ok := obj.(dropper); ok {
+			e.locker().Lock()
+			defer e.locker().Unlock()
+		}
+	}
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	deleted, err := d.deleteTo(batch, key)
+	if err != nil {
+		return false, err
+	}
+	if batch.Count() > 0 {
+		if err := d.WriteBatch(batch); err != nil {
+			return false, err
+		}
+	}
+	d.caches.Remove(skey)
+	if d.tx != nil {
+		d.tx.keys[skey] = true
+	}
+	return deleted, nil
+}
+
+//把删除key的写入加入batch，和覆盖它的新数据在同一个batch中提交，返回key是否存在
+//key的类型可能改变，写入之后调用者需要uncache
+func (d *DB) deleteTo(batch *gorocksdb.WriteBatch, key []byte) (bool, error) {
+	if err := d.clearExpire(batch, key); err != nil {
+		return false, err
+	}
+	switch t := d.typeOf(key); t {
+	case NONE:
+		return false, nil
+	case STRING:
+		batch.Delete(rawKey(key, STRING))
+	case BITMAP:
+		d.dropBitmap(batch, key)
+	default:
+		newElement(d, key, t).(dropper).dropTo(batch)
+	}
+	d.touch(key)
+	return true, nil
+}
+
+//删除全部数据，用于FLUSHALL和全量同步之前清空，内部的key保留
+//持有排它锁，不能在事务中调用，不发出键空间通知
+func (d *DB) FlushAll() error {
+	d.txMu.Lock()
+	defer d.txMu.Unlock()
+
+	keys := make([][]byte, 0, flushBatchSize)
+	flush := func() error {
+		batch := gorocksdb.NewWriteBatch()
+		defer batch.Destroy()
+		for _, key := range keys {
+			batch.Delete(key)
+		}
+		keys = keys[:0]
+		return d.WriteBatch(batch)
+	}
+	var err error
+	iter := d.newIterator()
+	for iter.Seek(nil); iter.Valid() && err == nil; iter.Next() {
+		// 保留内部的key和用于seek to last的key
+		if key := iter.Key(); !isInternalKey(key) {
+			keys = append(keys, copyBytes(key))
+		}
+		if len(keys) >= flushBatchSize {
+			err = flush()
+		}
+	}
+	iter.Close()
+	if err == nil && len(keys) > 0 {
+		err = flush()
+	}
+
+	d.mu.Lock()
+	d.caches.Clear()
+	d.mu.Unlock()
+	d.touchAll()
+	return err
 }
 
+//FlushAll每个WriteBatch删除的key数量
+const flushBatchSize = 1000
+
 func (d *DB) TypeOf(key []byte) ElementType {
+	if d.expireIfNeeded(key) {
+		return NONE
+	}
+	return d.typeOf(key)
+}
+
+func (d *DB) typeOf(key []byte) ElementType {
 	c := ElementType(NONE)
 	prefix := bytes.Join([][]byte{KEY, key, SEP}, nil)
 	d.PrefixEnumerate(prefix, IterForward, func(i int, key, value []byte, quit *bool) {
-		c = ElementType(key[len(prefix):][0])
+		// +a,s 与 +a,b,s 前缀相同，只认type只有一个字节的key
+		if len(key) != len(prefix)+1 {
+			return
+		}
+		c = ElementType(key[len(prefix)])
 		*quit = true
 	})
 	return c
 }
 
 func (d *DB) Get(key []byte) ([]byte, error) {
-	return d.RawGet(rawKey(key, STRING))
+	if d.expireIfNeeded(key) {
+		return nil, nil
+	}
+	val, err := d.RawGet(rawKey(key, STRING))
+	if err == nil && val == nil {
+		switch d.typeOf(key) {
+		case NONE:
+		case BITMAP:
+			return d.bitmapBytes(key)
+		default:
+			return nil, ErrWrongType
+		}
+	}
+	return val, err
 }
 
+//写入string，同时清除原有的过期时间
 func (d *DB) Set(key, value []byte) error {
-	return d.RawSet(rawKey(key, STRING), value)
+	return d.SetEx(key, value, 0)
+}
+
+//写入string，并在毫秒时间戳deadline过期，0表示不过期，KeepTTL表示保留原来的过期时间
+//和redis一样，key原来是其他类型时直接覆盖
+func (d *DB) SetEx(key, value []byte, deadline int64) error {
+	defer d.lockString(key)()
+	return d.setEx(key, value, deadline)
+}
+
+func (d *DB) setEx(key, value []byte, deadline int64) error {
+	if deadline == KeepTTL {
+		ms, err := d.deadline(key)
+		if err != nil {
+			return err
+		}
+		// 已经过期的key不再保留
+		if ms <= nowMs() {
+			ms = 0
+		}
+		deadline = ms
+	}
+	if t := d.typeOf(key); t != NONE && t != STRING {
+		if _, err := d.delete(key); err != nil {
+			return err
+		}
+	}
+	// 空的hash/list等也可能留在缓存里
+	d.uncache(key)
+	d.touch(key)
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	if err := d.clearExpire(batch, key); err != nil {
+		return err
+	}
+	batch.Put(rawKey(key, STRING), value)
+	if deadline > 0 {
+		batch.Put(expireKey(key), Int64ToBytes(deadline))
+		batch.Put(deadlineKey(deadline, key), nil)
+	}
+	if err := d.WriteBatch(batch); err != nil {
+		return err
+	}
+	d.notify(NotifyString, "set", key)
+	if deadline > 0 {
+		d.notify(NotifyGeneric, "expire", key)
+	}
+	return nil
 }
 
+// 事务中的写入只保存在内存里，Commit时写入
 func (d *DB) WriteBatch(batch *gorocksdb.WriteBatch) error {
+	if d.tx != nil {
+		d.tx.apply(batch)
+		return nil
+	}
 	return d.rdb.Write(d.wo, batch)
 }
 
 func (d *DB) RawGet(key []byte) ([]byte, error) {
+	if d.tx != nil {
+		if val, ok := d.tx.get(key); ok {
+			return val, nil
+		}
+	}
 	return d.rdb.GetBytes(d.ro, key)
 }
 
 //写入数据
 func (d *DB) RawSet(key, value []byte) error {
+	if d.tx != nil {
+		d.tx.put(key, value)
+		return nil
+	}
 	return d.rdb.Put(d.wo, key, value)
 }
 //删除数据
 func (d *DB) RawDelete(key []byte) error {
+	if d.tx != nil {
+		d.tx.delete(key)
+		return nil
+	}
 	return d.rdb.Delete(d.wo, key)
 }
 
 //关闭
 func (d *DB) Close() {
+	close(d.quit)
+	d.wg.Wait()
 	d.wo.Destroy()
 	d.ro.Destroy()
 	d.rdb.Close()
@@ -113,7 +392,7 @@ func (d *DB) Close() {
 func (d *DB) PrefixEnumerate(prefix []byte, direction IterDirection, 
 	fn func(i int, key, value []byte, quit *bool)) {
 	min := prefix
-	max := append(prefix, MAXBYTE)
+	max := prefixEnd(prefix)
 	j := -1
 	d.RangeEnumerate(min, max, direction, func(i int, key, value []byte, quit *bool) {
 		if bytes.HasPrefix(key, prefix) {
@@ -130,66 +409,56 @@ func (d *DB) PrefixEnumerate(prefix []byte, direction IterDirection,
 
 func (d *DB) RangeEnumerate(min, max []byte, 
 	direction IterDirection, fn func(i int, key, value []byte, quit *bool)) {
+	iter := d.newIterator()
+	defer iter.Close()
+	d.enumerate(iter, min, max, direction, fn)
+}
+
+// 事务中返回合并了事务内写入的迭代器
+func (d *DB) newIterator() iterator {
 	opts := gorocksdb.NewDefaultReadOptions()
 	opts.SetFillCache(false)
+	if d.snap != nil {
+		opts.SetSnapshot(d.snap)
+	}
+	// 迭代器创建之后ReadOptions就可以释放
 	defer opts.Destroy()
-	iter := d.rdb.NewIterator(opts)
-	defer iter.Close()
-	d.Enumerate(iter, min, max, direction, fn)
+	var it iterator = &rocksIterator{d.rdb.NewIterator(opts)}
+	if d.tx != nil {
+		it = newTxIterator(it, d.tx.writes)
+	}
+	return it
 }
 
 // 范围扫描
-func (d *DB) Enumerate(iter *gorocksdb.Iterator, min, max []byte, 
+func (d *DB) Enumerate(iter *gorocksdb.Iterator, min, max []byte,
+	direction IterDirection, fn func(i int, key, value []byte, quit *bool)) {
+	d.enumerate(&rocksIterator{iter}, min, max, direction, fn)
+}
+
+func (d *DB) enumerate(iter iterator, min, max []byte,
 	direction IterDirection, fn func(i int, key, value []byte, quit *bool)) {
-	found := false
 	if direction == IterBackward {
 		if len(max) == 0 {
 			iter.SeekToLast()
 		} else {
-			iter.Seek(max)
+			iter.SeekForPrev(max)
 		}
 	} else {
-		if len(min) == 0 {
-			iter.SeekToFirst()
-		} else {
-			iter.Seek(min)
-		}
-
-	}
-	found = iter.Valid()
-	if !found {
-		return
+		iter.Seek(min)
 	}
 
-	i := -1
 	// 范围判断
-	if found && between(iter.Key().Data(), min, max) {
-		i++
+	for i := 0; iter.Valid() && between(iter.Key(), min, max); i++ {
 		quit := false
-		fn(i, iter.Key().Data(), iter.Value().Data(), &quit)
+		fn(i, iter.Key(), iter.Value(), &quit)
 		if quit {
 			return
 		}
-	}
-	for {
-		found = false
 		if direction == IterBackward {
 			iter.Prev()
 		} else {
 			iter.Next()
 		}
-		found = iter.Valid()
-		if found && between(iter.Key().Data(), min, max) {
-			i++
-			quit := false
-			fn(i, iter.Key().Data(), iter.Value().Data(), &quit)
-			if quit {
-				return
-			}
-		} else {
-			break
-		}
 	}
-
-	return
 }
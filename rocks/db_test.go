@@ -82,3 +82,155 @@ func newRocksDB(t *testing.T) *gorocksdb.DB {
 
 	return db
 }
+
+func TestDBDelete(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("name"), []byte("latermoon")))
+	ensure.Nil(t, db.Set([]byte("name,h"), []byte("comma")))
+	h, _ := db.Hash([]byte("info"))
+	ensure.Nil(t, h.Set([]byte("age"), []byte("28")))
+	l, _ := db.List([]byte("list"))
+	l.RPush([]byte("a"), []byte("b"))
+
+	ensure.True(t, db.TypeOf([]byte("name")) == STRING)
+	ensure.True(t, db.TypeOf([]byte("info")) == HASH)
+	ensure.True(t, db.TypeOf([]byte("list")) == LIST)
+
+	for _, key := range []string{"name", "info", "list", "none"} {
+		ensure.Nil(t, db.Delete([]byte(key)))
+		ensure.True(t, db.TypeOf([]byte(key)) == NONE)
+	}
+
+	// deleted hash can be recreated
+	h, _ = db.Hash([]byte("info"))
+	val, err := h.Get([]byte("age"))
+	ensure.Nil(t, err)
+	ensure.True(t, val == nil)
+	ensure.Nil(t, h.Set([]byte("age"), []byte("29")))
+	ensure.True(t, db.TypeOf([]byte("info")) == HASH)
+
+	value, err := db.Get([]byte("name,h"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, value, []byte("comma"))
+}
+
+func TestDBWrongType(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	// 每种类型各建一个key
+	create := map[ElementType]func(key []byte) error{
+		STRING: func(key []byte) error { return db.Set(key, []byte("v")) },
+		HASH: func(key []byte) error {
+			h, err := db.Hash(key)
+			if err != nil {
+				return err
+			}
+			return h.Set([]byte("f"), []byte("v"))
+		},
+		LIST: func(key []byte) error {
+			l, err := db.List(key)
+			if err != nil {
+				return err
+			}
+			_, err = l.RPush([]byte("v"))
+			return err
+		},
+		SORTEDSET: func(key []byte) error {
+			z, err := db.SortedSet(key)
+			if err != nil {
+				return err
+			}
+			_, err = z.Add(0, ScoreMember{1, []byte("v")})
+			return err
+		},
+		SET: func(key []byte) error {
+			s, err := db.SetOf(key)
+			if err != nil {
+				return err
+			}
+			_, err = s.Add([]byte("v"))
+			return err
+		},
+	}
+	open := map[ElementType]func(key []byte) error{
+		STRING: func(key []byte) error { _, err := db.Get(key); return err },
+		HASH:   func(key []byte) error { _, err := db.Hash(key); return err },
+		LIST:   func(key []byte) error { _, err := db.List(key); return err },
+		SORTEDSET: func(key []byte) error {
+			_, err := db.SortedSet(key)
+			return err
+		},
+		SET: func(key []byte) error { _, err := db.SetOf(key); return err },
+	}
+
+	for kt, fn := range create {
+		key := []byte("key:" + kt.String())
+		ensure.Nil(t, fn(key))
+		ensure.True(t, db.TypeOf(key) == kt)
+		for ot, get := range open {
+			err := get(key)
+			if ot == kt {
+				ensure.Nil(t, err)
+			} else {
+				ensure.True(t, err == ErrWrongType, kt, ot)
+			}
+		}
+		// 写入其他类型也失败，且不会产生新的类型
+		for ot, put := range create {
+			if ot != kt && ot != STRING {
+				ensure.True(t, put(key) == ErrWrongType, kt, ot)
+				ensure.True(t, db.TypeOf(key) == kt)
+			}
+		}
+		if kt != SET {
+			err := db.SetCombine(SetUnion, [][]byte{key}, func(member []byte, quit *bool) {})
+			ensure.True(t, err == ErrWrongType)
+		}
+		// SET覆盖任意类型
+		ensure.Nil(t, db.Set(key, []byte("v")))
+		ensure.True(t, db.TypeOf(key) == STRING)
+		if kt != STRING {
+			ensure.True(t, open[kt](key) == ErrWrongType)
+		}
+	}
+}
+
+func TestDBFlushAll(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("name"), []byte("latermoon")))
+	ensure.Nil(t, db.SetEx([]byte("tmp"), []byte("v"), nowMs()+60000))
+	h, _ := db.Hash([]byte("info"))
+	ensure.Nil(t, h.Set([]byte("age"), []byte("27")))
+	l, _ := db.List([]byte("list"))
+	_, err := l.RPush([]byte("a"), []byte("b"))
+	ensure.Nil(t, err)
+	version := db.Watch([]byte("other"))
+	defer db.Unwatch([]byte("other"))
+
+	ensure.Nil(t, db.FlushAll())
+	for _, key := range []string{"name", "tmp", "info", "list"} {
+		ensure.True(t, db.TypeOf([]byte(key)) == NONE, key)
+	}
+	ensure.True(t, db.Version([]byte("other")) != version)
+	// 缓存的对象也已经清除
+	l, _ = db.List([]byte("list"))
+	ensure.True(t, l.Len() == 0)
+	n := 0
+	db.RangeEnumerate([]byte{0}, []byte{MAXBYTE}, IterForward, func(i int, key, value []byte, quit *bool) {
+		if !isInternalKey(key) {
+			n++
+		}
+	})
+	ensure.DeepEqual(t, n, 0)
+	// 内部的key保留
+	id, _ := db.Meta("id")
+	ensure.DeepEqual(t, string(id), db.ID())
+	ensure.Nil(t, db.Set([]byte("name"), []byte("v2")))
+	val, _ := db.Get([]byte("name"))
+	ensure.DeepEqual(t, val, []byte("v2"))
+}
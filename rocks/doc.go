@@ -37,10 +37,27 @@ list
 	l[list]3 = "d"
 zset
 	+user_rank,z = "3"
-	z[user_rank]m#100422 = "-2"
-	z[user_rank]m#100423 = "1"
-	z[user_rank]m#300000 = "2"
-	z[user_rank]s#-2#100422 = ""
-	z[user_rank]s#1#100423 = ""
-	z[user_rank]s#2#300000 = ""
+	z[user_rank]m100422 = <-2>
+	z[user_rank]m100423 = <1>
+	z[user_rank]m300000 = <2>
+	z[user_rank]s<-2>100422 = ""
+	z[user_rank]s<1>100423 = ""
+	z[user_rank]s<2>300000 = ""
+	<score>是8字节的Float64ToBytes编码，字节序即分数大小顺序
+set
+	+tags,S = "3"
+	s[tags]a = ""
+	s[tags]b = ""
+	s[tags]c = ""
+	string已经占用了s作为类型，所以set的类型为S，成员依然以s开头
+bitmap
+	+dau,b = "8193"
+	b[dau]<0> = 4096 bytes
+	b[dau]<2> = 4096 bytes
+	SETBIT/BITFIELD写过的string按4096字节分块，<n>是4字节大端的块序号，
+	全0的块不保存，+dau,b 记录字节长度，TYPE依然是string
+expire
+	e[name] = 1414565550000
+	x<1414565550000>name = ""
+	e记录key的过期时间（毫秒），x按过期时间排序，用于后台批量清理
 */
@@ -0,0 +1,183 @@
+package rocks
+
+import (
+	"bytes"
+	"github.com/tecbot/gorocksdb"
+	"time"
+)
+
+// expire
+// 	e[key] = deadline
+// 	x<deadline>key = ""
+// deadline为毫秒时间戳，读取时惰性删除，后台reaper按x的顺序批量删除
+
+const (
+	reapInterval = 100 * time.Millisecond
+	reapBatch    = 100
+)
+
+// 当前毫秒时间戳
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// ExpireAt 设置key在毫秒时间戳ms过期，key不存在返回false
+// ms早于当前时间则直接删除key
+func (d *DB) ExpireAt(key []byte, ms int64) (bool, error) {
+	if d.TypeOf(key) == NONE {
+		return false, nil
+	}
+	if ms <= nowMs() {
+		return true, d.Delete(key)
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	if err := d.clearExpire(batch, key); err != nil {
+		return false, err
+	}
+	batch.Put(expireKey(key), Int64ToBytes(ms))
+	batch.Put(deadlineKey(ms, key), nil)
+	d.touch(key)
+	if err := d.WriteBatch(batch); err != nil {
+		return false, err
+	}
+	d.notify(NotifyGeneric, "expire", key)
+	return true, nil
+}
+
+// TTL 返回剩余的毫秒数，key不存在返回-2，没有过期时间返回-1
+func (d *DB) TTL(key []byte) (int64, error) {
+	if d.TypeOf(key) == NONE {
+		return -2, nil
+	}
+	ms, err := d.deadline(key)
+	if err != nil {
+		return 0, err
+	}
+	if ms == 0 {
+		return -1, nil
+	}
+	ttl := ms - nowMs()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+// Persist 移除过期时间，没有过期时间返回false
+func (d *DB) Persist(key []byte) (bool, error) {
+	if d.TypeOf(key) == NONE {
+		return false, nil
+	}
+	ms, err := d.deadline(key)
+	if err != nil || ms == 0 {
+		return false, err
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.Delete(expireKey(key))
+	batch.Delete(deadlineKey(ms, key))
+	d.touch(key)
+	if err := d.WriteBatch(batch); err != nil {
+		return false, err
+	}
+	d.notify(NotifyGeneric, "persist", key)
+	return true, nil
+}
+
+// 读取过期时间，0表示不过期
+func (d *DB) deadline(key []byte) (int64, error) {
+	val, err := d.RawGet(expireKey(key))
+	if err != nil || len(val) != 8 {
+		return 0, err
+	}
+	return BytesToInt64(val), nil
+}
+
+// 把删除过期时间的操作加入batch
+func (d *DB) clearExpire(batch *gorocksdb.WriteBatch, key []byte) error {
+	ms, err := d.deadline(key)
+	if err != nil || ms == 0 {
+		return err
+	}
+	batch.Delete(expireKey(key))
+	batch.Delete(deadlineKey(ms, key))
+	return nil
+}
+
+// 惰性删除，key已过期则删除并返回true
+func (d *DB) expireIfNeeded(key []byte) bool {
+	ms, err := d.deadline(key)
+	if err != nil || ms == 0 || ms > nowMs() {
+		return false
+	}
+	deleted, err := d.delete(key)
+	if deleted {
+		d.notify(NotifyExpired, "expired", key)
+	}
+	return err == nil
+}
+
+// 后台定时清理过期的key
+func (d *DB) reaper() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			// 一批删满说明还有积压，继续清理
+			for d.reapExpired(reapBatch) == reapBatch {
+				select {
+				case <-d.quit:
+					return
+				default:
+				}
+			}
+		}
+	}
+}
+
+// 按deadline顺序最多删除limit个已过期的key，返回处理的数量
+func (d *DB) reapExpired(limit int) int {
+	// 不和事务交错执行
+	d.RLock()
+	defer d.RUnlock()
+	now := nowMs()
+	dkeys := make([][]byte, 0, limit)
+	d.PrefixEnumerate(DEADLINE, IterForward, func(i int, key, value []byte, quit *bool) {
+		if BytesToInt64(key[len(DEADLINE):len(DEADLINE)+8]) > now {
+			*quit = true
+			return
+		}
+		dkeys = append(dkeys, copyBytes(key))
+		if len(dkeys) >= limit {
+			*quit = true
+		}
+	})
+
+	for _, dkey := range dkeys {
+		key := dkey[len(DEADLINE)+8:]
+		if !d.expireIfNeeded(key) {
+			// e[key]已经被修改，x是残留的索引
+			if ms, err := d.deadline(key); err == nil && !bytes.Equal(Int64ToBytes(ms), dkey[len(DEADLINE):len(DEADLINE)+8]) {
+				d.RawDelete(dkey)
+			}
+		}
+	}
+	return len(dkeys)
+}
+
+// e[key]
+func expireKey(key []byte) []byte {
+	return bytes.Join([][]byte{EXPIRE, SOK, key, EOK}, nil)
+}
+
+// x<deadline>key
+func deadlineKey(ms int64, key []byte) []byte {
+	return bytes.Join([][]byte{DEADLINE, Int64ToBytes(ms), key}, nil)
+}
@@ -0,0 +1,81 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	name := []byte("name")
+	ok, err := db.ExpireAt(name, nowMs()+1000)
+	ensure.Nil(t, err)
+	ensure.False(t, ok)
+
+	ensure.Nil(t, db.Set(name, []byte("latermoon")))
+	ttl, err := db.TTL(name)
+	ensure.Nil(t, err)
+	ensure.True(t, ttl == -1)
+
+	ok, err = db.ExpireAt(name, nowMs()+1000)
+	ensure.Nil(t, err)
+	ensure.True(t, ok)
+	ttl, err = db.TTL(name)
+	ensure.Nil(t, err)
+	ensure.True(t, ttl > 0 && ttl <= 1000)
+
+	ok, err = db.Persist(name)
+	ensure.Nil(t, err)
+	ensure.True(t, ok)
+	ttl, _ = db.TTL(name)
+	ensure.True(t, ttl == -1)
+
+	// set clears ttl
+	db.ExpireAt(name, nowMs()+1000)
+	db.Set(name, []byte("latermoon"))
+	ttl, _ = db.TTL(name)
+	ensure.True(t, ttl == -1)
+
+	// lazy expire on read
+	ensure.Nil(t, db.SetEx(name, []byte("latermoon"), nowMs()+10))
+	time.Sleep(20 * time.Millisecond)
+	val, err := db.Get(name)
+	ensure.Nil(t, err)
+	ensure.True(t, val == nil)
+	ttl, _ = db.TTL(name)
+	ensure.True(t, ttl == -2)
+
+	h, _ := db.Hash([]byte("info"))
+	h.Set([]byte("age"), []byte("28"))
+	db.ExpireAt([]byte("info"), nowMs()+10)
+	time.Sleep(20 * time.Millisecond)
+	h, _ = db.Hash([]byte("info"))
+	val, err = h.Get([]byte("age"))
+	ensure.Nil(t, err)
+	ensure.True(t, val == nil)
+}
+
+func TestExpireReaper(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	deadline := nowMs() + 10
+	for _, key := range []string{"a", "b", "c"} {
+		db.SetEx([]byte(key), []byte(key), deadline)
+	}
+	l, _ := db.List([]byte("list"))
+	l.RPush([]byte("x"))
+	db.ExpireAt([]byte("list"), deadline)
+
+	time.Sleep(300 * time.Millisecond)
+	n := 0
+	for _, prefix := range [][]byte{KEY, EXPIRE, DEADLINE, []byte{LIST}} {
+		db.PrefixEnumerate(prefix, IterForward, func(i int, key, value []byte, quit *bool) {
+			n++
+		})
+	}
+	ensure.True(t, n == 0)
+}
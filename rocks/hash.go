@@ -4,20 +4,30 @@ import (
 	"bytes"
 	"errors"
 	"github.com/tecbot/gorocksdb"
+	"math"
+	"strconv"
 	"sync"
 )
 
 // hash
-// 	+key,h = ""
+// 	+key,h = "3"
 // 	h[key]name = "latermoon"
 // 	h[key]age = "27"
 // 	h[key]sex = "M"
+// +key,h saves the field count, it's "" for hashes written by
+// older versions and HLEN falls back to a prefix scan
 type HashElement struct {
 	db  *DB
 	key []byte
 	mu  sync.RWMutex
 }
 
+var (
+	ErrHashNotInteger = errors.New("hash value is not an integer")
+	ErrHashNotFloat   = errors.New("hash value is not a float")
+	ErrOverflow       = errors.New("increment or decrement would overflow")
+)
+
 func NewHashElement(db *DB, key []byte) *HashElement {
 	h := &HashElement{db: db, key: key}
 	return h
@@ -32,7 +42,37 @@ func (h *HashElement) Enumerate(fn func(i int, field, value []byte, quit *bool))
 }
 
 func (h *HashElement) Set(field, value []byte) error {
-	return h.multiSet(field, value)
+	_, err := h.multiSet(field, value)
+	return err
+}
+
+// HSET/HMSET, returns the number of fields added
+func (h *HashElement) MSet(fieldVals ...[]byte) (int, error) {
+	return h.multiSet(fieldVals...)
+}
+
+// returns false if field already exists
+func (h *HashElement) SetNX(field, value []byte) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old, err := h.get(field)
+	if err != nil || old != nil {
+		return false, err
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.Put(h.fieldKey(field), value)
+	if _, err := h.putCount(batch, 1); err != nil {
+		return false, err
+	}
+	h.db.touch(h.key)
+	if err := h.db.WriteBatch(batch); err != nil {
+		return false, err
+	}
+	h.db.notify(NotifyHash, "hset", h.key)
+	return true, nil
 }
 
 func (h *HashElement) Get(field []byte) ([]byte, error) {
@@ -57,23 +97,114 @@ func (h *HashElement) MGet(fields ...[]byte) ([][]byte, error) {
 	return vals, nil
 }
 
-func (h *HashElement) multiSet(fieldVals ...[]byte) error {
+// HINCRBY
+func (h *HashElement) IncrBy(field []byte, delta int64) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old, err := h.get(field)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if old != nil {
+		if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return 0, ErrHashNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	return n, h.put(field, []byte(strconv.FormatInt(n, 10)), old == nil, "hincrby")
+}
+
+// HINCRBYFLOAT
+func (h *HashElement) IncrByFloat(field []byte, delta float64) (float64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old, err := h.get(field)
+	if err != nil {
+		return 0, err
+	}
+	var f float64
+	if old != nil {
+		if f, err = strconv.ParseFloat(string(old), 64); err != nil || math.IsNaN(f) {
+			return 0, ErrHashNotFloat
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrIncrNaN
+	}
+	return f, h.put(field, []byte(strconv.FormatFloat(f, 'f', -1, 64)), old == nil, "hincrbyfloat")
+}
+
+// HLEN
+func (h *HashElement) Len() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, _ := h.count()
+	return n
+}
+
+func (h *HashElement) multiSet(fieldVals ...[]byte) (int, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if len(fieldVals) == 0 || len(fieldVals)%2 != 0 {
-		return errors.New("invalid field value pairs")
+		return 0, errors.New("invalid field value pairs")
 	}
 
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
+	added := 0
+	seen := make(map[string]bool)
 	for i := 0; i < len(fieldVals); i += 2 {
 		field, value := fieldVals[i], fieldVals[i+1]
+		if !seen[string(field)] {
+			seen[string(field)] = true
+			old, err := h.get(field)
+			if err != nil {
+				return 0, err
+			}
+			if old == nil {
+				added++
+			}
+		}
 		batch.Put(h.fieldKey(field), value)
 	}
-	batch.Put(h.rawKey(), nil)
+	if _, err := h.putCount(batch, added); err != nil {
+		return 0, err
+	}
 
-	return h.db.WriteBatch(batch)
+	h.db.touch(h.key)
+	if err := h.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	h.db.notify(NotifyHash, "hset", h.key)
+	return added, nil
+}
+
+// write a single field, caller holds h.mu
+func (h *HashElement) put(field, value []byte, isNew bool, event string) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.Put(h.fieldKey(field), value)
+	delta := 0
+	if isNew {
+		delta = 1
+	}
+	if _, err := h.putCount(batch, delta); err != nil {
+		return err
+	}
+	h.db.touch(h.key)
+	if err := h.db.WriteBatch(batch); err != nil {
+		return err
+	}
+	h.db.notify(NotifyHash, event, h.key)
+	return nil
 }
 
 func (h *HashElement) get(field []byte) ([]byte, error) {
@@ -88,51 +219,89 @@ func (h *HashElement) Exist(field []byte) (bool, error) {
 	return val != nil, nil
 }
 
-func (h *HashElement) Remove(fields ...[]byte) error {
+// HDEL, returns the number of fields removed
+func (h *HashElement) Remove(fields ...[]byte) (int, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
 
-	dict := make(map[string]bool)
+	removed := make(map[string]bool)
 	for _, field := range fields {
-		dict[string(field)] = true
+		if removed[string(field)] {
+			continue
+		}
+		val, err := h.get(field)
+		if err != nil {
+			return 0, err
+		}
+		if val == nil {
+			continue
+		}
+		removed[string(field)] = true
 		batch.Delete(h.fieldKey(field))
 	}
-
-	deleteAll := true
-	h.db.PrefixEnumerate(h.fieldPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
-		field := h.fieldInKey(key)
-		if _, ok := dict[string(field)]; !ok { // wouldn't delete raw key
-			deleteAll = false
-			*quit = true
-		}
-	})
-	if deleteAll {
-		batch.Delete(h.rawKey())
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	left, err := h.putCount(batch, -len(removed))
+	if err != nil {
+		return 0, err
 	}
 
-	return h.db.WriteBatch(batch)
+	h.db.touch(h.key)
+	if err := h.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	h.db.notify(NotifyHash, "hdel", h.key)
+	if left == 0 {
+		h.db.notify(NotifyGeneric, "del", h.key)
+	}
+	return len(removed), nil
 }
 
-func (h *HashElement) drop() error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	batch := gorocksdb.NewWriteBatch()
-	defer batch.Destroy()
+func (h *HashElement) locker() sync.Locker {
+	return &h.mu
+}
 
+func (h *HashElement) dropTo(batch *gorocksdb.WriteBatch) {
 	h.db.PrefixEnumerate(h.fieldPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
 		batch.Delete(copyBytes(key))
 	})
 	batch.Delete(h.rawKey())
+}
 
-	err := h.db.WriteBatch(batch)
-	if err == nil {
-		h.db = nil // make sure not invoked by others
+// field count in +key,h, or a prefix scan if the counter is missing
+func (h *HashElement) count() (int64, error) {
+	val, err := h.db.RawGet(h.rawKey())
+	if err != nil || val == nil {
+		return 0, err
 	}
-	return err
+	if len(val) == 0 {
+		n := int64(0)
+		h.db.PrefixEnumerate(h.fieldPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
+			n++
+		})
+		return n, nil
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+// update field count by delta, remove raw key when empty
+func (h *HashElement) putCount(batch *gorocksdb.WriteBatch, delta int) (int64, error) {
+	n, err := h.count()
+	if err != nil {
+		return 0, err
+	}
+	n += int64(delta)
+	if n > 0 {
+		batch.Put(h.rawKey(), []byte(strconv.FormatInt(n, 10)))
+	} else {
+		n = 0
+		batch.Delete(h.rawKey())
+	}
+	return n, nil
 }
 
 // +key,h
@@ -152,6 +321,5 @@ func (h *HashElement) fieldPrefix() []byte {
 
 // split h[key]field into field
 func (h *HashElement) fieldInKey(fieldKey []byte) []byte {
-	right := bytes.Index(fieldKey, EOK)
-	return fieldKey[right+1:]
+	return fieldKey[len(h.fieldPrefix()):]
 }
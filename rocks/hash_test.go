@@ -9,7 +9,7 @@ func TestHash(t *testing.T) {
 	db := New(newRocksDB(t))
 	defer db.Close()
 
-	h := db.Hash([]byte("user"))
+	h, _ := db.Hash([]byte("user"))
 	ensure.Nil(t, h.Set([]byte("name"), []byte("latermoon")))
 	ensure.Nil(t, h.Set([]byte("age"), []byte("28")))
 	ensure.Nil(t, h.Set([]byte("sex"), []byte("Male")))
@@ -31,8 +31,9 @@ func TestHash(t *testing.T) {
 	ensure.Nil(t, err)
 	ensure.True(t, exist)
 
-	err = h.Remove([]byte("name"))
+	n, err := h.Remove([]byte("name"))
 	ensure.Nil(t, err)
+	ensure.True(t, n == 1)
 
 	exist, err = h.Exist([]byte("name"))
 	ensure.Nil(t, err)
@@ -43,10 +44,57 @@ func TestHash(t *testing.T) {
 	ensure.True(t, len(vals) == 2)
 	ensure.DeepEqual(t, vals[0], []byte("28"), vals[1], []byte("Male"))
 
-	h.drop()
+	ensure.Nil(t, db.Delete([]byte("user")))
 
 	db.RangeEnumerate([]byte{0}, []byte{'z'}, IterForward, func(i int, key, value []byte, quit *bool) {
 		t.Log(i, string(key), string(value))
 		t.Fail()
 	})
 }
+
+func TestHashCount(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	h, _ := db.Hash([]byte("user"))
+	n, err := h.MSet([]byte("name"), []byte("latermoon"), []byte("age"), []byte("28"), []byte("name"), []byte("x"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 2)
+	ensure.True(t, h.Len() == 2)
+
+	ok, err := h.SetNX([]byte("age"), []byte("1"))
+	ensure.Nil(t, err)
+	ensure.False(t, ok)
+	ok, _ = h.SetNX([]byte("sex"), []byte("M"))
+	ensure.True(t, ok)
+	ensure.True(t, h.Len() == 3)
+
+	i, err := h.IncrBy([]byte("age"), 2)
+	ensure.Nil(t, err)
+	ensure.True(t, i == 30)
+	i, _ = h.IncrBy([]byte("visits"), -1)
+	ensure.True(t, i == -1)
+	ensure.True(t, h.Len() == 4)
+	_, err = h.IncrBy([]byte("name"), 1)
+	ensure.True(t, err == ErrHashNotInteger)
+	h.Set([]byte("big"), []byte("9223372036854775807"))
+	_, err = h.IncrBy([]byte("big"), 1)
+	ensure.True(t, err == ErrOverflow)
+
+	f, err := h.IncrByFloat([]byte("age"), 0.5)
+	ensure.Nil(t, err)
+	ensure.True(t, f == 30.5)
+
+	n, err = h.Remove([]byte("age"), []byte("age"), []byte("none"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 1)
+	ensure.True(t, h.Len() == 4)
+
+	// counter missing, written by older versions
+	db.RawSet(h.rawKey(), []byte{})
+	ensure.True(t, h.Len() == 4)
+
+	h.Remove([]byte("name"), []byte("sex"), []byte("visits"), []byte("big"))
+	ensure.True(t, h.Len() == 0)
+	ensure.True(t, db.TypeOf([]byte("user")) == NONE)
+}
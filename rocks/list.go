@@ -23,79 +23,128 @@ func NewListElement(db *DB, key []byte) *ListElement {
 	return &ListElement{db: db, key: key}
 }
 
+var ErrIndexOutOfRange = errors.New("index out of range")
+
+// start/stop和redis一样，负数表示从右边开始计算
 func (l *ListElement) Range(start, stop int, fn func(i int, value []byte, quit *bool)) error {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	if start < 0 || (stop != -1 && start > stop) {
-		return errors.New("bad start/stop index")
+	x, y := l.leftIndex(), l.rightIndex()
+	size := int(y - x + 1)
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop {
+		return nil
 	}
 
 	//调用range函数
-	min := l.indexKey(l.leftIndex() + int64(start))
-	max := []byte{MAXBYTE} // use rightIndex is better
-	prefix := l.keyPrefix()
+	min := l.indexKey(x + int64(start))
+	max := l.indexKey(x + int64(stop))
 	l.db.RangeEnumerate(min, max, IterForward, func(i int, key, value []byte, quit *bool) {
-		if !bytes.HasPrefix(key, prefix) {
-			*quit = true
-			return
-		}
 		fn(start+i, value, quit)
-		if stop != -1 && (i >= (stop - start)) {
-			*quit = true
-		}
 	})
 
 	return nil
 }
 
-//获取数据
+//获取数据，负数表示从右边开始
 func (l *ListElement) Index(i int64) ([]byte, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	x := l.leftIndex()
-	idxkey := l.indexKey(x + i)
+	idxkey, ok := l.indexKeyOf(i)
+	if !ok {
+		return nil, nil
+	}
 	return l.db.RawGet(idxkey)
 }
 
-//批量push数据
-func (l *ListElement) RPush(vals ...[]byte) error {
+// LSET
+func (l *ListElement) Set(i int64, value []byte) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	batch := gorocksdb.NewWriteBatch()
-	defer batch.Destroy()
+	idxkey, ok := l.indexKeyOf(i)
+	if !ok {
+		return ErrIndexOutOfRange
+	}
+	l.db.touch(l.key)
+	if err := l.db.RawSet(idxkey, value); err != nil {
+		return err
+	}
+	l.db.notify(NotifyList, "lset", l.key)
+	return nil
+}
 
+// 根据redis的index找到rocksdb的key，越界返回false
+func (l *ListElement) indexKeyOf(i int64) ([]byte, bool) {
 	x, y := l.leftIndex(), l.rightIndex()
-	if x == 0 && y == -1 {
-		// empty
-		batch.Put(l.rawKey(), nil)
+	if i < 0 {
+		i += y - x + 1
 	}
-	//放入index和值
-	for i, val := range vals {
-		batch.Put(l.indexKey(y+int64(i)+1), val)
+	if i < 0 || x+i > y {
+		return nil, false
+	}
+	return l.indexKey(x + i), true
+}
+
+//批量push数据，返回push后的长度
+func (l *ListElement) RPush(vals ...[]byte) (int64, error) {
+	n, err := l.push(false, vals)
+	if err == nil {
+		l.db.notify(NotifyList, "rpush", l.key)
 	}
-	return l.db.WriteBatch(batch)
+	return n, err
 }
+
 //左边push
-func (l *ListElement) LPush(vals ...[]byte) error {
+func (l *ListElement) LPush(vals ...[]byte) (int64, error) {
+	n, err := l.push(true, vals)
+	if err == nil {
+		l.db.notify(NotifyList, "lpush", l.key)
+	}
+	return n, err
+}
+
+// true for LPush(), false for RPush()
+func (l *ListElement) push(left bool, vals [][]byte) (int64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
+	n := l.pushTo(batch, left, vals)
+	l.db.touch(l.key)
+	return n, l.db.WriteBatch(batch)
+}
 
+//push加入batch，返回push后的长度
+func (l *ListElement) pushTo(batch *gorocksdb.WriteBatch, left bool, vals [][]byte) int64 {
 	x, y := l.leftIndex(), l.rightIndex()
 	if x == 0 && y == -1 {
 		// empty
 		batch.Put(l.rawKey(), nil)
 	}
-
+	//放入index和值
 	for i, val := range vals {
-		batch.Put(l.indexKey(x-int64(i)-1), val)
+		if left {
+			batch.Put(l.indexKey(x-int64(i)-1), val)
+		} else {
+			batch.Put(l.indexKey(y+int64(i)+1), val)
+		}
 	}
-	return l.db.WriteBatch(batch)
+	return y - x + 1 + int64(len(vals))
 }
 
 func (l *ListElement) RPop() ([]byte, error) {
@@ -111,10 +160,28 @@ func (l *ListElement) pop(left bool) ([]byte, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	val, n, err := l.popTo(batch, left)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	l.db.touch(l.key)
+	if err := l.db.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+	l.notifyPop(left, n == 0)
+	return val, nil
+}
+
+//pop加入batch，返回取出的值和剩下的长度，list为空时返回nil
+func (l *ListElement) popTo(batch *gorocksdb.WriteBatch, left bool) ([]byte, int64, error) {
 	x, y := l.leftIndex(), l.rightIndex()
 	size := y - x + 1
 	if size == 0 {
-		return nil, nil
+		return nil, 0, nil
+	} else if size < 0 {
+		return nil, 0, errors.New("size less than 0")
 	}
 
 	var idxkey []byte
@@ -123,45 +190,91 @@ func (l *ListElement) pop(left bool) ([]byte, error) {
 	} else {
 		idxkey = l.indexKey(y)
 	}
-
 	val, err := l.db.RawGet(idxkey)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	//返回和删除
-	if size > 1 {
-		return val, l.db.RawDelete(idxkey)
-	} else if size == 1 {
-		//删除和返回数据
-		batch := gorocksdb.NewWriteBatch()
-		defer batch.Destroy()
+	batch.Delete(idxkey)
+	//最后一个元素，连同key一起删除
+	if size == 1 {
 		batch.Delete(l.rawKey())
-		batch.Delete(idxkey)
-		return val, l.db.WriteBatch(batch)
-	} else {
-		return nil, errors.New("size less than 0")
 	}
+	return val, size - 1, nil
 }
 
-//删除数据
-func (l *ListElement) drop() error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func (l *ListElement) notifyPop(left, emptied bool) {
+	event := "rpop"
+	if left {
+		event = "lpop"
+	}
+	l.db.notify(NotifyList, event, l.key)
+	if emptied {
+		l.db.notify(NotifyGeneric, "del", l.key)
+	}
+}
+
+// LMOVE/RPOPLPUSH，从src取出一个元素放入dst，删除和写入在同一个batch中
+// src为空时返回nil，dst不是list时不会取出元素
+func (d *DB) ListMove(src, dst []byte, srcLeft, dstLeft bool) ([]byte, error) {
+	from, err := d.List(src)
+	if err != nil {
+		return nil, err
+	}
+	to := from
+	same := bytes.Equal(src, dst)
+	if !same {
+		if to, err = d.List(dst); err != nil {
+			return nil, err
+		}
+		// 按key的顺序加锁，两个方向相反的move不会死锁
+		first, second := from, to
+		if bytes.Compare(src, dst) > 0 {
+			first, second = to, from
+		}
+		first.mu.Lock()
+		defer first.mu.Unlock()
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	} else {
+		from.mu.Lock()
+		defer from.mu.Unlock()
+	}
 
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
+	val, n, err := from.popTo(batch, srcLeft)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	// 只有一个元素的list转回自身，popTo删除的key要写回
+	if same && n == 0 {
+		batch.Put(to.rawKey(), nil)
+	}
+	to.pushTo(batch, dstLeft, [][]byte{val})
+	d.touch(src)
+	d.touch(dst)
+	if err := d.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+	from.notifyPop(srcLeft, n == 0 && !same)
+	event := "rpush"
+	if dstLeft {
+		event = "lpush"
+	}
+	d.notify(NotifyList, event, dst)
+	return val, nil
+}
+
+func (l *ListElement) locker() sync.Locker {
+	return &l.mu
+}
 
+//删除数据
+func (l *ListElement) dropTo(batch *gorocksdb.WriteBatch) {
 	l.db.PrefixEnumerate(l.keyPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
 		batch.Delete(copyBytes(key))
 	})
 	batch.Delete(l.rawKey())
-
-	err := l.db.WriteBatch(batch)
-	if err == nil {
-		l.db = nil
-	}
-	return err
 }
 //长度
 func (l *ListElement) Len() int64 {
@@ -9,7 +9,7 @@ func TestList(t *testing.T) {
 	db := New(newRocksDB(t))
 	defer db.Close()
 
-	l := db.List([]byte("list"))
+	l, _ := db.List([]byte("list"))
 	ensure.True(t, l.Len() == 0)
 
 	l.RPush([]byte("a"), []byte("b"))
@@ -53,6 +53,104 @@ func TestList(t *testing.T) {
 	ensure.True(t, val == nil)
 
 	l.RPush([]byte("1"), []byte("2"), []byte("3"), []byte("4"))
-	l.drop()
+	ensure.Nil(t, db.Delete([]byte("list")))
 	ScanAll(t, db)
 }
+
+func TestListIndex(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	l, _ := db.List([]byte("list"))
+	n, err := l.RPush([]byte("a"), []byte("b"), []byte("c"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 3)
+	n, _ = l.LPush([]byte("z"))
+	ensure.True(t, n == 4)
+
+	var vals []string
+	l.Range(-3, -2, func(i int, value []byte, quit *bool) {
+		vals = append(vals, string(value))
+	})
+	ensure.DeepEqual(t, vals, []string{"a", "b"})
+
+	vals = nil
+	l.Range(2, 100, func(i int, value []byte, quit *bool) {
+		vals = append(vals, string(value))
+	})
+	ensure.DeepEqual(t, vals, []string{"b", "c"})
+
+	val, err := l.Index(-1)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("c"))
+	val, _ = l.Index(-5)
+	ensure.True(t, val == nil)
+
+	ensure.Nil(t, l.Set(-1, []byte("C")))
+	ensure.Nil(t, l.Set(0, []byte("Z")))
+	ensure.True(t, l.Set(4, []byte("x")) == ErrIndexOutOfRange)
+	val, _ = l.Index(3)
+	ensure.DeepEqual(t, val, []byte("C"))
+	val, _ = l.Index(0)
+	ensure.DeepEqual(t, val, []byte("Z"))
+}
+
+func TestListPushHook(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	var pushed []string
+	db.OnListPush(func(key []byte) {
+		// hook runs after the write, so the list can be read again
+		l, _ := db.List(key)
+		ensure.True(t, l.Len() > 0)
+		pushed = append(pushed, string(key))
+	})
+	a, _ := db.List([]byte("a"))
+	a.RPush([]byte("1"))
+	b, _ := db.List([]byte("b"))
+	b.LPush([]byte("1"), []byte("2"))
+	ensure.DeepEqual(t, pushed, []string{"a", "b"})
+}
+
+func TestListMove(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	values := func(key string) []string {
+		var vals []string
+		l, _ := db.List([]byte(key))
+		l.Range(0, -1, func(i int, value []byte, quit *bool) {
+			vals = append(vals, string(value))
+		})
+		return vals
+	}
+	src, _ := db.List([]byte("src"))
+	src.RPush([]byte("a"), []byte("b"))
+
+	val, err := db.ListMove([]byte("src"), []byte("dst"), false, true)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("b"))
+	val, _ = db.ListMove([]byte("src"), []byte("dst"), true, true)
+	ensure.DeepEqual(t, val, []byte("a"))
+	ensure.DeepEqual(t, values("dst"), []string{"a", "b"})
+	ensure.True(t, db.TypeOf([]byte("src")) == NONE)
+	val, err = db.ListMove([]byte("src"), []byte("dst"), false, true)
+	ensure.Nil(t, err)
+	ensure.True(t, val == nil)
+
+	// a wrong-typed dst leaves src untouched
+	db.Set([]byte("str"), []byte("v"))
+	_, err = db.ListMove([]byte("dst"), []byte("str"), false, true)
+	ensure.True(t, err == ErrWrongType)
+	ensure.DeepEqual(t, values("dst"), []string{"a", "b"})
+
+	// rotate onto itself, a single element list must survive
+	db.ListMove([]byte("dst"), []byte("dst"), false, true)
+	ensure.DeepEqual(t, values("dst"), []string{"b", "a"})
+	one, _ := db.List([]byte("one"))
+	one.RPush([]byte("x"))
+	db.ListMove([]byte("one"), []byte("one"), true, false)
+	ensure.DeepEqual(t, values("one"), []string{"x"})
+	ensure.True(t, db.TypeOf([]byte("one")) == LIST)
+}
@@ -0,0 +1,43 @@
+package rocks
+
+// 键空间通知
+// 写入成功之后调用OnNotify注册的函数，class和event与redis的notify-keyspace-events一致，
+// 比如 ('$', "set")、('l', "lpush")、('x', "expired")。事务中的通知在Commit之后发出
+
+type NotifyClass byte
+
+const (
+	NotifyGeneric   NotifyClass = 'g'
+	NotifyString    NotifyClass = '$'
+	NotifyList      NotifyClass = 'l'
+	NotifySet       NotifyClass = 's'
+	NotifyHash      NotifyClass = 'h'
+	NotifySortedSet NotifyClass = 'z'
+	NotifyExpired   NotifyClass = 'x'
+)
+
+type NotifyFunc func(class NotifyClass, event string, key []byte)
+
+// 注册通知函数，在写入的goroutine中同步调用
+func (d *DB) OnNotify(fn NotifyFunc) {
+	d.notifyFn = fn
+}
+
+// 注册list push的回调，在数据写入之后调用，用于唤醒阻塞的客户端
+func (d *DB) OnListPush(fn func(key []byte)) {
+	d.pushFn = fn
+}
+
+func (d *DB) notify(class NotifyClass, event string, key []byte) {
+	if d.tx != nil {
+		parent := d.tx.parent
+		d.afterCommit(func() { parent.notify(class, event, key) })
+		return
+	}
+	if d.notifyFn != nil {
+		d.notifyFn(class, event, key)
+	}
+	if class == NotifyList && (event == "lpush" || event == "rpush") && d.pushFn != nil {
+		d.pushFn(key)
+	}
+}
@@ -0,0 +1,89 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	// 过期也可能由reaper发出
+	var mu sync.Mutex
+	events := make([]string, 0)
+	db.OnNotify(func(class NotifyClass, event string, key []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, string(class)+event+" "+string(key))
+	})
+	expect := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		ensure.DeepEqual(t, events, append([]string{}, want...))
+		events = events[:0]
+	}
+
+	ensure.Nil(t, db.Set([]byte("s"), []byte("1")))
+	expect("$set s")
+	_, err := db.IncrBy([]byte("s"), 1)
+	ensure.Nil(t, err)
+	expect("$incrby s")
+	ensure.Nil(t, db.SetEx([]byte("s"), []byte("1"), nowMs()+10000))
+	expect("$set s", "gexpire s")
+	_, err = db.Persist([]byte("s"))
+	ensure.Nil(t, err)
+	expect("gpersist s")
+	ensure.Nil(t, db.Delete([]byte("s")))
+	expect("gdel s")
+	ensure.Nil(t, db.Delete([]byte("s")))
+	expect()
+
+	h, _ := db.Hash([]byte("h"))
+	ensure.Nil(t, h.Set([]byte("f"), []byte("v")))
+	_, err = h.Remove([]byte("f"))
+	ensure.Nil(t, err)
+	expect("hhset h", "hhdel h", "gdel h")
+
+	l, _ := db.List([]byte("l"))
+	_, err = l.RPush([]byte("a"))
+	ensure.Nil(t, err)
+	_, err = l.LPop()
+	ensure.Nil(t, err)
+	expect("lrpush l", "llpop l", "gdel l")
+
+	z, _ := db.SortedSet([]byte("z"))
+	_, err = z.Add(0, ScoreMember{1, []byte("m")})
+	ensure.Nil(t, err)
+	_, _, err = z.IncrBy(0, 1, []byte("m"))
+	ensure.Nil(t, err)
+	_, err = z.Remove([]byte("m"))
+	ensure.Nil(t, err)
+	expect("zzadd z", "zzincr z", "zzrem z", "gdel z")
+
+	// 覆盖其他类型时只有set
+	s, _ := db.SetOf([]byte("set"))
+	_, err = s.Add([]byte("m"))
+	ensure.Nil(t, err)
+	ensure.Nil(t, db.Set([]byte("set"), []byte("v")))
+	expect("ssadd set", "$set set")
+
+	// 事务中的通知在提交后发出
+	tx := db.Begin()
+	ensure.Nil(t, tx.Set([]byte("t"), []byte("v")))
+	expect()
+	ensure.Nil(t, tx.Commit())
+	expect("$set t")
+
+	_, err = db.ExpireAt([]byte("t"), nowMs()-1)
+	ensure.Nil(t, err)
+	expect("gdel t")
+	ensure.Nil(t, db.SetEx([]byte("e"), []byte("v"), nowMs()+1))
+	expect("$set e", "gexpire e")
+	time.Sleep(5 * time.Millisecond)
+	ensure.True(t, db.TypeOf([]byte("e")) == NONE)
+	expect("xexpired e")
+}
@@ -0,0 +1,142 @@
+package rocks
+
+import (
+	"github.com/latermoon/GoRedis/libs/rdb"
+	"io"
+)
+
+// 和官方redis的RDB互相转换，用于全量同步和离线的导入导出
+
+// 每个WriteBatch包含的元素个数，一个很大的集合仍然在一个WriteBatch中
+const DefaultImportBatch = 10000
+
+// 写入RDB中的一个key，已有的同名key先删除
+func (d *DB) LoadEntry(e *rdb.Entry) error {
+	if err := d.Delete(e.Key); err != nil {
+		return err
+	}
+	var err error
+	switch e.Type {
+	case rdb.TypeString:
+		return d.SetEx(e.Key, e.Value, e.ExpireAt)
+	case rdb.TypeList:
+		l, _ := d.List(e.Key)
+		_, err = l.RPush(e.Values...)
+	case rdb.TypeSet:
+		set, _ := d.SetOf(e.Key)
+		_, err = set.Add(e.Values...)
+	case rdb.TypeHash:
+		h, _ := d.Hash(e.Key)
+		_, err = h.MSet(e.Values...)
+	case rdb.TypeZSet:
+		z, _ := d.SortedSet(e.Key)
+		pairs := make([]ScoreMember, len(e.Members))
+		for i, m := range e.Members {
+			pairs[i] = ScoreMember{Score: m.Score, Member: m.Member}
+		}
+		_, err = z.Add(0, pairs...)
+	}
+	if err == nil && e.ExpireAt > 0 {
+		_, err = d.ExpireAt(e.Key, e.ExpireAt)
+	}
+	return err
+}
+
+// 载入RDB中db的全部key，已经过期的和不能表示的stream、module类型跳过
+// 每batch个元素在一个事务中写入，Commit时是一个WriteBatch
+func (d *DB) ImportRDB(r io.Reader, db, batch int) (loaded, skipped int, err error) {
+	now := nowMs()
+	tx := d.Begin()
+	n := 0
+	dec := rdb.NewDecoder(r)
+	defer func() { skipped += dec.Skipped }()
+	err = dec.Decode(func(e *rdb.Entry) error {
+		if e.DB != db || (e.ExpireAt > 0 && e.ExpireAt <= now) {
+			skipped++
+			return nil
+		}
+		if err := tx.LoadEntry(e); err != nil {
+			return err
+		}
+		loaded++
+		if n += 1 + len(e.Values) + len(e.Members); n >= batch {
+			if err := tx.Commit(); err != nil {
+				// Commit失败时已经结束事务
+				tx = nil
+				return err
+			}
+			tx, n = d.Begin(), 0
+		}
+		return nil
+	})
+	if tx == nil {
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// 把当前数据写成RDB，全部在db 0
+func (d *DB) ExportRDB(w io.Writer) error {
+	snap := d.Snapshot()
+	defer snap.Release()
+	return snap.WriteRDB(w)
+}
+
+// 把快照写成RDB，全部在db 0，空的集合跳过
+func (s *Snapshot) WriteRDB(w io.Writer) error {
+	e := rdb.NewEncoder(w)
+	e.WriteHeader()
+	err := s.Keys(func(key []byte, t ElementType, deadline int64) error {
+		if t == STRING {
+			val, err := s.Value(key)
+			if err != nil {
+				return err
+			}
+			if err := e.WriteKey(0, rdb.TypeString, key, deadline, 0); err != nil {
+				return err
+			}
+			return e.WriteString(val)
+		}
+		n := s.Len(key, t)
+		if n == 0 {
+			return nil
+		}
+		var rt rdb.Type
+		switch t {
+		case LIST:
+			rt = rdb.TypeList
+		case SET:
+			rt = rdb.TypeSet
+		case HASH:
+			rt = rdb.TypeHash
+		case SORTEDSET:
+			rt = rdb.TypeZSet
+		default:
+			return nil
+		}
+		if err := e.WriteKey(0, rt, key, deadline, int(n)); err != nil {
+			return err
+		}
+		return s.Each(key, t, func(a, b []byte) error {
+			if err := e.WriteString(a); err != nil {
+				return err
+			}
+			switch t {
+			case HASH:
+				return e.WriteString(b)
+			case SORTEDSET:
+				return e.WriteScore(BytesToFloat64(b))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return e.Close()
+}
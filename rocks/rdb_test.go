@@ -0,0 +1,70 @@
+package rocks
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/facebookgo/ensure"
+	"github.com/latermoon/GoRedis/libs/rdb"
+	"io/ioutil"
+	"testing"
+)
+
+func decodeRDB(t *testing.T, data []byte) map[string]*rdb.Entry {
+	entries := make(map[string]*rdb.Entry)
+	ensure.Nil(t, rdb.NewDecoder(bytes.NewReader(data)).Decode(func(e *rdb.Entry) error {
+		if e.DB == 0 {
+			entries[string(e.Key)] = e
+		}
+		return nil
+	}))
+	return entries
+}
+
+// 各个版本的RDB导入之后再导出，内容和原来的db 0一致
+func TestRDBRoundTrip(t *testing.T) {
+	for v := 6; v <= 11; v++ {
+		name := fmt.Sprintf("../libs/rdb/testdata/v%d.rdb", v)
+		data, err := ioutil.ReadFile(name)
+		ensure.Nil(t, err)
+		want := decodeRDB(t, data)
+
+		db := New(newRocksDB(t))
+		// 每批很少的元素，覆盖多个WriteBatch
+		loaded, skipped, err := db.ImportRDB(bytes.NewReader(data), 0, 3)
+		ensure.Nil(t, err, name)
+		ensure.DeepEqual(t, loaded, len(want), name)
+		ensure.DeepEqual(t, skipped, 1, name)
+		val, _ := db.Get([]byte("int"))
+		ensure.DeepEqual(t, string(val), "12345", name)
+		l, _ := db.List([]byte("list"))
+		ensure.DeepEqual(t, l.Len(), int64(3), name)
+		deadline, _ := db.deadline([]byte("exp"))
+		ensure.DeepEqual(t, deadline, int64(4102444800000), name)
+
+		var out bytes.Buffer
+		ensure.Nil(t, db.ExportRDB(&out), name)
+		ensure.DeepEqual(t, decodeRDB(t, out.Bytes()), want, name)
+
+		// 导出的RDB可以再次导入，重复导入时已有的key被替换
+		_, _, err = db.ImportRDB(bytes.NewReader(out.Bytes()), 0, DefaultImportBatch)
+		ensure.Nil(t, err, name)
+		var again bytes.Buffer
+		ensure.Nil(t, db.ExportRDB(&again), name)
+		ensure.DeepEqual(t, again.Bytes(), out.Bytes(), name)
+		db.Close()
+	}
+}
+
+func TestRDBImportError(t *testing.T) {
+	data, err := ioutil.ReadFile("../libs/rdb/testdata/v11.rdb")
+	ensure.Nil(t, err)
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	// 截断的文件返回错误，最后一批没有写入
+	_, _, err = db.ImportRDB(bytes.NewReader(data[:len(data)-20]), 0, DefaultImportBatch)
+	ensure.NotNil(t, err)
+	ensure.True(t, db.TypeOf([]byte("str")) == NONE)
+	// 之后仍然可以写入
+	ensure.Nil(t, db.Set([]byte("str"), []byte("v")))
+}
@@ -0,0 +1,84 @@
+package rocks
+
+import (
+	"bytes"
+)
+
+// 游标遍历
+// cursor是上一次遍历到的最后一行去掉prefix之后的部分，从它的下一行继续，
+// 所以两次调用之间的写入不会让遍历重复或遗漏未改动的key
+// 每次最多回调count次，返回下一次的cursor，nil表示已经遍历完
+func (d *DB) scanPrefix(prefix, cursor []byte, count int, fn func(key, value []byte)) []byte {
+	if count <= 0 {
+		count = 1
+	}
+	min := prefix
+	if cursor != nil {
+		// cursor后面紧跟的一行，空的field也可能是cursor
+		min = bytes.Join([][]byte{prefix, cursor, []byte{MINBYTE}}, nil)
+	}
+	var last, next []byte
+	n := 0
+	d.RangeEnumerate(min, prefixEnd(prefix), IterForward, func(i int, key, value []byte, quit *bool) {
+		if !bytes.HasPrefix(key, prefix) {
+			*quit = true
+			return
+		}
+		// 还有下一行，才需要返回cursor
+		if n == count {
+			next = last
+			*quit = true
+			return
+		}
+		n++
+		last = copyBytes(key[len(prefix):])
+		fn(key, value)
+	})
+	return next
+}
+
+// SCAN，按字节序遍历所有key，已过期但还没清理的key会被跳过
+func (d *DB) Scan(cursor []byte, count int, fn func(key []byte, t ElementType)) []byte {
+	now := nowMs()
+	return d.scanPrefix(KEY, cursor, count, func(raw, value []byte) {
+		// +key,t
+		if len(raw) < len(KEY)+2 || raw[len(raw)-2] != SEP[0] {
+			return
+		}
+		key := copyBytes(raw[len(KEY) : len(raw)-2])
+		if ms, _ := d.deadline(key); ms > 0 && ms <= now {
+			return
+		}
+		fn(key, ElementType(raw[len(raw)-1]))
+	})
+}
+
+// HSCAN
+func (h *HashElement) Scan(cursor []byte, count int, fn func(field, value []byte)) []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	prefix := h.fieldPrefix()
+	return h.db.scanPrefix(prefix, cursor, count, func(key, value []byte) {
+		fn(copyBytes(key[len(prefix):]), copyBytes(value))
+	})
+}
+
+// SSCAN
+func (s *SetElement) Scan(cursor []byte, count int, fn func(member []byte)) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := s.memberPrefix()
+	return s.db.scanPrefix(prefix, cursor, count, func(key, value []byte) {
+		fn(copyBytes(key[len(prefix):]))
+	})
+}
+
+// ZSCAN，按member的字节序遍历，而不是按score
+func (s *SortedSetElement) Scan(cursor []byte, count int, fn func(score float64, member []byte)) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := s.memberPrefix()
+	return s.db.scanPrefix(prefix, cursor, count, func(key, value []byte) {
+		fn(BytesToFloat64(value), copyBytes(key[len(prefix):]))
+	})
+}
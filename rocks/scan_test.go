@@ -0,0 +1,91 @@
+package rocks
+
+import (
+	"fmt"
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+func TestDBScan(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	for i := 0; i < 25; i++ {
+		ensure.Nil(t, db.Set([]byte(fmt.Sprintf("key:%02d", i)), []byte("v")))
+	}
+	// 包含分隔符的key
+	ensure.Nil(t, db.Set([]byte("key:05,h"), []byte("v")))
+	h, _ := db.Hash([]byte("key:05,h,x"))
+	ensure.Nil(t, h.Set([]byte("f"), []byte("v")))
+	// 已过期的key不会出现
+	ensure.Nil(t, db.SetEx([]byte("key:gone"), []byte("v"), nowMs()-1))
+
+	seen := make(map[string]ElementType)
+	var cursor []byte
+	calls := 0
+	for {
+		n := 0
+		cursor = db.Scan(cursor, 10, func(key []byte, typ ElementType) {
+			_, dup := seen[string(key)]
+			ensure.False(t, dup, string(key))
+			seen[string(key)] = typ
+			n++
+		})
+		ensure.True(t, n <= 10)
+		calls++
+		if cursor == nil {
+			break
+		}
+		// 两次遍历之间的写入不影响游标
+		db.Set([]byte("key:00"), []byte("new"))
+	}
+	ensure.DeepEqual(t, len(seen), 27)
+	ensure.True(t, calls == 3)
+	ensure.True(t, seen["key:05,h"] == STRING)
+	ensure.True(t, seen["key:05,h,x"] == HASH)
+	_, ok := seen["key:gone"]
+	ensure.False(t, ok)
+}
+
+func TestElementScan(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	h, _ := db.Hash([]byte("h"))
+	s, _ := db.SetOf([]byte("s"))
+	z, _ := db.SortedSet([]byte("z"))
+	for i := 0; i < 15; i++ {
+		m := []byte(fmt.Sprintf("m%02d", i))
+		h.Set(m, []byte("v"))
+		s.Add(m)
+		z.Add(0, ScoreMember{float64(i), m})
+	}
+
+	var fields []string
+	var cursor []byte
+	for {
+		cursor = h.Scan(cursor, 4, func(field, value []byte) {
+			fields = append(fields, string(field))
+			ensure.DeepEqual(t, value, []byte("v"))
+		})
+		if cursor == nil {
+			break
+		}
+	}
+	ensure.True(t, len(fields) == 15)
+	ensure.DeepEqual(t, fields[14], "m14")
+
+	var members []string
+	cursor = s.Scan(nil, 100, func(member []byte) {
+		members = append(members, string(member))
+	})
+	ensure.True(t, cursor == nil)
+	ensure.True(t, len(members) == 15)
+
+	var scores []float64
+	cursor = z.Scan(nil, 3, func(score float64, member []byte) {
+		scores = append(scores, score)
+	})
+	ensure.DeepEqual(t, scores, []float64{0, 1, 2})
+	ensure.DeepEqual(t, cursor, []byte("m02"))
+}
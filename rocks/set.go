@@ -0,0 +1,284 @@
+package rocks
+
+import (
+	"bytes"
+	"github.com/tecbot/gorocksdb"
+	"math/rand"
+	"strconv"
+	"sync"
+)
+
+// set
+// 	+key,S = "3"
+// 	s[key]a = ""
+// 	s[key]b = ""
+// 	s[key]c = ""
+type SetElement struct {
+	db  *DB
+	key []byte
+	mu  sync.RWMutex
+}
+
+// set member prefix, SET type is 'S' because 's' is taken by string
+const setMemberMark = 's'
+
+func NewSetElement(db *DB, key []byte) *SetElement {
+	return &SetElement{db: db, key: key}
+}
+
+// SADD, returns the number of members added
+func (s *SetElement) Add(members ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	added := make(map[string]bool)
+	for _, member := range members {
+		if added[string(member)] {
+			continue
+		}
+		exists, err := s.exists(member)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		added[string(member)] = true
+		batch.Put(s.memberKey(member), nil)
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	if _, err := s.putCount(batch, len(added)); err != nil {
+		return 0, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	s.db.notify(NotifySet, "sadd", s.key)
+	return len(added), nil
+}
+
+// SREM, returns the number of members removed
+func (s *SetElement) Remove(members ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove("srem", members...)
+}
+
+// event是通知的事件名，SREM或SPOP
+func (s *SetElement) remove(event string, members ...[]byte) (int, error) {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	removed := make(map[string]bool)
+	for _, member := range members {
+		if removed[string(member)] {
+			continue
+		}
+		exists, err := s.exists(member)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			continue
+		}
+		removed[string(member)] = true
+		batch.Delete(s.memberKey(member))
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	left, err := s.putCount(batch, -len(removed))
+	if err != nil {
+		return 0, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	s.db.notify(NotifySet, event, s.key)
+	if left == 0 {
+		s.db.notify(NotifyGeneric, "del", s.key)
+	}
+	return len(removed), nil
+}
+
+// SISMEMBER
+func (s *SetElement) Exists(member []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.exists(member)
+}
+
+func (s *SetElement) exists(member []byte) (bool, error) {
+	val, err := s.db.RawGet(s.memberKey(member))
+	return val != nil, err
+}
+
+// SCARD
+func (s *SetElement) Len() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, _ := s.count()
+	return n
+}
+
+// SMEMBERS, members in lexicographical order
+func (s *SetElement) Enumerate(fn func(i int, member []byte, quit *bool)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prefix := s.memberPrefix()
+	s.db.PrefixEnumerate(prefix, IterForward, func(i int, key, value []byte, quit *bool) {
+		fn(i, key[len(prefix):], quit)
+	})
+}
+
+// SPOP, removes and returns up to count random members
+func (s *SetElement) Pop(count int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.randMembers(count)
+	if len(members) == 0 {
+		return nil, nil
+	}
+	_, err := s.remove("spop", members...)
+	return members, err
+}
+
+// SRANDMEMBER, count > 0 returns distinct members,
+// count < 0 may return the same member multiple times
+func (s *SetElement) RandMembers(count int) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if count >= 0 {
+		return s.randMembers(count)
+	}
+	// count comes from the client, grow with the result instead of preallocating
+	var members [][]byte
+	for i := 0; i < -count; i++ {
+		member := s.randMember()
+		if member == nil {
+			break
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// distinct random members
+func (s *SetElement) randMembers(count int) [][]byte {
+	n, _ := s.count()
+	if count <= 0 || n == 0 {
+		return nil
+	}
+	if int64(count) > n {
+		count = int(n)
+	}
+
+	prefix := s.memberPrefix()
+	members := make([][]byte, 0, count)
+	if int64(count)*2 >= n {
+		// reservoir sampling when most of the set is wanted
+		s.db.PrefixEnumerate(prefix, IterForward, func(i int, key, value []byte, quit *bool) {
+			member := copyBytes(key[len(prefix):])
+			if len(members) < count {
+				members = append(members, member)
+			} else if j := rand.Intn(i + 1); j < count {
+				members[j] = member
+			}
+		})
+		return members
+	}
+
+	seen := make(map[string]bool)
+	for tries := 0; len(members) < count && tries < count*10; tries++ {
+		member := s.randMember()
+		if member == nil {
+			break
+		}
+		if !seen[string(member)] {
+			seen[string(member)] = true
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// seek to a random position inside s[key], wrap around at the end
+func (s *SetElement) randMember() []byte {
+	prefix := s.memberPrefix()
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+	var member []byte
+	fn := func(i int, key, value []byte, quit *bool) {
+		member = copyBytes(key[len(prefix):])
+		*quit = true
+	}
+	s.db.RangeEnumerate(append(copyBytes(prefix), rnd...), prefixEnd(prefix), IterForward, fn)
+	if member == nil {
+		s.db.PrefixEnumerate(prefix, IterForward, fn)
+	}
+	return member
+}
+
+func (s *SetElement) locker() sync.Locker {
+	return &s.mu
+}
+
+func (s *SetElement) dropTo(batch *gorocksdb.WriteBatch) {
+	s.db.PrefixEnumerate(s.memberPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
+		batch.Delete(copyBytes(key))
+	})
+	batch.Delete(s.rawKey())
+}
+
+// cardinality saved in +key,S
+func (s *SetElement) count() (int64, error) {
+	val, err := s.db.RawGet(s.rawKey())
+	if err != nil || len(val) == 0 {
+		return 0, err
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+// update cardinality by delta, remove raw key when empty
+func (s *SetElement) putCount(batch *gorocksdb.WriteBatch, delta int) (int64, error) {
+	n, err := s.count()
+	if err != nil {
+		return 0, err
+	}
+	n += int64(delta)
+	if n > 0 {
+		batch.Put(s.rawKey(), []byte(strconv.FormatInt(n, 10)))
+	} else {
+		n = 0
+		batch.Delete(s.rawKey())
+	}
+	return n, nil
+}
+
+// +key,S
+func (s *SetElement) rawKey() []byte {
+	return rawKey(s.key, SET)
+}
+
+// s[key]
+func (s *SetElement) memberPrefix() []byte {
+	return setMemberPrefix(s.key)
+}
+
+// s[key]member
+func (s *SetElement) memberKey(member []byte) []byte {
+	return bytes.Join([][]byte{s.memberPrefix(), member}, nil)
+}
+
+func setMemberPrefix(key []byte) []byte {
+	return bytes.Join([][]byte{[]byte{setMemberMark}, SOK, key, EOK}, nil)
+}
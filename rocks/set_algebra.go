@@ -0,0 +1,245 @@
+package rocks
+
+import (
+	"bytes"
+	"github.com/tecbot/gorocksdb"
+	"strconv"
+)
+
+// SINTER/SUNION/SDIFF
+// 每个set的成员在 s[key] 前缀下是有序的，因此可以像归并排序一样
+// 同时遍历多个set，不需要把成员读入内存
+
+type SetOperation int
+
+const (
+	SetInter SetOperation = iota
+	SetUnion
+	SetDiff
+)
+
+// 存储结果时的通知事件
+var setStoreEvents = map[SetOperation]string{
+	SetInter: "sinterstore",
+	SetUnion: "sunionstore",
+	SetDiff:  "sdiffstore",
+}
+
+// 按字典序输出运算结果
+func (d *DB) SetCombine(op SetOperation, keys [][]byte, fn func(member []byte, quit *bool)) error {
+	if err := d.checkSets(keys); err != nil {
+		return err
+	}
+	cursors, release := d.openSetCursors(keys)
+	defer release()
+	combineSets(op, cursors, fn)
+	return nil
+}
+
+// SINTERSTORE/SUNIONSTORE/SDIFFSTORE，dst原有的数据会被覆盖，返回结果的元素个数
+// 删除dst和全部成员在同一个batch中写入，读者看不到只写了一部分的set
+func (d *DB) SetCombineStore(op SetOperation, dst []byte, keys [][]byte) (int64, error) {
+	if err := d.checkSets(keys); err != nil {
+		return 0, err
+	}
+	// dst无论原来是什么类型都持有string的锁，和SET/MSET这类覆盖互斥，
+	// 原来是set或者不存在时，还要持有set的锁，和SADD这类写入互斥
+	defer d.lockString(dst)()
+	if s, err := d.SetOf(dst); err == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	// 先打开快照，dst同时是源的时候也能读到原来的数据
+	cursors, release := d.openSetCursors(keys)
+	defer release()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	deleted, err := d.deleteTo(batch, dst)
+	if err != nil {
+		return 0, err
+	}
+	prefix := setMemberPrefix(dst)
+	n := int64(0)
+	combineSets(op, cursors, func(member []byte, quit *bool) {
+		batch.Put(bytes.Join([][]byte{prefix, member}, nil), nil)
+		n++
+	})
+	if n > 0 {
+		batch.Put(rawKey(dst, SET), []byte(strconv.FormatInt(n, 10)))
+	}
+	d.touch(dst)
+	if batch.Count() > 0 {
+		err = d.WriteBatch(batch)
+		d.uncache(dst)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if n == 0 {
+		if deleted {
+			d.notify(NotifyGeneric, "del", dst)
+		}
+		return 0, nil
+	}
+	d.notify(NotifySet, setStoreEvents[op], dst)
+	return n, nil
+}
+
+// 所有key都必须是set或者不存在
+func (d *DB) checkSets(keys [][]byte) error {
+	for _, key := range keys {
+		if t := d.TypeOf(key); t != NONE && t != SET {
+			return ErrWrongType
+		}
+	}
+	return nil
+}
+
+// 在同一个快照上为每个set打开游标
+func (d *DB) openSetCursors(keys [][]byte) ([]*setCursor, func()) {
+	view, releaseView := d.snapshot()
+
+	cursors := make([]*setCursor, len(keys))
+	for i, key := range keys {
+		cursors[i] = &setCursor{iter: view.newIterator(), prefix: setMemberPrefix(key)}
+		cursors[i].seek(nil)
+	}
+	release := func() {
+		for _, c := range cursors {
+			c.iter.Close()
+		}
+		releaseView()
+	}
+	return cursors, release
+}
+
+func combineSets(op SetOperation, cursors []*setCursor, fn func(member []byte, quit *bool)) {
+	if len(cursors) == 0 {
+		return
+	}
+	switch op {
+	case SetInter:
+		interSets(cursors, fn)
+	case SetUnion:
+		unionSets(cursors, fn)
+	case SetDiff:
+		diffSets(cursors, fn)
+	}
+}
+
+// 所有游标追赶到当前最大的成员，全部相等时输出
+func interSets(cursors []*setCursor, fn func(member []byte, quit *bool)) {
+	quit := false
+	for {
+		var max []byte
+		for _, c := range cursors {
+			if !c.valid {
+				return
+			}
+			if max == nil || bytes.Compare(c.member, max) > 0 {
+				max = c.member
+			}
+		}
+		matched := true
+		for _, c := range cursors {
+			if bytes.Compare(c.member, max) < 0 {
+				c.seek(max)
+				if !c.valid {
+					return
+				}
+			}
+			if !bytes.Equal(c.member, max) {
+				matched = false
+			}
+		}
+		if !matched {
+			continue
+		}
+		if fn(max, &quit); quit {
+			return
+		}
+		for _, c := range cursors {
+			c.next()
+		}
+	}
+}
+
+// 每次输出最小的成员，并推进所有等于它的游标
+func unionSets(cursors []*setCursor, fn func(member []byte, quit *bool)) {
+	quit := false
+	for {
+		var min []byte
+		for _, c := range cursors {
+			if c.valid && (min == nil || bytes.Compare(c.member, min) < 0) {
+				min = c.member
+			}
+		}
+		if min == nil {
+			return
+		}
+		if fn(min, &quit); quit {
+			return
+		}
+		for _, c := range cursors {
+			if c.valid && bytes.Equal(c.member, min) {
+				c.next()
+			}
+		}
+	}
+}
+
+// 遍历第一个set，其他set追赶到当前成员，都不相等时输出
+func diffSets(cursors []*setCursor, fn func(member []byte, quit *bool)) {
+	first, others := cursors[0], cursors[1:]
+	quit := false
+	for ; first.valid; first.next() {
+		found := false
+		for _, c := range others {
+			if c.valid && bytes.Compare(c.member, first.member) < 0 {
+				c.seek(first.member)
+			}
+			if c.valid && bytes.Equal(c.member, first.member) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if fn(first.member, &quit); quit {
+			return
+		}
+	}
+}
+
+// 在 s[key] 前缀内移动的游标
+type setCursor struct {
+	iter   iterator
+	prefix []byte
+	member []byte
+	valid  bool
+}
+
+func (c *setCursor) seek(member []byte) {
+	c.iter.Seek(bytes.Join([][]byte{c.prefix, member}, nil))
+	c.load()
+}
+
+func (c *setCursor) next() {
+	c.iter.Next()
+	c.load()
+}
+
+func (c *setCursor) load() {
+	c.valid = false
+	if !c.iter.Valid() {
+		return
+	}
+	key := c.iter.Key()
+	if !bytes.HasPrefix(key, c.prefix) {
+		return
+	}
+	c.member = copyBytes(key[len(c.prefix):])
+	c.valid = true
+}
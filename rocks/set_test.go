@@ -0,0 +1,119 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	s, _ := db.SetOf([]byte("tags"))
+	n, err := s.Add([]byte("a"), []byte("b"), []byte("c"), []byte("a"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 3)
+	ensure.True(t, s.Len() == 3)
+	ensure.True(t, db.TypeOf([]byte("tags")) == SET)
+
+	ok, err := s.Exists([]byte("b"))
+	ensure.Nil(t, err)
+	ensure.True(t, ok)
+
+	n, err = s.Remove([]byte("b"), []byte("x"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 1)
+
+	var members []string
+	s.Enumerate(func(i int, member []byte, quit *bool) {
+		members = append(members, string(member))
+	})
+	ensure.DeepEqual(t, members, []string{"a", "c"})
+
+	ensure.True(t, len(s.RandMembers(5)) == 2)
+	ensure.True(t, len(s.RandMembers(-5)) == 5)
+	// counts from the client are not used to preallocate
+	ensure.True(t, len(s.RandMembers(1000000000000)) == 2)
+	none, _ := db.SetOf([]byte("none"))
+	ensure.True(t, len(none.RandMembers(-1000000000000)) == 0)
+
+	popped, err := s.Pop(1000000000000)
+	ensure.Nil(t, err)
+	ensure.True(t, len(popped) == 2)
+	ensure.True(t, s.Len() == 0)
+	ensure.True(t, db.TypeOf([]byte("tags")) == NONE)
+}
+
+func TestSetCombine(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	add := func(key string, members ...string) {
+		for _, m := range members {
+			s, _ := db.SetOf([]byte(key))
+			s.Add([]byte(m))
+		}
+	}
+	add("s1", "a", "b", "c", "d")
+	add("s2", "c", "d", "e")
+	add("s3", "a", "c", "d", "f")
+
+	combine := func(op SetOperation, keys ...string) []string {
+		bkeys := make([][]byte, len(keys))
+		for i, key := range keys {
+			bkeys[i] = []byte(key)
+		}
+		out := []string{}
+		db.SetCombine(op, bkeys, func(member []byte, quit *bool) {
+			out = append(out, string(member))
+		})
+		return out
+	}
+
+	ensure.DeepEqual(t, combine(SetInter, "s1", "s2", "s3"), []string{"c", "d"})
+	ensure.DeepEqual(t, combine(SetInter, "s1", "none"), []string{})
+	ensure.DeepEqual(t, combine(SetUnion, "s1", "s2", "s3"), []string{"a", "b", "c", "d", "e", "f"})
+	ensure.DeepEqual(t, combine(SetDiff, "s1", "s2"), []string{"a", "b"})
+	ensure.DeepEqual(t, combine(SetDiff, "s1", "s2", "s3"), []string{"b"})
+
+	// store into one of the sources
+	n, err := db.SetCombineStore(SetUnion, []byte("s1"), [][]byte{[]byte("s1"), []byte("s2")})
+	ensure.Nil(t, err)
+	ensure.True(t, n == 5)
+	s1, _ := db.SetOf([]byte("s1"))
+	ensure.True(t, s1.Len() == 5)
+
+	n, err = db.SetCombineStore(SetInter, []byte("dst"), [][]byte{[]byte("s2"), []byte("none")})
+	ensure.Nil(t, err)
+	ensure.True(t, n == 0)
+	ensure.True(t, db.TypeOf([]byte("dst")) == NONE)
+
+	// overwrite a key of another type
+	big, _ := db.SetOf([]byte("big"))
+	for i := 0; i < 1010; i++ {
+		big.Add([]byte(strconv.Itoa(i)))
+	}
+	h, _ := db.Hash([]byte("hdst"))
+	h.Set([]byte("f"), []byte("v"))
+	db.ExpireAt([]byte("hdst"), nowMs()+60000)
+	n, err = db.SetCombineStore(SetUnion, []byte("hdst"), [][]byte{[]byte("big"), []byte("s2")})
+	ensure.Nil(t, err)
+	ensure.True(t, n == int64(1013))
+	ensure.True(t, db.TypeOf([]byte("hdst")) == SET)
+	ttl, _ := db.TTL([]byte("hdst"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+	fields := 0
+	db.PrefixEnumerate(NewHashElement(db, []byte("hdst")).fieldPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
+		fields++
+	})
+	ensure.DeepEqual(t, fields, 0)
+	hdst, _ := db.SetOf([]byte("hdst"))
+	ensure.True(t, hdst.Len() == n)
+	ok, _ := hdst.Exists([]byte("e"))
+	ensure.True(t, ok)
+
+	members := combine(SetUnion, "s1")
+	ensure.True(t, sort.StringsAreSorted(members))
+}
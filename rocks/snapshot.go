@@ -0,0 +1,112 @@
+package rocks
+
+// 一致的只读快照，用于导出全部数据，比如给从库生成RDB
+// 从+key,type的索引遍历key，再按各类型的前缀读取元素，不把整个集合读入内存
+type Snapshot struct {
+	view    *DB
+	release func()
+	now     int64
+}
+
+func (d *DB) Snapshot() *Snapshot {
+	view, release := d.snapshot()
+	return &Snapshot{view: view, release: release, now: nowMs()}
+}
+
+func (s *Snapshot) Release() {
+	s.release()
+}
+
+// 按字节序遍历快照中的key，跳过已经过期的，deadline为0表示不过期
+// bitmap按STRING返回
+func (s *Snapshot) Keys(fn func(key []byte, t ElementType, deadline int64) error) error {
+	var err error
+	s.view.PrefixEnumerate(KEY, IterForward, func(i int, raw, value []byte, quit *bool) {
+		// +key,t
+		if len(raw) < len(KEY)+2 || raw[len(raw)-2] != SEP[0] {
+			return
+		}
+		key := copyBytes(raw[len(KEY) : len(raw)-2])
+		t := ElementType(raw[len(raw)-1])
+		var ms int64
+		if ms, err = s.view.deadline(key); err != nil {
+			*quit = true
+			return
+		}
+		if ms > 0 && ms <= s.now {
+			return
+		}
+		if t == BITMAP {
+			t = STRING
+		}
+		if err = fn(key, t, ms); err != nil {
+			*quit = true
+		}
+	})
+	return err
+}
+
+// string的值
+func (s *Snapshot) Value(key []byte) ([]byte, error) {
+	val, err := s.view.RawGet(rawKey(key, STRING))
+	if err == nil && val == nil {
+		return s.view.bitmapBytes(key)
+	}
+	return val, err
+}
+
+// 集合的元素个数，读取+key,t中记录的个数，list由两端的下标计算
+// 老版本写入的hash没有记录个数，count会遍历
+func (s *Snapshot) Len(key []byte, t ElementType) int64 {
+	var n int64
+	switch t {
+	case HASH:
+		n, _ = NewHashElement(s.view, key).count()
+	case LIST:
+		n = NewListElement(s.view, key).len()
+	case SET:
+		n, _ = NewSetElement(s.view, key).count()
+	case SORTEDSET:
+		n, _ = NewSortedSetElement(s.view, key).count()
+	}
+	return n
+}
+
+// 依次读取集合的元素，list按顺序是(value, nil)，set是(member, nil)，
+// hash是(field, value)，sortedset是(member, score)，score用BytesToFloat64解码
+// a和b只在回调中有效
+func (s *Snapshot) Each(key []byte, t ElementType, fn func(a, b []byte) error) error {
+	prefix := s.elementPrefix(key, t)
+	if prefix == nil {
+		return nil
+	}
+	var err error
+	s.view.PrefixEnumerate(prefix, IterForward, func(i int, raw, value []byte, quit *bool) {
+		switch t {
+		case LIST:
+			err = fn(value, nil)
+		case SET:
+			err = fn(raw[len(prefix):], nil)
+		default:
+			err = fn(raw[len(prefix):], value)
+		}
+		if err != nil {
+			*quit = true
+		}
+	})
+	return err
+}
+
+func (s *Snapshot) elementPrefix(key []byte, t ElementType) []byte {
+	switch t {
+	case HASH:
+		return NewHashElement(s.view, key).fieldPrefix()
+	case LIST:
+		return NewListElement(s.view, key).keyPrefix()
+	case SET:
+		return setMemberPrefix(key)
+	case SORTEDSET:
+		return NewSortedSetElement(s.view, key).memberPrefix()
+	}
+	return nil
+}
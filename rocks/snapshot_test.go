@@ -0,0 +1,87 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshotDump(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("name"), []byte("latermoon")))
+	db.ExpireAt([]byte("name"), nowMs()+60000)
+	db.SetBit([]byte("bits"), 7, 1)
+	l, _ := db.List([]byte("list"))
+	l.RPush([]byte("a"), []byte("b"))
+	l.LPush([]byte("z"))
+	h, _ := db.Hash([]byte("hash"))
+	h.MSet([]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2"))
+	// 老版本写入的hash，+key,h没有记录个数
+	old, _ := db.Hash([]byte("oldhash"))
+	old.MSet([]byte("f"), []byte("v"))
+	db.RawSet(rawKey([]byte("oldhash"), HASH), []byte{})
+	s, _ := db.SetOf([]byte("set"))
+	s.Add([]byte("m"))
+	z, _ := db.SortedSet([]byte("zset"))
+	z.Add(0, ScoreMember{Score: -1.5, Member: []byte("x")})
+	ensure.Nil(t, db.Set([]byte("expired"), []byte("v")))
+	db.RawSet(expireKey([]byte("expired")), Int64ToBytes(nowMs()-1))
+
+	snap := db.Snapshot()
+	defer snap.Release()
+	// 快照之后的修改不可见
+	ensure.Nil(t, db.Set([]byte("name"), []byte("v2")))
+	l.RPush([]byte("c"))
+	ensure.Nil(t, db.Set([]byte("after"), []byte("v")))
+
+	dump := map[string][]string{}
+	types := map[string]ElementType{}
+	err := snap.Keys(func(key []byte, et ElementType, deadline int64) error {
+		types[string(key)] = et
+		if string(key) == "name" {
+			ensure.True(t, deadline > 0)
+		}
+		var vals []string
+		if et == STRING {
+			v, err := snap.Value(key)
+			ensure.Nil(t, err)
+			vals = append(vals, string(v))
+		} else {
+			snap.Each(key, et, func(a, b []byte) error {
+				vals = append(vals, string(a))
+				if et == SORTEDSET {
+					vals = append(vals, strconv.FormatFloat(BytesToFloat64(b), 'g', -1, 64))
+				} else if b != nil {
+					vals = append(vals, string(b))
+				}
+				return nil
+			})
+			ensure.DeepEqual(t, snap.Len(key, et), int64(len(vals)/snapWidth(et)))
+		}
+		dump[string(key)] = vals
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, types, map[string]ElementType{
+		"name": STRING, "bits": STRING, "list": LIST, "hash": HASH, "oldhash": HASH, "set": SET, "zset": SORTEDSET,
+	})
+	ensure.DeepEqual(t, dump, map[string][]string{
+		"name":    {"latermoon"},
+		"bits":    {"\x01"},
+		"list":    {"z", "a", "b"},
+		"hash":    {"f1", "v1", "f2", "v2"},
+		"oldhash": {"f", "v"},
+		"set":     {"m"},
+		"zset":    {"x", "-1.5"},
+	})
+}
+
+// Each每个元素回调的值个数
+func snapWidth(t ElementType) int {
+	if t == LIST || t == SET {
+		return 1
+	}
+	return 2
+}
@@ -0,0 +1,256 @@
+package rocks
+
+import (
+	"errors"
+	"github.com/tecbot/gorocksdb"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// string
+// 	+name,s = "latermoon"
+// 读-改-写的操作(INCR/APPEND/SETRANGE...)在同一个key的锁内完成，
+// 锁按key的hash分片，不同的key可能共用一把锁
+
+var (
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrNotFloat   = errors.New("value is not a valid float")
+	ErrIncrNaN    = errors.New("increment would produce NaN or Infinity")
+	ErrTooLarge   = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// 和redis的proto-max-bulk-len一致
+const MaxStringSize = 512 * 1024 * 1024
+
+// 分片锁的数量
+const stringLockCount = 64
+
+// SET的NX/XX条件
+type SetCond int
+
+const (
+	SetAlways      SetCond = iota
+	SetIfNotExists         // NX
+	SetIfExists            // XX
+)
+
+// SET的deadline为KeepTTL时保留key原来的过期时间
+const KeepTTL int64 = -1
+
+type stringLocks [stringLockCount]sync.Mutex
+
+func stringLockIndex(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % stringLockCount)
+}
+
+// 锁住key，返回解锁函数：defer d.lockString(key)()
+func (d *DB) lockString(key []byte) func() {
+	mu := &d.strLocks[stringLockIndex(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// 同时锁住多个key，按分片顺序加锁避免死锁
+func (d *DB) lockStrings(keys ...[]byte) func() {
+	seen := make(map[int]bool)
+	idx := make([]int, 0, len(keys))
+	for _, key := range keys {
+		i := stringLockIndex(key)
+		if !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		d.strLocks[i].Lock()
+	}
+	return func() {
+		for j := len(idx) - 1; j >= 0; j-- {
+			d.strLocks[idx[j]].Unlock()
+		}
+	}
+}
+
+// 写入string并保留原来的过期时间，用于INCR/APPEND这类修改，event是通知的事件名
+// 调用方已经通过Get确认key不是其他类型，分块保存的bitmap会转回普通string
+func (d *DB) putString(key, value []byte, event string) error {
+	d.touch(key)
+	size, err := d.RawGet(rawKey(key, BITMAP))
+	if err != nil {
+		return err
+	}
+	if size == nil {
+		err = d.RawSet(rawKey(key, STRING), value)
+	} else {
+		batch := gorocksdb.NewWriteBatch()
+		defer batch.Destroy()
+		d.dropBitmap(batch, key)
+		batch.Put(rawKey(key, STRING), value)
+		err = d.WriteBatch(batch)
+	}
+	if err == nil {
+		d.notify(NotifyString, event, key)
+	}
+	return err
+}
+
+// 带条件的SET，返回是否写入
+func (d *DB) SetWith(key, value []byte, deadline int64, cond SetCond) (bool, error) {
+	defer d.lockString(key)()
+	if cond != SetAlways {
+		exists := d.TypeOf(key) != NONE
+		if (cond == SetIfNotExists && exists) || (cond == SetIfExists && !exists) {
+			return false, nil
+		}
+	}
+	return true, d.setEx(key, value, deadline)
+}
+
+// SETNX
+func (d *DB) SetNX(key, value []byte) (bool, error) {
+	return d.SetWith(key, value, 0, SetIfNotExists)
+}
+
+// GETSET，返回旧值，同时清除过期时间
+func (d *DB) GetSet(key, value []byte) ([]byte, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return old, d.setEx(key, value, 0)
+}
+
+// GETDEL，只删除string
+func (d *DB) GetDel(key []byte) ([]byte, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil || old == nil {
+		return nil, err
+	}
+	return old, d.Delete(key)
+}
+
+// MSET，全部写入同一个WriteBatch
+// 原来是其他类型的key，子元素的删除也加入同一个batch
+func (d *DB) MSet(keyVals ...[]byte) error {
+	if len(keyVals)%2 != 0 {
+		return errors.New("wrong number of arguments for MSET")
+	}
+	keys := make([][]byte, 0, len(keyVals)/2)
+	for i := 0; i < len(keyVals); i += 2 {
+		keys = append(keys, keyVals[i])
+	}
+	defer d.lockStrings(keys...)()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for i, key := range keys {
+		if _, err := d.deleteTo(batch, key); err != nil {
+			return err
+		}
+		batch.Put(rawKey(key, STRING), keyVals[i*2+1])
+	}
+	for _, key := range keys {
+		d.uncache(key)
+		d.touch(key)
+	}
+	if err := d.WriteBatch(batch); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		d.notify(NotifyString, "set", key)
+	}
+	return nil
+}
+
+// INCRBY
+func (d *DB) IncrBy(key []byte, delta int64) (int64, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if old != nil {
+		var ok bool
+		if n, ok = parseStrictInt(old); !ok {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	return n, d.putString(key, []byte(strconv.FormatInt(n, 10)), "incrby")
+}
+
+// INCRBYFLOAT
+func (d *DB) IncrByFloat(key []byte, delta float64) (float64, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var f float64
+	if old != nil {
+		if f, err = strconv.ParseFloat(string(old), 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, ErrNotFloat
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrIncrNaN
+	}
+	return f, d.putString(key, []byte(strconv.FormatFloat(f, 'f', -1, 64)), "incrbyfloat")
+}
+
+// APPEND，返回追加后的长度
+func (d *DB) Append(key, value []byte) (int, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(old)+len(value) > MaxStringSize {
+		return 0, ErrTooLarge
+	}
+	buf := make([]byte, 0, len(old)+len(value))
+	buf = append(append(buf, old...), value...)
+	return len(buf), d.putString(key, buf, "append")
+}
+
+// SETRANGE，不足的部分用0填充，返回修改后的长度
+func (d *DB) SetRange(key []byte, offset int, value []byte) (int, error) {
+	defer d.lockString(key)()
+	old, err := d.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	// 空value不创建key
+	if len(value) == 0 {
+		return len(old), nil
+	}
+	if offset+len(value) > MaxStringSize {
+		return 0, ErrTooLarge
+	}
+	buf := old
+	if n := offset + len(value); n > len(buf) {
+		buf = make([]byte, n)
+		copy(buf, old)
+	}
+	copy(buf[offset:], value)
+	return len(buf), d.putString(key, buf, "setrange")
+}
+
+// 和redis的string2ll一样，不接受 "+1" " 1" "01" 这样的写法
+func parseStrictInt(b []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	return n, err == nil && strconv.FormatInt(n, 10) == string(b)
+}
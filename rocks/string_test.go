@@ -0,0 +1,134 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestStringIncr(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	key := []byte("counter")
+	n, err := db.IncrBy(key, 5)
+	ensure.Nil(t, err)
+	ensure.True(t, n == 5)
+	n, err = db.IncrBy(key, -7)
+	ensure.Nil(t, err)
+	ensure.True(t, n == -2)
+
+	ensure.Nil(t, db.Set(key, []byte(strconv.FormatInt(math.MaxInt64, 10))))
+	_, err = db.IncrBy(key, 1)
+	ensure.True(t, err == ErrOverflow)
+
+	for _, bad := range []string{"abc", "+1", " 1", "01", "1.5", ""} {
+		ensure.Nil(t, db.Set(key, []byte(bad)))
+		_, err = db.IncrBy(key, 1)
+		ensure.True(t, err == ErrNotInteger, bad)
+	}
+
+	ensure.Nil(t, db.Set(key, []byte("10.5")))
+	f, err := db.IncrByFloat(key, 0.1)
+	ensure.Nil(t, err)
+	ensure.True(t, f == 10.6)
+	_, err = db.IncrByFloat(key, math.Inf(1))
+	ensure.True(t, err == ErrIncrNaN)
+
+	h, _ := db.Hash([]byte("h"))
+	h.Set([]byte("f"), []byte("1"))
+	_, err = db.IncrBy([]byte("h"), 1)
+	ensure.True(t, err == ErrWrongType)
+}
+
+func TestStringIncrConcurrent(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				db.IncrBy([]byte("counter"), 1)
+				db.Append([]byte("buf"), []byte("x"))
+			}
+		}()
+	}
+	wg.Wait()
+	val, _ := db.Get([]byte("counter"))
+	ensure.DeepEqual(t, string(val), "1000")
+	val, _ = db.Get([]byte("buf"))
+	ensure.True(t, len(val) == 1000)
+}
+
+func TestStringModify(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	key := []byte("s")
+	// APPEND/SETRANGE保留过期时间
+	ensure.Nil(t, db.SetEx(key, []byte("hello"), nowMs()+100000))
+	n, err := db.Append(key, []byte(" world"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 11)
+	n, err = db.SetRange(key, 6, []byte("redis"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 11)
+	val, _ := db.Get(key)
+	ensure.DeepEqual(t, string(val), "hello redis")
+	ttl, _ := db.TTL(key)
+	ensure.True(t, ttl > 0)
+
+	n, err = db.SetRange([]byte("pad"), 3, []byte("a"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 4)
+	val, _ = db.Get([]byte("pad"))
+	ensure.DeepEqual(t, val, []byte{0, 0, 0, 'a'})
+	n, err = db.SetRange([]byte("empty"), 3, nil)
+	ensure.Nil(t, err)
+	ensure.True(t, n == 0)
+	ensure.True(t, db.TypeOf([]byte("empty")) == NONE)
+
+	// GETSET清除过期时间
+	old, err := db.GetSet(key, []byte("v2"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(old), "hello redis")
+	ttl, _ = db.TTL(key)
+	ensure.True(t, ttl == -1)
+
+	old, err = db.GetDel(key)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(old), "v2")
+	ensure.True(t, db.TypeOf(key) == NONE)
+
+	ok, err := db.SetNX(key, []byte("a"))
+	ensure.Nil(t, err)
+	ensure.True(t, ok)
+	ok, err = db.SetNX(key, []byte("b"))
+	ensure.Nil(t, err)
+	ensure.False(t, ok)
+	ok, err = db.SetWith([]byte("none"), []byte("b"), 0, SetIfExists)
+	ensure.Nil(t, err)
+	ensure.False(t, ok)
+}
+
+func TestStringMSet(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	l, _ := db.List([]byte("b"))
+	l.RPush([]byte("x"))
+	ensure.Nil(t, db.SetEx([]byte("a"), []byte("old"), nowMs()+100000))
+	ensure.Nil(t, db.MSet([]byte("a"), []byte("1"), []byte("b"), []byte("2")))
+	val, _ := db.Get([]byte("a"))
+	ensure.DeepEqual(t, string(val), "1")
+	ttl, _ := db.TTL([]byte("a"))
+	ensure.True(t, ttl == -1)
+	val, _ = db.Get([]byte("b"))
+	ensure.DeepEqual(t, string(val), "2")
+	ensure.True(t, db.TypeOf([]byte("b")) == STRING)
+}
@@ -0,0 +1,316 @@
+package rocks
+
+import (
+	"bytes"
+	"github.com/golang/groupcache/lru"
+	"github.com/tecbot/gorocksdb"
+	"sort"
+	"sync"
+)
+
+// 事务
+// Begin取得排它锁并创建快照，返回一个只能在当前goroutine使用的DB，
+// 读取快照加上事务内的写入，写入只保存在内存里，Commit时合并成一个WriteBatch。
+// 普通命令执行期间持有共享锁(RLock)，所以事务执行时不会有其他写入
+type txn struct {
+	parent *DB
+	writes map[string][]byte // nil表示删除
+	// 事务内创建过对象或者改变过类型的key，提交后从parent的缓存中清除
+	keys  map[string]bool
+	hooks []func()
+	// 事务内修改过的key，提交后计入parent的WATCH计数
+	touched map[string]bool
+}
+
+// 开始事务，结束时必须调用Commit或Rollback
+func (d *DB) Begin() *DB {
+	d.txMu.Lock()
+	snap := d.rdb.NewSnapshot()
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetSnapshot(snap)
+	return &DB{
+		rdb:    d.rdb,
+		wo:     d.wo,
+		ro:     ro,
+		snap:   snap,
+		caches: lru.New(100),
+		tx: &txn{
+			parent:  d,
+			writes:  make(map[string][]byte),
+			keys:    make(map[string]bool),
+			touched: make(map[string]bool),
+		},
+	}
+}
+
+// 用一个WriteBatch写入事务内的全部修改，然后执行延后的回调
+func (d *DB) Commit() error {
+	t := d.tx
+	defer d.endTx()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for k, v := range t.writes {
+		if v == nil {
+			batch.Delete([]byte(k))
+		} else {
+			batch.Put([]byte(k), v)
+		}
+	}
+	if batch.Count() > 0 {
+		if err := t.parent.WriteBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	t.parent.mu.Lock()
+	for key := range t.keys {
+		t.parent.caches.Remove(key)
+	}
+	t.parent.mu.Unlock()
+	for key := range t.touched {
+		t.parent.touch([]byte(key))
+	}
+	// 比如唤醒阻塞在list上的客户端，这时仍然持有排它锁
+	for _, fn := range t.hooks {
+		fn()
+	}
+	return nil
+}
+
+// 放弃事务内的全部修改
+func (d *DB) Rollback() {
+	d.endTx()
+}
+
+func (d *DB) endTx() {
+	d.ro.Destroy()
+	d.rdb.ReleaseSnapshot(d.snap)
+	d.tx.parent.txMu.Unlock()
+}
+
+// 普通命令执行期间持有的共享锁，和Begin互斥
+func (d *DB) RLock() {
+	d.txMu.RLock()
+}
+
+func (d *DB) RUnlock() {
+	d.txMu.RUnlock()
+}
+
+func (d *DB) RLocker() sync.Locker {
+	return d.txMu.RLocker()
+}
+
+// 事务内的回调在Commit之后执行，否则立即执行
+func (d *DB) afterCommit(fn func()) {
+	if d.tx != nil {
+		d.tx.hooks = append(d.tx.hooks, fn)
+		return
+	}
+	fn()
+}
+
+// 清除key的缓存对象，用于Delete/Set这类会改变类型的操作
+func (d *DB) uncache(key []byte) {
+	d.mu.Lock()
+	d.caches.Remove(string(key))
+	d.mu.Unlock()
+	if d.tx != nil {
+		d.tx.keys[string(key)] = true
+	}
+}
+
+// 只读的快照视图，用于需要同时读取多个key的操作
+// 事务中的快照也包括事务内已有的写入
+func (d *DB) snapshot() (*DB, func()) {
+	if d.tx != nil {
+		writes := make(map[string][]byte, len(d.tx.writes))
+		for k, v := range d.tx.writes {
+			writes[k] = v
+		}
+		view := &DB{rdb: d.rdb, wo: d.wo, ro: d.ro, snap: d.snap, caches: lru.New(16), tx: &txn{writes: writes}}
+		return view, func() {}
+	}
+	snap := d.rdb.NewSnapshot()
+	ro := gorocksdb.NewDefaultReadOptions()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	view := &DB{rdb: d.rdb, wo: d.wo, ro: ro, snap: snap, caches: lru.New(16)}
+	return view, func() {
+		ro.Destroy()
+		d.rdb.ReleaseSnapshot(snap)
+	}
+}
+
+func (t *txn) get(key []byte) ([]byte, bool) {
+	v, ok := t.writes[string(key)]
+	if !ok || v == nil {
+		return nil, ok
+	}
+	return copyBytes(v), true
+}
+
+func (t *txn) put(key, value []byte) {
+	// nil表示删除，空值需要保存为[]byte{}
+	t.writes[string(key)] = append([]byte{}, value...)
+}
+
+func (t *txn) delete(key []byte) {
+	t.writes[string(key)] = nil
+}
+
+func (t *txn) apply(batch *gorocksdb.WriteBatch) {
+	it := batch.NewIterator()
+	for it.Next() {
+		rec := it.Record()
+		if rec.Type == gorocksdb.WriteBatchDeletionRecord {
+			t.delete(rec.Key)
+		} else {
+			t.put(rec.Key, rec.Value)
+		}
+	}
+}
+
+// rocksdb迭代器和事务迭代器的公共接口
+// 方向由Seek/SeekForPrev/SeekToLast决定，之后只能沿同一个方向移动
+type iterator interface {
+	Seek(key []byte)
+	SeekForPrev(key []byte)
+	SeekToLast()
+	Valid() bool
+	Next()
+	Prev()
+	Key() []byte
+	Value() []byte
+	Close()
+}
+
+type rocksIterator struct {
+	it *gorocksdb.Iterator
+}
+
+func (r *rocksIterator) Seek(key []byte)        { r.it.Seek(key) }
+func (r *rocksIterator) SeekForPrev(key []byte) { r.it.SeekForPrev(key) }
+func (r *rocksIterator) SeekToLast()            { r.it.SeekToLast() }
+func (r *rocksIterator) Valid() bool            { return r.it.Valid() }
+func (r *rocksIterator) Next()                  { r.it.Next() }
+func (r *rocksIterator) Prev()                  { r.it.Prev() }
+func (r *rocksIterator) Key() []byte            { return r.it.Key().Data() }
+func (r *rocksIterator) Value() []byte          { return r.it.Value().Data() }
+func (r *rocksIterator) Close()                 { r.it.Close() }
+
+// 合并快照和事务内写入的迭代器，同一个key以事务内的为准，删除的key被跳过
+type txIterator struct {
+	base    iterator
+	keys    []string // 创建时事务内写入的key，有序
+	vals    [][]byte
+	pos     int
+	forward bool
+
+	key, value []byte
+	valid      bool
+	useBase    bool
+	useTx      bool
+}
+
+func newTxIterator(base iterator, writes map[string][]byte) *txIterator {
+	t := &txIterator{base: base, keys: make([]string, 0, len(writes))}
+	for k := range writes {
+		t.keys = append(t.keys, k)
+	}
+	sort.Strings(t.keys)
+	t.vals = make([][]byte, len(t.keys))
+	for i, k := range t.keys {
+		t.vals[i] = writes[k]
+	}
+	return t
+}
+
+func (t *txIterator) Seek(key []byte) {
+	t.base.Seek(key)
+	t.pos = sort.SearchStrings(t.keys, string(key))
+	t.forward = true
+	t.settle()
+}
+
+func (t *txIterator) SeekForPrev(key []byte) {
+	t.base.SeekForPrev(key)
+	t.pos = sort.Search(len(t.keys), func(i int) bool { return t.keys[i] > string(key) }) - 1
+	t.forward = false
+	t.settle()
+}
+
+func (t *txIterator) SeekToLast() {
+	t.base.SeekToLast()
+	t.pos = len(t.keys) - 1
+	t.forward = false
+	t.settle()
+}
+
+func (t *txIterator) Valid() bool   { return t.valid }
+func (t *txIterator) Key() []byte   { return t.key }
+func (t *txIterator) Value() []byte { return t.value }
+func (t *txIterator) Close()        { t.base.Close() }
+
+func (t *txIterator) Next() {
+	t.step()
+	t.settle()
+}
+
+func (t *txIterator) Prev() {
+	t.step()
+	t.settle()
+}
+
+// 越过当前的key
+func (t *txIterator) step() {
+	if t.useTx {
+		if t.forward {
+			t.pos++
+		} else {
+			t.pos--
+		}
+	}
+	if t.useBase {
+		if t.forward {
+			t.base.Next()
+		} else {
+			t.base.Prev()
+		}
+	}
+}
+
+// 按方向选出下一个key
+func (t *txIterator) settle() {
+	for {
+		bv, tv := t.base.Valid(), t.pos >= 0 && t.pos < len(t.keys)
+		if !bv && !tv {
+			t.valid, t.useBase, t.useTx = false, false, false
+			return
+		}
+		cmp := 0
+		switch {
+		case !bv:
+			cmp = 1
+		case !tv:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(t.base.Key(), []byte(t.keys[t.pos]))
+			if !t.forward {
+				cmp = -cmp
+			}
+		}
+		t.useBase, t.useTx = cmp <= 0, cmp >= 0
+		if !t.useTx {
+			t.key, t.value = t.base.Key(), t.base.Value()
+		} else if t.vals[t.pos] == nil {
+			t.step()
+			continue
+		} else {
+			t.key, t.value = []byte(t.keys[t.pos]), t.vals[t.pos]
+		}
+		t.valid = true
+		return
+	}
+}
@@ -0,0 +1,108 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("a"), []byte("1")))
+	ensure.Nil(t, db.Set([]byte("c"), []byte("3")))
+
+	tx := db.Begin()
+	ensure.Nil(t, tx.Set([]byte("b"), []byte("2")))
+	ensure.Nil(t, tx.Delete([]byte("c")))
+	l, err := tx.List([]byte("l"))
+	ensure.Nil(t, err)
+	_, err = l.RPush([]byte("x"), []byte("y"))
+	ensure.Nil(t, err)
+
+	// 事务内可以读到自己的写入
+	val, err := tx.Get([]byte("b"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("2"))
+	val, err = tx.Get([]byte("c"))
+	ensure.Nil(t, err)
+	ensure.True(t, val == nil)
+	ensure.True(t, tx.TypeOf([]byte("l")) == LIST)
+
+	// 迭代时合并快照和事务内的写入
+	keys := make([]string, 0)
+	tx.PrefixEnumerate([]byte("+"), IterForward, func(i int, key, value []byte, quit *bool) {
+		keys = append(keys, string(key))
+	})
+	ensure.DeepEqual(t, keys, []string{"+a,s", "+b,s", "+l,l"})
+	keys = keys[:0]
+	tx.PrefixEnumerate([]byte("+"), IterBackward, func(i int, key, value []byte, quit *bool) {
+		keys = append(keys, string(key))
+	})
+	ensure.DeepEqual(t, keys, []string{"+l,l", "+b,s", "+a,s"})
+
+	ensure.Nil(t, tx.Commit())
+
+	val, _ = db.Get([]byte("b"))
+	ensure.DeepEqual(t, val, []byte("2"))
+	val, _ = db.Get([]byte("c"))
+	ensure.True(t, val == nil)
+	l, err = db.List([]byte("l"))
+	ensure.Nil(t, err)
+	ensure.True(t, l.Len() == 2)
+}
+
+func TestTxnRollback(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.Set([]byte("a"), []byte("1")))
+	// 缓存中已有的对象在事务提交后必须失效
+	h, err := db.Hash([]byte("h"))
+	ensure.Nil(t, err)
+	ensure.Nil(t, h.Set([]byte("f"), []byte("v")))
+
+	tx := db.Begin()
+	ensure.Nil(t, tx.Set([]byte("a"), []byte("2")))
+	ensure.Nil(t, tx.Delete([]byte("h")))
+	tx.Rollback()
+
+	val, _ := db.Get([]byte("a"))
+	ensure.DeepEqual(t, val, []byte("1"))
+	ensure.True(t, db.TypeOf([]byte("h")) == HASH)
+
+	tx = db.Begin()
+	ensure.Nil(t, tx.Delete([]byte("h")))
+	ensure.Nil(t, tx.Set([]byte("h"), []byte("s")))
+	ensure.Nil(t, tx.Commit())
+
+	ensure.True(t, db.TypeOf([]byte("h")) == STRING)
+	_, err = db.Hash([]byte("h"))
+	ensure.True(t, err == ErrWrongType)
+}
+
+func TestTxnSnapshot(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	s, _ := db.SetOf([]byte("s1"))
+	_, err := s.Add([]byte("a"), []byte("b"), []byte("c"))
+	ensure.Nil(t, err)
+
+	tx := db.Begin()
+	s2, _ := tx.SetOf([]byte("s2"))
+	_, err = s2.Add([]byte("b"), []byte("c"), []byte("d"))
+	ensure.Nil(t, err)
+
+	// 集合运算读取到事务内还没提交的set
+	members := make([]string, 0)
+	err = tx.SetCombine(SetInter, [][]byte{[]byte("s1"), []byte("s2")}, func(member []byte, quit *bool) {
+		members = append(members, string(member))
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, members, []string{"b", "c"})
+
+	ensure.Nil(t, tx.Commit())
+	s2, _ = db.SetOf([]byte("s2"))
+	ensure.True(t, s2.Len() == 3)
+}
@@ -19,6 +19,10 @@ var (
 	SOK = []byte{'['} // Start of Key
 	//结束
 	EOK = []byte{']'} // End of Key
+	//过期时间
+	EXPIRE = []byte{'e'} // e[key] = deadline
+	//按过期时间排序的索引
+	DEADLINE = []byte{'x'} // x<deadline>key = ""
 )
 
 type ElementType byte
@@ -29,13 +33,15 @@ const (
 	HASH                  = 'h'
 	LIST                  = 'l'
 	SORTEDSET             = 'z'
+	SET                   = 'S' // 's' is taken by string, members use s[key]
+	BITMAP                = 'b' // string saved in chunks, see bitmap.go
 	NONE                  = '0'
 )
 
 //返回类型说明
 func (e ElementType) String() string {
 	switch byte(e) {
-	case 's':
+	case 's', 'b':
 		return "string"
 	case 'h':
 		return "hash"
@@ -43,6 +49,8 @@ func (e ElementType) String() string {
 		return "list"
 	case 'z':
 		return "sortedset"
+	case 'S':
+		return "set"
 	default:
 		return "none"
 	}
@@ -72,6 +80,19 @@ func between(v, min, max []byte) bool {
 	return bytes.Compare(v, min) >= 0 && bytes.Compare(v, max) <= 0
 }
 
+// 前缀的上界，所有以prefix开头的key都小于它
+// prefix+MAXBYTE不够，比如 z[key]s 后面跟着 0xFF 0xF0 开头的分数
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < MAXBYTE {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return append(end, MAXBYTE)
+}
+
 // 复制数组
 func copyBytes(src []byte) []byte {
 	dst := make([]byte, len(src))
@@ -91,3 +112,30 @@ func Int64ToBytes(i int64) []byte {
 func BytesToInt64(buf []byte) int64 {
 	return int64(binary.BigEndian.Uint64(buf))
 }
+
+// 编码float64，编码后的字节序和数值大小一致：
+// 正数翻转符号位，负数翻转全部位
+func Float64ToBytes(f float64) []byte {
+	if f == 0 {
+		f = 0 // -0 => +0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, bits)
+	return buf
+}
+
+func BytesToFloat64(buf []byte) float64 {
+	bits := binary.BigEndian.Uint64(buf)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
@@ -0,0 +1,202 @@
+package rocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/tecbot/gorocksdb"
+)
+
+// 基于rocksdb WAL的复制
+// 每次写入都是WAL中的一个WriteBatch，带有递增的序列号，WAL本身就是持久化的写入日志。
+// 主库按序列号顺序发送WriteBatch，从库原样写入，并在同一个WriteBatch中记录下一个序列号，
+// 断开之后从记录的序列号继续。主库的WAL需要保留足够长的时间，见Options.SetWALTtlSeconds
+//
+// 序列号之前的快照加上之后的WAL可以得到完整的数据，重复写入同样的Put/Delete结果不变
+
+// 内部使用的key，~name = value，排在所有数据类型的前缀之后
+// 不参与复制，FLUSHALL也不会删除
+var META = []byte{'~'}
+
+// 请求的序列号已经不在WAL中，需要全量同步
+var ErrWALGap = errors.New("sequence number is no longer available in the WAL")
+
+var errBadBatch = errors.New("unsupported record in write batch")
+
+func metaKey(name string) []byte {
+	return append(append([]byte{}, META...), name...)
+}
+
+// 不复制的key：内部的key和用于seek to last的key
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, META) || (len(key) == 1 && key[0] == MAXBYTE)
+}
+
+func (d *DB) Meta(name string) ([]byte, error) {
+	return d.RawGet(metaKey(name))
+}
+
+func (d *DB) SetMeta(name string, value []byte) error {
+	return d.RawSet(metaKey(name), value)
+}
+
+func (d *DB) DeleteMeta(name string) error {
+	return d.RawDelete(metaKey(name))
+}
+
+// 依次读取名称以prefix开头的内部key，name不包括META
+func (d *DB) MetaEnumerate(prefix string, fn func(name string, value []byte)) {
+	d.PrefixEnumerate(metaKey(prefix), IterForward, func(i int, key, value []byte, quit *bool) {
+		fn(string(key[len(META):]), value)
+	})
+}
+
+// 数据库的编号，第一次打开时生成
+// 序列号只在同一个数据库中有意义，从库用编号判断记录的序列号是否还能继续使用
+func (d *DB) ID() string {
+	return d.id
+}
+
+func (d *DB) loadID() string {
+	if id, err := d.Meta("id"); err == nil && len(id) > 0 {
+		return string(id)
+	}
+	b := make([]byte, 20)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	d.SetMeta("id", []byte(id))
+	return id
+}
+
+// 最后一次写入的序列号
+func (d *DB) LatestSequence() uint64 {
+	return d.rdb.GetLatestSequenceNumber()
+}
+
+// 从序列号seq开始依次读取WAL中的WriteBatch，返回下一个需要读取的序列号
+// seq之后的写入已经不在WAL中时返回ErrWALGap
+func (d *DB) UpdatesSince(seq uint64, fn func(seq uint64, data []byte) error) (uint64, error) {
+	latest := d.LatestSequence()
+	if seq > latest {
+		return seq, nil
+	}
+	iter, err := d.rdb.GetUpdatesSince(seq)
+	if err != nil {
+		return seq, ErrWALGap
+	}
+	defer iter.Destroy()
+	for ; iter.Valid(); iter.Next() {
+		batch, start := iter.GetBatch()
+		count := uint64(batch.Count())
+		data := batch.Data()
+		batch.Destroy()
+		// 第一个WriteBatch可能包含seq之前的写入
+		if start+count <= seq {
+			continue
+		}
+		if start != seq {
+			return seq, ErrWALGap
+		}
+		if err := fn(start, data); err != nil {
+			return seq, err
+		}
+		seq = start + count
+	}
+	if err := iter.Err(); err != nil {
+		return seq, err
+	}
+	if seq <= latest {
+		return seq, ErrWALGap
+	}
+	return seq, nil
+}
+
+// 遍历当前数据的快照，跳过内部的key，返回之后需要从WAL读取的序列号
+func (d *DB) SnapshotAll(fn func(key, value []byte) error) (uint64, error) {
+	// 先取序列号再创建快照，快照中可能已经包含之后的写入，重复写入没有影响
+	seq := d.LatestSequence() + 1
+	view, release := d.snapshot()
+	defer release()
+	iter := view.newIterator()
+	defer iter.Close()
+	for iter.Seek(nil); iter.Valid(); iter.Next() {
+		if isInternalKey(iter.Key()) {
+			continue
+		}
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// WriteBatch中的写入个数，也是它占用的序列号个数
+func BatchCount(data []byte) uint64 {
+	batch := gorocksdb.WriteBatchFrom(data)
+	defer batch.Destroy()
+	return uint64(batch.Count())
+}
+
+// 写入主库WAL中的一个WriteBatch，跳过其中内部的key
+// meta是同时写入的内部key，比如从库记录的序列号，和数据在同一个WriteBatch中写入
+func (d *DB) ApplyBatch(data []byte, meta map[string][]byte) error {
+	src := gorocksdb.WriteBatchFrom(data)
+	defer src.Destroy()
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	var keys [][]byte
+	iter := src.NewIterator()
+	for iter.Next() {
+		rec := iter.Record()
+		if isInternalKey(rec.Key) {
+			continue
+		}
+		switch rec.Type {
+		case gorocksdb.WriteBatchValueRecord:
+			batch.Put(rec.Key, rec.Value)
+		case gorocksdb.WriteBatchDeletionRecord:
+			batch.Delete(rec.Key)
+		default:
+			return errBadBatch
+		}
+		keys = append(keys, rec.Key)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return d.writeReplicated(batch, keys, meta)
+}
+
+// 写入主库快照中的key和value，kvs是key, value交替，全量同步时使用
+func (d *DB) PutRaw(kvs [][]byte, meta map[string][]byte) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	var keys [][]byte
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if isInternalKey(kvs[i]) {
+			continue
+		}
+		batch.Put(kvs[i], kvs[i+1])
+		keys = append(keys, kvs[i])
+	}
+	return d.writeReplicated(batch, keys, meta)
+}
+
+// 绕过了类型检查的写入，key的类型可能改变，需要清除缓存的对象
+// 只从+key,type中取得key，内容的变化无法对应到key，全部WATCH都算作修改
+func (d *DB) writeReplicated(batch *gorocksdb.WriteBatch, keys [][]byte, meta map[string][]byte) error {
+	for name, value := range meta {
+		batch.Put(metaKey(name), value)
+	}
+	if err := d.WriteBatch(batch); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if bytes.HasPrefix(key, KEY) && len(key) >= len(KEY)+len(SEP)+1 {
+			d.uncache(key[len(KEY) : len(key)-len(SEP)-1])
+		}
+	}
+	d.touchAll()
+	return nil
+}
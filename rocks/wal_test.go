@@ -0,0 +1,90 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+// 把主库的写入按WAL复制到从库
+func replicate(t *testing.T, master, replica *DB, seq uint64) uint64 {
+	next, err := master.UpdatesSince(seq, func(seq uint64, data []byte) error {
+		return replica.ApplyBatch(data, map[string][]byte{"seq": Int64ToBytes(int64(seq))})
+	})
+	ensure.Nil(t, err)
+	return next
+}
+
+func TestWALReplicate(t *testing.T) {
+	master := New(newRocksDB(t))
+	defer master.Close()
+	replica := New(newRocksDB(t))
+	defer replica.Close()
+	ensure.True(t, master.ID() != replica.ID())
+
+	ensure.Nil(t, master.Set([]byte("name"), []byte("latermoon")))
+	h, _ := master.Hash([]byte("info"))
+	ensure.Nil(t, h.Set([]byte("age"), []byte("27")))
+
+	// 快照之后的写入从WAL读取
+	var kvs [][]byte
+	seq, err := master.SnapshotAll(func(key, value []byte) error {
+		ensure.False(t, isInternalKey(key))
+		kvs = append(kvs, copyBytes(key), copyBytes(value))
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.Nil(t, replica.PutRaw(kvs, nil))
+	ensure.Nil(t, master.Set([]byte("name"), []byte("v2")))
+	l, _ := master.List([]byte("list"))
+	l.RPush([]byte("a"), []byte("b"))
+	ensure.Nil(t, master.Delete([]byte("info")))
+	seq = replicate(t, master, replica, seq)
+	ensure.DeepEqual(t, seq, master.LatestSequence()+1)
+
+	val, _ := replica.Get([]byte("name"))
+	ensure.DeepEqual(t, string(val), "v2")
+	ensure.True(t, replica.TypeOf([]byte("info")) == NONE)
+	rl, _ := replica.List([]byte("list"))
+	ensure.True(t, rl.Len() == 2)
+	// 从库自己的编号不会被覆盖
+	id, _ := replica.Meta("id")
+	ensure.DeepEqual(t, string(id), replica.ID())
+	_, err = replica.Meta("seq")
+	ensure.Nil(t, err)
+
+	// 从库缓存的对象在类型改变之后失效
+	ensure.Nil(t, master.Set([]byte("list"), []byte("str")))
+	seq = replicate(t, master, replica, seq)
+	_, err = replica.List([]byte("list"))
+	ensure.DeepEqual(t, err, ErrWrongType)
+
+	// 没有新的写入
+	ensure.DeepEqual(t, replicate(t, master, replica, seq), seq)
+}
+
+func TestWALGap(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+	ensure.Nil(t, db.Set([]byte("a"), []byte("1")))
+	ensure.Nil(t, db.MSet([]byte("b"), []byte("2"), []byte("c"), []byte("3")))
+	latest := db.LatestSequence()
+
+	// 从一个WriteBatch的中间开始
+	_, err := db.UpdatesSince(latest, func(seq uint64, data []byte) error { return nil })
+	ensure.DeepEqual(t, err, ErrWALGap)
+}
+
+func TestMetaEnumerate(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	ensure.Nil(t, db.SetMeta("owner:a", []byte("1")))
+	ensure.Nil(t, db.SetMeta("owner:b", []byte("2")))
+	ensure.Nil(t, db.SetMeta("other", []byte("3")))
+	ensure.Nil(t, db.Set([]byte("owner:c"), []byte("v")))
+	got := map[string]string{}
+	db.MetaEnumerate("owner:", func(name string, value []byte) {
+		got[name] = string(value)
+	})
+	ensure.DeepEqual(t, got, map[string]string{"owner:a": "1", "owner:b": "2"})
+}
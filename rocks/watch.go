@@ -0,0 +1,80 @@
+package rocks
+
+import (
+	"sync"
+)
+
+// WATCH使用的修改计数
+// 只记录被WATCH的key，每次写入key时计数加一，EXEC比较计数判断key是否被修改过
+type watchedKeys struct {
+	mu   sync.Mutex
+	keys map[string]*watchEntry
+}
+
+type watchEntry struct {
+	refs    int    // WATCH这个key的连接数
+	version uint64 // 修改次数
+}
+
+// 开始跟踪key的修改，返回当前的计数，必须和Unwatch成对调用
+func (d *DB) Watch(key []byte) uint64 {
+	w := &d.watched
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys == nil {
+		w.keys = make(map[string]*watchEntry)
+	}
+	e, ok := w.keys[string(key)]
+	if !ok {
+		e = &watchEntry{}
+		w.keys[string(key)] = e
+	}
+	e.refs++
+	return e.version
+}
+
+func (d *DB) Unwatch(key []byte) {
+	w := &d.watched
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.keys[string(key)]; ok {
+		if e.refs--; e.refs <= 0 {
+			delete(w.keys, string(key))
+		}
+	}
+}
+
+// 被WATCH的key的当前计数
+func (d *DB) Version(key []byte) uint64 {
+	w := &d.watched
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.keys[string(key)]; ok {
+		return e.version
+	}
+	return 0
+}
+
+// 所有写入路径都要调用，事务内的修改在Commit时计数
+func (d *DB) touch(key []byte) {
+	if d.tx != nil {
+		d.tx.touched[string(key)] = true
+		return
+	}
+	w := &d.watched
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.keys[string(key)]; ok {
+		e.version++
+	}
+}
+
+// 清空数据时全部被WATCH的key都算作修改
+func (d *DB) touchAll() {
+	w := &d.watched
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, e := range w.keys {
+		e.version++
+	}
+}
@@ -0,0 +1,71 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"testing"
+)
+
+func TestWatchVersion(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	keys := []string{"s", "h", "l", "z", "set", "b"}
+	versions := make(map[string]uint64)
+	for _, k := range keys {
+		versions[k] = db.Watch([]byte(k))
+	}
+	changed := func(k string) bool {
+		v := db.Version([]byte(k))
+		old := versions[k]
+		versions[k] = v
+		return v != old
+	}
+
+	ensure.Nil(t, db.Set([]byte("s"), []byte("1")))
+	ensure.True(t, changed("s"))
+	_, err := db.IncrBy([]byte("s"), 1)
+	ensure.Nil(t, err)
+	ensure.True(t, changed("s"))
+
+	h, _ := db.Hash([]byte("h"))
+	ensure.Nil(t, h.Set([]byte("f"), []byte("v")))
+	ensure.True(t, changed("h"))
+	l, _ := db.List([]byte("l"))
+	_, err = l.LPush([]byte("x"))
+	ensure.Nil(t, err)
+	ensure.True(t, changed("l"))
+	z, _ := db.SortedSet([]byte("z"))
+	_, err = z.Add(0, ScoreMember{1, []byte("m")})
+	ensure.Nil(t, err)
+	ensure.True(t, changed("z"))
+	s, _ := db.SetOf([]byte("set"))
+	_, err = s.Add([]byte("m"))
+	ensure.Nil(t, err)
+	ensure.True(t, changed("set"))
+	_, err = db.SetBit([]byte("b"), 7, 1)
+	ensure.Nil(t, err)
+	ensure.True(t, changed("b"))
+
+	// 读取不改变计数
+	_, err = h.Get([]byte("f"))
+	ensure.Nil(t, err)
+	ensure.False(t, changed("h"))
+
+	_, err = db.ExpireAt([]byte("h"), nowMs()+100000)
+	ensure.Nil(t, err)
+	ensure.True(t, changed("h"))
+	ensure.Nil(t, db.Delete([]byte("l")))
+	ensure.True(t, changed("l"))
+
+	// 事务内的修改在提交时计数
+	tx := db.Begin()
+	ensure.Nil(t, tx.Set([]byte("s"), []byte("2")))
+	ensure.False(t, changed("s"))
+	ensure.Nil(t, tx.Commit())
+	ensure.True(t, changed("s"))
+
+	for _, k := range keys {
+		db.Unwatch([]byte(k))
+	}
+	ensure.True(t, len(db.watched.keys) == 0)
+}
@@ -4,20 +4,56 @@ import (
 	"bytes"
 	"errors"
 	"github.com/tecbot/gorocksdb"
+	"math"
+	"strconv"
 	"sync"
 )
 
 // SortedSet
-// +key,z = ""
-// z[key]m member = score
-// z[key]s score member = ""
+// +key,z = "count"
+// z[key]m member = <score>
+// z[key]s <score> member = ""
+// <score> is Float64ToBytes(score), 8 bytes in numeric order
 type SortedSetElement struct {
 	db  *DB
 	key []byte
 	mu  sync.RWMutex
 }
 
-type SortedSetEnumerateFunc func(i int, score, member []byte, quit *bool)
+// member is a copy and safe to retain
+type SortedSetEnumerateFunc func(i int, score float64, member []byte, quit *bool)
+
+// ZADD options
+type ZAddFlag int
+
+const (
+	ZAddNX ZAddFlag = 1 << iota // only add new elements
+	ZAddXX                      // only update existing elements
+	ZAddGT                      // only update when new score is greater
+	ZAddLT                      // only update when new score is less
+	ZAddCH                      // count changed elements as well as added
+)
+
+type ScoreMember struct {
+	Score  float64
+	Member []byte
+}
+
+// score interval, Min/Max can be +/-Inf
+type ScoreRange struct {
+	Min, Max     float64
+	MinEx, MaxEx bool // exclusive bounds, "(1.5" in redis
+}
+
+func (r ScoreRange) contains(score float64) bool {
+	if score < r.Min || (r.MinEx && score == r.Min) {
+		return false
+	}
+	if score > r.Max || (r.MaxEx && score == r.Max) {
+		return false
+	}
+	return true
+}
 
 func NewSortedSetElement(db *DB, key []byte) *SortedSetElement {
 	s := &SortedSetElement{db: db, key: key}
@@ -25,97 +61,429 @@ func NewSortedSetElement(db *DB, key []byte) *SortedSetElement {
 }
 
 // http://redis.io/commands/zadd#return-value
-func (s *SortedSetElement) Add(scoreMembers ...[]byte) (int, error) {
+func (s *SortedSetElement) Add(flags ZAddFlag, pairs ...ScoreMember) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	count := len(scoreMembers)
-	if count < 2 || count%2 != 0 {
+	if len(pairs) == 0 {
 		return 0, errors.New("invalid score/member pairs")
 	}
 
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
 
-	added := 0
-	for i := 0; i < count; i += 2 {
-		score, member := scoreMembers[i], scoreMembers[i+1]
-		skey, mkey := s.scoreKey(score, member), s.memberKey(member)
-
-		// remove old score key
-		oldscore, err := s.db.RawGet(mkey)
-		if err != nil {
-			return 0, err
-		} else if oldscore != nil {
-			batch.Delete(skey)
+	// members appear twice in one call see the pending score
+	pending := make(map[string]float64)
+	added, changed := 0, 0
+	for _, pair := range pairs {
+		score, member := pair.Score, pair.Member
+		old, exists := pending[string(member)]
+		if !exists {
+			var err error
+			if old, exists, err = s.score(member); err != nil {
+				return 0, err
+			}
+		}
+		if !s.allowed(flags, exists, old, score) || (exists && old == score) {
+			continue
+		}
+		if exists {
+			batch.Delete(s.scoreKey(old, member))
+			changed++
 		} else {
 			added++
 		}
+		batch.Put(s.memberKey(member), Float64ToBytes(score))
+		batch.Put(s.scoreKey(score, member), nil)
+		pending[string(member)] = score
+	}
+
+	if added+changed == 0 {
+		return 0, nil
+	}
+	if _, err := s.putCount(batch, added); err != nil {
+		return 0, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	s.db.notify(NotifySortedSet, "zadd", s.key)
+	if flags&ZAddCH != 0 {
+		return added + changed, nil
+	}
+	return added, nil
+}
+
+// ZADD ... INCR / ZINCRBY, returns false if flags prevent the update
+func (s *SortedSetElement) IncrBy(flags ZAddFlag, delta float64, member []byte) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists, err := s.score(member)
+	if err != nil {
+		return 0, false, err
+	}
+	score := old + delta
+	if math.IsNaN(score) {
+		return 0, false, errors.New("resulting score is not a number (NaN)")
+	}
+	if !s.allowed(flags, exists, old, score) {
+		return 0, false, nil
+	}
+	if exists && old == score {
+		return score, true, nil
+	}
 
-		// put new value
-		batch.Put(mkey, score)
-		batch.Put(skey, nil)
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	added := 1
+	if exists {
+		batch.Delete(s.scoreKey(old, member))
+		added = 0
+	}
+	batch.Put(s.memberKey(member), Float64ToBytes(score))
+	batch.Put(s.scoreKey(score, member), nil)
+	if _, err := s.putCount(batch, added); err != nil {
+		return 0, false, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, false, err
 	}
+	s.db.notify(NotifySortedSet, "zincr", s.key)
+	return score, true, nil
+}
 
-	return added, s.db.WriteBatch(batch)
+// NX/XX/GT/LT check
+func (s *SortedSetElement) allowed(flags ZAddFlag, exists bool, old, score float64) bool {
+	if exists {
+		if flags&ZAddNX != 0 {
+			return false
+		}
+		if flags&ZAddGT != 0 && score <= old {
+			return false
+		}
+		if flags&ZAddLT != 0 && score >= old {
+			return false
+		}
+	} else if flags&ZAddXX != 0 {
+		return false
+	}
+	return true
 }
 
-func (s *SortedSetElement) Score(member []byte) ([]byte, error) {
+func (s *SortedSetElement) Score(member []byte) (float64, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.score(member)
 }
 
-func (s *SortedSetElement) score(member []byte) ([]byte, error) {
-	return s.db.RawGet(s.memberKey(member))
+func (s *SortedSetElement) score(member []byte) (float64, bool, error) {
+	val, err := s.db.RawGet(s.memberKey(member))
+	if err != nil || len(val) != 8 {
+		return 0, false, err
+	}
+	return BytesToFloat64(val), true, nil
 }
 
 func (s *SortedSetElement) Remove(members ...[]byte) (int, error) {
-	return 0, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	removed := make(map[string]bool)
+	for _, member := range members {
+		if removed[string(member)] {
+			continue
+		}
+		score, exists, err := s.score(member)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			continue
+		}
+		batch.Delete(s.memberKey(member))
+		batch.Delete(s.scoreKey(score, member))
+		removed[string(member)] = true
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	left, err := s.putCount(batch, -len(removed))
+	if err != nil {
+		return 0, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	s.notifyRemoved("zrem", left)
+	return len(removed), nil
 }
 
-// +key,z = ""
-func (s *SortedSetElement) rawKey() []byte {
-	return rawKey(s.key, SORTEDSET)
+func (s *SortedSetElement) RemoveByScore(r ScoreRange) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	n := 0
+	s.rangeByScore(r, false, func(i int, score float64, member []byte, quit *bool) {
+		batch.Delete(s.memberKey(member))
+		batch.Delete(s.scoreKey(score, member))
+		n++
+	})
+	if n == 0 {
+		return 0, nil
+	}
+	left, err := s.putCount(batch, -n)
+	if err != nil {
+		return 0, err
+	}
+	s.db.touch(s.key)
+	if err := s.db.WriteBatch(batch); err != nil {
+		return 0, err
+	}
+	s.notifyRemoved("zremrangebyscore", left)
+	return n, nil
 }
 
-// z[key]
-func (s *SortedSetElement) keyPrefix() []byte {
-	return bytes.Join([][]byte{[]byte{SORTEDSET}, SOK, s.key, EOK}, nil)
+// 删除成员后的通知，删空时还有del
+func (s *SortedSetElement) notifyRemoved(event string, left int64) {
+	s.db.notify(NotifySortedSet, event, s.key)
+	if left == 0 {
+		s.db.notify(NotifyGeneric, "del", s.key)
+	}
 }
 
-func (s *SortedSetElement) memberKey(member []byte) []byte {
-	return bytes.Join([][]byte{s.keyPrefix(), []byte{'m'}, member}, nil)
+// ZCARD
+func (s *SortedSetElement) Len() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, _ := s.count()
+	return n
 }
 
-func (s *SortedSetElement) scoreKey(score, member []byte) []byte {
-	return bytes.Join([][]byte{s.keyPrefix(), []byte{'s'}, score, []byte{' '}, member}, nil)
+// ZCOUNT
+func (s *SortedSetElement) Count(r ScoreRange) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	s.rangeByScore(r, false, func(i int, score float64, member []byte, quit *bool) {
+		n++
+	})
+	return n
 }
 
-// split (z[key]s score member) into (score, member)
-func (s *SortedSetElement) splitScoreKey(skey []byte) ([]byte, []byte, error) {
-	buf := bytes.TrimPrefix(skey, s.keyPrefix())
-	pairs := bytes.Split(buf[1:], []byte{' '}) // skip score mark 's'
-	if len(pairs) != 2 {
-		return nil, nil, errors.New("invalid score/member key: " + string(skey))
+// ZRANK/ZREVRANK, returns false if member not exists
+func (s *SortedSetElement) Rank(member []byte, reverse bool) (int64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	score, exists, err := s.score(member)
+	if err != nil || !exists {
+		return 0, false, err
 	}
-	return pairs[0], pairs[1], nil
+	skey := s.scoreKey(score, member)
+	rank := int64(0)
+	s.db.PrefixEnumerate(s.scorePrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
+		if bytes.Compare(key, skey) >= 0 {
+			*quit = true
+			return
+		}
+		rank++
+	})
+	if reverse {
+		n, err := s.count()
+		if err != nil {
+			return 0, false, err
+		}
+		rank = n - 1 - rank
+	}
+	return rank, true, nil
 }
 
-// split (z[key]m member) into (member)
-func (s *SortedSetElement) splitMemberKey(mkey []byte) ([]byte, error) {
-	buf := bytes.TrimPrefix(mkey, s.keyPrefix())
-	return buf[1:], nil // skip member mark 'm'
-}
+// ZRANGE/ZREVRANGE, start/stop can be negative as redis
+func (s *SortedSetElement) RangeByIndex(start, stop int64, reverse bool, fn SortedSetEnumerateFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, err := s.count()
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil
+	}
 
-func (s *SortedSetElement) RemoveByScore(min, max []byte) (int, error) {
-	return 0, nil
+	direction := IterForward
+	if reverse {
+		direction = IterBackward
+	}
+	prefix := s.scorePrefix()
+	j := -1
+	s.db.PrefixEnumerate(prefix, direction, func(i int, key, value []byte, quit *bool) {
+		if int64(i) < start {
+			return
+		}
+		j++
+		score, member := s.splitScoreKey(key)
+		fn(j, score, member, quit)
+		if int64(i) >= stop {
+			*quit = true
+		}
+	})
+	return nil
 }
 
-func (s *SortedSetElement) RangeByScore(min, max []byte, fn SortedSetEnumerateFunc) error {
+// ZRANGEBYSCORE/ZREVRANGEBYSCORE
+func (s *SortedSetElement) RangeByScore(r ScoreRange, reverse bool, fn SortedSetEnumerateFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.rangeByScore(r, reverse, fn)
 	return nil
 }
 
-func (s *SortedSetElement) RangeByMember(min, max []byte, fu SortedSetEnumerateFunc) error {
+func (s *SortedSetElement) rangeByScore(r ScoreRange, reverse bool, fn SortedSetEnumerateFunc) {
+	prefix := s.scorePrefix()
+	min := bytes.Join([][]byte{prefix, Float64ToBytes(r.Min)}, nil)
+	max := prefixEnd(prefix)
+	direction := IterForward
+	if reverse {
+		direction = IterBackward
+		if !math.IsInf(r.Max, 1) {
+			// all keys with score <= Max sort before the next float
+			max = bytes.Join([][]byte{prefix, Float64ToBytes(math.Nextafter(r.Max, math.Inf(1)))}, nil)
+		}
+	}
+
+	j := -1
+	s.db.RangeEnumerate(min, max, direction, func(i int, key, value []byte, quit *bool) {
+		if !bytes.HasPrefix(key, prefix) {
+			*quit = true
+			return
+		}
+		score, member := s.splitScoreKey(key)
+		if !r.contains(score) {
+			// past the far end, or still on the excluded bound
+			if (!reverse && score > r.Max) || (reverse && score < r.Min) {
+				*quit = true
+			}
+			return
+		}
+		j++
+		fn(j, score, member, quit)
+	})
+}
+
+// enumerate members in lexicographical order, min/max inclusive, nil for unbounded
+func (s *SortedSetElement) RangeByMember(min, max []byte, fn SortedSetEnumerateFunc) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := s.memberPrefix()
+	j := -1
+	s.db.RangeEnumerate(append(copyBytes(prefix), min...), prefixEnd(prefix), IterForward, func(i int, key, value []byte, quit *bool) {
+		if !bytes.HasPrefix(key, prefix) {
+			*quit = true
+			return
+		}
+		member := key[len(prefix):]
+		if max != nil && bytes.Compare(member, max) > 0 {
+			*quit = true
+			return
+		}
+		j++
+		fn(j, BytesToFloat64(value), copyBytes(member), quit)
+	})
 	return nil
 }
+
+func (s *SortedSetElement) locker() sync.Locker {
+	return &s.mu
+}
+
+func (s *SortedSetElement) dropTo(batch *gorocksdb.WriteBatch) {
+	s.db.PrefixEnumerate(s.keyPrefix(), IterForward, func(i int, key, value []byte, quit *bool) {
+		batch.Delete(copyBytes(key))
+	})
+	batch.Delete(s.rawKey())
+}
+
+// cardinality saved in +key,z
+func (s *SortedSetElement) count() (int64, error) {
+	val, err := s.db.RawGet(s.rawKey())
+	if err != nil || len(val) == 0 {
+		return 0, err
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+// update cardinality by delta, remove raw key when empty
+func (s *SortedSetElement) putCount(batch *gorocksdb.WriteBatch, delta int) (int64, error) {
+	n, err := s.count()
+	if err != nil {
+		return 0, err
+	}
+	n += int64(delta)
+	if n > 0 {
+		batch.Put(s.rawKey(), []byte(strconv.FormatInt(n, 10)))
+	} else {
+		n = 0
+		batch.Delete(s.rawKey())
+	}
+	return n, nil
+}
+
+// +key,z = "count"
+func (s *SortedSetElement) rawKey() []byte {
+	return rawKey(s.key, SORTEDSET)
+}
+
+// z[key]
+func (s *SortedSetElement) keyPrefix() []byte {
+	return bytes.Join([][]byte{[]byte{SORTEDSET}, SOK, s.key, EOK}, nil)
+}
+
+// z[key]m
+func (s *SortedSetElement) memberPrefix() []byte {
+	return bytes.Join([][]byte{s.keyPrefix(), []byte{'m'}}, nil)
+}
+
+// z[key]s
+func (s *SortedSetElement) scorePrefix() []byte {
+	return bytes.Join([][]byte{s.keyPrefix(), []byte{'s'}}, nil)
+}
+
+func (s *SortedSetElement) memberKey(member []byte) []byte {
+	return bytes.Join([][]byte{s.memberPrefix(), member}, nil)
+}
+
+func (s *SortedSetElement) scoreKey(score float64, member []byte) []byte {
+	return bytes.Join([][]byte{s.scorePrefix(), Float64ToBytes(score), member}, nil)
+}
+
+// split (z[key]s <score> member) into (score, member)
+func (s *SortedSetElement) splitScoreKey(skey []byte) (float64, []byte) {
+	buf := skey[len(s.scorePrefix()):]
+	return BytesToFloat64(buf[:8]), copyBytes(buf[8:])
+}
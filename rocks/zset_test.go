@@ -0,0 +1,85 @@
+package rocks
+
+import (
+	"github.com/facebookgo/ensure"
+	"math"
+	"testing"
+)
+
+func TestFloat64Bytes(t *testing.T) {
+	scores := []float64{math.Inf(-1), -1e300, -10, -9, -0.5, 0, 0.5, 9, 10, 1e300, math.Inf(1)}
+	for i, f := range scores {
+		ensure.True(t, BytesToFloat64(Float64ToBytes(f)) == f)
+		if i > 0 {
+			ensure.True(t, string(Float64ToBytes(scores[i-1])) < string(Float64ToBytes(f)))
+		}
+	}
+	ensure.DeepEqual(t, Float64ToBytes(math.Copysign(0, -1)), Float64ToBytes(0))
+}
+
+func TestSortedSet(t *testing.T) {
+	db := New(newRocksDB(t))
+	defer db.Close()
+
+	z, _ := db.SortedSet([]byte("rank"))
+	n, err := z.Add(0,
+		ScoreMember{10, []byte("a")},
+		ScoreMember{9, []byte("b")},
+		ScoreMember{-2, []byte("c")},
+		ScoreMember{math.Inf(1), []byte("d")},
+		ScoreMember{9, []byte("b")})
+	ensure.Nil(t, err)
+	ensure.True(t, n == 4)
+	ensure.True(t, z.Len() == 4)
+	ensure.True(t, db.TypeOf([]byte("rank")) == SORTEDSET)
+
+	members := func(fn func(SortedSetEnumerateFunc)) (out []string) {
+		fn(func(i int, score float64, member []byte, quit *bool) {
+			out = append(out, string(member))
+		})
+		return
+	}
+
+	ensure.DeepEqual(t, members(func(fn SortedSetEnumerateFunc) { z.RangeByIndex(0, -1, false, fn) }), []string{"c", "b", "a", "d"})
+	ensure.DeepEqual(t, members(func(fn SortedSetEnumerateFunc) { z.RangeByIndex(1, 2, true, fn) }), []string{"a", "b"})
+	ensure.DeepEqual(t, members(func(fn SortedSetEnumerateFunc) {
+		z.RangeByScore(ScoreRange{Min: 9, Max: math.Inf(1), MinEx: true}, false, fn)
+	}), []string{"a", "d"})
+	ensure.DeepEqual(t, members(func(fn SortedSetEnumerateFunc) {
+		z.RangeByScore(ScoreRange{Min: -2, Max: 10, MaxEx: true}, true, fn)
+	}), []string{"b", "c"})
+	ensure.True(t, z.Count(ScoreRange{Min: math.Inf(-1), Max: math.Inf(1)}) == 4)
+
+	rank, ok, err := z.Rank([]byte("a"), false)
+	ensure.Nil(t, err)
+	ensure.True(t, ok && rank == 2)
+	rank, ok, _ = z.Rank([]byte("a"), true)
+	ensure.True(t, ok && rank == 1)
+
+	// NX/XX/GT/LT/CH
+	n, _ = z.Add(ZAddNX, ScoreMember{100, []byte("a")}, ScoreMember{1, []byte("e")})
+	ensure.True(t, n == 1)
+	n, _ = z.Add(ZAddXX|ZAddCH, ScoreMember{100, []byte("a")}, ScoreMember{1, []byte("f")})
+	ensure.True(t, n == 1)
+	n, _ = z.Add(ZAddGT|ZAddCH, ScoreMember{50, []byte("a")})
+	ensure.True(t, n == 0)
+	score, ok, err := z.IncrBy(0, 0.5, []byte("c"))
+	ensure.Nil(t, err)
+	ensure.True(t, ok && score == -1.5)
+	score, _, _ = z.Score([]byte("a"))
+	ensure.True(t, score == 100)
+
+	n, err = z.Remove([]byte("a"), []byte("a"), []byte("none"))
+	ensure.Nil(t, err)
+	ensure.True(t, n == 1)
+	n, err = z.RemoveByScore(ScoreRange{Min: math.Inf(-1), Max: 9})
+	ensure.Nil(t, err)
+	ensure.True(t, n == 3)
+	ensure.True(t, z.Len() == 1)
+
+	ensure.Nil(t, db.Delete([]byte("rank")))
+	ensure.True(t, db.TypeOf([]byte("rank")) == NONE)
+	db.PrefixEnumerate([]byte{SORTEDSET}, IterForward, func(i int, key, value []byte, quit *bool) {
+		t.Fail()
+	})
+}
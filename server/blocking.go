@@ -0,0 +1,168 @@
+package server
+
+import (
+	"container/list"
+	. "github.com/latermoon/GoRedis/redis"
+	"sync"
+	"time"
+)
+
+// 阻塞在list上的客户端，按key排队，先阻塞的先服务
+// 任何LPush/RPush之后都会signal对应的key
+type blockingKeys struct {
+	// db的共享锁，服务客户端时会读写db
+	lock    sync.Locker
+	mu      sync.Mutex
+	waiters map[string]*list.List // key => *blockedClient
+
+	readyMu sync.Mutex
+	ready   [][]byte
+	serving bool
+}
+
+type blockedClient struct {
+	keys  [][]byte
+	elems []*list.Element
+	// 尝试从key取出数据，list为空时返回false
+	serve func(key []byte) (Reply, bool)
+	reply chan Reply
+}
+
+//用于阻塞期间检测客户端断开，redis.Session实现了该接口
+type closeNotifier interface {
+	CloseNotify() (<-chan bool, func())
+}
+
+func newBlockingKeys(lock sync.Locker) *blockingKeys {
+	return &blockingKeys{lock: lock, waiters: make(map[string]*list.List)}
+}
+
+//EXEC中的阻塞命令不等待，list为空时和超时一样回复
+func (s *GoRedisServer) wait(r ReplyWriter, keys [][]byte, timeout time.Duration, timeoutReply Reply, serve func(key []byte) (Reply, bool)) {
+	if !s.inTx {
+		s.blocking.wait(r, keys, timeout, timeoutReply, serve)
+		return
+	}
+	for _, key := range keys {
+		if reply, ok := serve(key); ok {
+			r.WriteReply(reply)
+			return
+		}
+	}
+	r.WriteReply(timeoutReply)
+}
+
+//阻塞直到被服务、超时或者客户端断开，timeout为0表示一直等待
+func (bk *blockingKeys) wait(r ReplyWriter, keys [][]byte, timeout time.Duration, timeoutReply Reply, serve func(key []byte) (Reply, bool)) {
+	b := &blockedClient{keys: keys, serve: serve, reply: make(chan Reply, 1)}
+	bk.add(b)
+	// list里已经有数据的话立即被服务
+	bk.lock.Lock()
+	bk.signal(keys...)
+	bk.lock.Unlock()
+
+	// 等待之前写出pipeline中前面命令的回复
+	flush(r)
+	var closed <-chan bool
+	if cn, ok := r.(closeNotifier); ok {
+		var stop func()
+		closed, stop = cn.CloseNotify()
+		defer stop()
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case reply := <-b.reply:
+		r.WriteReply(reply)
+	case <-expired:
+		if bk.remove(b) {
+			r.WriteReply(timeoutReply)
+		} else {
+			// 超时的同时被服务了
+			r.WriteReply(<-b.reply)
+		}
+	case <-closed:
+		if !bk.remove(b) {
+			r.WriteReply(<-b.reply)
+		}
+	}
+}
+
+func (bk *blockingKeys) add(b *blockedClient) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	for _, key := range b.keys {
+		q, ok := bk.waiters[string(key)]
+		if !ok {
+			q = list.New()
+			bk.waiters[string(key)] = q
+		}
+		b.elems = append(b.elems, q.PushBack(b))
+	}
+}
+
+//移除等待的客户端，已经被服务过返回false
+func (bk *blockingKeys) remove(b *blockedClient) bool {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	return bk.removeLocked(b)
+}
+
+func (bk *blockingKeys) removeLocked(b *blockedClient) bool {
+	if b.elems == nil {
+		return false
+	}
+	for i, key := range b.keys {
+		q := bk.waiters[string(key)]
+		q.Remove(b.elems[i])
+		if q.Len() == 0 {
+			delete(bk.waiters, string(key))
+		}
+	}
+	b.elems = nil
+	return true
+}
+
+//key上有新数据，按顺序服务等待的客户端
+//服务过程中可能会push到其他key(BLMOVE)，这时只记录下来由当前循环处理
+func (bk *blockingKeys) signal(keys ...[]byte) {
+	bk.readyMu.Lock()
+	bk.ready = append(bk.ready, keys...)
+	if bk.serving {
+		bk.readyMu.Unlock()
+		return
+	}
+	bk.serving = true
+	for len(bk.ready) > 0 {
+		key := bk.ready[0]
+		bk.ready = bk.ready[1:]
+		bk.readyMu.Unlock()
+		bk.serveKey(key)
+		bk.readyMu.Lock()
+	}
+	bk.serving = false
+	bk.readyMu.Unlock()
+}
+
+func (bk *blockingKeys) serveKey(key []byte) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+	for {
+		q, ok := bk.waiters[string(key)]
+		if !ok {
+			return
+		}
+		b := q.Front().Value.(*blockedClient)
+		reply, ok := b.serve(key)
+		if !ok {
+			return
+		}
+		bk.removeLocked(b)
+		b.reply <- reply
+	}
+}
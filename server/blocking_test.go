@@ -0,0 +1,164 @@
+package server
+
+import (
+	"github.com/facebookgo/ensure"
+	. "github.com/latermoon/GoRedis/redis"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 通过net.Pipe连接到s的客户端，服务端和真实连接一样由ServeSession处理
+func pipeClient(t *testing.T, s *GoRedisServer) *Session {
+	conn, client := net.Pipe()
+	srv := NewServer()
+	srv.Register(s)
+	go srv.ServeSession(NewSession(conn))
+	sess := NewSession(client)
+	sess.SetDeadline(time.Now().Add(5 * time.Second))
+	return sess
+}
+
+// 发送命令，不等待回复
+func send(t *testing.T, client *Session, args ...string) {
+	client.WriteReply(makeCommand(args...))
+	ensure.Nil(t, client.Flush())
+}
+
+// 读取一个回复，转成字符串方便比较：
+// 状态、错误和整数保留前缀，bulk只有内容，nil为(nil)，数组为[a b]
+func readReply(t *testing.T, client *Session) string {
+	line, err := client.ReadLine()
+	ensure.Nil(t, err)
+	switch line[0] {
+	case '+', '-', ':':
+		return string(line)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		ensure.Nil(t, err)
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(client, buf)
+		ensure.Nil(t, err)
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		ensure.Nil(t, err)
+		if n < 0 {
+			return "(nil)"
+		}
+		items := make([]string, n)
+		for i := range items {
+			items[i] = readReply(t, client)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+// 发送命令并读取回复
+func call(t *testing.T, client *Session, args ...string) string {
+	send(t, client, args...)
+	return readReply(t, client)
+}
+
+// 阻塞在key上的客户端个数
+func blockedOn(s *GoRedisServer, key string) int {
+	s.blocking.mu.Lock()
+	defer s.blocking.mu.Unlock()
+	if q, ok := s.blocking.waiters[key]; ok {
+		return q.Len()
+	}
+	return 0
+}
+
+func TestBlockingFIFO(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	a, b, c := pipeClient(t, s), pipeClient(t, s), pipeClient(t, s)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	send(t, a, "BLPOP", "list", "0")
+	waitFor(t, "a blocked", func() bool { return blockedOn(s, "list") == 1 })
+	send(t, b, "BRPOP", "other", "list", "0")
+	waitFor(t, "b blocked", func() bool { return blockedOn(s, "list") == 2 })
+
+	// 先阻塞的先被服务，每次push只唤醒能取到数据的客户端
+	ensure.DeepEqual(t, call(t, c, "RPUSH", "list", "x"), ":1")
+	ensure.DeepEqual(t, readReply(t, a), "[list x]")
+	ensure.DeepEqual(t, blockedOn(s, "list"), 1)
+	ensure.DeepEqual(t, blockedOn(s, "other"), 1)
+	ensure.DeepEqual(t, call(t, c, "RPUSH", "other", "y", "z"), ":2")
+	ensure.DeepEqual(t, readReply(t, b), "[other z]")
+	ensure.DeepEqual(t, blockedOn(s, "list"), 0)
+	ensure.DeepEqual(t, call(t, c, "LRANGE", "other", "0", "-1"), "[y]")
+
+	// list不为空时不阻塞
+	ensure.DeepEqual(t, call(t, a, "BLPOP", "empty", "other", "0"), "[other y]")
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	a := pipeClient(t, s)
+	defer a.Close()
+
+	start := time.Now()
+	ensure.DeepEqual(t, call(t, a, "BLPOP", "list", "0.05"), "(nil)")
+	ensure.DeepEqual(t, call(t, a, "BRPOPLPUSH", "list", "dst", "0.05"), "(nil)")
+	ensure.True(t, time.Since(start) >= 100*time.Millisecond)
+	ensure.DeepEqual(t, blockedOn(s, "list"), 0)
+	ensure.DeepEqual(t, call(t, a, "BLPOP", "list", "-1"), "-ERR timeout is negative")
+	ensure.DeepEqual(t, call(t, a, "BLPOP", "list", "abc"), "-ERR timeout is not a float or out of range")
+}
+
+func TestBlockingDisconnect(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	a, b := pipeClient(t, s), pipeClient(t, s)
+	defer b.Close()
+
+	// 断开的客户端从等待队列中移除，之后push的数据留在list里
+	send(t, a, "BLPOP", "list", "0")
+	waitFor(t, "a blocked", func() bool { return blockedOn(s, "list") == 1 })
+	a.Close()
+	waitFor(t, "a removed", func() bool { return blockedOn(s, "list") == 0 })
+	ensure.DeepEqual(t, call(t, b, "RPUSH", "list", "x"), ":1")
+	ensure.DeepEqual(t, call(t, b, "LLEN", "list"), ":1")
+}
+
+func TestBlockingMove(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	a, b, c := pipeClient(t, s), pipeClient(t, s), pipeClient(t, s)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	ensure.DeepEqual(t, call(t, a, "BLMOVE", "src", "dst", "UP", "LEFT", "0"), "-ERR syntax error")
+	send(t, a, "BLMOVE", "src", "dst", "LEFT", "RIGHT", "0")
+	waitFor(t, "a blocked", func() bool { return blockedOn(s, "src") == 1 })
+	send(t, b, "BLPOP", "dst", "0")
+	waitFor(t, "b blocked", func() bool { return blockedOn(s, "dst") == 1 })
+
+	// BLMOVE放入dst的元素继续唤醒阻塞在dst上的客户端
+	ensure.DeepEqual(t, call(t, c, "RPUSH", "src", "v"), ":1")
+	ensure.DeepEqual(t, readReply(t, a), "v")
+	ensure.DeepEqual(t, readReply(t, b), "[dst v]")
+	ensure.DeepEqual(t, call(t, c, "LLEN", "src"), ":0")
+	ensure.DeepEqual(t, call(t, c, "LLEN", "dst"), ":0")
+
+	// src不为空时立即移动
+	ensure.DeepEqual(t, call(t, c, "RPUSH", "src", "1", "2"), ":2")
+	ensure.DeepEqual(t, call(t, a, "BLMOVE", "src", "dst", "RIGHT", "LEFT", "0"), "2")
+	ensure.DeepEqual(t, call(t, a, "BRPOPLPUSH", "src", "dst", "0"), "1")
+	ensure.DeepEqual(t, call(t, c, "LRANGE", "dst", "0", "-1"), "[1 2]")
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"sort"
+	"strings"
+)
+
+// http://redis.io/commands/command
+// 命令表，分发前按arity检查参数个数，COMMAND命令也从这里取得信息
+
+type cmdFlags int
+
+const (
+	flagWrite cmdFlags = 1 << iota
+	flagReadonly
+	flagAdmin
+	flagBlocking
+	flagPubsub
+	flagNoMulti // 不能在MULTI中执行
+	// 以下只在内部使用，COMMAND不输出
+	flagNoQueue // MULTI之后直接执行，不进入队列
+	flagNoLock  // 不持有db的共享锁
+)
+
+// COMMAND输出的flag名称
+var flagNames = []struct {
+	flag cmdFlags
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagBlocking, "blocking"},
+	{flagPubsub, "pubsub"},
+	{flagNoMulti, "no_multi"},
+}
+
+type command struct {
+	name  string // 小写
+	arity int    // 包括命令名，负数表示至少-arity个
+	flags cmdFlags
+	// key的位置，lastKey为负数时从末尾算起，没有key时都为0
+	firstKey, lastKey, step int
+	handler                 cmdMethod
+}
+
+var commandTable = []*command{
+	// connection & server
+	{"ping", -1, 0, 0, 0, 0, (*GoRedisServer).OnPING},
+	{"quit", -1, flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnQUIT},
+	{"config", -2, flagAdmin, 0, 0, 0, (*GoRedisServer).OnCONFIG},
+	{"command", -1, 0, 0, 0, 0, (*GoRedisServer).OnCOMMAND},
+	{"hello", -1, 0, 0, 0, 0, (*GoRedisServer).OnHELLO},
+	{"info", -1, flagNoLock, 0, 0, 0, (*GoRedisServer).OnINFO},
+	{"time", 1, flagNoLock, 0, 0, 0, (*GoRedisServer).OnTIME},
+	{"flushall", -1, flagWrite | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnFLUSHALL},
+	{"flushdb", -1, flagWrite | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnFLUSHDB},
+
+	// replication
+	{"slaveof", 3, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnSLAVEOF},
+	{"replicaof", 3, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnREPLICAOF},
+	{"role", 1, flagNoLock, 0, 0, 0, (*GoRedisServer).OnROLE},
+	{"sync", -1, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnSYNC},
+	{"psync", 3, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnPSYNC},
+	{"replconf", -1, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnREPLCONF},
+	{"replsource", -2, flagAdmin | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnREPLSOURCE},
+
+	// keys
+	{"del", -2, flagWrite, 1, -1, 1, (*GoRedisServer).OnDEL},
+	{"exists", -2, flagReadonly, 1, -1, 1, (*GoRedisServer).OnEXISTS},
+	{"keys", 2, flagReadonly, 0, 0, 0, (*GoRedisServer).OnKEYS},
+	{"scan", -2, flagReadonly, 0, 0, 0, (*GoRedisServer).OnSCAN},
+	{"type", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnTYPE},
+	{"expire", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnEXPIRE},
+	{"pexpire", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnPEXPIRE},
+	{"expireat", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnEXPIREAT},
+	{"pexpireat", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnPEXPIREAT},
+	{"ttl", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnTTL},
+	{"pttl", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnPTTL},
+	{"persist", 2, flagWrite, 1, 1, 1, (*GoRedisServer).OnPERSIST},
+
+	// strings
+	{"get", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnGET},
+	{"set", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnSET},
+	{"setnx", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnSETNX},
+	{"getset", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnGETSET},
+	{"getdel", 2, flagWrite, 1, 1, 1, (*GoRedisServer).OnGETDEL},
+	{"mget", -2, flagReadonly, 1, -1, 1, (*GoRedisServer).OnMGET},
+	{"mset", -3, flagWrite, 1, -1, 2, (*GoRedisServer).OnMSET},
+	{"incr", 2, flagWrite, 1, 1, 1, (*GoRedisServer).OnINCR},
+	{"decr", 2, flagWrite, 1, 1, 1, (*GoRedisServer).OnDECR},
+	{"incrby", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnINCRBY},
+	{"decrby", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnDECRBY},
+	{"incrbyfloat", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnINCRBYFLOAT},
+	{"append", 3, flagWrite, 1, 1, 1, (*GoRedisServer).OnAPPEND},
+	{"strlen", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSTRLEN},
+	{"getrange", 4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnGETRANGE},
+	{"setrange", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnSETRANGE},
+
+	// bitmaps
+	{"setbit", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnSETBIT},
+	{"getbit", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnGETBIT},
+	{"bitcount", -2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnBITCOUNT},
+	{"bitpos", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnBITPOS},
+	{"bitop", -4, flagWrite, 2, -1, 1, (*GoRedisServer).OnBITOP},
+	{"bitfield", -2, flagWrite, 1, 1, 1, (*GoRedisServer).OnBITFIELD},
+
+	// hashes
+	{"hdel", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnHDEL},
+	{"hexists", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHEXISTS},
+	{"hget", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHGET},
+	{"hmget", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHMGET},
+	{"hset", -4, flagWrite, 1, 1, 1, (*GoRedisServer).OnHSET},
+	{"hmset", -4, flagWrite, 1, 1, 1, (*GoRedisServer).OnHMSET},
+	{"hsetnx", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnHSETNX},
+	{"hlen", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHLEN},
+	{"hstrlen", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHSTRLEN},
+	{"hincrby", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnHINCRBY},
+	{"hincrbyfloat", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnHINCRBYFLOAT},
+	{"hgetall", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHGETALL},
+	{"hkeys", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHKEYS},
+	{"hvals", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHVALS},
+	{"hscan", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnHSCAN},
+
+	// lists
+	{"lindex", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnLINDEX},
+	{"llen", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnLLEN},
+	{"lpop", -2, flagWrite, 1, 1, 1, (*GoRedisServer).OnLPOP},
+	{"rpop", -2, flagWrite, 1, 1, 1, (*GoRedisServer).OnRPOP},
+	{"lpush", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnLPUSH},
+	{"rpush", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnRPUSH},
+	{"lrange", 4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnLRANGE},
+	{"lset", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnLSET},
+	{"lmove", 5, flagWrite, 1, 2, 1, (*GoRedisServer).OnLMOVE},
+	{"rpoplpush", 3, flagWrite, 1, 2, 1, (*GoRedisServer).OnRPOPLPUSH},
+	// 阻塞命令等待期间不能持有锁
+	{"blpop", -3, flagWrite | flagBlocking | flagNoLock, 1, -2, 1, (*GoRedisServer).OnBLPOP},
+	{"brpop", -3, flagWrite | flagBlocking | flagNoLock, 1, -2, 1, (*GoRedisServer).OnBRPOP},
+	{"blmove", 6, flagWrite | flagBlocking | flagNoLock, 1, 2, 1, (*GoRedisServer).OnBLMOVE},
+	{"brpoplpush", 4, flagWrite | flagBlocking | flagNoLock, 1, 2, 1, (*GoRedisServer).OnBRPOPLPUSH},
+
+	// sets
+	{"sadd", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnSADD},
+	{"srem", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnSREM},
+	{"smembers", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSMEMBERS},
+	{"sismember", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSISMEMBER},
+	{"smismember", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSMISMEMBER},
+	{"scard", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSCARD},
+	{"spop", -2, flagWrite, 1, 1, 1, (*GoRedisServer).OnSPOP},
+	{"srandmember", -2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSRANDMEMBER},
+	{"sinter", -2, flagReadonly, 1, -1, 1, (*GoRedisServer).OnSINTER},
+	{"sunion", -2, flagReadonly, 1, -1, 1, (*GoRedisServer).OnSUNION},
+	{"sdiff", -2, flagReadonly, 1, -1, 1, (*GoRedisServer).OnSDIFF},
+	{"sinterstore", -3, flagWrite, 1, -1, 1, (*GoRedisServer).OnSINTERSTORE},
+	{"sunionstore", -3, flagWrite, 1, -1, 1, (*GoRedisServer).OnSUNIONSTORE},
+	{"sdiffstore", -3, flagWrite, 1, -1, 1, (*GoRedisServer).OnSDIFFSTORE},
+	{"sscan", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnSSCAN},
+
+	// sorted sets
+	{"zadd", -4, flagWrite, 1, 1, 1, (*GoRedisServer).OnZADD},
+	{"zincrby", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnZINCRBY},
+	{"zrem", -3, flagWrite, 1, 1, 1, (*GoRedisServer).OnZREM},
+	{"zscore", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZSCORE},
+	{"zcard", 2, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZCARD},
+	{"zcount", 4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZCOUNT},
+	{"zrange", -4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZRANGE},
+	{"zrevrange", -4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZREVRANGE},
+	{"zrangebyscore", -4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZRANGEBYSCORE},
+	{"zrevrangebyscore", -4, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZREVRANGEBYSCORE},
+	{"zrank", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZRANK},
+	{"zrevrank", 3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZREVRANK},
+	{"zremrangebyscore", 4, flagWrite, 1, 1, 1, (*GoRedisServer).OnZREMRANGEBYSCORE},
+	{"zscan", -3, flagReadonly, 1, 1, 1, (*GoRedisServer).OnZSCAN},
+
+	// transactions，EXEC自己取得排它锁
+	{"multi", 1, flagNoQueue, 0, 0, 0, (*GoRedisServer).OnMULTI},
+	{"exec", 1, flagNoQueue | flagNoLock, 0, 0, 0, (*GoRedisServer).OnEXEC},
+	{"discard", 1, flagNoQueue, 0, 0, 0, (*GoRedisServer).OnDISCARD},
+	{"watch", -2, flagNoQueue, 1, -1, 1, (*GoRedisServer).OnWATCH},
+	{"unwatch", 1, 0, 0, 0, 0, (*GoRedisServer).OnUNWATCH},
+
+	// pub/sub，不读写db，订阅时可能等待回复写出
+	{"subscribe", -2, flagPubsub | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnSUBSCRIBE},
+	{"psubscribe", -2, flagPubsub | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnPSUBSCRIBE},
+	{"unsubscribe", -1, flagPubsub | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnUNSUBSCRIBE},
+	{"punsubscribe", -1, flagPubsub | flagNoMulti | flagNoLock, 0, 0, 0, (*GoRedisServer).OnPUNSUBSCRIBE},
+	{"publish", 3, flagPubsub | flagNoLock, 0, 0, 0, (*GoRedisServer).OnPUBLISH},
+	{"pubsub", -2, flagPubsub | flagNoLock, 0, 0, 0, (*GoRedisServer).OnPUBSUB},
+}
+
+// 按小写名称索引，sortedCommands用于COMMAND的输出
+// 在init中建立，OnCOMMAND不能直接引用commandTable
+var (
+	commands       map[string]*command
+	sortedCommands []*command
+)
+
+func init() {
+	commands = make(map[string]*command, len(commandTable))
+	for _, cmd := range commandTable {
+		commands[cmd.name] = cmd
+		sortedCommands = append(sortedCommands, cmd)
+	}
+	sort.Sort(byName(sortedCommands))
+}
+
+type byName []*command
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].name < b[j].name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func lookupCommand(name []byte) (*command, bool) {
+	cmd, ok := commands[strings.ToLower(string(name))]
+	return cmd, ok
+}
+
+func (cmd *command) is(flag cmdFlags) bool {
+	return cmd.flags&flag != 0
+}
+
+// 参数个数是否符合arity
+func (cmd *command) checkArity(argc int) bool {
+	if cmd.arity < 0 {
+		return argc >= -cmd.arity
+	}
+	return argc == cmd.arity
+}
+
+func (cmd *command) arityError() Reply {
+	return ErrorReply("ERR wrong number of arguments for '" + cmd.name + "' command")
+}
+
+// 按firstKey/lastKey/step取出参数中的key
+func (cmd *command) keys(c Command) [][]byte {
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(c)
+	}
+	keys := make([][]byte, 0)
+	for i := cmd.firstKey; i <= last && i < len(c); i += cmd.step {
+		keys = append(keys, c[i])
+	}
+	return keys
+}
+
+// COMMAND的回复格式：name arity flags first-key last-key step
+func (cmd *command) info() MultiBulkReply {
+	flags := make([]interface{}, 0)
+	for _, f := range flagNames {
+		if cmd.is(f.flag) {
+			flags = append(flags, StatusReply(f.name))
+		}
+	}
+	return MultiBulkReply{cmd.name, cmd.arity, MultiBulkReply(flags), cmd.firstKey, cmd.lastKey, cmd.step}
+}
+
+// COMMAND [COUNT | INFO [command ...] | GETKEYS command [arg ...]]
+func (s *GoRedisServer) OnCOMMAND(r ReplyWriter, c Command) {
+	if len(c) == 1 {
+		infos := make([]interface{}, len(sortedCommands))
+		for i, cmd := range sortedCommands {
+			infos[i] = cmd.info()
+		}
+		r.WriteReply(MultiBulkReply(infos))
+		return
+	}
+	switch sub := strings.ToUpper(string(c[1])); {
+	case sub == "COUNT" && len(c) == 2:
+		r.WriteReply(IntegerReply(len(commands)))
+	case sub == "INFO":
+		if len(c) == 2 {
+			s.OnCOMMAND(r, c[:1])
+			return
+		}
+		infos := make([]interface{}, len(c)-2)
+		for i, name := range c[2:] {
+			if cmd, ok := lookupCommand(name); ok {
+				infos[i] = cmd.info()
+			}
+		}
+		r.WriteReply(MultiBulkReply(infos))
+	case sub == "GETKEYS" && len(c) > 2:
+		cmd, ok := lookupCommand(c[2])
+		if !ok {
+			r.WriteReply(ErrorReply("ERR Invalid command specified"))
+			return
+		}
+		args := c[2:]
+		if !cmd.checkArity(len(args)) {
+			r.WriteReply(ErrorReply("ERR Invalid number of arguments specified for command"))
+			return
+		}
+		keys := cmd.keys(args)
+		if len(keys) == 0 {
+			r.WriteReply(ErrorReply("ERR The command has no key arguments"))
+			return
+		}
+		bulks := make([]interface{}, len(keys))
+		for i, key := range keys {
+			bulks[i] = key
+		}
+		r.WriteReply(MultiBulkReply(bulks))
+	default:
+		r.WriteReply(ErrorReply("ERR Unknown subcommand or wrong number of arguments for '" + string(c[1]) + "'. Try COMMAND HELP."))
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/facebookgo/ensure"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 每个On*处理函数都在命令表中，并且表中的handler就是同名的方法
+func TestCommandTableCoversHandlers(t *testing.T) {
+	st := reflect.TypeOf(&GoRedisServer{})
+	for i := 0; i < st.NumMethod(); i++ {
+		m := st.Method(i)
+		if !strings.HasPrefix(m.Name, "On") {
+			continue
+		}
+		cmd, ok := lookupCommand([]byte(m.Name[2:]))
+		ensure.True(t, ok, m.Name)
+		ensure.DeepEqual(t, reflect.ValueOf(cmd.handler).Pointer(), m.Func.Pointer(), m.Name)
+	}
+	seen := make(map[string]bool)
+	for _, cmd := range commandTable {
+		ensure.False(t, seen[cmd.name], cmd.name)
+		seen[cmd.name] = true
+		ensure.DeepEqual(t, cmd.name, strings.ToLower(cmd.name))
+		ensure.True(t, cmd.arity != 0, cmd.name)
+		if cmd.firstKey == 0 {
+			ensure.True(t, cmd.lastKey == 0 && cmd.step == 0, cmd.name)
+		} else {
+			ensure.True(t, cmd.lastKey != 0 && cmd.step > 0, cmd.name)
+		}
+	}
+}
+
+func TestCommandInfo(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	client := pipeClient(t, s)
+	defer client.Close()
+
+	ensure.DeepEqual(t, call(t, client, "COMMAND", "COUNT"), ":"+strconv.Itoa(len(commandTable)))
+	ensure.DeepEqual(t, call(t, client, "COMMAND", "INFO", "get", "nosuch"), "[[get :2 [+readonly] :1 :1 :1] (nil)]")
+	for _, tt := range []struct {
+		args []string
+		keys string
+	}{
+		{[]string{"GET", "k"}, "[k]"},
+		{[]string{"MSET", "k1", "v1", "k2", "v2"}, "[k1 k2]"},
+		{[]string{"DEL", "a", "b", "c"}, "[a b c]"},
+		{[]string{"BLPOP", "a", "b", "0"}, "[a b]"},
+		{[]string{"LMOVE", "src", "dst", "LEFT", "RIGHT"}, "[src dst]"},
+		{[]string{"BITOP", "AND", "dst", "a", "b"}, "[dst a b]"},
+		{[]string{"PING"}, "-ERR The command has no key arguments"},
+		{[]string{"GET"}, "-ERR Invalid number of arguments specified for command"},
+		{[]string{"NOSUCH", "k"}, "-ERR Invalid command specified"},
+	} {
+		ensure.DeepEqual(t, call(t, client, append([]string{"COMMAND", "GETKEYS"}, tt.args...)...), tt.keys)
+	}
+
+	// 分发前按arity检查参数个数
+	for _, args := range [][]string{
+		{"GET"},
+		{"GET", "a", "b"},
+		{"SET", "k"},
+		{"HSET", "h", "f"},
+		{"LMOVE", "a", "b", "LEFT"},
+		{"BLPOP", "k"},
+		{"ZADD", "z", "1"},
+	} {
+		want := "-ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command"
+		ensure.DeepEqual(t, call(t, client, args...), want)
+	}
+	ensure.DeepEqual(t, call(t, client, "NOSUCH", "a"), "-ERR unknown command 'NOSUCH', with args beginning with: 'a' ")
+}
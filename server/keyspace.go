@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/latermoon/GoRedis/rocks"
+	"strings"
+	"sync/atomic"
+)
+
+// http://redis.io/topics/notifications
+// rocks写入之后发出的事件按notify-keyspace-events过滤，
+// 发布到 __keyspace@0__:<key> 和 __keyevent@0__:<event>
+
+// notify-keyspace-events的字符，A是g$lshzxetd的别名
+const (
+	notifyAll     = "g$lshzxetd"
+	notifyClasses = notifyAll + "KEmn"
+)
+
+type keyspaceNotifier struct {
+	ps    *pubsub
+	flags atomic.Value // map[byte]bool，CONFIG SET时整体替换
+}
+
+func newKeyspaceNotifier(ps *pubsub) *keyspaceNotifier {
+	kn := &keyspaceNotifier{ps: ps}
+	kn.setFlags("")
+	return kn
+}
+
+func (kn *keyspaceNotifier) setFlags(value string) {
+	flags, _ := parseNotifyFlags(value)
+	kn.flags.Store(flags)
+}
+
+func (kn *keyspaceNotifier) notify(class rocks.NotifyClass, event string, key []byte) {
+	flags := kn.flags.Load().(map[byte]bool)
+	if !flags[byte(class)] {
+		return
+	}
+	if flags['K'] {
+		kn.ps.publish(append([]byte("__keyspace@0__:"), key...), []byte(event))
+	}
+	if flags['E'] {
+		kn.ps.publish([]byte("__keyevent@0__:"+event), key)
+	}
+}
+
+// 解析 "KEA"、"Kx$" 这样的配置，有不认识的字符时返回false
+func parseNotifyFlags(value string) (map[byte]bool, bool) {
+	flags := make(map[byte]bool)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 'A':
+			for j := 0; j < len(notifyAll); j++ {
+				flags[notifyAll[j]] = true
+			}
+		case strings.IndexByte(notifyClasses, c) >= 0:
+			flags[c] = true
+		default:
+			return nil, false
+		}
+	}
+	return flags, true
+}
+
+func isNotifyFlags(value string) bool {
+	_, ok := parseNotifyFlags(value)
+	return ok
+}
+
+// 转成CONFIG GET返回的标准形式，比如 "$glK" => "g$lK"
+func formatNotifyFlags(value string) string {
+	flags, _ := parseNotifyFlags(value)
+	var buf []byte
+	all := true
+	for j := 0; j < len(notifyAll); j++ {
+		all = all && flags[notifyAll[j]]
+	}
+	if all {
+		buf = append(buf, 'A')
+	}
+	for j := 0; j < len(notifyClasses); j++ {
+		c := notifyClasses[j]
+		if all && j < len(notifyAll) {
+			continue
+		}
+		if flags[c] {
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"github.com/latermoon/GoRedis/libs/glob"
+	. "github.com/latermoon/GoRedis/redis"
+	"io"
+	"log"
+	"sync"
+)
+
+// 订阅者最多积压的消息数，超过时断开连接，相当于redis的client-output-buffer-limit pubsub
+const subscriberBacklog = 4096
+
+// 频道和模式的订阅关系
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+	}
+}
+
+// 处于订阅模式的连接
+// 消息由单独的goroutine按顺序写出，订阅模式下连接自己的回复也经过同一个队列，
+// 保证订阅确认一定在消息之前
+type subscriber struct {
+	w        ReplyWriter
+	out      chan Reply
+	quit     chan struct{}
+	once     sync.Once
+	channels map[string]bool // 只由连接自己的goroutine访问
+	patterns map[string]bool
+}
+
+// flush时放入队列，写到这里说明之前的回复都已经写出
+type flushReply chan struct{}
+
+func (f flushReply) Bytes() []byte { return nil }
+
+func newSubscriber(w ReplyWriter) *subscriber {
+	sub := &subscriber{
+		w:        w,
+		out:      make(chan Reply, subscriberBacklog),
+		quit:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	go sub.loop()
+	return sub
+}
+
+func (sub *subscriber) loop() {
+	for {
+		select {
+		case r := <-sub.out:
+			if f, ok := r.(flushReply); ok {
+				close(f)
+				continue
+			}
+			if _, err := sub.w.WriteReply(r); err != nil {
+				sub.stop()
+				return
+			}
+			// 队列空了再写到连接，积压的消息合并写出
+			if f, ok := sub.w.(flusher); ok && len(sub.out) == 0 {
+				if err := f.Flush(); err != nil {
+					sub.stop()
+					return
+				}
+			}
+		case <-sub.quit:
+			return
+		}
+	}
+}
+
+// 连接自己的回复，队列满时等待
+func (sub *subscriber) WriteReply(r Reply) (int, error) {
+	select {
+	case sub.out <- r:
+	case <-sub.quit:
+	}
+	return 0, nil
+}
+
+// 推送消息，不阻塞发布者，积压过多时断开订阅者
+func (sub *subscriber) push(r Reply) {
+	select {
+	case sub.out <- r:
+	case <-sub.quit:
+	default:
+		log.Println("pubsub: subscriber too slow, closing connection")
+		sub.stop()
+		if c, ok := sub.w.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// 等待队列中的回复写完
+func (sub *subscriber) flush() {
+	done := make(flushReply)
+	select {
+	case sub.out <- done:
+	case <-sub.quit:
+		return
+	}
+	select {
+	case <-done:
+	case <-sub.quit:
+	}
+}
+
+func (sub *subscriber) stop() {
+	sub.once.Do(func() { close(sub.quit) })
+}
+
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+func (ps *pubsub) subscribe(sub *subscriber, channel []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub.channels[string(channel)] = true
+	addSubscriber(ps.channels, string(channel), sub)
+}
+
+// 没有订阅该频道返回false
+func (ps *pubsub) unsubscribe(sub *subscriber, channel []byte) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !sub.channels[string(channel)] {
+		return false
+	}
+	delete(sub.channels, string(channel))
+	removeSubscriber(ps.channels, string(channel), sub)
+	return true
+}
+
+func (ps *pubsub) psubscribe(sub *subscriber, pattern []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub.patterns[string(pattern)] = true
+	addSubscriber(ps.patterns, string(pattern), sub)
+}
+
+func (ps *pubsub) punsubscribe(sub *subscriber, pattern []byte) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !sub.patterns[string(pattern)] {
+		return false
+	}
+	delete(sub.patterns, string(pattern))
+	removeSubscriber(ps.patterns, string(pattern), sub)
+	return true
+}
+
+// 发送给频道和匹配的模式的订阅者，返回接收者的数量
+func (ps *pubsub) publish(channel, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	n := 0
+	for sub := range ps.channels[string(channel)] {
+		sub.push(PushReply{"message", channel, message})
+		n++
+	}
+	for pattern, subs := range ps.patterns {
+		if !glob.Match([]byte(pattern), channel) {
+			continue
+		}
+		for sub := range subs {
+			sub.push(PushReply{"pmessage", pattern, channel, message})
+			n++
+		}
+	}
+	return n
+}
+
+func addSubscriber(m map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	subs, ok := m[name]
+	if !ok {
+		subs = make(map[*subscriber]bool)
+		m[name] = subs
+	}
+	subs[sub] = true
+}
+
+func removeSubscriber(m map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	if subs, ok := m[name]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(m, name)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/facebookgo/ensure"
+	. "github.com/latermoon/GoRedis/redis"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 订阅者在pubsub中的频道数
+func numSub(s *GoRedisServer, channel string) int {
+	s.pubsub.mu.RLock()
+	defer s.pubsub.mu.RUnlock()
+	return len(s.pubsub.channels[channel])
+}
+
+func TestPubSub(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	sub, pub := pipeClient(t, s), pipeClient(t, s)
+	defer sub.Close()
+	defer pub.Close()
+
+	send(t, sub, "SUBSCRIBE", "a", "b")
+	ensure.DeepEqual(t, readReply(t, sub), "[subscribe a :1]")
+	ensure.DeepEqual(t, readReply(t, sub), "[subscribe b :2]")
+	ensure.DeepEqual(t, call(t, sub, "PSUBSCRIBE", "n*"), "[psubscribe n* :3]")
+
+	ensure.DeepEqual(t, call(t, pub, "PUBLISH", "a", "hello"), ":1")
+	ensure.DeepEqual(t, call(t, pub, "PUBLISH", "news", "x"), ":1")
+	ensure.DeepEqual(t, call(t, pub, "PUBLISH", "other", "y"), ":0")
+	ensure.DeepEqual(t, readReply(t, sub), "[message a hello]")
+	ensure.DeepEqual(t, readReply(t, sub), "[pmessage n* news x]")
+
+	ensure.DeepEqual(t, call(t, pub, "PUBSUB", "CHANNELS"), "[a b]")
+	ensure.DeepEqual(t, call(t, pub, "PUBSUB", "CHANNELS", "b*"), "[b]")
+	ensure.DeepEqual(t, call(t, pub, "PUBSUB", "NUMSUB", "a", "c"), "[a :1 c :0]")
+	ensure.DeepEqual(t, call(t, pub, "PUBSUB", "NUMPAT"), ":1")
+
+	// RESP2的订阅模式下只能执行订阅相关的命令
+	ensure.DeepEqual(t, call(t, sub, "GET", "k"), "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	ensure.DeepEqual(t, call(t, sub, "PING"), "[pong ]")
+	ensure.DeepEqual(t, call(t, sub, "PING", "hi"), "[pong hi]")
+
+	// 全部取消之后退出订阅模式
+	ensure.DeepEqual(t, call(t, sub, "UNSUBSCRIBE", "a"), "[unsubscribe a :2]")
+	ensure.DeepEqual(t, call(t, sub, "PUNSUBSCRIBE", "n*"), "[punsubscribe n* :1]")
+	ensure.DeepEqual(t, call(t, pub, "PUBLISH", "a", "lost"), ":0")
+	ensure.DeepEqual(t, call(t, sub, "UNSUBSCRIBE", "b"), "[unsubscribe b :0]")
+	ensure.DeepEqual(t, call(t, sub, "GET", "k"), "(nil)")
+	ensure.DeepEqual(t, call(t, sub, "PING"), "+PONG")
+	ensure.DeepEqual(t, call(t, sub, "UNSUBSCRIBE"), "[unsubscribe (nil) :0]")
+}
+
+// 订阅确认一定在这个频道的消息之前
+func TestPubSubConfirmBeforeMessages(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	sub := pipeClient(t, s)
+	defer sub.Close()
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		rec := &replyRecorder{}
+		// 送达的消息不超过subscriberBacklog，否则订阅者会被当作慢客户端断开
+		for i, sent := 0, 0; sent < subscriberBacklog/2; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.dispatch(rec, makeCommand("PUBLISH", "c", strconv.Itoa(i)))
+			if rec.replies[0] == IntegerReply(1) {
+				sent++
+			}
+			rec.replies = nil
+		}
+	}()
+	send(t, sub, "SUBSCRIBE", "c")
+	ensure.DeepEqual(t, readReply(t, sub), "[subscribe c :1]")
+	defer close(stop)
+	// 之后的消息按发布的顺序到达
+	last := -1
+	for i := 0; i < 10; i++ {
+		reply := readReply(t, sub)
+		ensure.True(t, strings.HasPrefix(reply, "[message c "), reply)
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(reply, "[message c "), "]"))
+		ensure.Nil(t, err)
+		ensure.True(t, n > last, reply)
+		last = n
+	}
+	<-done
+}
+
+// 不读取消息的订阅者积压超过subscriberBacklog时被断开，不影响发布者
+func TestPubSubSlowSubscriber(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	sub := pipeClient(t, s)
+	defer sub.Close()
+	ensure.DeepEqual(t, call(t, sub, "SUBSCRIBE", "c"), "[subscribe c :1]")
+
+	rec := &replyRecorder{}
+	for i := 0; i < subscriberBacklog*2; i++ {
+		s.dispatch(rec, makeCommand("PUBLISH", "c", "message"))
+	}
+	waitFor(t, "slow subscriber closed", func() bool { return numSub(s, "c") == 0 })
+	rec = &replyRecorder{}
+	s.dispatch(rec, makeCommand("PUBLISH", "c", "message"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{IntegerReply(0)})
+	// 已经写出的消息读完之后连接被关闭
+	_, err := io.Copy(ioutil.Discard, sub)
+	ensure.Nil(t, err)
+}
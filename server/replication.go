@@ -0,0 +1,531 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/latermoon/GoRedis/libs/rdb"
+	. "github.com/latermoon/GoRedis/redis"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 作为官方redis的从库
+// SLAVEOF host port之后在后台连接主库，握手之后发送PSYNC，
+// 全量同步时解析主库发来的RDB写入rocks，之后主库发来的命令流经过命令表执行。
+// 连接断开时自动重连，并用记录的replid和offset尝试部分同步
+// https://redis.io/docs/management/replication/
+
+// 复制连接的状态，ROLE命令输出
+const (
+	replStateConnect    = "connect"    // 等待重连
+	replStateConnecting = "connecting" // 握手
+	replStateSync       = "sync"       // 接收RDB
+	replStateConnected  = "connected"  // 接收命令流
+)
+
+const (
+	// 主库每10秒发送一次PING，超过这个时间没有数据就断开，和redis的repl-timeout一致
+	replTimeout = 60 * time.Second
+	// 断开之后重连的间隔
+	replRetryInterval = time.Second
+	// 向主库发送REPLCONF ACK的间隔
+	replAckInterval = time.Second
+	// diskless同步时RDB之后的结束标记长度
+	replEOFMarkLen = 40
+)
+
+var ErrReadonly = ErrorReply("READONLY You can't write against a read only replica.")
+
+var errReplStopped = errors.New("replication stopped")
+
+type replication struct {
+	mu   sync.Mutex
+	link *replLink // nil表示自己是主库
+	// 已经处理的复制进度，重连时用于PSYNC
+	replid string
+	offset int64
+	// 多主复制中的来源，SLAVEOF时为nil
+	src *replSource
+}
+
+// 一次SLAVEOF创建的复制，SLAVEOF NO ONE或者切换主库时关闭
+type replLink struct {
+	addr  string
+	state string
+	wal   bool // 主库是GoRedis，按WAL同步
+	conn  net.Conn
+	quit  chan bool
+	done  chan bool
+}
+
+func newReplication() *replication {
+	return &replication{replid: "?", offset: -1}
+}
+
+// 当前的主库地址，空表示自己是主库
+func (rp *replication) master() string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.link == nil {
+		return ""
+	}
+	return rp.link.addr
+}
+
+// 停止当前的复制，等待复制的goroutine退出
+func (rp *replication) stop() {
+	rp.mu.Lock()
+	link := rp.link
+	rp.link = nil
+	if link != nil {
+		close(link.quit)
+		if link.conn != nil {
+			link.conn.Close()
+		}
+	}
+	rp.mu.Unlock()
+	if link != nil {
+		<-link.done
+	}
+}
+
+// 保存连接，stop时关闭它来中断阻塞的读取
+// 已经stop的返回false
+func (rp *replication) attach(link *replLink, conn net.Conn) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	select {
+	case <-link.quit:
+		return false
+	default:
+	}
+	link.conn = conn
+	link.state = replStateConnecting
+	return true
+}
+
+// 按WAL同步时数据不经过命令表，不能再作为官方redis的主库
+func (rp *replication) viaWAL() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.link != nil && rp.link.wal
+}
+
+func (rp *replication) setState(link *replLink, state string) {
+	rp.mu.Lock()
+	link.state = state
+	rp.mu.Unlock()
+}
+
+func (rp *replication) progress() (string, int64) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.replid, rp.offset
+}
+
+func (rp *replication) setProgress(replid string, offset int64) {
+	rp.mu.Lock()
+	rp.replid, rp.offset = replid, offset
+	rp.mu.Unlock()
+}
+
+func (rp *replication) advance(n int64) {
+	rp.mu.Lock()
+	rp.offset += n
+	rp.mu.Unlock()
+}
+
+// 开始复制addr，已有的复制先停止
+func (s *GoRedisServer) replicaOf(addr string) {
+	s.startReplication(s.repl, addr)
+}
+
+// SLAVEOF和多主复制的每个来源都是一个replication
+func (s *GoRedisServer) startReplication(rp *replication, addr string) {
+	rp.stop()
+	link := &replLink{addr: addr, state: replStateConnect, quit: make(chan bool), done: make(chan bool)}
+	rp.mu.Lock()
+	rp.link = link
+	rp.mu.Unlock()
+	go s.replicate(rp, link)
+}
+
+// 只读的从库拒绝客户端的写命令，主库发来的命令不受限制
+func (s *GoRedisServer) readonlyFor(r ReplyWriter) bool {
+	if _, ok := r.(*masterClient); ok {
+		return false
+	}
+	return s.config.get("replica-read-only") == "yes" && s.replicating()
+}
+
+// 是否在复制其他redis，SLAVEOF或者多主复制
+func (s *GoRedisServer) replicating() bool {
+	return s.repl.master() != "" || s.sources.count() > 0
+}
+
+func (s *GoRedisServer) replicate(rp *replication, link *replLink) {
+	defer close(link.done)
+	for {
+		err := s.syncWithMaster(rp, link)
+		if err == errReplStopped {
+			return
+		}
+		log.Println("replication: lost connection with master", link.addr, err)
+		rp.setState(link, replStateConnect)
+		select {
+		case <-link.quit:
+			return
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+// 一次连接：握手、同步、然后执行命令流直到连接断开
+func (s *GoRedisServer) syncWithMaster(rp *replication, link *replLink) error {
+	conn, err := net.DialTimeout("tcp", link.addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !rp.attach(link, conn) {
+		return errReplStopped
+	}
+	sess := NewSession(deadlineConn{conn})
+
+	if auth := s.config.get("masterauth"); auth != "" {
+		if _, err := masterCall(sess, "AUTH", auth); err != nil {
+			return err
+		}
+	}
+	if _, err := masterCall(sess, "PING"); err != nil {
+		return err
+	}
+	// 多主复制的lww按来源的时钟比较，不支持TIME的主库按本机的时钟
+	if rp.src != nil {
+		skew, err := masterClock(sess)
+		if _, ok := err.(*masterError); ok {
+			log.Println("replication: can't get the clock of source", rp.src.name, err)
+		} else if err != nil {
+			return err
+		}
+		rp.src.skew = skew
+	}
+	// GoRedis主库按WAL同步，官方redis不支持时改用PSYNC
+	// 多主复制需要按key过滤和处理冲突，只使用命令流
+	if rp.src == nil {
+		if ok, err := s.syncWAL(link, sess); ok {
+			return err
+		}
+	}
+	// eof表示支持diskless同步，psync2表示支持PSYNC的replid切换
+	if _, err := masterCall(sess, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	}
+	// 没有同步过时发送 PSYNC ? -1 要求全量同步
+	replid, offset := rp.progress()
+	from := "-1"
+	if replid != "?" {
+		from = strconv.FormatInt(offset+1, 10)
+	}
+	reply, err := masterCall(sess, "PSYNC", replid, from)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad FULLRESYNC reply %q", reply)
+		}
+		rp.setState(link, replStateSync)
+		if err := s.fullSync(rp, sess); err != nil {
+			return err
+		}
+		rp.setProgress(fields[1], offset)
+		s.saveProgress(rp)
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		// 主库切换过replid时带上新的replid
+		if len(fields) == 2 {
+			rp.setProgress(fields[1], offset)
+			s.saveProgress(rp)
+		}
+		log.Println("replication: partial resync with master", link.addr, "at offset", offset)
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply)
+	}
+	rp.setState(link, replStateConnected)
+	return s.streamFromMaster(rp, sess)
+}
+
+// 发送一个命令并读取一行回复，错误回复转为error
+func masterCall(sess *Session, args ...string) (string, error) {
+	c := make(Command, len(args))
+	for i, arg := range args {
+		c[i] = []byte(arg)
+	}
+	sess.WriteReply(c)
+	if err := sess.Flush(); err != nil {
+		return "", err
+	}
+	line, err := sess.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) > 0 && line[0] == '-' {
+		return "", &masterError{args[0], string(line[1:])}
+	}
+	return strings.TrimPrefix(string(line), "+"), nil
+}
+
+// 主库的错误回复
+type masterError struct {
+	cmd, msg string
+}
+
+func (e *masterError) Error() string {
+	return "master replied to " + e.cmd + ": " + e.msg
+}
+
+// 接收RDB，清空本地数据之后载入
+// $<len>后面是RDB文件，diskless同步时是$EOF:<40字节标记>，RDB之后再发送同样的标记
+func (s *GoRedisServer) fullSync(rp *replication, sess *Session) error {
+	for {
+		b, err := sess.ReadByte()
+		if err != nil {
+			return err
+		}
+		// 主库生成RDB期间发送的保活
+		if b == '\n' {
+			continue
+		}
+		if b != '$' {
+			return fmt.Errorf("bad bulk payload from master: %q", b)
+		}
+		break
+	}
+	line, err := sess.ReadLine()
+	if err != nil {
+		return err
+	}
+	var r io.Reader = sess
+	var lr *io.LimitedReader
+	mark := []byte{}
+	if bytes.HasPrefix(line, []byte("EOF:")) {
+		mark = line[4:]
+		if len(mark) != replEOFMarkLen {
+			return fmt.Errorf("bad EOF mark from master: %q", line)
+		}
+	} else {
+		n, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad bulk length from master: %q", line)
+		}
+		lr = &io.LimitedReader{R: sess, N: n}
+		r = lr
+	}
+	if err := s.loadRDB(rp, r); err != nil {
+		return err
+	}
+	if len(mark) > 0 {
+		end := make([]byte, replEOFMarkLen)
+		if _, err := io.ReadFull(sess, end); err != nil {
+			return err
+		}
+		if !bytes.Equal(end, mark) {
+			return errors.New("EOF mark mismatch after RDB payload")
+		}
+	}
+	if lr != nil {
+		_, err = io.Copy(ioutil.Discard, lr)
+	}
+	return err
+}
+
+// 清空数据，然后写入RDB中的key，只有db 0会载入
+// 多主复制的来源只替换这个来源写入的key
+func (s *GoRedisServer) loadRDB(rp *replication, r io.Reader) error {
+	start := time.Now()
+	if rp.src != nil {
+		if err := s.dropSource(rp.src); err != nil {
+			return err
+		}
+	} else {
+		// 数据来自官方redis，之前按WAL同步的进度不再有效
+		if err := s.db.DeleteMeta(replMeta); err != nil {
+			return err
+		}
+		if err := s.db.FlushAll(); err != nil {
+			return err
+		}
+	}
+	now := nowMs()
+	loaded, skipped := 0, 0
+	dec := rdb.NewDecoder(r)
+	err := dec.Decode(func(e *rdb.Entry) error {
+		if e.DB != 0 || (e.ExpireAt > 0 && e.ExpireAt <= now) {
+			skipped++
+			return nil
+		}
+		if rp.src != nil {
+			ok, err := s.loadFromSource(rp.src, e.Key, func() error { return s.loadEntry(e) })
+			if ok {
+				loaded++
+			} else {
+				skipped++
+			}
+			return err
+		}
+		loaded++
+		return s.loadEntry(e)
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("replication: loaded", loaded, "keys from master in", time.Since(start), "skipped", skipped)
+	if dec.Skipped > 0 {
+		log.Println("replication: skipped", dec.Skipped, "keys of types GoRedis can't store, like streams and modules")
+	}
+	// 数据已经整体替换，自己的从库需要重新全量同步
+	s.feed.reset()
+	return nil
+}
+
+func (s *GoRedisServer) loadEntry(e *rdb.Entry) error {
+	s.db.RLock()
+	defer s.db.RUnlock()
+	return s.db.LoadEntry(e)
+}
+
+// 执行主库发来的命令，直到连接断开
+func (s *GoRedisServer) streamFromMaster(rp *replication, sess *Session) error {
+	m := &masterClient{sess: sess, repl: rp, st: &sessionState{}}
+	// 来源的进度和ACK一起定时保存，连接断开时再保存一次
+	// 等待ACK的goroutine退出，REPLSOURCE REMOVE删除进度之后不会再写入
+	m.onAck = func() { s.saveProgress(rp) }
+	defer s.saveProgress(rp)
+	stop, acked := make(chan bool), make(chan bool)
+	defer func() {
+		close(stop)
+		<-acked
+	}()
+	go func() {
+		m.ackLoop(stop)
+		close(acked)
+	}()
+	for {
+		c, err := sess.ReadCommand()
+		if err != nil {
+			return err
+		}
+		s.applyFromMaster(m, c)
+		// GETACK回复的是这个命令之前的offset，和redis一致
+		rp.advance(int64(len(c.Bytes())))
+	}
+}
+
+func (s *GoRedisServer) applyFromMaster(m *masterClient, c Command) {
+	switch strings.ToLower(string(c[0])) {
+	case "ping":
+		return
+	case "select":
+		if len(c) == 2 {
+			if db, ok := parseInt(c[1]); ok {
+				m.db = db
+			}
+		}
+		return
+	case "replconf":
+		if len(c) >= 2 && strings.EqualFold(string(c[1]), "getack") {
+			m.ack()
+		}
+		return
+	}
+	// 只有一个db，其他db的命令丢弃
+	if m.db != 0 {
+		return
+	}
+	// SLAVEOF这类管理命令不会出现在命令流里，执行的话会等待复制的goroutine自己退出
+	cmd, ok := lookupCommand(c[0])
+	if ok && cmd.is(flagAdmin) {
+		return
+	}
+	if ok && m.repl.src != nil && (cmd.is(flagWrite) || m.st.multi) {
+		s.applyFromSource(m, cmd, c)
+		return
+	}
+	s.dispatch(m, c)
+}
+
+// 主库连接上执行命令使用的ReplyWriter，回复不发给主库，出错时记录日志
+// 有自己的sessionState，MULTI/EXEC可以正常执行
+type masterClient struct {
+	sess *Session
+	repl *replication
+	st   *sessionState
+	db   int64 // SELECT选择的db
+	// 最后一个回复，多主复制据此判断写入是否成功
+	reply Reply
+	// 来源的MULTI中进入队列的命令写入的key，不是写命令的为nil
+	queued [][][]byte
+	// 每次定时ACK之后调用
+	onAck func()
+}
+
+func (m *masterClient) WriteReply(reply Reply) (int, error) {
+	m.reply = reply
+	if e, ok := reply.(ErrorReply); ok {
+		log.Println("replication: error executing command from master:", string(e))
+	}
+	return 0, nil
+}
+
+func (m *masterClient) Context() interface{} {
+	return m.st
+}
+
+// REPLCONF ACK <offset>，主库据此计算从库的延迟
+func (m *masterClient) ack() {
+	_, offset := m.repl.progress()
+	m.sess.WriteReply(Command{[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(offset, 10))})
+	m.sess.Flush()
+}
+
+// 定时发送ACK直到stop关闭
+func (m *masterClient) ackLoop(stop chan bool) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.ack()
+			if m.onAck != nil {
+				m.onAck()
+			}
+		}
+	}
+}
+
+// 每次读写都重新设置超时，主库长时间没有数据时断开重连
+type deadlineConn struct {
+	net.Conn
+}
+
+func (c deadlineConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(replTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c deadlineConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(replTimeout))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,517 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 作为官方redis从库的主库
+// 写命令执行之后按执行顺序进入命令流(feed)，命令流写入backlog和已连接的从库，offset是命令流的总长度。
+// 从库PSYNC时，replid一致并且offset还在backlog中就从backlog继续；
+// 否则在同一时刻取得rocks快照和命令流的offset，用快照生成RDB，之后发送offset之后的命令流。
+// 进入命令流之前，相对的过期时间改写成绝对时间，随机的结果改写成确定的命令，
+// 阻塞命令被服务时改写成对应的非阻塞命令。
+// 和redis一样，第一个从库连接之前没有backlog，写命令不进入命令流，也不需要互相等待
+// https://redis.io/docs/management/replication/
+
+const (
+	// 从库的发送缓冲超过这个大小就断开，和redis的client-output-buffer-limit replica一致
+	replOutputLimit = 256 * 1024 * 1024
+	// repl-backlog-size的默认值
+	replBacklogSize = 1024 * 1024
+)
+
+type replFeed struct {
+	// 第一个从库连接之前写命令只持有gate的共享锁，active之后持有mu
+	gate   sync.RWMutex
+	active int32
+	// 写命令持有mu执行，进入命令流的顺序和执行顺序一致
+	mu sync.Mutex
+	// 当前命令改写之后的命令，rewritten为false时按rewriteForReplica改写
+	own       []Command
+	rewritten bool
+	// 执行期间被服务的阻塞命令
+	also []Command
+
+	// 以下由bmu保护
+	bmu         sync.Mutex
+	replid      string
+	offset      int64
+	backlog     []byte // 命令流最后的一段
+	backlogSize int
+	replicas    map[*replicaConn]bool
+}
+
+func newReplFeed() *replFeed {
+	return &replFeed{replid: newReplID(), backlogSize: replBacklogSize, replicas: make(map[*replicaConn]bool)}
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (f *replFeed) enabled() bool {
+	return atomic.LoadInt32(&f.active) == 1
+}
+
+// 第一个从库连接时调用，等待没有进入命令流的写命令结束，之后的写命令持有mu
+func (f *replFeed) activate() {
+	if f.enabled() {
+		return
+	}
+	f.gate.Lock()
+	atomic.StoreInt32(&f.active, 1)
+	f.gate.Unlock()
+}
+
+// 写命令执行之前调用，有命令流时等待正在执行的写命令
+func (f *replFeed) lock() {
+	f.gate.RLock()
+	if !f.enabled() {
+		return
+	}
+	f.gate.RUnlock()
+	f.mu.Lock()
+	f.own, f.rewritten, f.also = nil, false, nil
+}
+
+// 写命令执行之后调用，c和执行期间产生的命令进入命令流
+// lock和unlock之间active不会改变
+func (f *replFeed) unlock(c Command) {
+	if !f.enabled() {
+		f.gate.RUnlock()
+		return
+	}
+	f.emit(f.take(c)...)
+	f.mu.Unlock()
+}
+
+// 命令c需要传播的命令，EXEC中逐个取出放进MULTI/EXEC
+func (f *replFeed) take(c Command) []Command {
+	if !f.enabled() {
+		return nil
+	}
+	cmds := f.own
+	if !f.rewritten && c != nil {
+		cmds = rewriteForReplica(c)
+	}
+	cmds = append(cmds, f.also...)
+	f.own, f.rewritten, f.also = nil, false, nil
+	return cmds
+}
+
+// 命令执行时调用，用cmds代替命令本身进入命令流，没有参数表示不传播
+func (f *replFeed) rewrite(cmds ...Command) {
+	if !f.enabled() {
+		return
+	}
+	f.own, f.rewritten = cmds, true
+}
+
+// 阻塞的客户端被服务时调用，排在当前命令之后
+func (f *replFeed) alsoPropagate(c Command) {
+	if !f.enabled() {
+		return
+	}
+	f.also = append(f.also, c)
+}
+
+// 写入backlog和所有从库
+func (f *replFeed) emit(cmds ...Command) {
+	if len(cmds) == 0 || !f.enabled() {
+		return
+	}
+	f.bmu.Lock()
+	defer f.bmu.Unlock()
+	for _, c := range cmds {
+		b := c.Bytes()
+		f.backlog = append(f.backlog, b...)
+		// 超过两倍时才截断，避免每次都复制
+		if len(f.backlog) > 2*f.backlogSize {
+			f.backlog = append([]byte{}, f.backlog[len(f.backlog)-f.backlogSize:]...)
+		}
+		f.offset += int64(len(b))
+		for rc := range f.replicas {
+			rc.push(b)
+		}
+	}
+}
+
+func (f *replFeed) setBacklogSize(n int64) {
+	f.bmu.Lock()
+	f.backlogSize = int(n)
+	f.bmu.Unlock()
+}
+
+func (f *replFeed) progress() (string, int64) {
+	f.bmu.Lock()
+	defer f.bmu.Unlock()
+	return f.replid, f.offset
+}
+
+// 数据被整体替换之后，比如从主库全量同步，已有的从库和backlog都不能继续使用
+func (f *replFeed) reset() {
+	f.bmu.Lock()
+	defer f.bmu.Unlock()
+	f.replid = newReplID()
+	f.backlog = nil
+	for rc := range f.replicas {
+		rc.close()
+		delete(f.replicas, rc)
+	}
+}
+
+// PSYNC replid offset，offset是从库需要的下一个字节，还在backlog中时加入从库
+func (f *replFeed) attachContinue(rc *replicaConn, replid string, offset int64) bool {
+	f.activate()
+	f.bmu.Lock()
+	defer f.bmu.Unlock()
+	start := f.offset - int64(len(f.backlog)) + 1
+	if replid != f.replid || offset < start || offset > f.offset+1 {
+		return false
+	}
+	rc.buf = append([]byte{}, f.backlog[offset-start:]...)
+	f.replicas[rc] = true
+	return true
+}
+
+// 全量同步，返回快照和它对应的offset，之后的命令流缓存在rc中
+func (f *replFeed) attachFull(rc *replicaConn, db *rocks.DB) (*rocks.Snapshot, string, int64) {
+	// 等待执行中的写命令，快照包含offset之前的全部写入
+	f.activate()
+	f.lock()
+	defer f.unlock(nil)
+	// 过期删除不持有mu，快照和加入从库在bmu内完成，之后的DEL都会发给从库
+	f.bmu.Lock()
+	snap := db.Snapshot()
+	replid, offset := f.replid, f.offset
+	f.replicas[rc] = true
+	f.bmu.Unlock()
+	// 从库的命令流从db 0开始
+	f.emit(Command{[]byte("SELECT"), []byte("0")})
+	return snap, replid, offset
+}
+
+func (f *replFeed) detach(rc *replicaConn) {
+	f.bmu.Lock()
+	delete(f.replicas, rc)
+	f.bmu.Unlock()
+}
+
+// ROLE中的从库列表：ip, port, offset
+func (f *replFeed) roleReplicas() MultiBulkReply {
+	f.bmu.Lock()
+	defer f.bmu.Unlock()
+	list := MultiBulkReply{}
+	for rc := range f.replicas {
+		host, port, _ := net.SplitHostPort(rc.addr)
+		list = append(list, MultiBulkReply{host, port, strconv.FormatInt(rc.acked(), 10)})
+	}
+	return list
+}
+
+// 记录写命令是否回复了错误，WRONGTYPE、参数错误、读写出错的命令都不传播
+type replyWatcher struct {
+	ReplyWriter
+	failed bool
+}
+
+func (w *replyWatcher) WriteReply(reply Reply) (int, error) {
+	if _, ok := reply.(ErrorReply); ok {
+		w.failed = true
+	}
+	return w.ReplyWriter.WriteReply(reply)
+}
+
+// 在unlock之前调用
+func (w *replyWatcher) dropIfFailed(f *replFeed) {
+	if w.failed {
+		f.rewrite()
+	}
+}
+
+// 阻塞命令第一次尝试时使用的锁，和写命令一样等待feed
+type feedLocker struct {
+	s *GoRedisServer
+}
+
+func (l feedLocker) Lock() {
+	l.s.feed.lock()
+	l.s.db.RLock()
+}
+
+func (l feedLocker) Unlock() {
+	l.s.db.RUnlock()
+	l.s.feed.unlock(nil)
+}
+
+// 改写成从库执行结果确定的命令，不是写命令的不传播
+// 阻塞命令只在被服务时传播对应的非阻塞命令
+func rewriteForReplica(c Command) []Command {
+	cmd, ok := lookupCommand(c[0])
+	if !ok || !cmd.is(flagWrite) || cmd.is(flagBlocking) {
+		return nil
+	}
+	switch cmd.name {
+	case "expire", "pexpire", "expireat":
+		n, ok := parseInt(c[2])
+		if !ok {
+			break
+		}
+		unit := int64(1000)
+		if cmd.name == "pexpire" {
+			unit = 1
+		}
+		ms, ok := deadlineMs(n, unit, cmd.name == "expireat")
+		if !ok {
+			break
+		}
+		return []Command{{[]byte("PEXPIREAT"), c[1], []byte(strconv.FormatInt(ms, 10))}}
+	case "set":
+		for i := 3; i+1 < len(c); i++ {
+			opt := strings.ToUpper(string(c[i]))
+			if opt != "EX" && opt != "PX" && opt != "EXAT" {
+				continue
+			}
+			n, ok := parseInt(c[i+1])
+			if !ok {
+				break
+			}
+			unit := int64(1000)
+			if opt == "PX" {
+				unit = 1
+			}
+			ms, ok := deadlineMs(n, unit, opt == "EXAT")
+			if !ok {
+				break
+			}
+			rc := append(Command{}, c...)
+			rc[i], rc[i+1] = []byte("PXAT"), []byte(strconv.FormatInt(ms, 10))
+			return []Command{rc}
+		}
+	}
+	return []Command{c}
+}
+
+// 一个官方redis从库
+type replicaConn struct {
+	sess *Session
+	addr string // ip:listening-port
+	mu   sync.Mutex
+	// 等待发送的命令流
+	buf    []byte
+	ready  chan bool
+	closed bool
+	ack    int64
+}
+
+func newReplicaConn(sess *Session) *replicaConn {
+	st := stateOf(sess)
+	host, port, _ := net.SplitHostPort(sess.RemoteAddr().String())
+	if st.replPort != "" {
+		port = st.replPort
+	}
+	return &replicaConn{sess: sess, addr: net.JoinHostPort(host, port), ready: make(chan bool, 1)}
+}
+
+func (rc *replicaConn) push(b []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return
+	}
+	if len(rc.buf)+len(b) > replOutputLimit {
+		log.Println("replication: replica", rc.addr, "output buffer limit reached, closing")
+		rc.closed = true
+		rc.sess.Close()
+		return
+	}
+	rc.buf = append(rc.buf, b...)
+	select {
+	case rc.ready <- true:
+	default:
+	}
+}
+
+func (rc *replicaConn) pull() []byte {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	b := rc.buf
+	rc.buf = nil
+	return b
+}
+
+func (rc *replicaConn) close() {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.sess.Close()
+	rc.mu.Unlock()
+}
+
+func (rc *replicaConn) setAck(offset int64) {
+	rc.mu.Lock()
+	rc.ack = offset
+	rc.mu.Unlock()
+}
+
+func (rc *replicaConn) acked() int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.ack
+}
+
+// 官方redis从库的全量或部分同步，psync为false时是老的SYNC，没有FULLRESYNC回复
+// 阻塞直到从库断开
+func (s *GoRedisServer) serveOfficialReplica(sess *Session, replid string, offset int64, psync bool) error {
+	if s.repl.viaWAL() {
+		sess.WriteReply(ErrorReply("ERR replicating from a GoRedis master by WAL, can't serve official replicas"))
+		return nil
+	}
+	rc := newReplicaConn(sess)
+	defer s.feed.detach(rc)
+	if psync && s.feed.attachContinue(rc, replid, offset) {
+		sess.WriteReply(StatusReply("CONTINUE " + replid))
+		log.Println("replication: partial resync with replica", rc.addr, "from offset", offset)
+	} else {
+		snap, replid, offset := s.feed.attachFull(rc, s.db)
+		err := s.sendRDB(sess, snap, replid, offset, psync)
+		snap.Release()
+		if err != nil {
+			return err
+		}
+		log.Println("replication: full resync with replica", rc.addr, "at offset", offset)
+	}
+	sess.SetWriteDeadline(time.Now().Add(replTimeout))
+	if err := sess.Flush(); err != nil {
+		return err
+	}
+
+	closed, wait := readReplica(sess, func(c Command) {
+		if len(c) == 3 && strings.EqualFold(string(c[0]), "replconf") && strings.EqualFold(string(c[1]), "ack") {
+			if n, ok := parseInt(c[2]); ok {
+				rc.setAck(n)
+			}
+		}
+	})
+	defer wait()
+	ping := time.NewTicker(replPingInterval)
+	defer ping.Stop()
+	for {
+		if b := rc.pull(); len(b) > 0 {
+			sess.SetWriteDeadline(time.Now().Add(replTimeout))
+			if _, err := sess.Conn.Write(b); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-rc.ready:
+		case err := <-closed:
+			return err
+		case <-ping.C:
+			// 和redis一样，PING也是命令流的一部分
+			s.feed.emit(Command{[]byte("PING")})
+		}
+	}
+}
+
+// 读取从库发来的命令，直到连接断开
+// 返回的wait关闭连接并等待读取的goroutine退出，之后ServeSession才能继续读取
+func readReplica(sess *Session, fn func(c Command)) (<-chan error, func()) {
+	closed := make(chan error, 1)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			sess.SetReadDeadline(time.Now().Add(replTimeout))
+			c, err := sess.ReadCommand()
+			if err != nil {
+				closed <- err
+				return
+			}
+			fn(c)
+		}
+	}()
+	return closed, func() {
+		sess.Close()
+		<-done
+	}
+}
+
+// 发送RDB，从库支持diskless时直接发送，否则先写入临时文件得到长度
+func (s *GoRedisServer) sendRDB(sess *Session, snap *rocks.Snapshot, replid string, offset int64, psync bool) error {
+	if psync {
+		sess.WriteReply(StatusReply(fmt.Sprintf("FULLRESYNC %s %d", replid, offset)))
+	}
+	sess.SetWriteDeadline(time.Now().Add(replTimeout))
+	if err := sess.Flush(); err != nil {
+		return err
+	}
+	w := deadlineConn{sess.Conn}
+	if stateOf(sess).replCapaEOF {
+		mark := newReplID()
+		if _, err := io.WriteString(w, "$EOF:"+mark+"\r\n"); err != nil {
+			return err
+		}
+		if err := snap.WriteRDB(w); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, mark)
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "goredis-sync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// 生成RDB期间发送换行，避免从库超时
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.Write([]byte("\n"))
+			}
+		}
+	}()
+	err = snap.WriteRDB(f)
+	close(stop)
+	<-done
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "$"+strconv.FormatInt(size, 10)+"\r\n"); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 一从多主：同时复制多个主库，每个主库是一个来源(source)
+// REPLSOURCE ADD <name> <host> <port> [PREFIX <prefix>] [POLICY lww|priority] [PRIORITY <n>]
+// REPLSOURCE REMOVE <name>
+// REPLSOURCE LIST
+// 每个来源独立连接主库，按PSYNC和命令流复制（不使用WAL，需要按key过滤），
+// 来源的定义和复制进度记录在rocks中，重启之后自动恢复并尝试部分同步。
+// 进度不是每个命令都保存，而是和ACK一起每replAckInterval保存一次，
+// 进程崩溃时最后一个间隔内的命令在重启之后会重新执行，INCR这类命令可能重复生效
+// 只接受key以PREFIX开头的写命令，多个key的命令需要全部匹配。
+// 每个key记录最后写入它的来源和写入时间，其他来源再写入时按写入方的策略处理冲突：
+//   lww       写入时间不早于记录的时间时生效。写入时间按来源自己的时钟：
+//             连接时用TIME取得来源和本机的时钟差，加上命令到达时本机的时间
+//   priority  优先级不低于记录的来源时生效
+// 写入成功之后才记录写入者，MULTI中的命令在EXEC之后按各自的结果记录。
+// 不是来源的写入，比如客户端的写入、DEL和过期，清除key的写入者，
+// 全量同步和命令流中的FLUSHALL只删除仍然属于这个来源的key
+
+const (
+	policyLWW      = "lww"
+	policyPriority = "priority"
+
+	// 内部key的名称
+	sourceMeta   = "source:"          // 来源的定义
+	progressMeta = "source-progress:" // 来源的复制进度，"replid offset"
+	ownerMeta    = "owner:"           // key最后的写入者，"name priority ms"
+)
+
+type replSource struct {
+	name     string
+	addr     string
+	prefix   []byte
+	policy   string
+	priority int64
+	// 执行和因为过滤或冲突丢弃的写命令
+	applied, rejected int64
+	// 来源的时钟减去本机的时钟，毫秒，只在复制的goroutine中使用
+	skew int64
+}
+
+// 按来源的时钟，现在的时间
+func (src *replSource) now() int64 {
+	return nowMs() + src.skew
+}
+
+// 记录在sourceMeta中的定义
+func (src *replSource) encode() []byte {
+	return []byte(fmt.Sprintf("%s %s %d %s", src.addr, src.policy, src.priority, strconv.Quote(string(src.prefix))))
+}
+
+func decodeSource(name string, v []byte) (*replSource, bool) {
+	fields := strings.SplitN(string(v), " ", 4)
+	if len(fields) != 4 {
+		return nil, false
+	}
+	priority, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	prefix, err := strconv.Unquote(fields[3])
+	if err != nil {
+		return nil, false
+	}
+	return &replSource{name: name, addr: fields[0], policy: fields[1], priority: priority, prefix: []byte(prefix)}, true
+}
+
+type replSources struct {
+	mu sync.Mutex
+	m  map[string]*replication
+	// len(m)，每次写入的通知都要检查，不持有mu读取
+	n int32
+	// 来源正在写入的key，这些key的写入通知不清除写入者，由mu保护
+	applying map[string]bool
+	// 检查冲突、执行命令和记录写入者之间不能有其他来源的写入
+	applyMu sync.Mutex
+}
+
+func newReplSources() *replSources {
+	return &replSources{m: make(map[string]*replication), applying: make(map[string]bool)}
+}
+
+func (ss *replSources) count() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.m)
+}
+
+// 按名称排序的全部来源
+func (ss *replSources) list() []*replication {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	list := make([]*replication, 0, len(ss.m))
+	for _, rp := range ss.m {
+		list = append(list, rp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].src.name < list[j].src.name })
+	return list
+}
+
+// 重启之后恢复记录的来源
+func (s *GoRedisServer) restoreSources() {
+	s.db.MetaEnumerate(sourceMeta, func(name string, value []byte) {
+		name = name[len(sourceMeta):]
+		src, ok := decodeSource(name, value)
+		if !ok {
+			log.Println("replication: bad source definition", name, string(value))
+			return
+		}
+		s.addSource(src)
+		log.Println("replication: source", name, "restored, master", src.addr)
+	})
+}
+
+// 开始复制一个来源，同名的来源先停止
+func (s *GoRedisServer) addSource(src *replSource) {
+	rp := newReplication()
+	rp.src = src
+	if v, err := s.db.Meta(progressMeta + src.name); err == nil {
+		fields := strings.Fields(string(v))
+		if len(fields) == 2 {
+			if offset, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				rp.replid, rp.offset = fields[0], offset
+			}
+		}
+	}
+	s.sources.mu.Lock()
+	old := s.sources.m[src.name]
+	s.sources.m[src.name] = rp
+	atomic.StoreInt32(&s.sources.n, int32(len(s.sources.m)))
+	s.sources.mu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+	s.startReplication(rp, src.addr)
+}
+
+func (s *GoRedisServer) removeSource(name string) bool {
+	s.sources.mu.Lock()
+	rp := s.sources.m[name]
+	delete(s.sources.m, name)
+	atomic.StoreInt32(&s.sources.n, int32(len(s.sources.m)))
+	s.sources.mu.Unlock()
+	if rp == nil {
+		return false
+	}
+	rp.stop()
+	s.db.DeleteMeta(sourceMeta + name)
+	s.db.DeleteMeta(progressMeta + name)
+	for _, key := range s.ownedBy(name) {
+		s.db.DeleteMeta(ownerMeta + string(key))
+	}
+	return true
+}
+
+// 记录来源的复制进度，SLAVEOF的进度只在内存中
+// 复制的goroutine和ACK的goroutine都会调用，SetMeta本身是原子的
+func (s *GoRedisServer) saveProgress(rp *replication) {
+	if rp.src == nil {
+		return
+	}
+	replid, offset := rp.progress()
+	if err := s.db.SetMeta(progressMeta+rp.src.name, []byte(replid+" "+strconv.FormatInt(offset, 10))); err != nil {
+		log.Println("replication: save progress of source", rp.src.name, err)
+	}
+}
+
+// key最后的写入者
+func (s *GoRedisServer) ownerOf(key []byte) (name string, priority, ms int64, ok bool) {
+	v, err := s.db.Meta(ownerMeta + string(key))
+	if err != nil || v == nil {
+		return "", 0, 0, false
+	}
+	fields := strings.Fields(string(v))
+	if len(fields) != 3 {
+		return "", 0, 0, false
+	}
+	priority, err1 := strconv.ParseInt(fields[1], 10, 64)
+	ms, err2 := strconv.ParseInt(fields[2], 10, 64)
+	return fields[0], priority, ms, err1 == nil && err2 == nil
+}
+
+// 写入成功之后记录来源和写入时间，写入之后key不存在时不需要记录
+func (s *GoRedisServer) setOwner(src *replSource, key []byte, ms int64) {
+	var err error
+	if s.db.TypeOf(key) == rocks.NONE {
+		err = s.db.DeleteMeta(ownerMeta + string(key))
+	} else {
+		err = s.db.SetMeta(ownerMeta+string(key), []byte(fmt.Sprintf("%s %d %d", src.name, src.priority, ms)))
+	}
+	if err != nil {
+		log.Println("replication: set owner of", string(key), err)
+	}
+}
+
+// 写入通知中调用，不是来源写入的key不再属于之前的来源
+func (s *GoRedisServer) disown(key []byte) {
+	ss := s.sources
+	if atomic.LoadInt32(&ss.n) == 0 {
+		return
+	}
+	ss.mu.Lock()
+	skip := ss.applying[string(key)]
+	ss.mu.Unlock()
+	if skip {
+		return
+	}
+	// 大部分key没有写入者，先读再删，避免每次写入都多一次rocks写入
+	if v, err := s.db.Meta(ownerMeta + string(key)); err != nil || v == nil {
+		return
+	}
+	if err := s.db.DeleteMeta(ownerMeta + string(key)); err != nil {
+		log.Println("replication: clear owner of", string(key), err)
+	}
+}
+
+// 来源写入keys，执行fn期间这些key的写入通知不清除写入者
+func (ss *replSources) writing(keys [][]byte, fn func()) {
+	ss.mu.Lock()
+	for _, key := range keys {
+		ss.applying[string(key)] = true
+	}
+	ss.mu.Unlock()
+	defer func() {
+		ss.mu.Lock()
+		ss.applying = make(map[string]bool)
+		ss.mu.Unlock()
+	}()
+	fn()
+}
+
+// 属于来源name的key
+func (s *GoRedisServer) ownedBy(name string) [][]byte {
+	var keys [][]byte
+	s.db.MetaEnumerate(ownerMeta, func(meta string, value []byte) {
+		if fields := strings.Fields(string(value)); len(fields) > 0 && fields[0] == name {
+			keys = append(keys, []byte(meta[len(ownerMeta):]))
+		}
+	})
+	return keys
+}
+
+// 来源在ms时是否可以写入key，key不存在时之前的写入者已经没有意义
+func (s *GoRedisServer) acceptFrom(src *replSource, key []byte, ms int64) bool {
+	if !bytes.HasPrefix(key, src.prefix) {
+		return false
+	}
+	if s.db.TypeOf(key) == rocks.NONE {
+		return true
+	}
+	name, priority, owned, ok := s.ownerOf(key)
+	if !ok || name == src.name {
+		return true
+	}
+	if src.policy == policyPriority {
+		return src.priority >= priority
+	}
+	return ms >= owned
+}
+
+// 执行来源发来的写命令，以及MULTI之后的全部命令
+func (s *GoRedisServer) applyFromSource(m *masterClient, cmd *command, c Command) {
+	src := m.repl.src
+	s.sources.applyMu.Lock()
+	defer s.sources.applyMu.Unlock()
+	ms := src.now()
+	switch cmd.name {
+	case "flushall", "flushdb":
+		if err := s.dropSource(src); err != nil {
+			log.Println("replication: flush source", src.name, err)
+		}
+		return
+	case "exec":
+		// 按EXEC的结果记录，事务没有执行时回复不是数组
+		queued := m.queued
+		m.queued = nil
+		var keys [][]byte
+		for _, q := range queued {
+			keys = append(keys, q...)
+		}
+		replies, _ := s.sourceCall(m, keys, c).(MultiBulkReply)
+		for i, q := range queued {
+			if i >= len(replies) || q == nil {
+				continue
+			}
+			if _, failed := replies[i].(ErrorReply); !failed {
+				s.applied(src, q, ms)
+			}
+		}
+		return
+	case "discard":
+		m.queued = nil
+		s.dispatch(m, c)
+		return
+	}
+	var keys [][]byte
+	if cmd.is(flagWrite) {
+		keys = cmd.keys(c)
+		for _, key := range keys {
+			if !s.acceptFrom(src, key, ms) {
+				atomic.AddInt64(&src.rejected, 1)
+				return
+			}
+		}
+	}
+	reply := s.sourceCall(m, keys, c)
+	if _, failed := reply.(ErrorReply); failed {
+		return
+	}
+	// 事务中的命令只是进入队列，不是写命令的也占一个位置，和EXEC的回复对应
+	if reply == StatusReply("QUEUED") {
+		m.queued = append(m.queued, keys)
+		return
+	}
+	if cmd.is(flagWrite) {
+		s.applied(src, keys, ms)
+	}
+}
+
+// 执行来源的命令c，返回它的回复
+func (s *GoRedisServer) sourceCall(m *masterClient, keys [][]byte, c Command) Reply {
+	m.reply = nil
+	s.sources.writing(keys, func() { s.dispatch(m, c) })
+	return m.reply
+}
+
+// 来源的写命令执行成功
+func (s *GoRedisServer) applied(src *replSource, keys [][]byte, ms int64) {
+	atomic.AddInt64(&src.applied, 1)
+	for _, key := range keys {
+		s.setOwner(src, key, ms)
+	}
+}
+
+// 删除仍然属于来源的全部key，以DEL进入自己的命令流
+func (s *GoRedisServer) dropSource(src *replSource) error {
+	keys := s.ownedBy(src.name)
+	s.feed.lock()
+	defer s.feed.unlock(nil)
+	s.db.RLock()
+	defer s.db.RUnlock()
+	dropped := 0
+	for _, key := range keys {
+		// 枚举之后可能被其他写入清除了写入者
+		if name, _, _, ok := s.ownerOf(key); !ok || name != src.name {
+			continue
+		}
+		dropped++
+		if err := s.db.Delete(key); err != nil {
+			return err
+		}
+		if err := s.db.DeleteMeta(ownerMeta + string(key)); err != nil {
+			return err
+		}
+		s.feed.alsoPropagate(Command{[]byte("DEL"), key})
+	}
+	log.Println("replication: dropped", dropped, "keys of source", src.name)
+	return nil
+}
+
+// 全量同步时用load载入RDB中的一个key，被过滤或者冲突时返回false
+func (s *GoRedisServer) loadFromSource(src *replSource, key []byte, load func() error) (bool, error) {
+	s.sources.applyMu.Lock()
+	defer s.sources.applyMu.Unlock()
+	ms := src.now()
+	if !s.acceptFrom(src, key, ms) {
+		atomic.AddInt64(&src.rejected, 1)
+		return false, nil
+	}
+	// 其他来源写入的同名key整个替换
+	var err error
+	s.sources.writing([][]byte{key}, func() { err = load() })
+	if err != nil {
+		return false, err
+	}
+	s.applied(src, [][]byte{key}, ms)
+	return true, nil
+}
+
+// 主库的时钟减去本机的时钟，毫秒，按往返时间的一半修正
+// TIME回复两个bulk：unix时间的秒和微秒
+func masterClock(sess *Session) (int64, error) {
+	start := nowMs()
+	line, err := masterCall(sess, "TIME")
+	if err != nil {
+		return 0, err
+	}
+	if line != "*2" {
+		return 0, fmt.Errorf("bad TIME reply %q", line)
+	}
+	var v [2]int64
+	for i := range v {
+		if _, err := sess.ReadLine(); err != nil {
+			return 0, err
+		}
+		b, err := sess.ReadLine()
+		if err != nil {
+			return 0, err
+		}
+		if v[i], err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return 0, fmt.Errorf("bad TIME reply %q", b)
+		}
+	}
+	return v[0]*1000 + v[1]/1000 - (start+nowMs())/2, nil
+}
+
+// REPLSOURCE ADD <name> <host> <port> [PREFIX <prefix>] [POLICY lww|priority] [PRIORITY <n>]
+// REPLSOURCE REMOVE <name>
+// REPLSOURCE LIST
+func (s *GoRedisServer) OnREPLSOURCE(r ReplyWriter, c Command) {
+	switch strings.ToLower(string(c[1])) {
+	case "add":
+		s.replSourceAdd(r, c)
+	case "remove":
+		if len(c) != 3 {
+			r.WriteReply(ErrSyntax)
+			return
+		}
+		if !s.removeSource(string(c[2])) {
+			r.WriteReply(ErrorReply("ERR no such replication source"))
+			return
+		}
+		log.Println("replication: source", string(c[2]), "removed")
+		r.WriteReply(StatusReply("OK"))
+	case "list":
+		list := MultiBulkReply{}
+		for _, rp := range s.sources.list() {
+			list = append(list, rp.sourceInfo())
+		}
+		r.WriteReply(list)
+	default:
+		r.WriteReply(ErrorReply("ERR unknown subcommand '" + string(c[1]) + "'. Try ADD, REMOVE, LIST."))
+	}
+}
+
+func (s *GoRedisServer) replSourceAdd(r ReplyWriter, c Command) {
+	if len(c) < 5 || len(c)%2 != 1 {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	name := string(c[2])
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		r.WriteReply(ErrorReply("ERR invalid source name"))
+		return
+	}
+	if n, err := strconv.Atoi(string(c[4])); err != nil || n <= 0 || n > 65535 {
+		r.WriteReply(ErrorReply("ERR Invalid master port"))
+		return
+	}
+	src := &replSource{name: name, addr: net.JoinHostPort(string(c[3]), string(c[4])), policy: policyLWW}
+	for i := 5; i < len(c); i += 2 {
+		switch strings.ToUpper(string(c[i])) {
+		case "PREFIX":
+			src.prefix = c[i+1]
+		case "POLICY":
+			src.policy = strings.ToLower(string(c[i+1]))
+			if src.policy != policyLWW && src.policy != policyPriority {
+				r.WriteReply(ErrorReply("ERR policy must be lww or priority"))
+				return
+			}
+		case "PRIORITY":
+			n, ok := parseInt(c[i+1])
+			if !ok {
+				r.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+				return
+			}
+			src.priority = n
+		default:
+			r.WriteReply(ErrSyntax)
+			return
+		}
+	}
+	if s.repl.master() != "" {
+		r.WriteReply(ErrorReply("ERR can't add a replication source while SLAVEOF is active"))
+		return
+	}
+	// 换了主库之后之前的进度不能继续使用
+	if v, err := s.db.Meta(sourceMeta + name); err == nil && v != nil {
+		if old, ok := decodeSource(name, v); !ok || old.addr != src.addr {
+			s.db.DeleteMeta(progressMeta + name)
+		}
+	}
+	if err := s.db.SetMeta(sourceMeta+name, src.encode()); err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	s.addSource(src)
+	log.Println("replication: source", name, "added, master", src.addr)
+	r.WriteReply(StatusReply("OK"))
+}
+
+// REPLSOURCE LIST和INFO中的一个来源
+func (rp *replication) sourceInfo() MultiBulkReply {
+	src := rp.src
+	rp.mu.Lock()
+	state, offset := replStateConnect, rp.offset
+	if rp.link != nil {
+		state = rp.link.state
+	}
+	rp.mu.Unlock()
+	return MultiBulkReply{
+		"name", src.name,
+		"addr", src.addr,
+		"state", state,
+		"offset", int(offset),
+		"prefix", string(src.prefix),
+		"policy", src.policy,
+		"priority", int(src.priority),
+		"applied", int(atomic.LoadInt64(&src.applied)),
+		"rejected", int(atomic.LoadInt64(&src.rejected)),
+	}
+}
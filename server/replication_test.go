@@ -0,0 +1,692 @@
+package server
+
+import (
+	"bytes"
+	"github.com/facebookgo/ensure"
+	"github.com/latermoon/GoRedis/libs/rdb"
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"github.com/tecbot/gorocksdb"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplicaServer(t *testing.T) *GoRedisServer {
+	dir, err := ioutil.TempDir("", "replica")
+	ensure.Nil(t, err)
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	rdb, err := gorocksdb.OpenDb(opts, dir)
+	ensure.Nil(t, err)
+	return New(rocks.New(rdb))
+}
+
+func makeCommand(args ...string) Command {
+	c := make(Command, len(args))
+	for i, arg := range args {
+		c[i] = []byte(arg)
+	}
+	return c
+}
+
+// 官方redis作为主库时的行为：回复握手，返回从库发来的PSYNC参数
+func acceptReplica(t *testing.T, lis net.Listener) (*Session, Command) {
+	return acceptReplicaAt(t, lis, 0)
+}
+
+// 同acceptReplica，主库的时钟比本机快skew毫秒
+func acceptReplicaAt(t *testing.T, lis net.Listener, skew int64) (*Session, Command) {
+	conn, err := lis.Accept()
+	ensure.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	sess := NewSession(conn)
+	for {
+		c, err := sess.ReadCommand()
+		ensure.Nil(t, err)
+		switch strings.ToUpper(string(c[0])) {
+		case "PING":
+			sess.WriteReply(StatusReply("PONG"))
+		case "SYNC":
+			// 官方redis的SYNC没有参数
+			sess.WriteReply(ErrorReply("ERR wrong number of arguments for 'sync' command"))
+		case "REPLCONF":
+			sess.WriteReply(StatusReply("OK"))
+		case "TIME":
+			ms := nowMs() + skew
+			sess.WriteReply(MultiBulkReply{strconv.FormatInt(ms/1000, 10), strconv.FormatInt(ms%1000*1000, 10)})
+		case "PSYNC":
+			return sess, c
+		default:
+			t.Fatalf("unexpected command from replica: %s", c)
+		}
+		ensure.Nil(t, sess.Flush())
+	}
+}
+
+// 发送命令流，返回命令流的长度
+func sendStream(t *testing.T, sess *Session, cmds ...Command) int64 {
+	var buf bytes.Buffer
+	for _, c := range cmds {
+		buf.Write(c.Bytes())
+	}
+	_, err := sess.Write(buf.Bytes())
+	ensure.Nil(t, err)
+	return int64(buf.Len())
+}
+
+// 发送GETACK，等待从库回复处理到offset
+func waitAck(t *testing.T, sess *Session, offset int64) {
+	sendStream(t, sess, makeCommand("REPLCONF", "GETACK", "*"))
+	for {
+		c, err := sess.ReadCommand()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, strings.ToUpper(string(c[1])), "ACK")
+		if string(c[2]) == strconv.FormatInt(offset, 10) {
+			return
+		}
+	}
+}
+
+func getString(s *GoRedisServer, key string) string {
+	val, _ := s.db.Get([]byte(key))
+	return string(val)
+}
+
+func TestReplicaOfFakeMaster(t *testing.T) {
+	sample, err := ioutil.ReadFile("../libs/rdb/testdata/sample.rdb")
+	ensure.Nil(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer lis.Close()
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	ensure.Nil(t, s.db.Set([]byte("stale"), []byte("x")))
+	rec := &replyRecorder{}
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host, port))
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host, port))
+	ensure.DeepEqual(t, rec.replies, []interface{}{StatusReply("OK"), StatusReply("OK Already connected to specified master")})
+
+	// 全量同步，RDB之前有保活的换行
+	replid := strings.Repeat("a", 40)
+	sess, psync := acceptReplica(t, lis)
+	ensure.DeepEqual(t, psync.String(), `["PSYNC","?","-1"]`)
+	sess.Write([]byte("+FULLRESYNC " + replid + " 100\r\n\n\n$" + strconv.Itoa(len(sample)) + "\r\n"))
+	sess.Write(sample)
+
+	offset := 100 + sendStream(t, sess,
+		makeCommand("PING"),
+		makeCommand("SELECT", "0"),
+		makeCommand("SET", "str", "world"),
+		makeCommand("RPUSH", "list:lp", "b"),
+		makeCommand("SET", "tmp", "v", "PXAT", strconv.FormatInt(nowMs()+60000, 10)),
+		// redis 6.2+的INCRBYFLOAT
+		makeCommand("SET", "tmp", "1.5", "KEEPTTL"),
+		makeCommand("SELECT", "1"),
+		makeCommand("SET", "db1", "ignored"),
+		makeCommand("SELECT", "0"),
+		makeCommand("MULTI"),
+		makeCommand("INCR", "counter"),
+		makeCommand("HSET", "hash:plain", "k2", "v2"),
+		makeCommand("EXEC"),
+	)
+	waitAck(t, sess, offset)
+
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("stale")), rocks.ElementType(rocks.NONE))
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("db1")), rocks.ElementType(rocks.NONE))
+	ensure.DeepEqual(t, getString(s, "str"), "world")
+	ensure.DeepEqual(t, getString(s, "lzf"), "aaaaaaaaaa")
+	ensure.DeepEqual(t, getString(s, "counter"), "1")
+	ensure.DeepEqual(t, getString(s, "tmp"), "1.5")
+	ttl, _ := s.db.TTL([]byte("tmp"))
+	ensure.True(t, ttl > 0)
+	ttl, _ = s.db.TTL([]byte("expiring"))
+	ensure.True(t, ttl > 0)
+	l, _ := s.db.List([]byte("list:lp"))
+	ensure.DeepEqual(t, l.Len(), int64(4))
+	set, _ := s.db.SetOf([]byte("set:intset"))
+	ok, _ := set.Exists([]byte("-1"))
+	ensure.True(t, ok)
+	h, _ := s.db.Hash([]byte("hash:plain"))
+	val, _ := h.Get([]byte("k2"))
+	ensure.DeepEqual(t, string(val), "v2")
+	z, _ := s.db.SortedSet([]byte("zset:2"))
+	score, _, _ := z.Score([]byte("e"))
+	ensure.DeepEqual(t, score, 3.25)
+
+	// 客户端不能写入
+	rec = &replyRecorder{}
+	s.dispatch(rec, makeCommand("SET", "str", "client"))
+	s.dispatch(rec, makeCommand("GET", "str"))
+	s.OnROLE(rec, makeCommand("ROLE"))
+	p, _ := strconv.Atoi(port)
+	ensure.DeepEqual(t, rec.replies[:2], []interface{}{ErrReadonly, BulkReply("world")})
+	ensure.DeepEqual(t, rec.replies[2].(MultiBulkReply)[:4], MultiBulkReply{"slave", host, p, "connected"})
+
+	// 断开之后用PSYNC继续
+	sess.Close()
+	sess, psync = acceptReplica(t, lis)
+	offset += int64(len(makeCommand("REPLCONF", "GETACK", "*").Bytes()))
+	ensure.DeepEqual(t, psync.String(), `["PSYNC","`+replid+`","`+strconv.FormatInt(offset+1, 10)+`"]`)
+	sess.Write([]byte("+CONTINUE\r\n"))
+	offset += sendStream(t, sess, makeCommand("DEL", "str"))
+	waitAck(t, sess, offset)
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("str")), rocks.ElementType(rocks.NONE))
+
+	// 停止复制之后可以写入
+	rec = &replyRecorder{}
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", "NO", "ONE"))
+	s.dispatch(rec, makeCommand("SET", "str", "client"))
+	s.OnROLE(rec, makeCommand("ROLE"))
+	ensure.DeepEqual(t, rec.replies[:2], []interface{}{StatusReply("OK"), StatusReply("OK")})
+	// 没有从库连接过，和redis一样不记录命令流，offset为0
+	role := rec.replies[2].(MultiBulkReply)
+	ensure.DeepEqual(t, role[0], "master")
+	ensure.DeepEqual(t, role[1], 0)
+	ensure.DeepEqual(t, role[2], MultiBulkReply{})
+	sess.Close()
+}
+
+func TestReplicaOfDisklessMaster(t *testing.T) {
+	sample, err := ioutil.ReadFile("../libs/rdb/testdata/sample.rdb")
+	ensure.Nil(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer lis.Close()
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	s.OnREPLICAOF(&replyRecorder{}, makeCommand("REPLICAOF", host, port))
+	defer s.repl.stop()
+
+	// diskless同步没有长度，RDB前后是同样的40字节标记
+	mark := strings.Repeat("0123456789", 4)
+	sess, _ := acceptReplica(t, lis)
+	defer sess.Close()
+	sess.Write([]byte("+FULLRESYNC " + strings.Repeat("b", 40) + " 0\r\n$EOF:" + mark + "\r\n"))
+	sess.Write(sample)
+	sess.Write([]byte(mark))
+	offset := sendStream(t, sess, makeCommand("SET", "after", "rdb"))
+	waitAck(t, sess, offset)
+
+	ensure.DeepEqual(t, getString(s, "after"), "rdb")
+	ensure.DeepEqual(t, getString(s, "int16"), "-1234")
+}
+
+func openServer(t *testing.T, dir string) *GoRedisServer {
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	rdb, err := gorocksdb.OpenDb(opts, dir)
+	ensure.Nil(t, err)
+	return New(rocks.New(rdb))
+}
+
+// GoRedis作为主库监听，返回host和port
+func serveMaster(t *testing.T, s *GoRedisServer) (net.Listener, string, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	srv := NewServer()
+	srv.Register(s)
+	go srv.Serve(lis)
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+	return lis, host, port
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicaOfGoRedis(t *testing.T) {
+	master := newReplicaServer(t)
+	defer master.db.Close()
+	lis, host, port := serveMaster(t, master)
+	defer lis.Close()
+	rec := &replyRecorder{}
+	master.dispatch(rec, makeCommand("SET", "name", "latermoon"))
+	master.dispatch(rec, makeCommand("HSET", "user", "age", "28"))
+
+	dir, err := ioutil.TempDir("", "replica")
+	ensure.Nil(t, err)
+	s := openServer(t, dir)
+	ensure.Nil(t, s.db.Set([]byte("stale"), []byte("x")))
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host, port))
+
+	// 全量同步之后的写入按WAL增量发送
+	waitFor(t, "full sync", func() bool { return getString(s, "name") == "latermoon" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("stale")), rocks.ElementType(rocks.NONE))
+	master.dispatch(rec, makeCommand("RPUSH", "list", "a", "b"))
+	master.dispatch(rec, makeCommand("DEL", "user"))
+	master.dispatch(rec, makeCommand("SET", "name", "v2"))
+	waitFor(t, "incremental sync", func() bool { return getString(s, "name") == "v2" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("user")), rocks.ElementType(rocks.NONE))
+	l, _ := s.db.List([]byte("list"))
+	ensure.DeepEqual(t, l.Len(), int64(2))
+	rec = &replyRecorder{}
+	s.dispatch(rec, makeCommand("SET", "name", "client"))
+	s.OnROLE(rec, makeCommand("ROLE"))
+	ensure.DeepEqual(t, rec.replies[0], ErrReadonly)
+	ensure.DeepEqual(t, rec.replies[1].(MultiBulkReply)[3], "connected")
+
+	// 重启之后从记录的序列号继续，本地的key说明没有重新全量同步
+	s.repl.stop()
+	s.db.Close()
+	master.dispatch(rec, makeCommand("SET", "offline", "1"))
+	s = openServer(t, dir)
+	defer s.db.Close()
+	ensure.Nil(t, s.db.Set([]byte("marker"), []byte("local")))
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host, port))
+	waitFor(t, "resume", func() bool { return getString(s, "offline") == "1" })
+	ensure.DeepEqual(t, getString(s, "marker"), "local")
+	master.dispatch(rec, makeCommand("SET", "online", "2"))
+	waitFor(t, "stream after resume", func() bool { return getString(s, "online") == "2" })
+
+	// 换成另一个主库需要全量同步
+	other := newReplicaServer(t)
+	defer other.db.Close()
+	lis2, host2, port2 := serveMaster(t, other)
+	defer lis2.Close()
+	other.dispatch(rec, makeCommand("SET", "from", "other"))
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host2, port2))
+	waitFor(t, "switch master", func() bool { return getString(s, "from") == "other" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("marker")), rocks.ElementType(rocks.NONE))
+	s.repl.stop()
+}
+
+// 官方redis作为从库时的行为：握手之后发送PSYNC，返回主库的回复
+func dialReplica(t *testing.T, host, port string, capaEOF bool, replid string, offset int64) (*Session, string) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	ensure.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	sess := NewSession(conn)
+	call := func(args ...string) string {
+		sess.WriteReply(makeCommand(args...))
+		ensure.Nil(t, sess.Flush())
+		line, err := sess.ReadLine()
+		ensure.Nil(t, err)
+		return string(line)
+	}
+	ensure.DeepEqual(t, call("PING"), "+PONG")
+	ensure.DeepEqual(t, call("REPLCONF", "listening-port", "6380"), "+OK")
+	if capaEOF {
+		ensure.DeepEqual(t, call("REPLCONF", "capa", "eof", "capa", "psync2"), "+OK")
+	}
+	return sess, call("PSYNC", replid, strconv.FormatInt(offset, 10))
+}
+
+// 读取主库发来的RDB
+func readRDB(t *testing.T, sess *Session) map[string]*rdb.Entry {
+	b, err := sess.ReadByte()
+	for err == nil && b == '\n' {
+		b, err = sess.ReadByte()
+	}
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, b, byte('$'))
+	line, err := sess.ReadLine()
+	ensure.Nil(t, err)
+	var r io.Reader = sess
+	if !bytes.HasPrefix(line, []byte("EOF:")) {
+		n, err := strconv.ParseInt(string(line), 10, 64)
+		ensure.Nil(t, err)
+		r = &io.LimitedReader{R: sess, N: n}
+	}
+	entries := make(map[string]*rdb.Entry)
+	ensure.Nil(t, rdb.NewDecoder(r).Decode(func(e *rdb.Entry) error {
+		entries[string(e.Key)] = e
+		return nil
+	}))
+	if bytes.HasPrefix(line, []byte("EOF:")) {
+		mark := make([]byte, replEOFMarkLen)
+		_, err := io.ReadFull(sess, mark)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, mark, line[4:])
+	}
+	return entries
+}
+
+// 读取命令流中的n个命令，返回命令和它们的长度
+func readStream(t *testing.T, sess *Session, n int) ([]string, int64) {
+	cmds := []string{}
+	size := int64(0)
+	for len(cmds) < n {
+		c, err := sess.ReadCommand()
+		ensure.Nil(t, err)
+		size += int64(len(c.Bytes()))
+		cmds = append(cmds, c.String())
+	}
+	return cmds, size
+}
+
+func TestServeOfficialReplica(t *testing.T) {
+	master := newReplicaServer(t)
+	defer master.db.Close()
+	lis, host, port := serveMaster(t, master)
+	defer lis.Close()
+	rec := &replyRecorder{}
+	master.dispatch(rec, makeCommand("SET", "name", "latermoon"))
+	master.dispatch(rec, makeCommand("SET", "tmp", "v", "EX", "100"))
+	master.dispatch(rec, makeCommand("HSET", "user", "age", "28"))
+	master.dispatch(rec, makeCommand("RPUSH", "list", "a", "b"))
+	master.dispatch(rec, makeCommand("SADD", "set", "x"))
+	master.dispatch(rec, makeCommand("ZADD", "rank", "1.5", "m"))
+
+	// diskless全量同步
+	sess, reply := dialReplica(t, host, port, true, "?", -1)
+	fields := strings.Fields(reply)
+	ensure.DeepEqual(t, len(fields), 3)
+	ensure.DeepEqual(t, fields[0], "+FULLRESYNC")
+	replid := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	ensure.Nil(t, err)
+	entries := readRDB(t, sess)
+	ensure.DeepEqual(t, len(entries), 6)
+	ensure.DeepEqual(t, entries["name"].Value, []byte("latermoon"))
+	ensure.True(t, entries["tmp"].ExpireAt > nowMs())
+	ensure.DeepEqual(t, entries["user"].Values, [][]byte{[]byte("age"), []byte("28")})
+	ensure.DeepEqual(t, entries["list"].Values, [][]byte{[]byte("a"), []byte("b")})
+	ensure.DeepEqual(t, entries["set"].Values, [][]byte{[]byte("x")})
+	ensure.DeepEqual(t, entries["rank"].Members[0].Score, 1.5)
+
+	// 之后的写入改写成确定的命令
+	master.dispatch(rec, makeCommand("GET", "name"))
+	master.dispatch(rec, makeCommand("EXPIRE", "name", "100"))
+	master.dispatch(rec, makeCommand("SPOP", "set"))
+	// 出错或者没有写入的命令不传播
+	master.dispatch(rec, makeCommand("LPUSH", "name", "x"))
+	master.dispatch(rec, makeCommand("SET", "name", "x", "NX"))
+	master.dispatch(rec, makeCommand("INCRBYFLOAT", "f", "1.5"))
+	_, err = master.exec([]Command{makeCommand("SET", "a", "1"), makeCommand("GET", "a"), makeCommand("LPUSH", "a", "x"), makeCommand("INCR", "n")}, nil)
+	ensure.Nil(t, err)
+	cmds, n := readStream(t, sess, 8)
+	ensure.DeepEqual(t, cmds[0], `["SELECT","0"]`)
+	ensure.True(t, strings.HasPrefix(cmds[1], `["PEXPIREAT","name","`), cmds[1])
+	ensure.DeepEqual(t, cmds[2:], []string{
+		`["SREM","set","x"]`,
+		`["SET","f","1.5","KEEPTTL"]`,
+		`["MULTI"]`,
+		`["SET","a","1"]`,
+		`["INCR","n"]`,
+		`["EXEC"]`,
+	})
+	offset += n
+	sendStream(t, sess, makeCommand("REPLCONF", "ACK", strconv.FormatInt(offset, 10)))
+	waitFor(t, "replica ack", func() bool {
+		rec := &replyRecorder{}
+		master.OnROLE(rec, makeCommand("ROLE"))
+		role := rec.replies[0].(MultiBulkReply)
+		return role[1] == int(offset) && len(role[2].(MultiBulkReply)) == 1 &&
+			role[2].(MultiBulkReply)[0].(MultiBulkReply)[2] == strconv.FormatInt(offset, 10)
+	})
+	rec = &replyRecorder{}
+	master.OnROLE(rec, makeCommand("ROLE"))
+	ensure.DeepEqual(t, rec.replies[0].(MultiBulkReply)[2].(MultiBulkReply)[0].(MultiBulkReply)[:2], MultiBulkReply{"127.0.0.1", "6380"})
+
+	// 断开期间的写入从backlog继续
+	sess.Close()
+	waitFor(t, "replica detached", func() bool {
+		rec := &replyRecorder{}
+		master.OnROLE(rec, makeCommand("ROLE"))
+		return len(rec.replies[0].(MultiBulkReply)[2].(MultiBulkReply)) == 0
+	})
+	master.dispatch(rec, makeCommand("SET", "offline", "1"))
+	sess, reply = dialReplica(t, host, port, true, replid, offset+1)
+	ensure.DeepEqual(t, reply, "+CONTINUE "+replid)
+	cmds, _ = readStream(t, sess, 1)
+	ensure.DeepEqual(t, cmds, []string{`["SET","offline","1"]`})
+	sess.Close()
+
+	// replid不一致时全量同步，不支持diskless时先写入临时文件
+	sess, reply = dialReplica(t, host, port, false, "0000", offset+1)
+	ensure.True(t, strings.HasPrefix(reply, "+FULLRESYNC "), reply)
+	entries = readRDB(t, sess)
+	ensure.DeepEqual(t, entries["offline"].Value, []byte("1"))
+	ensure.DeepEqual(t, entries["f"].Value, []byte("1.5"))
+	sess.Close()
+}
+
+// 没有从库时写命令不互相等待，也不记录命令流
+func TestFeedWithoutReplicas(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	// 模拟一个正在执行的写命令
+	s.feed.lock()
+	done := make(chan bool)
+	go func() {
+		s.dispatch(&replyRecorder{}, makeCommand("SET", "k", "v"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by another write without replicas")
+	}
+	s.feed.unlock(nil)
+	_, offset := s.feed.progress()
+	ensure.DeepEqual(t, offset, int64(0))
+	ensure.DeepEqual(t, getString(s, "k"), "v")
+}
+
+// GoRedis主库发出的命令流可以被GoRedis从库执行，INCRBYFLOAT保留key的过期时间
+func TestReplicaOfGoRedisStream(t *testing.T) {
+	master := newReplicaServer(t)
+	defer master.db.Close()
+	mlis, host, port := serveMaster(t, master)
+	defer mlis.Close()
+	msess, reply := dialReplica(t, host, port, true, "?", -1)
+	defer msess.Close()
+	ensure.True(t, strings.HasPrefix(reply, "+FULLRESYNC "), reply)
+	readRDB(t, msess)
+	rec := &replyRecorder{}
+	master.dispatch(rec, makeCommand("SET", "f", "1", "EX", "100"))
+	master.dispatch(rec, makeCommand("INCRBYFLOAT", "f", "0.5"))
+	master.dispatch(rec, makeCommand("SET", "g", "1", "EX", "100"))
+	master.dispatch(rec, makeCommand("INCRBYFLOAT", "g", "1"))
+	master.dispatch(rec, makeCommand("PERSIST", "g"))
+	stream := make([]Command, 6)
+	for i := range stream {
+		c, err := msess.ReadCommand()
+		ensure.Nil(t, err)
+		stream[i] = c
+	}
+
+	// 把主库的命令流转发给从库
+	sample, err := ioutil.ReadFile("../libs/rdb/testdata/sample.rdb")
+	ensure.Nil(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer lis.Close()
+	host, port, _ = net.SplitHostPort(lis.Addr().String())
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host, port))
+	sess, _ := acceptReplica(t, lis)
+	defer sess.Close()
+	sess.Write([]byte("+FULLRESYNC " + strings.Repeat("a", 40) + " 0\r\n$" + strconv.Itoa(len(sample)) + "\r\n"))
+	sess.Write(sample)
+	waitAck(t, sess, sendStream(t, sess, stream...))
+	s.repl.stop()
+
+	ensure.DeepEqual(t, getString(s, "f"), "1.5")
+	ttl, _ := s.db.TTL([]byte("f"))
+	ensure.True(t, ttl > 90000 && ttl <= 100000, ttl)
+	ensure.DeepEqual(t, getString(s, "g"), "2")
+	ttl, _ = s.db.TTL([]byte("g"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+}
+
+func TestReplicaOfSources(t *testing.T) {
+	m1 := newReplicaServer(t)
+	defer m1.db.Close()
+	lis1, host1, port1 := serveMaster(t, m1)
+	defer lis1.Close()
+	m2 := newReplicaServer(t)
+	defer m2.db.Close()
+	lis2, host2, port2 := serveMaster(t, m2)
+	defer lis2.Close()
+	rec := &replyRecorder{}
+	m1.dispatch(rec, makeCommand("SET", "a:name", "m1"))
+	m1.dispatch(rec, makeCommand("SET", "b:name", "m1"))
+	m1.dispatch(rec, makeCommand("SET", "shared", "m1"))
+	m2.dispatch(rec, makeCommand("SET", "b:other", "m2"))
+
+	dir, err := ioutil.TempDir("", "replica")
+	ensure.Nil(t, err)
+	s := openServer(t, dir)
+	rec = &replyRecorder{}
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "ADD", "m1", host1, port1, "PREFIX", "a:", "POLICY", "priority", "PRIORITY", "1"))
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "ADD", "m2", host2, port2, "POLICY", "priority", "PRIORITY", "2"))
+	s.OnSLAVEOF(rec, makeCommand("SLAVEOF", host1, port1))
+	ensure.DeepEqual(t, rec.replies[:2], []interface{}{StatusReply("OK"), StatusReply("OK")})
+	ensure.True(t, strings.HasPrefix(string(rec.replies[2].(ErrorReply)), "ERR "))
+
+	// 每个来源只同步PREFIX匹配的key
+	waitFor(t, "full sync", func() bool { return getString(s, "a:name") == "m1" && getString(s, "b:other") == "m2" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("b:name")), rocks.ElementType(rocks.NONE))
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("shared")), rocks.ElementType(rocks.NONE))
+
+	// 优先级高的来源写入之后，优先级低的不能覆盖
+	m2.dispatch(rec, makeCommand("SET", "a:shared", "m2"))
+	waitFor(t, "m2 write", func() bool { return getString(s, "a:shared") == "m2" })
+	m1.dispatch(rec, makeCommand("SET", "a:shared", "m1"))
+	m1.dispatch(rec, makeCommand("SET", "a:done", "1"))
+	waitFor(t, "m1 write", func() bool { return getString(s, "a:done") == "1" })
+	ensure.DeepEqual(t, getString(s, "a:shared"), "m2")
+	rec = &replyRecorder{}
+	s.dispatch(rec, makeCommand("SET", "a:name", "client"))
+	ensure.DeepEqual(t, rec.replies[0], ErrReadonly)
+
+	// INFO和LIST中的状态
+	rec = &replyRecorder{}
+	s.OnINFO(rec, makeCommand("INFO", "replication"))
+	info := string(rec.replies[0].(BulkReply))
+	ensure.True(t, strings.Contains(info, "role:slave\r\n"), info)
+	ensure.True(t, strings.Contains(info, "sources:2\r\n"), info)
+	ensure.True(t, strings.Contains(info, "source0:name=m1,addr="+net.JoinHostPort(host1, port1)+",state=connected,"), info)
+	ensure.True(t, strings.Contains(info, ",prefix=a:,policy=priority,priority=1,"), info)
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "LIST"))
+	list := rec.replies[1].(MultiBulkReply)
+	ensure.DeepEqual(t, len(list), 2)
+	ensure.DeepEqual(t, list[1].(MultiBulkReply)[:2], MultiBulkReply{"name", "m2"})
+
+	// 重启之后恢复来源，从记录的offset继续，本地删除的key说明没有重新全量同步
+	s.sources.list()[0].stop()
+	s.sources.list()[1].stop()
+	s.db.Close()
+	m1.dispatch(rec, makeCommand("SET", "a:offline", "1"))
+	s = openServer(t, dir)
+	defer s.db.Close()
+	ensure.DeepEqual(t, s.sources.count(), 2)
+	ensure.Nil(t, s.db.Delete([]byte("a:name")))
+	waitFor(t, "resume", func() bool { return getString(s, "a:offline") == "1" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("a:name")), rocks.ElementType(rocks.NONE))
+
+	// 来源的FLUSHALL只删除它写入的key
+	m2.dispatch(rec, makeCommand("FLUSHALL"))
+	m2.dispatch(rec, makeCommand("SET", "a:after", "m2"))
+	waitFor(t, "flushall", func() bool { return getString(s, "a:after") == "m2" })
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("b:other")), rocks.ElementType(rocks.NONE))
+	ensure.DeepEqual(t, getString(s, "a:offline"), "1")
+
+	// 删除的来源不再同步
+	rec = &replyRecorder{}
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "REMOVE", "m2"))
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "REMOVE", "m2"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{StatusReply("OK"), ErrorReply("ERR no such replication source")})
+	ensure.DeepEqual(t, s.sources.count(), 1)
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "REMOVE", "m1"))
+	ensure.False(t, s.replicating())
+}
+
+func TestReplicaOfSourcesConflicts(t *testing.T) {
+	empty := newReplicaServer(t)
+	snap := empty.db.Snapshot()
+	var rdbBuf bytes.Buffer
+	ensure.Nil(t, snap.WriteRDB(&rdbBuf))
+	snap.Release()
+	empty.db.Close()
+
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	// 来源m2的时钟慢一个小时
+	sources := map[string]*Session{}
+	for _, src := range []struct {
+		name string
+		skew int64
+	}{{"m1", 0}, {"m2", -3600 * 1000}} {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		defer lis.Close()
+		host, port, _ := net.SplitHostPort(lis.Addr().String())
+		rec := &replyRecorder{}
+		s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "ADD", src.name, host, port))
+		ensure.DeepEqual(t, rec.replies, []interface{}{StatusReply("OK")})
+		sess, _ := acceptReplicaAt(t, lis, src.skew)
+		defer sess.Close()
+		sess.Write([]byte("+FULLRESYNC " + strings.Repeat(src.name[1:], 40) + " 0\r\n$" + strconv.Itoa(rdbBuf.Len()) + "\r\n"))
+		sess.Write(rdbBuf.Bytes())
+		sources[src.name] = sess
+	}
+	offsets := map[string]int64{}
+	stream := func(name string, cmds ...Command) {
+		offsets[name] += sendStream(t, sources[name], cmds...)
+		waitAck(t, sources[name], offsets[name])
+		offsets[name] += int64(len(makeCommand("REPLCONF", "GETACK", "*").Bytes()))
+	}
+	owner := func(key string) string {
+		name, _, _, _ := s.ownerOf([]byte(key))
+		return name
+	}
+
+	// 按来源的时钟，m2之后到达的写入更早，不能覆盖m1
+	stream("m1", makeCommand("SET", "k", "m1"))
+	stream("m2", makeCommand("SET", "k", "m2"), makeCommand("SET", "other", "m2"))
+	ensure.DeepEqual(t, getString(s, "k"), "m1")
+	ensure.DeepEqual(t, getString(s, "other"), "m2")
+	ensure.DeepEqual(t, owner("k"), "m1")
+
+	// 执行出错的写入不记录写入者
+	ensure.Nil(t, s.db.Set([]byte("n"), []byte("abc")))
+	stream("m1", makeCommand("INCR", "n"))
+	ensure.DeepEqual(t, owner("n"), "")
+	stream("m2", makeCommand("SET", "n", "m2"))
+	ensure.DeepEqual(t, getString(s, "n"), "m2")
+
+	// 事务中的命令在EXEC之后按各自的结果记录
+	stream("m1", makeCommand("MULTI"), makeCommand("SET", "t", "m1"), makeCommand("GET", "t"), makeCommand("LPUSH", "n", "x"))
+	ensure.DeepEqual(t, owner("t"), "")
+	stream("m1", makeCommand("EXEC"))
+	ensure.DeepEqual(t, getString(s, "t"), "m1")
+	ensure.DeepEqual(t, owner("t"), "m1")
+	ensure.DeepEqual(t, owner("n"), "m2")
+
+	// 本机的写入和删除清除写入者，FLUSHALL只删除仍然属于来源的key
+	ensure.Nil(t, s.db.Set([]byte("k"), []byte("local")))
+	ensure.Nil(t, s.db.Delete([]byte("other")))
+	ensure.DeepEqual(t, owner("k"), "")
+	ensure.DeepEqual(t, owner("other"), "")
+	stream("m1", makeCommand("FLUSHALL"))
+	ensure.DeepEqual(t, getString(s, "k"), "local")
+	ensure.DeepEqual(t, s.db.TypeOf([]byte("t")), rocks.ElementType(rocks.NONE))
+	ensure.DeepEqual(t, getString(s, "n"), "m2")
+
+	rec := &replyRecorder{}
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "LIST"))
+	list := rec.replies[0].(MultiBulkReply)
+	ensure.DeepEqual(t, list[0].(MultiBulkReply)[14:], MultiBulkReply{"applied", 2, "rejected", 0})
+	ensure.DeepEqual(t, list[1].(MultiBulkReply)[14:], MultiBulkReply{"applied", 2, "rejected", 1})
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "REMOVE", "m1"))
+	s.OnREPLSOURCE(rec, makeCommand("REPLSOURCE", "REMOVE", "m2"))
+	ensure.DeepEqual(t, owner("n"), "")
+}
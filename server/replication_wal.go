@@ -0,0 +1,296 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GoRedis之间的复制
+// 从库发送 SYNC <dbid> <next>，dbid是主库rocks的编号，next是下一个需要的WAL序列号，
+// 从库在写入数据的同一个WriteBatch中记录进度，重启或断开之后从记录的位置继续。
+// 主库回复：
+//   +CONTINUE <dbid>    WAL中还有next之后的写入，直接发送增量
+//   +FULLSYNC <dbid>    先发送快照，然后是快照对应的序列号
+// 之后的数据都是multibulk：
+//   raw <key> <value> ...   快照中的raw key
+//   seq <next>              快照结束
+//   batch <seq> <data>      WAL中的一个WriteBatch
+//   ping                    保活
+// 从库每秒回复 REPLCONF ACK <seq>，seq是已经写入的最后一个序列号
+
+const (
+	// 从库记录的进度，"<dbid> <next>"
+	replMeta = "master"
+	// 没有新的写入时检查WAL的间隔
+	replPollInterval = 10 * time.Millisecond
+	// 没有数据时发送ping的间隔
+	replPingInterval = 10 * time.Second
+	// 快照每个raw的大小
+	replChunkSize = 1024 * 1024
+)
+
+var errWALProbe = errors.New("wal probe")
+
+// SYNC <dbid> <next>，没有参数时是官方redis的老版本从库
+// 阻塞直到从库断开
+func (s *GoRedisServer) OnSYNC(r ReplyWriter, c Command) {
+	sess, ok := r.(*Session)
+	if !ok {
+		r.WriteReply(ErrorReply("ERR SYNC is only allowed on a replica connection"))
+		return
+	}
+	switch len(c) {
+	case 1:
+		s.serveOfficial(sess, "?", -1, false)
+		return
+	case 3:
+	default:
+		r.WriteReply(ErrorReply("ERR wrong number of arguments for 'sync' command"))
+		return
+	}
+	next, err := strconv.ParseUint(string(c[2]), 10, 64)
+	if err != nil {
+		r.WriteReply(ErrorReply("ERR invalid sequence number"))
+		return
+	}
+	log.Println("replication: replica", sess.RemoteAddr(), "sync from", string(c[1]), next)
+	err = s.serveReplica(sess, string(c[1]), next)
+	log.Println("replication: replica", sess.RemoteAddr(), "disconnected:", err)
+}
+
+// next之后的写入是否都还在WAL中
+func (s *GoRedisServer) walAvailable(next uint64) bool {
+	if next == 0 || next > s.db.LatestSequence()+1 {
+		return false
+	}
+	_, err := s.db.UpdatesSince(next, func(seq uint64, data []byte) error {
+		return errWALProbe
+	})
+	return err == nil || err == errWALProbe
+}
+
+func (s *GoRedisServer) serveReplica(sess *Session, dbid string, next uint64) error {
+	id := s.db.ID()
+	sess.SetWriteDeadline(time.Now().Add(replTimeout))
+	if dbid == id && s.walAvailable(next) {
+		sess.WriteReply(StatusReply("CONTINUE " + id))
+	} else {
+		sess.WriteReply(StatusReply("FULLSYNC " + id))
+		var err error
+		if next, err = s.sendSnapshot(sess); err != nil {
+			return err
+		}
+	}
+	if err := sess.Flush(); err != nil {
+		return err
+	}
+
+	// 读取从库的ACK，连接断开时退出
+	closed, wait := readReplica(sess, func(c Command) {})
+	defer wait()
+
+	ping := time.NewTicker(replPingInterval)
+	defer ping.Stop()
+	for {
+		sess.SetWriteDeadline(time.Now().Add(replTimeout))
+		n, err := s.db.UpdatesSince(next, func(seq uint64, data []byte) error {
+			_, err := sess.WriteReply(walFrame("batch", strconv.FormatUint(seq, 10), data))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if n != next {
+			next = n
+			if err := sess.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case err := <-closed:
+			return err
+		case <-ping.C:
+			sess.WriteReply(walFrame("ping"))
+			if err := sess.Flush(); err != nil {
+				return err
+			}
+		case <-time.After(replPollInterval):
+		}
+	}
+}
+
+// 发送快照，返回之后需要从WAL发送的序列号
+func (s *GoRedisServer) sendSnapshot(sess *Session) (uint64, error) {
+	frame := walFrame("raw")
+	size := 0
+	write := func() error {
+		sess.SetWriteDeadline(time.Now().Add(replTimeout))
+		_, err := sess.WriteReply(frame)
+		frame, size = walFrame("raw"), 0
+		return err
+	}
+	next, err := s.db.SnapshotAll(func(key, value []byte) error {
+		frame = append(frame, append([]byte{}, key...), append([]byte{}, value...))
+		if size += len(key) + len(value); size >= replChunkSize {
+			return write()
+		}
+		return nil
+	})
+	if err == nil && len(frame) > 1 {
+		err = write()
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = sess.WriteReply(walFrame("seq", strconv.FormatUint(next, 10)))
+	return next, err
+}
+
+func walFrame(name string, args ...interface{}) Command {
+	c := Command{[]byte(name)}
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			c = append(c, []byte(v))
+		case []byte:
+			c = append(c, v)
+		}
+	}
+	return c
+}
+
+// 从库记录的进度，没有同步过时是"?"和0
+func (s *GoRedisServer) walProgress() (string, uint64) {
+	v, err := s.db.Meta(replMeta)
+	if err != nil {
+		return "?", 0
+	}
+	fields := strings.Fields(string(v))
+	if len(fields) != 2 {
+		return "?", 0
+	}
+	next, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "?", 0
+	}
+	return fields[0], next
+}
+
+func walMeta(dbid string, next uint64) map[string][]byte {
+	return map[string][]byte{replMeta: []byte(dbid + " " + strconv.FormatUint(next, 10))}
+}
+
+// 作为GoRedis的从库同步，主库不支持SYNC <dbid> <next>时返回false
+func (s *GoRedisServer) syncWAL(link *replLink, sess *Session) (bool, error) {
+	dbid, next := s.walProgress()
+	reply, err := masterCall(sess, "SYNC", dbid, strconv.FormatUint(next, 10))
+	if _, ok := err.(*masterError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	s.repl.mu.Lock()
+	link.wal = true
+	s.repl.mu.Unlock()
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 2 && fields[0] == "CONTINUE" && fields[1] == dbid:
+		log.Println("replication: continue from", link.addr, "at sequence", next)
+	case len(fields) == 2 && fields[0] == "FULLSYNC":
+		s.repl.setState(link, replStateSync)
+		dbid = fields[1]
+		if next, err = s.fullSyncWAL(sess, dbid); err != nil {
+			return true, err
+		}
+	default:
+		return true, fmt.Errorf("unexpected SYNC reply %q", reply)
+	}
+	s.repl.setProgress(dbid, int64(next)-1)
+	s.repl.setState(link, replStateConnected)
+	return true, s.streamWAL(sess, dbid, next)
+}
+
+// 清空本地数据，写入主库的快照，返回快照对应的序列号
+func (s *GoRedisServer) fullSyncWAL(sess *Session, dbid string) (uint64, error) {
+	start := time.Now()
+	if err := s.db.DeleteMeta(replMeta); err != nil {
+		return 0, err
+	}
+	if err := s.db.FlushAll(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		c, err := sess.ReadCommand()
+		if err != nil {
+			return 0, err
+		}
+		switch strings.ToLower(string(c[0])) {
+		case "raw":
+			s.db.RLock()
+			err = s.db.PutRaw(c[1:], nil)
+			s.db.RUnlock()
+			n += len(c) / 2
+		case "seq":
+			next, err := strconv.ParseUint(string(c[1]), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("bad sequence from master: %q", c[1])
+			}
+			if err := s.db.PutRaw(nil, walMeta(dbid, next)); err != nil {
+				return 0, err
+			}
+			log.Println("replication: loaded", n, "raw keys from master in", time.Since(start))
+			s.feed.reset()
+			return next, nil
+		case "ping":
+		default:
+			return 0, fmt.Errorf("unexpected %s during full sync", c[0])
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// 按顺序写入主库发来的WriteBatch，直到连接断开
+func (s *GoRedisServer) streamWAL(sess *Session, dbid string, next uint64) error {
+	m := &masterClient{sess: sess, repl: s.repl}
+	stop := make(chan bool)
+	defer close(stop)
+	go m.ackLoop(stop)
+	for {
+		c, err := sess.ReadCommand()
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(string(c[0])) {
+		case "batch":
+			if len(c) != 3 {
+				return errors.New("bad batch from master")
+			}
+			seq, err := strconv.ParseUint(string(c[1]), 10, 64)
+			if err != nil || seq != next {
+				return fmt.Errorf("unexpected sequence from master: %q, want %d", c[1], next)
+			}
+			next = seq + rocks.BatchCount(c[2])
+			s.db.RLock()
+			err = s.db.ApplyBatch(c[2], walMeta(dbid, next))
+			s.db.RUnlock()
+			if err != nil {
+				return err
+			}
+			s.repl.setProgress(dbid, int64(next)-1)
+		case "ping":
+		default:
+			return fmt.Errorf("unexpected %s from master", c[0])
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"github.com/latermoon/GoRedis/libs/glob"
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCAN/HSCAN/SSCAN/ZSCAN的默认COUNT
+const defaultScanCount = 10
+
+// 游标遍历的参数
+// cursor是上一次遍历到的位置，客户端看到的是scanCursors中的编号，"0"表示开始和结束
+type scanArgs struct {
+	cursor []byte
+	match  []byte
+	count  int
+	typ    string
+}
+
+// 解析 cursor [MATCH pattern] [COUNT count] [TYPE type]，出错时直接回复客户端
+func (s *GoRedisServer) parseScanArgs(r ReplyWriter, args [][]byte, allowType bool) (*scanArgs, bool) {
+	if len(args) == 0 {
+		r.WriteReply(ErrorReply("ERR wrong number of arguments"))
+		return nil, false
+	}
+	sa := &scanArgs{count: defaultScanCount}
+	cursor, ok := s.cursors.parse(args[0])
+	if !ok {
+		r.WriteReply(ErrorReply("ERR invalid cursor"))
+		return nil, false
+	}
+	sa.cursor = cursor
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			r.WriteReply(ErrSyntax)
+			return nil, false
+		}
+		val := args[i+1]
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "MATCH":
+			sa.match = val
+		case opt == "COUNT":
+			n, ok := parseInt(val)
+			if !ok {
+				r.WriteReply(ErrNotInt)
+				return nil, false
+			}
+			if n < 1 {
+				r.WriteReply(ErrSyntax)
+				return nil, false
+			}
+			sa.count = int(n)
+		case opt == "TYPE" && allowType:
+			sa.typ = strings.ToLower(string(val))
+		default:
+			r.WriteReply(ErrSyntax)
+			return nil, false
+		}
+	}
+	return sa, true
+}
+
+// MATCH过滤，没有MATCH时全部匹配
+func (sa *scanArgs) matches(b []byte) bool {
+	return sa.match == nil || glob.Match(sa.match, b)
+}
+
+// 游标是十进制整数，客户端按整数解析，继续的位置保存在服务端
+// 只保留最近scanCursorsSize个，过早的游标和重启前的游标都是无效游标
+const scanCursorsSize = 1 << 16
+
+type scanCursors struct {
+	mu   sync.Mutex
+	last uint64
+	keys map[uint64][]byte
+}
+
+func newScanCursors() *scanCursors {
+	return &scanCursors{keys: make(map[uint64][]byte)}
+}
+
+// "0"表示从头开始
+func (sc *scanCursors) parse(b []byte) ([]byte, bool) {
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	if n == 0 {
+		return nil, true
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cursor, ok := sc.keys[n]
+	return cursor, ok
+}
+
+// 遍历结束时返回"0"
+func (sc *scanCursors) format(cursor []byte) []byte {
+	if cursor == nil {
+		return []byte("0")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.last++
+	sc.keys[sc.last] = cursor
+	if sc.last > scanCursorsSize {
+		delete(sc.keys, sc.last-scanCursorsSize)
+	}
+	return []byte(strconv.FormatUint(sc.last, 10))
+}
+
+// [cursor, [item ...]]
+func (s *GoRedisServer) scanReply(next []byte, items []interface{}) Reply {
+	return MultiBulkReply{s.cursors.format(next), MultiBulkReply(items)}
+}
+
+// TYPE命令和SCAN TYPE使用的类型名，和redis保持一致
+func typeName(t rocks.ElementType) string {
+	if t == rocks.SORTEDSET {
+		return "zset"
+	}
+	return t.String()
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/facebookgo/ensure"
+	. "github.com/latermoon/GoRedis/redis"
+	"strconv"
+	"testing"
+)
+
+func TestScanCursorIsInteger(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	rec := &replyRecorder{}
+	s.dispatch(rec, makeCommand("HSET", "h", "", "0", "a", "1", "b", "2", "c", "3"))
+
+	// 空的field也要能作为继续的位置
+	var fields []string
+	cursor := "0"
+	for i := 0; i < 10; i++ {
+		rec.replies = nil
+		s.dispatch(rec, makeCommand("HSCAN", "h", cursor, "COUNT", "1"))
+		reply := rec.replies[0].(MultiBulkReply)
+		cursor = string(reply[0].([]byte))
+		_, err := strconv.ParseUint(cursor, 10, 64)
+		ensure.Nil(t, err, cursor)
+		items := reply[1].(MultiBulkReply)
+		for j := 0; j < len(items); j += 2 {
+			fields = append(fields, string(items[j].([]byte)))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	ensure.DeepEqual(t, cursor, "0")
+	ensure.DeepEqual(t, fields, []string{"", "a", "b", "c"})
+
+	rec.replies = nil
+	s.dispatch(rec, makeCommand("SCAN", "abc"))
+	s.dispatch(rec, makeCommand("SCAN", "123456"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{ErrorReply("ERR invalid cursor"), ErrorReply("ERR invalid cursor")})
+}
@@ -4,73 +4,152 @@ import (
 	. "github.com/latermoon/GoRedis/redis"
 	"github.com/latermoon/GoRedis/rocks"
 	"log"
-	"reflect"
 	"strings"
+	"sync/atomic"
 )
 
 //redis的server
 type GoRedisServer struct {
 	ServerHandler//处理接口
 	db      *rocks.DB//rocks.db
-	cmdfunc map[string]HandlerFunc//处理器
+	blocking *blockingKeys//阻塞在list上的客户端
+	config  *config//CONFIG GET/SET
+	pubsub  *pubsub//频道的订阅关系
+	keyspace *keyspaceNotifier//键空间通知
+	inTx    bool//EXEC执行队列时使用的副本，db是事务
+	limits  *Limits//读取命令的限制，所有连接共享
+	repl    *replication//作为从库时的复制状态
+	sources *replSources//多主复制的来源
+	feed    *replFeed//作为主库时发给从库的命令流
+	cursors *scanCursors//SCAN游标对应的继续位置
 }
 
 func New(db *rocks.DB) *GoRedisServer {
 	s := &GoRedisServer{db: db}
-	s.registerCmdFunc()
+	s.config = newConfig()
+	s.feed = newReplFeed()
+	s.blocking = newBlockingKeys(feedLocker{s})
+	s.pubsub = newPubsub()
+	s.keyspace = newKeyspaceNotifier(s.pubsub)
+	s.config.onChange("notify-keyspace-events", s.keyspace.setFlags)
+	s.repl = newReplication()
+	s.sources = newReplSources()
+	s.limits = NewLimits()
+	s.cursors = newScanCursors()
+	s.config.onChange("proto-max-bulk-len", setInt(s.limits.SetMaxBulkLen))
+	s.config.onChange("proto-max-multibulk-len", setInt(s.limits.SetMaxMultiBulkLen))
+	s.config.onChange("client-query-buffer-limit", setInt(s.limits.SetQueryBufferLimit))
+	s.config.onChange("repl-backlog-size", setInt(s.feed.setBacklogSize))
+	db.OnNotify(func(class rocks.NotifyClass, event string, key []byte) {
+		s.keyspace.notify(class, event, key)
+		//不是来源的写入清除key的写入者
+		s.disown(key)
+		//过期删除的key以DEL进入命令流
+		if class == rocks.NotifyExpired {
+			s.feed.emit(Command{[]byte("DEL"), copyBytes(key)})
+		}
+	})
+	db.OnListPush(func(key []byte) {
+		s.blocking.signal(key)
+	})
+	s.restoreSources()
 	return s
 }
 
 //打开
 func (s *GoRedisServer) SessionOpened(sess *Session) {
 	log.Println("connection accepted from", sess.RemoteAddr())
+	sess.SetContext(&sessionState{id: atomic.AddInt64(&lastSessionId, 1)})
+	sess.SetLimits(s.limits)
 }
 
+//最后分配的连接编号
+var lastSessionId int64
+
 //关闭
 func (s *GoRedisServer) SessoinClosed(sess *Session, err error) {
 	log.Println("end connection", sess.RemoteAddr(), err)
+	st := stateOf(sess)
+	st.unwatch(s.db)
+	s.closeSubscribe(st)
 }
 
 //接收
 func (s *GoRedisServer) RecvCommand(sess *Session, c Command) {
 	log.Println("command:", c)
+	s.dispatch(sess, c)
+}
 
-	// invoke On[Command] functions
-	cmdname := strings.ToUpper(string(c[0]))
-	//获取函数
-	cmdFunc, ok := s.cmdfunc[cmdname]
+//执行一个命令，客户端连接和主库的复制连接都经过这里
+func (s *GoRedisServer) dispatch(r ReplyWriter, c Command) {
+	cmd, ok := lookupCommand(c[0])
+	st := stateOf(r)
+	//RESP2的订阅模式下只能执行订阅相关的命令
+	if st.sub != nil && protocolOf(r) == RESP2 && (!ok || !subscriberCommands[cmd.name]) {
+		st.sub.WriteReply(ErrorReply("ERR Can't execute '" + strings.ToLower(string(c[0])) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+		return
+	}
+	//只读的从库只接受主库发来的写命令
+	readonly := ok && cmd.is(flagWrite) && s.readonlyFor(r)
+	//MULTI之后命令进入队列，入队时出错的话EXEC会被拒绝
+	if st.multi && (!ok || !cmd.is(flagNoQueue)) {
+		var reply Reply
+		switch {
+		case !ok:
+			reply = unknownCommand(c)
+		case !cmd.checkArity(len(c)):
+			reply = cmd.arityError()
+		case cmd.is(flagNoMulti):
+			reply = ErrorReply("ERR Command not allowed inside a transaction")
+		case readonly:
+			reply = ErrReadonly
+		}
+		if reply != nil {
+			st.dirty = true
+			r.WriteReply(reply)
+			return
+		}
+		st.queue = append(st.queue, c)
+		r.WriteReply(StatusReply("QUEUED"))
+		return
+	}
 	if !ok {
-		sess.WriteReply(ErrorReply("Handler Not Found"))
+		r.WriteReply(unknownCommand(c))
+		return
+	}
+	if !cmd.checkArity(len(c)) {
+		r.WriteReply(cmd.arityError())
+		return
+	}
+	if readonly {
+		r.WriteReply(ErrReadonly)
+		return
+	}
+	//写命令按执行顺序进入复制的命令流，阻塞命令在blocking中处理
+	if cmd.is(flagWrite) && !cmd.is(flagBlocking) {
+		s.feed.lock()
+		defer s.feed.unlock(c)
+		//回复错误的命令没有写入，不进入命令流
+		if s.feed.enabled() {
+			w := &replyWatcher{ReplyWriter: r}
+			r = w
+			defer w.dropIfFailed(s.feed)
+		}
+	}
+	//持有共享锁，和EXEC互斥
+	if !cmd.is(flagNoLock) {
+		s.db.RLock()
+		defer s.db.RUnlock()
 	}
-	//调用写入
-	cmdFunc(sess, c)
+	cmd.handler(s, r, c)
 }
 
-//注册处理函数
-// register all On[Comamd Name] functions,
-// such as OnPING/OnGET/OnSET, into HandlerFunc map
-func (s *GoRedisServer) registerCmdFunc() {
-	s.cmdfunc = make(map[string]HandlerFunc)
-	//注册val，type
-	objval := reflect.ValueOf(s)
-	objtyp := reflect.TypeOf(s)
-
-	//注册调用函数
-	for i := 0; i < objtyp.NumMethod(); i++ {
-		name := objtyp.Method(i).Name
-		if len(name) > 2 && strings.HasPrefix(name, "On") {
-			//
-			// tricks
-			func(name string, method reflect.Value) {
-				//注册函数
-				s.cmdfunc[name] = HandlerFunc(func(r ReplyWriter, c Command) {
-					//接收的值是，value，命令行
-					in := []reflect.Value{reflect.ValueOf(r), reflect.ValueOf(c)}
-					method.Call(in)
-				})
-			}(strings.ToUpper(name[2:]), objval.Method(i))
-		}
+func unknownCommand(c Command) Reply {
+	args := ""
+	for _, arg := range c[1:] {
+		args += "'" + string(arg) + "' "
 	}
+	return ErrorReply("ERR unknown command '" + string(c[0]) + "', with args beginning with: " + args)
 }
 
 //回复接口
@@ -78,9 +157,23 @@ type ReplyWriter interface {
 	WriteReply(Reply) (int, error)
 }
 
+//Session的回复先写入缓冲区，等待或者关闭连接之前需要flush
+type flusher interface {
+	Flush() error
+}
+
+func flush(r ReplyWriter) {
+	if f, ok := r.(flusher); ok {
+		f.Flush()
+	}
+}
+
 //处理函数
 type HandlerFunc func(ReplyWriter, Command)
 
+//未绑定server的处理函数
+type cmdMethod func(*GoRedisServer, ReplyWriter, Command)
+
 func (f HandlerFunc) Serve(r ReplyWriter, c Command) {
 	f(r, c)
 }
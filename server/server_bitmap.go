@@ -0,0 +1,268 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"strconv"
+	"strings"
+)
+
+// http://redis.io/commands#bitmap
+
+var (
+	ErrBitOffset = ErrorReply("ERR bit offset is not an integer or out of range")
+	ErrBitValue  = ErrorReply("ERR bit is not an integer or out of range")
+)
+
+// SETBIT key offset value
+func (s *GoRedisServer) OnSETBIT(r ReplyWriter, c Command) {
+	offset, ok := parseInt(c[2])
+	if !ok || offset < 0 || offset > rocks.MaxBitOffset {
+		r.WriteReply(ErrBitOffset)
+		return
+	}
+	bit, ok := parseBit(c[3])
+	if !ok {
+		r.WriteReply(ErrBitValue)
+		return
+	}
+	old, err := s.db.SetBit(c[1], offset, bit)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(old))
+}
+
+// GETBIT key offset
+func (s *GoRedisServer) OnGETBIT(r ReplyWriter, c Command) {
+	offset, ok := parseInt(c[2])
+	if !ok || offset < 0 || offset > rocks.MaxBitOffset {
+		r.WriteReply(ErrBitOffset)
+		return
+	}
+	bit, err := s.db.GetBit(c[1], offset)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(bit))
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func (s *GoRedisServer) OnBITCOUNT(r ReplyWriter, c Command) {
+	var br *rocks.BitRange
+	switch len(c) {
+	case 2:
+	case 4, 5:
+		var ok bool
+		if br, ok = parseBitRange(r, c[2], c[3], c[4:]); !ok {
+			return
+		}
+	default:
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	n, err := s.db.BitCount(c[1], br)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func (s *GoRedisServer) OnBITPOS(r ReplyWriter, c Command) {
+	bit, ok := parseBit(c[2])
+	if !ok {
+		r.WriteReply(ErrorReply("ERR The bit argument must be 1 or 0."))
+		return
+	}
+	var br *rocks.BitRange
+	endGiven := false
+	switch len(c) {
+	case 3:
+	case 4:
+		start, ok := parseInt(c[3])
+		if !ok {
+			r.WriteReply(ErrNotInt)
+			return
+		}
+		br = &rocks.BitRange{Start: start, End: -1}
+	case 5, 6:
+		if br, ok = parseBitRange(r, c[3], c[4], c[5:]); !ok {
+			return
+		}
+		endGiven = true
+	default:
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	pos, err := s.db.BitPos(c[1], bit, br, endGiven)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(pos))
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...]
+func (s *GoRedisServer) OnBITOP(r ReplyWriter, c Command) {
+	var op rocks.BitOperation
+	switch strings.ToUpper(string(c[1])) {
+	case "AND":
+		op = rocks.BitAnd
+	case "OR":
+		op = rocks.BitOr
+	case "XOR":
+		op = rocks.BitXor
+	case "NOT":
+		op = rocks.BitNot
+	default:
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	n, err := s.db.BitOp(op, c[2], c[3:]...)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]
+func (s *GoRedisServer) OnBITFIELD(r ReplyWriter, c Command) {
+	ops := make([]rocks.BitFieldOp, 0)
+	overflow := rocks.BitOverflowWrap
+	for i := 2; i < len(c); {
+		name := strings.ToUpper(string(c[i]))
+		if name == "OVERFLOW" {
+			if i+1 >= len(c) {
+				r.WriteReply(ErrSyntax)
+				return
+			}
+			switch strings.ToUpper(string(c[i+1])) {
+			case "WRAP":
+				overflow = rocks.BitOverflowWrap
+			case "SAT":
+				overflow = rocks.BitOverflowSat
+			case "FAIL":
+				overflow = rocks.BitOverflowFail
+			default:
+				r.WriteReply(ErrorReply("ERR Invalid OVERFLOW type specified"))
+				return
+			}
+			i += 2
+			continue
+		}
+
+		op := rocks.BitFieldOp{Overflow: overflow}
+		nargs := 3
+		switch name {
+		case "GET":
+			op.Kind = rocks.BitFieldGet
+			nargs = 2
+		case "SET":
+			op.Kind = rocks.BitFieldSet
+		case "INCRBY":
+			op.Kind = rocks.BitFieldIncrBy
+		default:
+			r.WriteReply(ErrSyntax)
+			return
+		}
+		if i+nargs >= len(c) {
+			r.WriteReply(ErrSyntax)
+			return
+		}
+		var ok bool
+		if op.Signed, op.Bits, ok = parseBitFieldType(c[i+1]); !ok {
+			r.WriteReply(ErrorReply("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."))
+			return
+		}
+		if op.Offset, ok = parseBitFieldOffset(c[i+2], op.Bits); !ok {
+			r.WriteReply(ErrBitOffset)
+			return
+		}
+		if nargs == 3 {
+			if op.Value, ok = parseInt(c[i+3]); !ok {
+				r.WriteReply(ErrNotInt)
+				return
+			}
+		}
+		ops = append(ops, op)
+		i += nargs + 1
+	}
+
+	results, err := s.db.BitField(c[1], ops)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	bulks := make([]interface{}, len(results))
+	for i, v := range results {
+		if v != nil {
+			bulks[i] = int(*v)
+		}
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+func parseBit(b []byte) (int, bool) {
+	switch string(b) {
+	case "0":
+		return 0, true
+	case "1":
+		return 1, true
+	}
+	return 0, false
+}
+
+// 解析 start end [BYTE|BIT]
+func parseBitRange(r ReplyWriter, start, end []byte, unit [][]byte) (*rocks.BitRange, bool) {
+	br := &rocks.BitRange{}
+	var ok1, ok2 bool
+	br.Start, ok1 = parseInt(start)
+	br.End, ok2 = parseInt(end)
+	if !ok1 || !ok2 {
+		r.WriteReply(ErrNotInt)
+		return nil, false
+	}
+	if len(unit) > 0 {
+		switch strings.ToUpper(string(unit[0])) {
+		case "BYTE":
+		case "BIT":
+			br.Bit = true
+		default:
+			r.WriteReply(ErrSyntax)
+			return nil, false
+		}
+	}
+	return br, true
+}
+
+// i1~i64，u1~u63
+func parseBitFieldType(b []byte) (signed bool, bits uint, ok bool) {
+	if len(b) < 2 || (b[0] != 'i' && b[0] != 'u') {
+		return false, 0, false
+	}
+	n, err := strconv.Atoi(string(b[1:]))
+	signed = b[0] == 'i'
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, false
+	}
+	return signed, uint(n), true
+}
+
+// offset可以写成 #n，表示第n个同类型的字段
+func parseBitFieldOffset(b []byte, bits uint) (int64, bool) {
+	mul := int64(1)
+	if len(b) > 0 && b[0] == '#' {
+		mul = int64(bits)
+		b = b[1:]
+	}
+	n, ok := parseInt(b)
+	if !ok || n < 0 || n > rocks.MaxBitOffset/mul {
+		return 0, false
+	}
+	return n * mul, true
+}
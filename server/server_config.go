@@ -0,0 +1,181 @@
+package server
+
+import (
+	"github.com/latermoon/GoRedis/libs/glob"
+	. "github.com/latermoon/GoRedis/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 运行时配置，通过CONFIG GET/SET读写
+type config struct {
+	mu     sync.RWMutex
+	params map[string]string
+	// 参数修改之后的回调
+	hooks map[string]func(string)
+}
+
+// 支持的参数和默认值
+var configDefaults = map[string]string{
+	// KEYS最多遍历的key数量，超过时报错，0表示不限制
+	"keys-max": "100000",
+	// 键空间通知的类型，空表示关闭
+	"notify-keyspace-events": "",
+	// 读取命令时的限制，单位是字节和个数
+	"proto-max-bulk-len":        strconv.Itoa(DefaultMaxBulkLen),
+	"proto-max-multibulk-len":   strconv.Itoa(DefaultMaxMultiBulkLen),
+	"client-query-buffer-limit": strconv.Itoa(DefaultQueryBufferLimit),
+	"repl-backlog-size":         strconv.Itoa(replBacklogSize),
+	// 连接主库时使用的密码
+	"masterauth": "",
+	// 作为从库时拒绝客户端的写命令
+	"replica-read-only": "yes",
+}
+
+// 参数校验，没有的表示任意字符串
+var configCheckers = map[string]func(string) bool{
+	"keys-max":                  isNonNegativeInt,
+	"notify-keyspace-events":    isNotifyFlags,
+	"proto-max-bulk-len":        isPositiveInt,
+	"proto-max-multibulk-len":   isPositiveInt,
+	"client-query-buffer-limit": isPositiveInt,
+	"repl-backlog-size":         isPositiveInt,
+	"replica-read-only":         isYesNo,
+}
+
+// 保存之前转成标准形式
+var configNormalizers = map[string]func(string) string{
+	"notify-keyspace-events": formatNotifyFlags,
+	"replica-read-only":      strings.ToLower,
+}
+
+func newConfig() *config {
+	c := &config{params: make(map[string]string), hooks: make(map[string]func(string))}
+	for name, value := range configDefaults {
+		c.params[name] = value
+	}
+	return c
+}
+
+func (c *config) get(name string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.params[name]
+}
+
+func (c *config) getInt(name string) int64 {
+	n, _ := strconv.ParseInt(c.get(name), 10, 64)
+	return n
+}
+
+func (c *config) set(name, value string) bool {
+	if _, ok := configDefaults[name]; !ok {
+		return false
+	}
+	if check, ok := configCheckers[name]; ok && !check(value) {
+		return false
+	}
+	if normalize, ok := configNormalizers[name]; ok {
+		value = normalize(value)
+	}
+	c.mu.Lock()
+	c.params[name] = value
+	hook := c.hooks[name]
+	c.mu.Unlock()
+	if hook != nil {
+		hook(value)
+	}
+	return true
+}
+
+// 注册参数修改的回调，注册时用当前值调用一次
+func (c *config) onChange(name string, fn func(string)) {
+	c.mu.Lock()
+	c.hooks[name] = fn
+	value := c.params[name]
+	c.mu.Unlock()
+	fn(value)
+}
+
+// 按glob匹配参数名，返回 [name, value, ...]
+func (c *config) match(pattern []byte) []interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.params))
+	for name := range c.params {
+		if glob.Match(pattern, []byte(name)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	bulks := make([]interface{}, 0, len(names)*2)
+	for _, name := range names {
+		bulks = append(bulks, name, c.params[name])
+	}
+	return bulks
+}
+
+func isNonNegativeInt(s string) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && n >= 0
+}
+
+func isPositiveInt(s string) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && n > 0
+}
+
+func isYesNo(s string) bool {
+	s = strings.ToLower(s)
+	return s == "yes" || s == "no"
+}
+
+// 修改之后调用set，参数已经校验过
+func setInt(set func(int64)) func(string) {
+	return func(value string) {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		set(n)
+	}
+}
+
+// CONFIG GET pattern
+// CONFIG SET parameter value [parameter value ...]
+func (s *GoRedisServer) OnCONFIG(r ReplyWriter, c Command) {
+	if len(c) < 2 {
+		r.WriteReply(ErrorReply("ERR wrong number of arguments for 'config' command"))
+		return
+	}
+	switch strings.ToUpper(string(c[1])) {
+	case "GET":
+		if len(c) != 3 {
+			r.WriteReply(ErrorReply("ERR wrong number of arguments for 'config|get' command"))
+			return
+		}
+		r.WriteReply(MapReply(s.config.match([]byte(strings.ToLower(string(c[2]))))))
+	case "SET":
+		if len(c) < 4 || len(c)%2 != 0 {
+			r.WriteReply(ErrorReply("ERR wrong number of arguments for 'config|set' command"))
+			return
+		}
+		// 先全部校验，避免只设置了一部分
+		for i := 2; i < len(c); i += 2 {
+			name := strings.ToLower(string(c[i]))
+			if _, ok := configDefaults[name]; !ok {
+				r.WriteReply(ErrorReply("ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'"))
+				return
+			}
+			if check, ok := configCheckers[name]; ok && !check(string(c[i+1])) {
+				r.WriteReply(ErrorReply("ERR Invalid argument '" + string(c[i+1]) + "' for CONFIG SET '" + name + "'"))
+				return
+			}
+		}
+		for i := 2; i < len(c); i += 2 {
+			s.config.set(strings.ToLower(string(c[i])), string(c[i+1]))
+		}
+		r.WriteReply(StatusReply("OK"))
+	default:
+		r.WriteReply(ErrorReply("ERR unknown subcommand '" + string(c[1]) + "'. Try CONFIG GET, CONFIG SET."))
+	}
+}
@@ -2,10 +2,101 @@ package server
 
 import (
 	. "github.com/latermoon/GoRedis/redis"
+	"io"
+	"strconv"
+	"strings"
 )
 
 // http://redis.io/commands#connection
 //连接处理
 func (s *GoRedisServer) OnPING(r ReplyWriter, c Command) {
+	//RESP2的订阅模式下回复数组
+	if st := stateOf(r); st.sub != nil && protocolOf(r) == RESP2 {
+		msg := []byte{}
+		if len(c) > 1 {
+			msg = c[1]
+		}
+		st.sub.WriteReply(MultiBulkReply{"pong", msg})
+		return
+	}
+	if len(c) > 1 {
+		r.WriteReply(BulkReply(c[1]))
+		return
+	}
 	r.WriteReply(StatusReply("PONG"))
 }
+
+//回复OK之后关闭连接
+func (s *GoRedisServer) OnQUIT(r ReplyWriter, c Command) {
+	w := stateOf(r).writer(r)
+	w.WriteReply(StatusReply("OK"))
+	if sub, ok := w.(*subscriber); ok {
+		sub.flush()
+	}
+	flush(r)
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// HELLO返回的版本号，按这个版本的redis提供命令
+const redisVersion = "7.0.0"
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// 协商协议版本，回复按新的版本编码
+func (s *GoRedisServer) OnHELLO(r ReplyWriter, c Command) {
+	proto := protocolOf(r)
+	if len(c) > 1 {
+		v, err := strconv.Atoi(string(c[1]))
+		if err != nil {
+			r.WriteReply(ErrorReply("ERR Protocol version is not an integer or out of range"))
+			return
+		}
+		if v != RESP2 && v != RESP3 {
+			r.WriteReply(ErrorReply("NOPROTO unsupported protocol version"))
+			return
+		}
+		proto = v
+	}
+	var name []byte
+	for i := 2; i < len(c); i++ {
+		more := len(c) - i - 1
+		switch opt := strings.ToUpper(string(c[i])); {
+		case opt == "AUTH" && more >= 2:
+			// 没有设置密码，和redis的default用户一样接受任何密码
+			if string(c[i+1]) != "default" {
+				r.WriteReply(ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+				return
+			}
+			i += 2
+		case opt == "SETNAME" && more >= 1:
+			name = c[i+1]
+			i++
+		default:
+			r.WriteReply(ErrorReply("ERR Syntax error in HELLO option '" + string(c[i]) + "'"))
+			return
+		}
+	}
+	st := stateOf(r)
+	if name != nil {
+		st.name = string(name)
+	}
+	if p, ok := r.(interface {
+		SetProtocol(int)
+	}); ok {
+		p.SetProtocol(proto)
+	}
+	role := "master"
+	if s.replicating() {
+		role = "replica"
+	}
+	r.WriteReply(MapReply{
+		"server", "redis",
+		"version", redisVersion,
+		"proto", proto,
+		"id", int(st.id),
+		"mode", "standalone",
+		"role", role,
+		"modules", MultiBulkReply{},
+	})
+}
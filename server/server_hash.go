@@ -2,21 +2,48 @@ package server
 
 import (
 	. "github.com/latermoon/GoRedis/redis"
+	"strconv"
 )
 
 // http://redis.io/commands#hash
 
 func (s *GoRedisServer) OnHDEL(r ReplyWriter, c Command) {
-
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := h.Remove(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
 }
 
 func (s *GoRedisServer) OnHEXISTS(r ReplyWriter, c Command) {
-
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	exist, err := h.Exist(c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if exist {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		r.WriteReply(IntegerReply(0))
+	}
 }
 
 //获取第一个数据
 func (s *GoRedisServer) OnHGET(r ReplyWriter, c Command) {
-	h := s.db.Hash(c[1])
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
 	//获取数据
 	val, err := h.Get(c[2])
 	if err != nil {
@@ -28,19 +55,188 @@ func (s *GoRedisServer) OnHGET(r ReplyWriter, c Command) {
 }
 
 func (s *GoRedisServer) OnHMGET(r ReplyWriter, c Command) {
-
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	vals, err := h.MGet(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(bytesReply(vals))
 }
 
-//设置数据
+//设置数据，返回新增的field数量
+// HSET key field value [field value ...]
 func (s *GoRedisServer) OnHSET(r ReplyWriter, c Command) {
-	h := s.db.Hash(c[1])
-	if err := h.Set(c[2], c[3]); err != nil {
+	if len(c) < 4 || len(c)%2 != 0 {
+		r.WriteReply(ErrorReply("ERR wrong number of arguments for 'hset' command"))
+		return
+	}
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := h.MSet(c[2:]...)
+	if err != nil {
 		r.WriteReply(ErrorReply(err.Error()))
 		return
 	}
-	r.WriteReply(IntegerReply(1))
+	r.WriteReply(IntegerReply(n))
 }
 
 func (s *GoRedisServer) OnHMSET(r ReplyWriter, c Command) {
+	if len(c) < 4 || len(c)%2 != 0 {
+		r.WriteReply(ErrorReply("ERR wrong number of arguments for 'hmset' command"))
+		return
+	}
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	if _, err := h.MSet(c[2:]...); err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnHSETNX(r ReplyWriter, c Command) {
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	ok, err := h.SetNX(c[2], c[3])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if ok {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		s.feed.rewrite()
+		r.WriteReply(IntegerReply(0))
+	}
+}
+
+func (s *GoRedisServer) OnHLEN(r ReplyWriter, c Command) {
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(h.Len()))
+}
+
+func (s *GoRedisServer) OnHSTRLEN(r ReplyWriter, c Command) {
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	val, err := h.Get(c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(len(val)))
+}
+
+func (s *GoRedisServer) OnHINCRBY(r ReplyWriter, c Command) {
+	delta, ok := parseInt(c[3])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := h.IncrBy(c[2], delta)
+	if err != nil {
+		r.WriteReply(ErrorReply("ERR " + err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+func (s *GoRedisServer) OnHINCRBYFLOAT(r ReplyWriter, c Command) {
+	delta, ok := parseFloat(c[3])
+	if !ok {
+		r.WriteReply(ErrNotFloat)
+		return
+	}
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	f, err := h.IncrByFloat(c[2], delta)
+	if err != nil {
+		r.WriteReply(ErrorReply("ERR " + err.Error()))
+		return
+	}
+	val := []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	// 和INCRBYFLOAT一样传播结果
+	s.feed.rewrite(Command{[]byte("HSET"), c[1], c[2], val})
+	r.WriteReply(BulkReply(val))
+}
+
+func (s *GoRedisServer) OnHGETALL(r ReplyWriter, c Command) {
+	s.hgetall(r, c, true, true)
+}
+
+func (s *GoRedisServer) OnHKEYS(r ReplyWriter, c Command) {
+	s.hgetall(r, c, true, false)
+}
+
+func (s *GoRedisServer) OnHVALS(r ReplyWriter, c Command) {
+	s.hgetall(r, c, false, true)
+}
 
+func (s *GoRedisServer) hgetall(r ReplyWriter, c Command, fields, values bool) {
+	bulks := make([]interface{}, 0)
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	h.Enumerate(func(i int, field, value []byte, quit *bool) {
+		if fields {
+			bulks = append(bulks, copyBytes(field))
+		}
+		if values {
+			bulks = append(bulks, copyBytes(value))
+		}
+	})
+	//HGETALL在RESP3中返回map
+	if fields && values {
+		r.WriteReply(MapReply(bulks))
+		return
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *GoRedisServer) OnHSCAN(r ReplyWriter, c Command) {
+	sa, ok := s.parseScanArgs(r, c[2:], false)
+	if !ok {
+		return
+	}
+	h, err := s.db.Hash(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	bulks := make([]interface{}, 0)
+	next := h.Scan(sa.cursor, sa.count, func(field, value []byte) {
+		if sa.matches(field) {
+			bulks = append(bulks, field, value)
+		}
+	})
+	r.WriteReply(s.scanReply(next, bulks))
 }
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/latermoon/GoRedis/redis"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// INFO [section ...]
+// 目前只有server和replication两段，没有参数或者all、default、everything时输出全部
+func (s *GoRedisServer) OnINFO(r ReplyWriter, c Command) {
+	sections := []struct {
+		name string
+		fn   func(w *bytes.Buffer)
+	}{
+		{"server", s.infoServer},
+		{"replication", s.infoReplication},
+	}
+	want := map[string]bool{}
+	for _, arg := range c[1:] {
+		want[strings.ToLower(string(arg))] = true
+	}
+	all := len(want) == 0 || want["all"] || want["default"] || want["everything"]
+	var buf bytes.Buffer
+	for _, sec := range sections {
+		if !all && !want[sec.name] {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		sec.fn(&buf)
+	}
+	r.WriteReply(BulkReply(buf.Bytes()))
+}
+
+func infoLine(w *bytes.Buffer, key string, value interface{}) {
+	fmt.Fprintf(w, "%s:%v\r\n", key, value)
+}
+
+func (s *GoRedisServer) infoServer(w *bytes.Buffer) {
+	w.WriteString("# Server\r\n")
+	infoLine(w, "redis_version", redisVersion)
+	infoLine(w, "redis_mode", "standalone")
+}
+
+// 和redis一致的字段，多主复制的来源是sources和source<n>
+func (s *GoRedisServer) infoReplication(w *bytes.Buffer) {
+	w.WriteString("# Replication\r\n")
+	role := "master"
+	if s.replicating() {
+		role = "slave"
+	}
+	infoLine(w, "role", role)
+
+	rp := s.repl
+	rp.mu.Lock()
+	if rp.link != nil {
+		host, port, _ := net.SplitHostPort(rp.link.addr)
+		status := "down"
+		if rp.link.state == replStateConnected {
+			status = "up"
+		}
+		sync := 0
+		if rp.link.state == replStateSync {
+			sync = 1
+		}
+		infoLine(w, "master_host", host)
+		infoLine(w, "master_port", port)
+		infoLine(w, "master_link_status", status)
+		infoLine(w, "master_sync_in_progress", sync)
+		infoLine(w, "slave_repl_offset", rp.offset)
+	}
+	rp.mu.Unlock()
+
+	sources := s.sources.list()
+	infoLine(w, "sources", len(sources))
+	for i, src := range sources {
+		info := src.sourceInfo()
+		fields := make([]string, 0, len(info)/2)
+		for j := 0; j+1 < len(info); j += 2 {
+			fields = append(fields, fmt.Sprintf("%v=%v", info[j], info[j+1]))
+		}
+		infoLine(w, fmt.Sprintf("source%d", i), strings.Join(fields, ","))
+	}
+
+	replicas := s.feed.roleReplicas()
+	infoLine(w, "connected_slaves", len(replicas))
+	for i, item := range replicas {
+		rc := item.(MultiBulkReply)
+		infoLine(w, fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%v,port=%v,state=online,offset=%v", rc[0], rc[1], rc[2]))
+	}
+	replid, offset := s.feed.progress()
+	infoLine(w, "master_replid", replid)
+	infoLine(w, "master_repl_offset", offset)
+	infoLine(w, "repl_backlog_size", s.config.get("repl-backlog-size"))
+}
+
+// TIME 回复unix时间的秒和微秒，多主复制用它取得来源的时钟
+func (s *GoRedisServer) OnTIME(r ReplyWriter, c Command) {
+	now := time.Now()
+	r.WriteReply(MultiBulkReply{strconv.FormatInt(now.Unix(), 10), strconv.Itoa(now.Nanosecond() / 1000)})
+}
@@ -1,24 +1,182 @@
 package server
 
 import (
+	"github.com/latermoon/GoRedis/libs/glob"
 	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"strings"
 )
 
 // http://redis.io/commands#generic
 
+//删除多个key，返回实际删除的数量
 func (s *GoRedisServer) OnDEL(r ReplyWriter, c Command) {
-
+	n := 0
+	for _, key := range c[1:] {
+		if s.db.TypeOf(key) == rocks.NONE {
+			continue
+		}
+		if err := s.db.Delete(key); err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		n++
+	}
+	r.WriteReply(IntegerReply(n))
 }
 
+//返回存在的key数量，重复的key重复计数
 func (s *GoRedisServer) OnEXISTS(r ReplyWriter, c Command) {
-
+	n := 0
+	for _, key := range c[1:] {
+		if s.db.TypeOf(key) != rocks.NONE {
+			n++
+		}
+	}
+	r.WriteReply(IntegerReply(n))
 }
 
+// KEYS pattern
+// 需要遍历全部key，遍历数量超过keys-max时报错，应该改用SCAN
 func (s *GoRedisServer) OnKEYS(r ReplyWriter, c Command) {
+	max := s.config.getInt("keys-max")
+	bulks := make([]interface{}, 0)
+	scanned := int64(0)
+	var cursor []byte
+	for {
+		cursor = s.db.Scan(cursor, 1000, func(key []byte, t rocks.ElementType) {
+			scanned++
+			if glob.Match(c[1], key) {
+				bulks = append(bulks, key)
+			}
+		})
+		if max > 0 && scanned > max {
+			r.WriteReply(ErrorReply("ERR KEYS scanned more than keys-max keys, use SCAN instead"))
+			return
+		}
+		if cursor == nil {
+			break
+		}
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
 
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (s *GoRedisServer) OnSCAN(r ReplyWriter, c Command) {
+	sa, ok := s.parseScanArgs(r, c[1:], true)
+	if !ok {
+		return
+	}
+	bulks := make([]interface{}, 0)
+	next := s.db.Scan(sa.cursor, sa.count, func(key []byte, t rocks.ElementType) {
+		if sa.typ != "" && sa.typ != typeName(t) {
+			return
+		}
+		if sa.matches(key) {
+			bulks = append(bulks, key)
+		}
+	})
+	r.WriteReply(s.scanReply(next, bulks))
 }
+
 //获取类型
 func (s *GoRedisServer) OnTYPE(r ReplyWriter, c Command) {
 	elemType := s.db.TypeOf(c[1])
-	r.WriteReply(StatusReply(elemType.String()))
+	r.WriteReply(StatusReply(typeName(elemType)))
+}
+
+// EXPIRE key seconds
+func (s *GoRedisServer) OnEXPIRE(r ReplyWriter, c Command) {
+	s.expire(r, c, 1000, false)
+}
+
+// PEXPIRE key milliseconds
+func (s *GoRedisServer) OnPEXPIRE(r ReplyWriter, c Command) {
+	s.expire(r, c, 1, false)
+}
+
+// EXPIREAT key timestamp
+func (s *GoRedisServer) OnEXPIREAT(r ReplyWriter, c Command) {
+	s.expire(r, c, 1000, true)
+}
+
+// PEXPIREAT key milliseconds-timestamp
+func (s *GoRedisServer) OnPEXPIREAT(r ReplyWriter, c Command) {
+	s.expire(r, c, 1, true)
+}
+
+//设置过期时间，unit为参数的毫秒倍数，abs表示参数是时间戳
+func (s *GoRedisServer) expire(r ReplyWriter, c Command, unit int64, abs bool) {
+	n, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	deadline, ok := deadlineMs(n, unit, abs)
+	if !ok {
+		r.WriteReply(errInvalidExpire(c))
+		return
+	}
+	ok, err := s.db.ExpireAt(c[1], deadline)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if ok {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		r.WriteReply(IntegerReply(0))
+	}
+}
+
+//剩余秒数
+func (s *GoRedisServer) OnTTL(r ReplyWriter, c Command) {
+	s.ttl(r, c, 1000)
+}
+
+//剩余毫秒数
+func (s *GoRedisServer) OnPTTL(r ReplyWriter, c Command) {
+	s.ttl(r, c, 1)
+}
+
+func (s *GoRedisServer) ttl(r ReplyWriter, c Command, unit int64) {
+	ttl, err := s.db.TTL(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	if ttl > 0 {
+		// 和redis一样四舍五入到秒
+		ttl = (ttl + unit/2) / unit
+	}
+	r.WriteReply(IntegerReply(ttl))
+}
+
+//移除过期时间
+func (s *GoRedisServer) OnPERSIST(r ReplyWriter, c Command) {
+	ok, err := s.db.Persist(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if ok {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		r.WriteReply(IntegerReply(0))
+	}
+}
+
+// FLUSHALL [ASYNC|SYNC]
+// 只有一个db，FLUSHDB和FLUSHALL相同，都是同步删除
+// 需要排它锁，不能在MULTI中执行
+func (s *GoRedisServer) OnFLUSHALL(r ReplyWriter, c Command) {
+	if len(c) > 2 || (len(c) == 2 && !strings.EqualFold(string(c[1]), "async") && !strings.EqualFold(string(c[1]), "sync")) {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	if err := s.db.FlushAll(); err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnFLUSHDB(r ReplyWriter, c Command) {
+	s.OnFLUSHALL(r, c)
 }
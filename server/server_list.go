@@ -2,38 +2,301 @@ package server
 
 import (
 	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"strings"
+	"time"
 )
 
 // http://redis.io/commands#list
 
 func (s *GoRedisServer) OnLINDEX(r ReplyWriter, c Command) {
-
+	i, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	val, err := l.Index(i)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(BulkReply(val))
 }
 
 func (s *GoRedisServer) OnLLEN(r ReplyWriter, c Command) {
-
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(l.Len()))
 }
 
+// LPOP key [count]
 func (s *GoRedisServer) OnLPOP(r ReplyWriter, c Command) {
+	s.pop(r, c, true)
+}
 
+func (s *GoRedisServer) OnRPOP(r ReplyWriter, c Command) {
+	s.pop(r, c, false)
 }
 
-func (s *GoRedisServer) OnLPUSH(r ReplyWriter, c Command) {
+//带count时返回数组
+func (s *GoRedisServer) pop(r ReplyWriter, c Command, left bool) {
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	popFn := l.RPop
+	if left {
+		popFn = l.LPop
+	}
+
+	if len(c) < 3 {
+		val, err := popFn()
+		if err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		r.WriteReply(BulkReply(val))
+		return
+	}
 
+	count, ok := parseInt(c[2])
+	if !ok || count < 0 {
+		r.WriteReply(ErrorReply("ERR value is out of range, must be positive"))
+		return
+	}
+	bulks := make([]interface{}, 0)
+	for i := int64(0); i < count; i++ {
+		val, err := popFn()
+		if err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		if val == nil {
+			break
+		}
+		bulks = append(bulks, val)
+	}
+	if len(bulks) == 0 {
+		r.WriteReply(MultiBulkReply(nil))
+		return
+	}
+	r.WriteReply(MultiBulkReply(bulks))
 }
 
-func (s *GoRedisServer) OnLRANGE(r ReplyWriter, c Command) {
+func (s *GoRedisServer) OnLPUSH(r ReplyWriter, c Command) {
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := l.LPush(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
 
+func (s *GoRedisServer) OnLRANGE(r ReplyWriter, c Command) {
+	start, ok1 := parseInt(c[2])
+	stop, ok2 := parseInt(c[3])
+	if !ok1 || !ok2 {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	bulks := make([]interface{}, 0)
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	err = l.Range(int(start), int(stop), func(i int, value []byte, quit *bool) {
+		bulks = append(bulks, copyBytes(value))
+	})
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(MultiBulkReply(bulks))
 }
 
 func (s *GoRedisServer) OnLSET(r ReplyWriter, c Command) {
+	i, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	if l.Len() == 0 {
+		r.WriteReply(ErrorReply("ERR no such key"))
+		return
+	}
+	if err := l.Set(i, c[3]); err == rocks.ErrIndexOutOfRange {
+		r.WriteReply(ErrorReply("ERR index out of range"))
+	} else if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else {
+		r.WriteReply(StatusReply("OK"))
+	}
+}
 
+func (s *GoRedisServer) OnRPUSH(r ReplyWriter, c Command) {
+	l, err := s.db.List(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := l.RPush(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
 }
 
-func (s *GoRedisServer) OnRPOP(r ReplyWriter, c Command) {
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func (s *GoRedisServer) OnLMOVE(r ReplyWriter, c Command) {
+	srcLeft, dstLeft, ok := parseMoveWhere(c[3], c[4])
+	if !ok {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	val, err := s.move(c[1], c[2], srcLeft, dstLeft)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(BulkReply(val))
+}
 
+// RPOPLPUSH source destination
+func (s *GoRedisServer) OnRPOPLPUSH(r ReplyWriter, c Command) {
+	val, err := s.move(c[1], c[2], false, true)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(BulkReply(val))
 }
 
-func (s *GoRedisServer) OnRPUSH(r ReplyWriter, c Command) {
+// BLPOP key [key ...] timeout
+func (s *GoRedisServer) OnBLPOP(r ReplyWriter, c Command) {
+	s.bpop(r, c, true)
+}
+
+// BRPOP key [key ...] timeout
+func (s *GoRedisServer) OnBRPOP(r ReplyWriter, c Command) {
+	s.bpop(r, c, false)
+}
+
+func (s *GoRedisServer) bpop(r ReplyWriter, c Command, left bool) {
+	timeout, ok := parseTimeout(r, c[len(c)-1])
+	if !ok {
+		return
+	}
+	keys := c[1 : len(c)-1]
+	s.wait(r, keys, timeout, MultiBulkReply(nil), func(key []byte) (Reply, bool) {
+		l, err := s.db.List(key)
+		if err != nil {
+			return ErrorReply(err.Error()), true
+		}
+		popFn := l.RPop
+		if left {
+			popFn = l.LPop
+		}
+		val, err := popFn()
+		if err != nil {
+			return ErrorReply(err.Error()), true
+		}
+		if val == nil {
+			return nil, false
+		}
+		pop := "RPOP"
+		if left {
+			pop = "LPOP"
+		}
+		s.feed.alsoPropagate(Command{[]byte(pop), copyBytes(key)})
+		return MultiBulkReply{copyBytes(key), val}, true
+	})
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func (s *GoRedisServer) OnBLMOVE(r ReplyWriter, c Command) {
+	srcLeft, dstLeft, ok := parseMoveWhere(c[3], c[4])
+	if !ok {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	s.bmove(r, c[1], c[2], srcLeft, dstLeft, c[5])
+}
+
+// BRPOPLPUSH source destination timeout
+func (s *GoRedisServer) OnBRPOPLPUSH(r ReplyWriter, c Command) {
+	s.bmove(r, c[1], c[2], false, true, c[3])
+}
+
+func (s *GoRedisServer) bmove(r ReplyWriter, src, dst []byte, srcLeft, dstLeft bool, arg []byte) {
+	timeout, ok := parseTimeout(r, arg)
+	if !ok {
+		return
+	}
+	s.wait(r, [][]byte{src}, timeout, BulkReply(nil), func(key []byte) (Reply, bool) {
+		val, err := s.move(src, dst, srcLeft, dstLeft)
+		if err != nil {
+			return ErrorReply(err.Error()), true
+		}
+		if val == nil {
+			return nil, false
+		}
+		s.feed.alsoPropagate(Command{[]byte("LMOVE"), src, dst, []byte(whereName(srcLeft)), []byte(whereName(dstLeft))})
+		return BulkReply(val), true
+	})
+}
+
+//从src取出一个元素放入dst，src为空时返回nil
+func (s *GoRedisServer) move(src, dst []byte, srcLeft, dstLeft bool) ([]byte, error) {
+	return s.db.ListMove(src, dst, srcLeft, dstLeft)
+}
+
+//解析 LEFT|RIGHT LEFT|RIGHT
+func parseMoveWhere(wherefrom, whereto []byte) (srcLeft, dstLeft, ok bool) {
+	from, to := strings.ToUpper(string(wherefrom)), strings.ToUpper(string(whereto))
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		return false, false, false
+	}
+	return from == "LEFT", to == "LEFT", true
+}
+
+func whereName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
 
+//解析秒为单位的超时时间，支持小数，出错时直接回复客户端
+func parseTimeout(r ReplyWriter, arg []byte) (time.Duration, bool) {
+	sec, ok := parseFloat(arg)
+	if !ok {
+		r.WriteReply(ErrorReply("ERR timeout is not a float or out of range"))
+		return 0, false
+	}
+	if sec < 0 {
+		r.WriteReply(ErrorReply("ERR timeout is negative"))
+		return 0, false
+	}
+	return time.Duration(sec * float64(time.Second)), true
 }
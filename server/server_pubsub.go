@@ -0,0 +1,154 @@
+package server
+
+import (
+	"github.com/latermoon/GoRedis/libs/glob"
+	. "github.com/latermoon/GoRedis/redis"
+	"sort"
+	"strings"
+)
+
+// http://redis.io/commands#pubsub
+
+// RESP2的订阅模式下允许的命令，RESP3可以执行任何命令
+var subscriberCommands = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// SUBSCRIBE channel [channel ...]
+func (s *GoRedisServer) OnSUBSCRIBE(r ReplyWriter, c Command) {
+	sub := s.enterSubscribe(r)
+	for _, ch := range c[1:] {
+		s.pubsub.subscribe(sub, ch)
+		sub.WriteReply(PushReply{"subscribe", ch, sub.count()})
+	}
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func (s *GoRedisServer) OnPSUBSCRIBE(r ReplyWriter, c Command) {
+	sub := s.enterSubscribe(r)
+	for _, p := range c[1:] {
+		s.pubsub.psubscribe(sub, p)
+		sub.WriteReply(PushReply{"psubscribe", p, sub.count()})
+	}
+}
+
+// UNSUBSCRIBE [channel [channel ...]]，不带参数时取消全部频道
+func (s *GoRedisServer) OnUNSUBSCRIBE(r ReplyWriter, c Command) {
+	s.unsubscribe(r, c[1:], false)
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func (s *GoRedisServer) OnPUNSUBSCRIBE(r ReplyWriter, c Command) {
+	s.unsubscribe(r, c[1:], true)
+}
+
+// PUBLISH channel message
+func (s *GoRedisServer) OnPUBLISH(r ReplyWriter, c Command) {
+	r.WriteReply(IntegerReply(s.pubsub.publish(c[1], c[2])))
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func (s *GoRedisServer) OnPUBSUB(r ReplyWriter, c Command) {
+	ps := s.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	switch sub := strings.ToUpper(string(c[1])); {
+	case sub == "CHANNELS" && len(c) <= 3:
+		names := make([]string, 0, len(ps.channels))
+		for ch := range ps.channels {
+			if len(c) == 2 || glob.Match(c[2], []byte(ch)) {
+				names = append(names, ch)
+			}
+		}
+		sort.Strings(names)
+		bulks := make([]interface{}, len(names))
+		for i, ch := range names {
+			bulks[i] = ch
+		}
+		r.WriteReply(MultiBulkReply(bulks))
+	case sub == "NUMSUB":
+		bulks := make([]interface{}, 0, (len(c)-2)*2)
+		for _, ch := range c[2:] {
+			bulks = append(bulks, ch, len(ps.channels[string(ch)]))
+		}
+		r.WriteReply(MapReply(bulks))
+	case sub == "NUMPAT" && len(c) == 2:
+		r.WriteReply(IntegerReply(len(ps.patterns)))
+	default:
+		r.WriteReply(ErrorReply("ERR Unknown subcommand or wrong number of arguments for '" + string(c[1]) + "'. Try PUBSUB HELP."))
+	}
+}
+
+// 进入订阅模式，之后连接的回复都经过subscriber的队列
+func (s *GoRedisServer) enterSubscribe(r ReplyWriter) *subscriber {
+	st := stateOf(r)
+	if st.sub == nil {
+		st.sub = newSubscriber(r)
+	}
+	return st.sub
+}
+
+func (s *GoRedisServer) unsubscribe(r ReplyWriter, names [][]byte, pattern bool) {
+	st := stateOf(r)
+	sub := st.sub
+	kind, unsub := "unsubscribe", s.pubsub.unsubscribe
+	if pattern {
+		kind, unsub = "punsubscribe", s.pubsub.punsubscribe
+	}
+	if sub == nil {
+		// 不在订阅模式
+		if len(names) == 0 {
+			r.WriteReply(PushReply{kind, nil, 0})
+		}
+		for _, name := range names {
+			r.WriteReply(PushReply{kind, name, 0})
+		}
+		return
+	}
+	if len(names) == 0 {
+		subscribed := sub.channels
+		if pattern {
+			subscribed = sub.patterns
+		}
+		for name := range subscribed {
+			names = append(names, []byte(name))
+		}
+		if len(names) == 0 {
+			sub.WriteReply(PushReply{kind, nil, sub.count()})
+		}
+	}
+	for _, name := range names {
+		unsub(sub, name)
+		sub.WriteReply(PushReply{kind, name, sub.count()})
+	}
+	if sub.count() == 0 {
+		s.leaveSubscribe(st)
+	}
+}
+
+// 写完队列中的回复后退出订阅模式
+func (s *GoRedisServer) leaveSubscribe(st *sessionState) {
+	st.sub.flush()
+	st.sub.stop()
+	st.sub = nil
+}
+
+// 连接关闭时取消全部订阅
+func (s *GoRedisServer) closeSubscribe(st *sessionState) {
+	if st.sub == nil {
+		return
+	}
+	for ch := range st.sub.channels {
+		s.pubsub.unsubscribe(st.sub, []byte(ch))
+	}
+	for p := range st.sub.patterns {
+		s.pubsub.punsubscribe(st.sub, []byte(p))
+	}
+	st.sub.stop()
+	st.sub = nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// http://redis.io/commands/replicaof
+// SLAVEOF host port | SLAVEOF NO ONE
+// 开始复制另一个redis，NO ONE停止复制并保留已有的数据
+func (s *GoRedisServer) OnSLAVEOF(r ReplyWriter, c Command) {
+	host, port := string(c[1]), string(c[2])
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if s.repl.master() != "" {
+			s.repl.stop()
+			log.Println("replication: master mode enabled")
+		}
+		r.WriteReply(StatusReply("OK"))
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		r.WriteReply(ErrorReply("ERR Invalid master port"))
+		return
+	}
+	if s.sources.count() > 0 {
+		r.WriteReply(ErrorReply("ERR can't use SLAVEOF while replicating from sources, see REPLSOURCE"))
+		return
+	}
+	addr := net.JoinHostPort(host, port)
+	if s.repl.master() == addr {
+		r.WriteReply(StatusReply("OK Already connected to specified master"))
+		return
+	}
+	s.replicaOf(addr)
+	log.Println("replication: replica of", addr, "enabled")
+	r.WriteReply(StatusReply("OK"))
+}
+
+// REPLICAOF是SLAVEOF的新名字
+func (s *GoRedisServer) OnREPLICAOF(r ReplyWriter, c Command) {
+	s.OnSLAVEOF(r, c)
+}
+
+// ROLE
+// 主库：master, offset, [[ip, port, offset] ...]
+// 从库：slave, host, port, state, offset
+func (s *GoRedisServer) OnROLE(r ReplyWriter, c Command) {
+	rp := s.repl
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.link == nil {
+		_, offset := s.feed.progress()
+		r.WriteReply(MultiBulkReply{"master", int(offset), s.feed.roleReplicas()})
+		return
+	}
+	host, port, _ := net.SplitHostPort(rp.link.addr)
+	p, _ := strconv.Atoi(port)
+	r.WriteReply(MultiBulkReply{"slave", host, p, rp.link.state, int(rp.offset)})
+}
+
+// PSYNC replid offset
+// 官方redis从库的同步，阻塞直到从库断开
+func (s *GoRedisServer) OnPSYNC(r ReplyWriter, c Command) {
+	sess, ok := r.(*Session)
+	if !ok {
+		r.WriteReply(ErrorReply("ERR PSYNC is only allowed on a replica connection"))
+		return
+	}
+	offset, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+		return
+	}
+	s.serveOfficial(sess, string(c[1]), offset, true)
+}
+
+func (s *GoRedisServer) serveOfficial(sess *Session, replid string, offset int64, psync bool) {
+	log.Println("replication: replica", sess.RemoteAddr(), "psync", replid, offset)
+	err := s.serveOfficialReplica(sess, replid, offset, psync)
+	log.Println("replication: replica", sess.RemoteAddr(), "disconnected:", err)
+}
+
+// REPLCONF listening-port <port> | ip-address <ip> | capa <capa> | ack <offset> | getack *
+// 从库握手时发送，ack和getack没有回复
+func (s *GoRedisServer) OnREPLCONF(r ReplyWriter, c Command) {
+	if len(c)%2 != 1 {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	st := stateOf(r)
+	for i := 1; i < len(c); i += 2 {
+		switch strings.ToLower(string(c[i])) {
+		case "listening-port":
+			if n, err := strconv.Atoi(string(c[i+1])); err != nil || n <= 0 || n > 65535 {
+				r.WriteReply(ErrorReply("ERR Invalid port"))
+				return
+			}
+			st.replPort = string(c[i+1])
+		case "ip-address":
+		case "capa":
+			if strings.EqualFold(string(c[i+1]), "eof") {
+				st.replCapaEOF = true
+			}
+		case "ack", "getack":
+			return
+		default:
+			r.WriteReply(ErrorReply("ERR Unrecognized REPLCONF option: " + string(c[i])))
+			return
+		}
+	}
+	r.WriteReply(StatusReply("OK"))
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"math"
+)
+
+// http://redis.io/commands#set
+
+func (s *GoRedisServer) OnSADD(r ReplyWriter, c Command) {
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := set.Add(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+func (s *GoRedisServer) OnSREM(r ReplyWriter, c Command) {
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := set.Remove(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+func (s *GoRedisServer) OnSMEMBERS(r ReplyWriter, c Command) {
+	bulks := make([]interface{}, 0)
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	set.Enumerate(func(i int, member []byte, quit *bool) {
+		bulks = append(bulks, copyBytes(member))
+	})
+	r.WriteReply(SetReply(bulks))
+}
+
+func (s *GoRedisServer) OnSISMEMBER(r ReplyWriter, c Command) {
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	ok, err := set.Exists(c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if ok {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		r.WriteReply(IntegerReply(0))
+	}
+}
+
+// SMISMEMBER key member [member ...]
+func (s *GoRedisServer) OnSMISMEMBER(r ReplyWriter, c Command) {
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	bulks := make([]interface{}, 0, len(c)-2)
+	for _, member := range c[2:] {
+		ok, err := set.Exists(member)
+		if err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		if ok {
+			bulks = append(bulks, 1)
+		} else {
+			bulks = append(bulks, 0)
+		}
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+func (s *GoRedisServer) OnSCARD(r ReplyWriter, c Command) {
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(set.Len()))
+}
+
+// SPOP key [count]
+func (s *GoRedisServer) OnSPOP(r ReplyWriter, c Command) {
+	count := int64(1)
+	if len(c) > 2 {
+		var ok bool
+		if count, ok = parseInt(c[2]); !ok || count < 0 {
+			r.WriteReply(ErrorReply("ERR value is out of range, must be positive"))
+			return
+		}
+	}
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	members, err := set.Pop(int(count))
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	// 从库删除同样的成员
+	if len(members) > 0 {
+		s.feed.rewrite(append(Command{[]byte("SREM"), c[1]}, members...))
+	} else {
+		s.feed.rewrite()
+	}
+	if len(c) == 2 {
+		if len(members) == 0 {
+			r.WriteReply(BulkReply(nil))
+		} else {
+			r.WriteReply(BulkReply(members[0]))
+		}
+		return
+	}
+	r.WriteReply(bytesReply(members))
+}
+
+// SRANDMEMBER key [count]
+func (s *GoRedisServer) OnSRANDMEMBER(r ReplyWriter, c Command) {
+	if len(c) == 2 {
+		set, err := s.db.SetOf(c[1])
+		if err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		members := set.RandMembers(1)
+		if len(members) == 0 {
+			r.WriteReply(BulkReply(nil))
+		} else {
+			r.WriteReply(BulkReply(members[0]))
+		}
+		return
+	}
+	count, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	// 和redis一样只接受-LONG_MAX到LONG_MAX，-count不能溢出
+	if count == math.MinInt64 {
+		r.WriteReply(ErrorReply("ERR value is out of range"))
+		return
+	}
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(bytesReply(set.RandMembers(int(count))))
+}
+
+func (s *GoRedisServer) OnSINTER(r ReplyWriter, c Command) {
+	s.setCombine(r, rocks.SetInter, c[1:])
+}
+
+func (s *GoRedisServer) OnSUNION(r ReplyWriter, c Command) {
+	s.setCombine(r, rocks.SetUnion, c[1:])
+}
+
+func (s *GoRedisServer) OnSDIFF(r ReplyWriter, c Command) {
+	s.setCombine(r, rocks.SetDiff, c[1:])
+}
+
+func (s *GoRedisServer) OnSINTERSTORE(r ReplyWriter, c Command) {
+	s.setCombineStore(r, rocks.SetInter, c[1], c[2:])
+}
+
+func (s *GoRedisServer) OnSUNIONSTORE(r ReplyWriter, c Command) {
+	s.setCombineStore(r, rocks.SetUnion, c[1], c[2:])
+}
+
+func (s *GoRedisServer) OnSDIFFSTORE(r ReplyWriter, c Command) {
+	s.setCombineStore(r, rocks.SetDiff, c[1], c[2:])
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *GoRedisServer) OnSSCAN(r ReplyWriter, c Command) {
+	sa, ok := s.parseScanArgs(r, c[2:], false)
+	if !ok {
+		return
+	}
+	set, err := s.db.SetOf(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	bulks := make([]interface{}, 0)
+	next := set.Scan(sa.cursor, sa.count, func(member []byte) {
+		if sa.matches(member) {
+			bulks = append(bulks, member)
+		}
+	})
+	r.WriteReply(s.scanReply(next, bulks))
+}
+
+func (s *GoRedisServer) setCombine(r ReplyWriter, op rocks.SetOperation, keys [][]byte) {
+	bulks := make([]interface{}, 0)
+	err := s.db.SetCombine(op, keys, func(member []byte, quit *bool) {
+		bulks = append(bulks, member)
+	})
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(SetReply(bulks))
+}
+
+func (s *GoRedisServer) setCombineStore(r ReplyWriter, op rocks.SetOperation, dst []byte, keys [][]byte) {
+	n, err := s.db.SetCombineStore(op, dst, keys)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+//[][]byte转为MultiBulkReply
+func bytesReply(vals [][]byte) MultiBulkReply {
+	bulks := make([]interface{}, len(vals))
+	for i, val := range vals {
+		bulks[i] = val
+	}
+	return MultiBulkReply(bulks)
+}
@@ -2,6 +2,10 @@ package server
 
 import (
 	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"math"
+	"strconv"
+	"strings"
 )
 
 // http://redis.io/commands#string
@@ -16,11 +20,274 @@ func (s *GoRedisServer) OnGET(r ReplyWriter, c Command) {
 }
 
 //设置数据
+// SET key value [EX seconds|PX milliseconds|EXAT timestamp|PXAT ms-timestamp|KEEPTTL] [NX|XX]
+// 主库把EX/PX改写成PXAT再发给从库，INCRBYFLOAT在redis 6.2+的命令流中是SET KEEPTTL
 func (s *GoRedisServer) OnSET(r ReplyWriter, c Command) {
-	err := s.db.Set(c[1], c[2])
+	var deadline int64
+	var nx, xx, keepTTL bool
+	for i := 3; i < len(c); i++ {
+		switch opt := strings.ToUpper(string(c[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			if deadline != 0 {
+				r.WriteReply(ErrSyntax)
+				return
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if deadline != 0 || keepTTL || i+1 >= len(c) {
+				r.WriteReply(ErrSyntax)
+				return
+			}
+			i++
+			n, ok := parseInt(c[i])
+			if !ok {
+				r.WriteReply(ErrNotInt)
+				return
+			}
+			unit := int64(1)
+			if opt == "EX" || opt == "EXAT" {
+				unit = 1000
+			}
+			if n > 0 {
+				deadline, ok = deadlineMs(n, unit, opt == "EXAT" || opt == "PXAT")
+			}
+			if n <= 0 || !ok {
+				r.WriteReply(errInvalidExpire(c))
+				return
+			}
+		default:
+			r.WriteReply(ErrSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	if keepTTL {
+		deadline = rocks.KeepTTL
+	}
+
+	cond := rocks.SetAlways
+	if nx {
+		cond = rocks.SetIfNotExists
+	} else if xx {
+		cond = rocks.SetIfExists
+	}
+	ok, err := s.db.SetWith(c[1], c[2], deadline, cond)
 	if err != nil {
 		r.WriteReply(ErrorReply(err.Error()))
+	} else if !ok {
+		//NX/XX没有写入，不传播
+		s.feed.rewrite()
+		r.WriteReply(BulkReply(nil))
 	} else {
 		r.WriteReply(StatusReply("OK"))
 	}
 }
+
+// SETNX key value
+func (s *GoRedisServer) OnSETNX(r ReplyWriter, c Command) {
+	ok, err := s.db.SetNX(c[1], c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if ok {
+		r.WriteReply(IntegerReply(1))
+	} else {
+		s.feed.rewrite()
+		r.WriteReply(IntegerReply(0))
+	}
+}
+
+// GETSET key value
+func (s *GoRedisServer) OnGETSET(r ReplyWriter, c Command) {
+	old, err := s.db.GetSet(c[1], c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(BulkReply(old))
+}
+
+// GETDEL key
+func (s *GoRedisServer) OnGETDEL(r ReplyWriter, c Command) {
+	old, err := s.db.GetDel(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(BulkReply(old))
+}
+
+// MGET key [key ...]，不是string的key返回nil
+func (s *GoRedisServer) OnMGET(r ReplyWriter, c Command) {
+	bulks := make([]interface{}, 0, len(c)-1)
+	for _, key := range c[1:] {
+		val, err := s.db.Get(key)
+		if err != nil && err != rocks.ErrWrongType {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		bulks = append(bulks, val)
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+// MSET key value [key value ...]
+func (s *GoRedisServer) OnMSET(r ReplyWriter, c Command) {
+	if len(c) < 3 || len(c)%2 != 1 {
+		r.WriteReply(ErrorReply("ERR wrong number of arguments for 'mset' command"))
+		return
+	}
+	if err := s.db.MSet(c[1:]...); err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnINCR(r ReplyWriter, c Command) {
+	s.incrBy(r, c[1], 1)
+}
+
+func (s *GoRedisServer) OnDECR(r ReplyWriter, c Command) {
+	s.incrBy(r, c[1], -1)
+}
+
+// INCRBY key increment
+func (s *GoRedisServer) OnINCRBY(r ReplyWriter, c Command) {
+	delta, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	s.incrBy(r, c[1], delta)
+}
+
+// DECRBY key decrement
+func (s *GoRedisServer) OnDECRBY(r ReplyWriter, c Command) {
+	delta, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	if delta == math.MinInt64 {
+		r.WriteReply(ErrorReply("ERR decrement would overflow"))
+		return
+	}
+	s.incrBy(r, c[1], -delta)
+}
+
+func (s *GoRedisServer) incrBy(r ReplyWriter, key []byte, delta int64) {
+	n, err := s.db.IncrBy(key, delta)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// INCRBYFLOAT key increment
+func (s *GoRedisServer) OnINCRBYFLOAT(r ReplyWriter, c Command) {
+	delta, ok := parseFloat(c[2])
+	if !ok || math.IsInf(delta, 0) {
+		r.WriteReply(ErrNotFloat)
+		return
+	}
+	f, err := s.db.IncrByFloat(c[1], delta)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	val := []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	// 浮点运算的结果和从库可能不一致，直接传播结果，KEEPTTL需要redis 6.0
+	s.feed.rewrite(Command{[]byte("SET"), c[1], val, []byte("KEEPTTL")})
+	r.WriteReply(BulkReply(val))
+}
+
+// APPEND key value
+func (s *GoRedisServer) OnAPPEND(r ReplyWriter, c Command) {
+	n, err := s.db.Append(c[1], c[2])
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// STRLEN key
+func (s *GoRedisServer) OnSTRLEN(r ReplyWriter, c Command) {
+	val, err := s.db.Get(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(len(val)))
+}
+
+// GETRANGE key start end，负数表示从末尾开始
+func (s *GoRedisServer) OnGETRANGE(r ReplyWriter, c Command) {
+	start, ok1 := parseInt(c[2])
+	end, ok2 := parseInt(c[3])
+	if !ok1 || !ok2 {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	val, err := s.db.Get(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		r.WriteReply(BulkReply([]byte{}))
+		return
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		r.WriteReply(BulkReply([]byte{}))
+		return
+	}
+	r.WriteReply(BulkReply(val[start : end+1]))
+}
+
+// SETRANGE key offset value
+func (s *GoRedisServer) OnSETRANGE(r ReplyWriter, c Command) {
+	offset, ok := parseInt(c[2])
+	if !ok {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	if offset < 0 {
+		r.WriteReply(ErrorReply("ERR offset is out of range"))
+		return
+	}
+	if offset+int64(len(c[3])) > rocks.MaxStringSize {
+		r.WriteReply(errReply(rocks.ErrTooLarge))
+		return
+	}
+	n, err := s.db.SetRange(c[1], int(offset), c[3])
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
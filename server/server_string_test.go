@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/facebookgo/ensure"
+	. "github.com/latermoon/GoRedis/redis"
+	"testing"
+)
+
+func TestDecrBy(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	rec := &replyRecorder{}
+	s.dispatch(rec, makeCommand("DECRBY", "n", "abc"))
+	s.dispatch(rec, makeCommand("DECRBY", "n", "-9223372036854775808"))
+	s.dispatch(rec, makeCommand("DECRBY", "n", "5"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{
+		ErrNotInt,
+		ErrorReply("ERR decrement would overflow"),
+		IntegerReply(-5),
+	})
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	rec := &replyRecorder{}
+	s.dispatch(rec, makeCommand("SET", "k", "v1", "EX", "100"))
+	s.dispatch(rec, makeCommand("SET", "k", "v2", "KEEPTTL"))
+	s.dispatch(rec, makeCommand("SET", "k", "v3", "KEEPTTL", "PX", "100"))
+	s.dispatch(rec, makeCommand("SET", "k", "v3", "EX", "100", "KEEPTTL"))
+	s.dispatch(rec, makeCommand("SET", "none", "v", "KEEPTTL"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{StatusReply("OK"), StatusReply("OK"), ErrSyntax, ErrSyntax, StatusReply("OK")})
+	ensure.DeepEqual(t, getString(s, "k"), "v2")
+	ttl, _ := s.db.TTL([]byte("k"))
+	ensure.True(t, ttl > 90000, ttl)
+	ttl, _ = s.db.TTL([]byte("none"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+
+	// 没有KEEPTTL时清除过期时间
+	s.dispatch(rec, makeCommand("SET", "k", "v4"))
+	ttl, _ = s.db.TTL([]byte("k"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+}
+
+func TestExpireOverflow(t *testing.T) {
+	s := newReplicaServer(t)
+	defer s.db.Close()
+	rec := &replyRecorder{}
+	s.dispatch(rec, makeCommand("SET", "k", "v"))
+	s.dispatch(rec, makeCommand("EXPIRE", "k", "9223372036854775807"))
+	s.dispatch(rec, makeCommand("PEXPIRE", "k", "9223372036854775807"))
+	s.dispatch(rec, makeCommand("EXPIREAT", "k", "9223372036854775807"))
+	s.dispatch(rec, makeCommand("SET", "k", "v", "EX", "9223372036854775807"))
+	s.dispatch(rec, makeCommand("SET", "k", "v", "PX", "9223372036854775807"))
+	s.dispatch(rec, makeCommand("SET", "k", "v", "EXAT", "9223372036854775807"))
+	ensure.DeepEqual(t, rec.replies, []interface{}{
+		StatusReply("OK"),
+		ErrorReply("ERR invalid expire time in 'expire' command"),
+		ErrorReply("ERR invalid expire time in 'pexpire' command"),
+		ErrorReply("ERR invalid expire time in 'expireat' command"),
+		ErrorReply("ERR invalid expire time in 'set' command"),
+		ErrorReply("ERR invalid expire time in 'set' command"),
+		ErrorReply("ERR invalid expire time in 'set' command"),
+	})
+	// 溢出不能把key当作已过期删除
+	ensure.DeepEqual(t, getString(s, "k"), "v")
+	ttl, _ := s.db.TTL([]byte("k"))
+	ensure.DeepEqual(t, ttl, int64(-1))
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+)
+
+// http://redis.io/commands#transactions
+// EXEC在一个rocks事务中执行队列，全部写入合并成一个WriteBatch，
+// 读取看到的是同一个快照加上事务内的写入
+
+var ErrExecAbort = ErrorReply("EXECABORT Transaction discarded because of previous errors.")
+
+func (s *GoRedisServer) OnMULTI(r ReplyWriter, c Command) {
+	st := stateOf(r)
+	if st.multi {
+		r.WriteReply(ErrorReply("ERR MULTI calls can not be nested"))
+		return
+	}
+	st.multi = true
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnDISCARD(r ReplyWriter, c Command) {
+	st := stateOf(r)
+	if !st.multi {
+		r.WriteReply(ErrorReply("ERR DISCARD without MULTI"))
+		return
+	}
+	st.reset()
+	st.unwatch(s.db)
+	r.WriteReply(StatusReply("OK"))
+}
+
+// WATCH key [key ...]
+func (s *GoRedisServer) OnWATCH(r ReplyWriter, c Command) {
+	st := stateOf(r)
+	if st.multi {
+		r.WriteReply(ErrorReply("ERR WATCH inside MULTI is not allowed"))
+		return
+	}
+	if st.watched == nil {
+		st.watched = make(map[string]uint64)
+	}
+	for _, key := range c[1:] {
+		if _, ok := st.watched[string(key)]; ok {
+			continue
+		}
+		st.watched[string(key)] = s.db.Watch(key)
+	}
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnUNWATCH(r ReplyWriter, c Command) {
+	stateOf(r).unwatch(s.db)
+	r.WriteReply(StatusReply("OK"))
+}
+
+func (s *GoRedisServer) OnEXEC(r ReplyWriter, c Command) {
+	st := stateOf(r)
+	if !st.multi {
+		r.WriteReply(ErrorReply("ERR EXEC without MULTI"))
+		return
+	}
+	queue, dirty, watched := st.queue, st.dirty, st.watched
+	st.reset()
+	defer st.unwatch(s.db)
+	if dirty {
+		r.WriteReply(ErrExecAbort)
+		return
+	}
+	replies, err := s.exec(queue, watched)
+	if err != nil {
+		r.WriteReply(errReply(err))
+		return
+	}
+	// WATCH的key被修改过，事务没有执行
+	if replies == nil {
+		r.WriteReply(MultiBulkReply(nil))
+		return
+	}
+	r.WriteReply(MultiBulkReply(replies))
+}
+
+// 依次执行队列中的命令，单个命令出错不影响其他命令，和redis一致
+// WATCH的key被修改过时返回nil
+func (s *GoRedisServer) exec(queue []Command, watched map[string]uint64) ([]interface{}, error) {
+	// 写命令包在MULTI/EXEC中进入命令流，先于事务的排它锁持有
+	s.feed.lock()
+	defer s.feed.unlock(nil)
+	tx := s.db.Begin()
+	// 持有排它锁之后再检查，检查和执行之间不会有其他写入
+	for key, version := range watched {
+		if s.db.Version([]byte(key)) != version {
+			tx.Rollback()
+			return nil, nil
+		}
+	}
+	done := false
+	defer func() {
+		// 命令panic时放弃全部写入
+		if !done {
+			tx.Rollback()
+		}
+	}()
+
+	txs := *s
+	txs.db = tx
+	txs.inTx = true
+	rec := &replyRecorder{replies: make([]interface{}, 0, len(queue))}
+	var propagate []Command
+	for _, c := range queue {
+		cmd, _ := lookupCommand(c[0])
+		cmd.handler(&txs, rec, c)
+		if _, failed := rec.replies[len(rec.replies)-1].(ErrorReply); failed {
+			s.feed.rewrite()
+		}
+		propagate = append(propagate, s.feed.take(c)...)
+	}
+	done = true
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(propagate) > 0 {
+		s.feed.emit(append(append([]Command{{[]byte("MULTI")}}, propagate...), Command{[]byte("EXEC")})...)
+	}
+	return rec.replies, nil
+}
+
+// 记录EXEC中每个命令的回复
+type replyRecorder struct {
+	replies []interface{}
+}
+
+func (rr *replyRecorder) WriteReply(reply Reply) (int, error) {
+	rr.replies = append(rr.replies, reply)
+	return 0, nil
+}
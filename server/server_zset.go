@@ -0,0 +1,358 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"strings"
+)
+
+// http://redis.io/commands#sorted_set
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func (s *GoRedisServer) OnZADD(r ReplyWriter, c Command) {
+	var flags rocks.ZAddFlag
+	incr := false
+	i := 2
+options:
+	for ; i < len(c); i++ {
+		switch strings.ToUpper(string(c[i])) {
+		case "NX":
+			flags |= rocks.ZAddNX
+		case "XX":
+			flags |= rocks.ZAddXX
+		case "GT":
+			flags |= rocks.ZAddGT
+		case "LT":
+			flags |= rocks.ZAddLT
+		case "CH":
+			flags |= rocks.ZAddCH
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	if flags&rocks.ZAddNX != 0 && flags&rocks.ZAddXX != 0 {
+		r.WriteReply(ErrorReply("ERR XX and NX options at the same time are not compatible"))
+		return
+	}
+	if (flags&rocks.ZAddGT != 0 && flags&(rocks.ZAddLT|rocks.ZAddNX) != 0) || (flags&rocks.ZAddLT != 0 && flags&rocks.ZAddNX != 0) {
+		r.WriteReply(ErrorReply("ERR GT, LT, and/or NX options at the same time are not compatible"))
+		return
+	}
+	args := c[i:]
+	if len(args) == 0 || len(args)%2 != 0 {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+	if incr && len(args) != 2 {
+		r.WriteReply(ErrorReply("ERR INCR option supports a single increment-element pair"))
+		return
+	}
+
+	pairs := make([]rocks.ScoreMember, 0, len(args)/2)
+	for j := 0; j < len(args); j += 2 {
+		score, ok := parseFloat(args[j])
+		if !ok {
+			r.WriteReply(ErrNotFloat)
+			return
+		}
+		pairs = append(pairs, rocks.ScoreMember{Score: score, Member: args[j+1]})
+	}
+
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	if incr {
+		score, ok, err := z.IncrBy(flags, pairs[0].Score, pairs[0].Member)
+		if err != nil {
+			r.WriteReply(ErrorReply("ERR " + err.Error()))
+		} else if !ok {
+			r.WriteReply(BulkReply(nil))
+		} else {
+			r.WriteReply(DoubleReply(score))
+		}
+		return
+	}
+
+	n, err := z.Add(flags, pairs...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// ZINCRBY key increment member
+func (s *GoRedisServer) OnZINCRBY(r ReplyWriter, c Command) {
+	delta, ok := parseFloat(c[2])
+	if !ok {
+		r.WriteReply(ErrNotFloat)
+		return
+	}
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	score, _, err := z.IncrBy(0, delta, c[3])
+	if err != nil {
+		r.WriteReply(ErrorReply("ERR " + err.Error()))
+		return
+	}
+	r.WriteReply(DoubleReply(score))
+}
+
+func (s *GoRedisServer) OnZREM(r ReplyWriter, c Command) {
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := z.Remove(c[2:]...)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+func (s *GoRedisServer) OnZSCORE(r ReplyWriter, c Command) {
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	score, exists, err := z.Score(c[2])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if !exists {
+		r.WriteReply(BulkReply(nil))
+	} else {
+		r.WriteReply(DoubleReply(score))
+	}
+}
+
+func (s *GoRedisServer) OnZCARD(r ReplyWriter, c Command) {
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(z.Len()))
+}
+
+// ZCOUNT key min max
+func (s *GoRedisServer) OnZCOUNT(r ReplyWriter, c Command) {
+	sr, ok := parseScoreRange(c[2], c[3])
+	if !ok {
+		r.WriteReply(ErrorReply("ERR min or max is not a float"))
+		return
+	}
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(z.Count(sr)))
+}
+
+// ZRANGE key start stop [WITHSCORES]
+func (s *GoRedisServer) OnZRANGE(r ReplyWriter, c Command) {
+	s.zrange(r, c, false)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func (s *GoRedisServer) OnZREVRANGE(r ReplyWriter, c Command) {
+	s.zrange(r, c, true)
+}
+
+func (s *GoRedisServer) zrange(r ReplyWriter, c Command, reverse bool) {
+	start, ok1 := parseInt(c[2])
+	stop, ok2 := parseInt(c[3])
+	if !ok1 || !ok2 {
+		r.WriteReply(ErrNotInt)
+		return
+	}
+	withScores := false
+	if len(c) == 5 && strings.ToUpper(string(c[4])) == "WITHSCORES" {
+		withScores = true
+	} else if len(c) > 4 {
+		r.WriteReply(ErrSyntax)
+		return
+	}
+
+	bulks := make([]interface{}, 0)
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	err = z.RangeByIndex(start, stop, reverse, func(i int, score float64, member []byte, quit *bool) {
+		bulks = appendScoreMember(bulks, score, member, withScores)
+	})
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func (s *GoRedisServer) OnZRANGEBYSCORE(r ReplyWriter, c Command) {
+	s.zrangeByScore(r, c, false)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func (s *GoRedisServer) OnZREVRANGEBYSCORE(r ReplyWriter, c Command) {
+	s.zrangeByScore(r, c, true)
+}
+
+func (s *GoRedisServer) zrangeByScore(r ReplyWriter, c Command, reverse bool) {
+	min, max := c[2], c[3]
+	if reverse {
+		min, max = max, min
+	}
+	sr, ok := parseScoreRange(min, max)
+	if !ok {
+		r.WriteReply(ErrorReply("ERR min or max is not a float"))
+		return
+	}
+
+	withScores := false
+	offset, count := int64(0), int64(-1)
+	for i := 4; i < len(c); i++ {
+		switch strings.ToUpper(string(c[i])) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(c) {
+				r.WriteReply(ErrSyntax)
+				return
+			}
+			var ok1, ok2 bool
+			offset, ok1 = parseInt(c[i+1])
+			count, ok2 = parseInt(c[i+2])
+			if !ok1 || !ok2 {
+				r.WriteReply(ErrNotInt)
+				return
+			}
+			i += 2
+		default:
+			r.WriteReply(ErrSyntax)
+			return
+		}
+	}
+
+	bulks := make([]interface{}, 0)
+	if offset >= 0 && count != 0 {
+		z, err := s.db.SortedSet(c[1])
+		if err != nil {
+			r.WriteReply(ErrorReply(err.Error()))
+			return
+		}
+		z.RangeByScore(sr, reverse, func(i int, score float64, member []byte, quit *bool) {
+			if int64(i) < offset {
+				return
+			}
+			bulks = appendScoreMember(bulks, score, member, withScores)
+			if count > 0 && int64(i)-offset+1 >= count {
+				*quit = true
+			}
+		})
+	}
+	r.WriteReply(MultiBulkReply(bulks))
+}
+
+func (s *GoRedisServer) OnZRANK(r ReplyWriter, c Command) {
+	s.zrank(r, c, false)
+}
+
+func (s *GoRedisServer) OnZREVRANK(r ReplyWriter, c Command) {
+	s.zrank(r, c, true)
+}
+
+func (s *GoRedisServer) zrank(r ReplyWriter, c Command, reverse bool) {
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	rank, exists, err := z.Rank(c[2], reverse)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+	} else if !exists {
+		r.WriteReply(BulkReply(nil))
+	} else {
+		r.WriteReply(IntegerReply(rank))
+	}
+}
+
+// ZREMRANGEBYSCORE key min max
+func (s *GoRedisServer) OnZREMRANGEBYSCORE(r ReplyWriter, c Command) {
+	sr, ok := parseScoreRange(c[2], c[3])
+	if !ok {
+		r.WriteReply(ErrorReply("ERR min or max is not a float"))
+		return
+	}
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	n, err := z.RemoveByScore(sr)
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	r.WriteReply(IntegerReply(n))
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+func (s *GoRedisServer) OnZSCAN(r ReplyWriter, c Command) {
+	sa, ok := s.parseScanArgs(r, c[2:], false)
+	if !ok {
+		return
+	}
+	z, err := s.db.SortedSet(c[1])
+	if err != nil {
+		r.WriteReply(ErrorReply(err.Error()))
+		return
+	}
+	bulks := make([]interface{}, 0)
+	next := z.Scan(sa.cursor, sa.count, func(score float64, member []byte) {
+		if sa.matches(member) {
+			bulks = appendScoreMember(bulks, score, member, true)
+		}
+	})
+	r.WriteReply(s.scanReply(next, bulks))
+}
+
+//解析 "(1.5" "-inf" "+inf" 这样的分数区间
+func parseScoreRange(min, max []byte) (rocks.ScoreRange, bool) {
+	var sr rocks.ScoreRange
+	var ok1, ok2 bool
+	sr.Min, sr.MinEx, ok1 = parseScoreBound(min)
+	sr.Max, sr.MaxEx, ok2 = parseScoreBound(max)
+	return sr, ok1 && ok2
+}
+
+func parseScoreBound(b []byte) (float64, bool, bool) {
+	exclusive := false
+	if len(b) > 0 && b[0] == '(' {
+		exclusive = true
+		b = b[1:]
+	}
+	f, ok := parseFloat(b)
+	return f, exclusive, ok
+}
+
+func appendScoreMember(bulks []interface{}, score float64, member []byte, withScores bool) []interface{} {
+	bulks = append(bulks, member)
+	if withScores {
+		bulks = append(bulks, formatFloat(score))
+	}
+	return bulks
+}
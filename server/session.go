@@ -0,0 +1,66 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+)
+
+// 每个连接的状态，保存在Session的Context里
+type sessionState struct {
+	id    int64     // 连接的编号，HELLO返回
+	name  string    // HELLO SETNAME设置的名字
+	multi bool      // 在MULTI之后
+	queue []Command // 等待EXEC的命令
+	dirty bool      // 入队时出过错，EXEC会被拒绝
+	// WATCH的key和当时的修改计数
+	watched map[string]uint64
+	// 订阅模式，非nil时回复都经过它的队列
+	sub *subscriber
+	// 从库握手时REPLCONF发送的监听端口，以及是否支持diskless同步
+	replPort    string
+	replCapaEOF bool
+}
+
+func (st *sessionState) reset() {
+	st.multi = false
+	st.queue = nil
+	st.dirty = false
+}
+
+// 取消全部WATCH，EXEC/DISCARD/UNWATCH和连接关闭时调用
+func (st *sessionState) unwatch(db *rocks.DB) {
+	for key := range st.watched {
+		db.Unwatch([]byte(key))
+	}
+	st.watched = nil
+}
+
+// 订阅模式下回复必须经过subscriber的队列
+func (st *sessionState) writer(r ReplyWriter) ReplyWriter {
+	if st.sub != nil {
+		return st.sub
+	}
+	return r
+}
+
+// 连接的协议版本，测试中直接使用的ReplyWriter按RESP2处理
+func protocolOf(r ReplyWriter) int {
+	if p, ok := r.(interface {
+		Protocol() int
+	}); ok {
+		return p.Protocol()
+	}
+	return RESP2
+}
+
+// 取得连接的状态，测试中直接使用的ReplyWriter没有状态
+func stateOf(r ReplyWriter) *sessionState {
+	if sc, ok := r.(interface {
+		Context() interface{}
+	}); ok {
+		if st, ok := sc.Context().(*sessionState); ok {
+			return st
+		}
+	}
+	return &sessionState{}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	. "github.com/latermoon/GoRedis/redis"
+	"github.com/latermoon/GoRedis/rocks"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 常用的错误回复
+var (
+	ErrSyntax   = ErrorReply("ERR syntax error")
+	ErrNotInt   = ErrorReply("ERR value is not an integer or out of range")
+	ErrNotFloat = ErrorReply("ERR value is not a valid float")
+)
+
+// 解析整数参数
+func parseInt(b []byte) (int64, bool) {
+	i, err := strconv.ParseInt(string(b), 10, 64)
+	return i, err == nil
+}
+
+// 当前毫秒时间戳
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// 过期时间参数换算成毫秒时间戳，unit为参数的毫秒倍数，abs表示参数是时间戳
+// 乘法或加上当前时间溢出时返回false
+func deadlineMs(n, unit int64, abs bool) (int64, bool) {
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, false
+	}
+	ms := n * unit
+	if !abs {
+		now := nowMs()
+		if ms > math.MaxInt64-now {
+			return 0, false
+		}
+		ms += now
+	}
+	return ms, true
+}
+
+// 过期时间溢出的错误回复
+func errInvalidExpire(c Command) Reply {
+	return ErrorReply("ERR invalid expire time in '" + strings.ToLower(string(c[0])) + "' command")
+}
+
+// 解析浮点数参数，不接受NaN
+func parseFloat(b []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// 按redis的格式输出浮点数
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+//复制数组，rocksdb迭代器返回的数据在迭代结束后失效
+func copyBytes(src []byte) []byte {
+	dst := make([]byte, len(src))
+	copy(dst, src)
+	return dst
+}
+
+// rocks返回的错误转为回复，WRONGTYPE自带前缀，其他的加上ERR
+func errReply(err error) ErrorReply {
+	if err == rocks.ErrWrongType {
+		return ErrorReply(err.Error())
+	}
+	return ErrorReply("ERR " + err.Error())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/latermoon/GoRedis/rocks"
+	"github.com/tecbot/gorocksdb"
+	"log"
+	"os"
+	"time"
+)
+
+// 离线的RDB导入导出，目录不能同时被运行中的GoRedis打开
+//
+// 导入官方redis的RDB（版本6到11）到rocks目录，已有的同名key被替换：
+//   goredis-rdb import -rdb dump.rdb -dir /tmp/rocks_6380 [-select 0] [-batch 10000]
+// 把rocks目录导出成RDB，可以直接给redis-server载入：
+//   goredis-rdb export -dir /tmp/rocks_6380 -rdb dump.rdb
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  goredis-rdb import -rdb dump.rdb -dir <rocksdb dir> [-select 0] [-batch 10000]")
+	fmt.Fprintln(os.Stderr, "  goredis-rdb export -dir <rocksdb dir> -rdb dump.rdb")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	file := fs.String("rdb", "", "RDB file")
+	dir := fs.String("dir", "", "RocksDB directory")
+	db := fs.Int("select", 0, "Import keys of this db, GoRedis has only one db")
+	batch := fs.Int("batch", rocks.DefaultImportBatch, "Elements per WriteBatch")
+	fs.Parse(os.Args[2:])
+	if *file == "" || *dir == "" {
+		usage()
+	}
+
+	start := time.Now()
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = importRDB(*file, *dir, *db, *batch)
+	case "export":
+		err = exportRDB(*dir, *file)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalln(os.Args[1], "failed:", err)
+	}
+	log.Println(os.Args[1], "done in", time.Since(start))
+}
+
+func openRocks(dir string, create bool) (*rocks.DB, error) {
+	opts := gorocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(create)
+	rdb, err := gorocksdb.OpenDb(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	return rocks.New(rdb), nil
+}
+
+func importRDB(file, dir string, db, batch int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := openRocks(dir, true)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	loaded, skipped, err := d.ImportRDB(bufio.NewReaderSize(f, 1024*1024), db, batch)
+	log.Println("loaded", loaded, "keys, skipped", skipped, "expired, in other dbs or of unsupported types")
+	return err
+}
+
+// 先写入临时文件，完成之后再改名，失败时不会留下不完整的RDB
+func exportRDB(dir, file string) error {
+	d, err := openRocks(dir, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := d.ExportRDB(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}